@@ -0,0 +1,177 @@
+package ipam
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// addressPlanDatacenter is a section of the address plan: the pools configured in a datacenter.
+type addressPlanDatacenter struct {
+	Name  string
+	Pools []addressPlanPool
+}
+
+type addressPlanPool struct {
+	Name    string
+	Summary string
+	// Rows are the allocations and free blocks of the pool, in address order
+	Rows []addressPlanRow
+}
+
+type addressPlanRow struct {
+	Block       string
+	Cluster     string
+	Description string
+	Free        bool
+}
+
+var addressPlanHTMLTemplate = template.Must(template.New("").Parse(`<h1>Address plan</h1>
+{{- range . }}
+<h2>{{ .Name }}</h2>
+{{- range .Pools }}
+<h3>{{ .Name }}</h3>
+<p>{{ .Summary }}</p>
+<table>
+<tr><th>Block</th><th>Cluster</th><th>Description</th></tr>
+{{- range .Rows }}
+<tr{{ if .Free }} class="free"{{ end }}><td>{{ .Block }}</td><td>{{ if .Free }}free{{ else }}{{ .Cluster }}{{ end }}</td><td>{{ .Description }}</td></tr>
+{{- end }}
+</table>
+{{- end }}
+{{- end }}
+`))
+
+// RenderAddressPlan generates a human-readable address plan from the current allocations: a table per datacenter
+// and pool (and purpose) listing the allocations and the free blocks of the pool in address order. Supported
+// formats are "markdown" and "html".
+func RenderAddressPlan(p IPAM, ipamPools []IPAMPool, format string) (string, error) {
+	datacenters, err := p.addressPlan(ipamPools)
+	if err != nil {
+		return "", err
+	}
+
+	switch format {
+	case "markdown":
+		return renderAddressPlanMarkdown(datacenters), nil
+	case "html":
+		html := bytes.Buffer{}
+		if err := addressPlanHTMLTemplate.Execute(&html, datacenters); err != nil {
+			return "", err
+		}
+		return html.String(), nil
+	default:
+		return "", fmt.Errorf("unsupported address plan format %q", format)
+	}
+}
+
+func (p IPAM) addressPlan(ipamPools []IPAMPool) ([]addressPlanDatacenter, error) {
+	dcPools := map[string][]addressPlanPool{}
+	for _, ipamPool := range sortedIPAMPools(ipamPools) {
+		purposePools, err := ipamPool.purposePools()
+		if err != nil {
+			return nil, err
+		}
+		for _, purposePool := range purposePools {
+			purposePool, err := purposePool.withResolvedAllocationSizes()
+			if err != nil {
+				return nil, err
+			}
+			dcIPAMPoolUsageMap, err := p.compileCurrentAllocationsForPool(purposePool)
+			if err != nil {
+				return nil, err
+			}
+			for dc, dcIPAMPoolCfg := range purposePool.Datacenters {
+				planPool, err := p.addressPlanPool(purposePool, dc, dcIPAMPoolCfg, dcIPAMPoolUsageMap)
+				if err != nil {
+					return nil, err
+				}
+				dcPools[dc] = append(dcPools[dc], planPool)
+			}
+		}
+	}
+
+	datacenters := []addressPlanDatacenter{}
+	for _, dc := range sortedKeys(dcPools) {
+		datacenters = append(datacenters, addressPlanDatacenter{Name: dc, Pools: dcPools[dc]})
+	}
+	return datacenters, nil
+}
+
+func (p IPAM) addressPlanPool(ipamPool IPAMPool, dc string, dcIPAMPoolCfg IPAMPoolDatacenterSettings, dcIPAMPoolUsageMap datacenterIPAMPoolUsageMap) (addressPlanPool, error) {
+	rows := []addressPlanRow{}
+	allocations := 0
+	for _, dcCluster := range p.datacenterAllocations[dc] {
+		for _, ipamAllocation := range dcCluster.IPAMAllocations {
+			if !ipamAllocation.isFromPool(ipamPool) {
+				continue
+			}
+			allocations++
+			for _, block := range allocationBlocks(ipamAllocation) {
+				rows = append(rows, addressPlanRow{Block: block, Cluster: dcCluster.ref(dc).qualifiedName(), Description: ipamAllocation.Description})
+			}
+		}
+	}
+
+	freeBlocks, err := freeBlocksOfPool(dc, dcIPAMPoolCfg, dcIPAMPoolUsageMap, 0)
+	if err != nil {
+		return addressPlanPool{}, err
+	}
+	freeAddresses := big.NewInt(0)
+	for _, block := range freeBlocks {
+		first, last, err := blockBounds(block)
+		if err != nil {
+			return addressPlanPool{}, err
+		}
+		firstInt, _ := ipToInt(first)
+		lastInt, _ := ipToInt(last)
+		freeAddresses.Add(freeAddresses, new(big.Int).Sub(lastInt, firstInt))
+		freeAddresses.Add(freeAddresses, big.NewInt(1))
+		rows = append(rows, addressPlanRow{Block: block, Free: true})
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		firstI, _, _ := blockBounds(rows[i].Block)
+		firstJ, _, _ := blockBounds(rows[j].Block)
+		return bytes.Compare(firstI, firstJ) < 0
+	})
+
+	allocationSize := fmt.Sprintf("/%d", dcIPAMPoolCfg.AllocationPrefix)
+	if dcIPAMPoolCfg.Type == "range" {
+		allocationSize = fmt.Sprintf("%d addresses", dcIPAMPoolCfg.AllocationRange)
+	}
+	return addressPlanPool{
+		Name: ipamPool.qualifiedName(),
+		Summary: fmt.Sprintf("%s pool %s with allocations of %s: %d allocations, %s free addresses",
+			dcIPAMPoolCfg.Type, dcIPAMPoolCfg.PoolCIDR, allocationSize, allocations, freeAddresses),
+		Rows: rows,
+	}, nil
+}
+
+func renderAddressPlanMarkdown(datacenters []addressPlanDatacenter) string {
+	markdown := strings.Builder{}
+	markdown.WriteString("# Address plan\n")
+	for _, dc := range datacenters {
+		fmt.Fprintf(&markdown, "\n## %s\n", escapeMarkdown(dc.Name))
+		for _, planPool := range dc.Pools {
+			fmt.Fprintf(&markdown, "\n### %s\n\n%s\n\n", escapeMarkdown(planPool.Name), escapeMarkdown(planPool.Summary))
+			markdown.WriteString("| Block | Cluster | Description |\n| --- | --- | --- |\n")
+			for _, row := range planPool.Rows {
+				cluster := escapeMarkdown(row.Cluster)
+				if row.Free {
+					cluster = "*free*"
+				}
+				fmt.Fprintf(&markdown, "| %s | %s | %s |\n", row.Block, cluster, escapeMarkdown(row.Description))
+			}
+		}
+	}
+	return markdown.String()
+}
+
+// escapeMarkdown escapes the characters which would break the tables or the formatting of the markdown document.
+func escapeMarkdown(text string) string {
+	return strings.NewReplacer(`\`, `\\`, "|", `\|`, "*", `\*`, "_", `\_`, "\n", " ").Replace(text)
+}
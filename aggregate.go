@@ -0,0 +1,77 @@
+package ipam
+
+import (
+	"fmt"
+	"math/big"
+	"math/bits"
+	"net"
+	"sort"
+)
+
+// DatacenterDemand is the expected need of a datacenter for a pool: a number of clusters, each with an allocation
+// of the given prefix length.
+type DatacenterDemand struct {
+	Datacenter       string
+	Clusters         int
+	AllocationPrefix uint8
+}
+
+// PlanIPAMPoolFromAggregate splits an aggregate CIDR into non-overlapping prefix pool CIDRs, one per datacenter, each
+// the smallest CIDR holding the expected clusters. The largest pool CIDRs are placed first, so the CIDRs are aligned
+// without leaving gaps between them and the rest of the aggregate stays contiguous for future datacenters.
+func PlanIPAMPoolFromAggregate(name, aggregateCIDR string, demands []DatacenterDemand) (IPAMPool, error) {
+	aggregateIP, aggregateNet, err := net.ParseCIDR(aggregateCIDR)
+	if err != nil {
+		return IPAMPool{}, err
+	}
+	aggregatePrefix, addressBits := aggregateNet.Mask.Size()
+
+	type datacenterBlock struct {
+		datacenter       string
+		prefix           int
+		allocationPrefix uint8
+	}
+	blocks := make([]datacenterBlock, 0, len(demands))
+	for _, demand := range demands {
+		if demand.Clusters <= 0 {
+			return IPAMPool{}, fmt.Errorf("datacenter %s must expect at least one cluster", demand.Datacenter)
+		}
+		if int(demand.AllocationPrefix) < aggregatePrefix || int(demand.AllocationPrefix) > addressBits {
+			return IPAMPool{}, fmt.Errorf("allocation prefix %d of datacenter %s must be between the aggregate prefix %d and %d", demand.AllocationPrefix, demand.Datacenter, aggregatePrefix, addressBits)
+		}
+		// the pool CIDR holds the next power of two of the expected clusters
+		prefix := int(demand.AllocationPrefix) - bits.Len(uint(demand.Clusters-1))
+		if prefix < aggregatePrefix {
+			return IPAMPool{}, fmt.Errorf("%d clusters of datacenter %s with allocation prefix %d don't fit in %s", demand.Clusters, demand.Datacenter, demand.AllocationPrefix, aggregateNet)
+		}
+		blocks = append(blocks, datacenterBlock{datacenter: demand.Datacenter, prefix: prefix, allocationPrefix: demand.AllocationPrefix})
+	}
+	sort.SliceStable(blocks, func(i, j int) bool {
+		if blocks[i].prefix != blocks[j].prefix {
+			return blocks[i].prefix < blocks[j].prefix
+		}
+		return blocks[i].datacenter < blocks[j].datacenter
+	})
+
+	ipamPool := IPAMPool{Name: name, Datacenters: map[string]IPAMPoolDatacenterSettings{}}
+	start, _ := ipToInt(checkIPv4(aggregateIP.Mask(aggregateNet.Mask)))
+	end := new(big.Int).Add(start, new(big.Int).Lsh(big.NewInt(1), uint(addressBits-aggregatePrefix)))
+	next := new(big.Int).Set(start)
+	for _, block := range blocks {
+		if _, isDuplicated := ipamPool.Datacenters[block.datacenter]; isDuplicated {
+			return IPAMPool{}, fmt.Errorf("datacenter %s is planned more than once", block.datacenter)
+		}
+		blockEnd := new(big.Int).Add(next, new(big.Int).Lsh(big.NewInt(1), uint(addressBits-block.prefix)))
+		if blockEnd.Cmp(end) > 0 {
+			return IPAMPool{}, fmt.Errorf("aggregate %s is too small for the expected clusters of every datacenter", aggregateNet)
+		}
+		poolCIDR := net.IPNet{IP: intToIP(next, addressBits), Mask: net.CIDRMask(block.prefix, addressBits)}
+		ipamPool.Datacenters[block.datacenter] = IPAMPoolDatacenterSettings{
+			Type:             "prefix",
+			PoolCIDR:         poolCIDR.String(),
+			AllocationPrefix: block.allocationPrefix,
+		}
+		next = blockEnd
+	}
+	return ipamPool, nil
+}
@@ -0,0 +1,92 @@
+package ipam
+
+import (
+	"math/big"
+	"net"
+)
+
+// Allocations of a cluster from anti-affine pools must not share a network of these prefix lengths, so no route
+// summarization covers both.
+const (
+	antiAffinityIPv4PrefixLen = 24
+	antiAffinityIPv6PrefixLen = 64
+)
+
+// antiAffineBlocks returns the blocks (CIDRs or "first-last" address ranges) of the cluster allocations from the
+// pools the IPAM pool is anti-affine with.
+func antiAffineBlocks(ipamPool IPAMPool, cluster Cluster) []string {
+	blocks := []string{}
+	for _, antiAffinePool := range ipamPool.AntiAffinityPools {
+		for _, clusterAllocation := range cluster.IPAMAllocations {
+			if clusterAllocation.qualifiedIPAMPoolName() != antiAffinePool {
+				continue
+			}
+			switch clusterAllocation.Type {
+			case "range":
+				blocks = append(blocks, clusterAllocation.Addresses...)
+			case "prefix":
+				blocks = append(blocks, clusterAllocation.CIDR)
+			}
+		}
+	}
+	return blocks
+}
+
+// antiAffinityUsageMap returns a copy of the datacenter pool usage where the IPs (for range allocation type) or
+// subnets (for prefix allocation type) sharing a /24 (/64 for IPv6) with, or adjacent to, any of the anti-affine
+// blocks are also marked as used.
+func antiAffinityUsageMap(dc string, blocks []string, dcIPAMPoolUsageMap datacenterIPAMPoolUsageMap) (datacenterIPAMPoolUsageMap, error) {
+	searchUsageMap := dcIPAMPoolUsageMap.copyDatacenter(dc)
+	for _, block := range blocks {
+		first, last, err := blockBounds(block)
+		if err != nil {
+			return nil, err
+		}
+		forbiddenRange := antiAffinityRange(first, last)
+		searchUsageMap.setUsedBounds(dc, forbiddenRange[0], forbiddenRange[1])
+	}
+	return searchUsageMap, nil
+}
+
+// antiAffinityConflict returns the first of the anti-affine blocks conflicting with the blocks of the allocation, or
+// "" if there is none.
+func antiAffinityConflict(allocation IPAMAllocation, blocks []string) (string, error) {
+	for _, block := range blocks {
+		first, last, err := blockBounds(block)
+		if err != nil {
+			return "", err
+		}
+		forbiddenRange := antiAffinityRange(first, last)
+		for _, allocationBlock := range allocationBlocks(allocation) {
+			allocationFirst, allocationLast, err := blockBounds(allocationBlock)
+			if err != nil {
+				return "", err
+			}
+			firstInt, _ := ipToInt(allocationFirst.To16())
+			lastInt, _ := ipToInt(allocationLast.To16())
+			if firstInt.Cmp(forbiddenRange[1]) <= 0 && forbiddenRange[0].Cmp(lastInt) <= 0 {
+				return block, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// antiAffinityRange returns the integer range (in 16-byte form) of the addresses conflicting with a block: the
+// /24 (/64 for IPv6) networks containing it plus the addresses right before and after them.
+func antiAffinityRange(first, last net.IP) [2]*big.Int {
+	prefixLen := antiAffinityIPv6PrefixLen
+	if first.To4() != nil {
+		prefixLen = 8*(net.IPv6len-net.IPv4len) + antiAffinityIPv4PrefixLen
+	}
+	mask := net.CIDRMask(prefixLen, 8*net.IPv6len)
+	networkFirst, _ := addressRange(&net.IPNet{IP: first.To16().Mask(mask), Mask: mask})
+	_, networkLast := addressRange(&net.IPNet{IP: last.To16().Mask(mask), Mask: mask})
+
+	rangeFirst, _ := ipToInt(networkFirst.To16())
+	rangeLast, _ := ipToInt(networkLast.To16())
+	return [2]*big.Int{
+		rangeFirst.Sub(rangeFirst, big.NewInt(1)),
+		rangeLast.Add(rangeLast, big.NewInt(1)),
+	}
+}
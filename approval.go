@@ -0,0 +1,47 @@
+package ipam
+
+import (
+	"fmt"
+)
+
+const (
+	// DestructiveReallocation replaces allocations by new blocks, e.g. when a cluster moves to another datacenter
+	DestructiveReallocation = "reallocation"
+	// DestructiveRelease releases allocations without replacing them
+	DestructiveRelease = "release"
+)
+
+// DestructiveOperation describes an operation about to release allocations, for approval hooks to decide on.
+type DestructiveOperation struct {
+	// Kind is DestructiveReallocation or DestructiveRelease
+	Kind string
+	// IPAMPool is the pool the operation is made for, if any, which tells its owner
+	IPAMPool *IPAMPool
+	// Allocations are the allocations the operation releases
+	Allocations []IPAMAllocation
+}
+
+// ApprovalHook is called before a destructive operation changes anything. An error rejects the operation, e.g.
+// when the change ticket referenced by the owner of the pool isn't approved.
+type ApprovalHook func(DestructiveOperation) error
+
+// WithApprovalHook makes the IPAM ask the hook to approve every destructive operation.
+func WithApprovalHook(hook ApprovalHook) Option {
+	return func(p *IPAM) {
+		p.approvalHooks = append(p.approvalHooks, hook)
+	}
+}
+
+// requestApproval asks every approval hook to approve the operation, and fails with errNotApproved on the first
+// rejection.
+func (p IPAM) requestApproval(operation DestructiveOperation) error {
+	if len(operation.Allocations) == 0 {
+		return nil
+	}
+	for _, hook := range p.approvalHooks {
+		if err := hook(operation); err != nil {
+			return fmt.Errorf("%w: %v", errNotApproved, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package ipam
+
+// AWSSubnetLister lists the CIDR blocks (IPv4 and IPv6) of the VPC subnets of an AWS account in a region.
+// It's usually backed by the EC2 DescribeSubnets API.
+type AWSSubnetLister interface {
+	ListSubnetCIDRs(account, region string) ([]string, error)
+}
+
+// AWSLocation identifies where the VPC subnets of a datacenter live in AWS.
+type AWSLocation struct {
+	Account string
+	Region  string
+}
+
+// ReconcileAWSSubnets registers the existing VPC subnets of each datacenter as external reservations, so they are
+// never allocated to clusters, and returns the current allocations that already collide with them. Subnets matching
+// exactly a prefix allocation of the datacenter are the ones created for that allocation, so they are not reserved.
+func ReconcileAWSSubnets(p IPAM, lister AWSSubnetLister, dcLocations map[string]AWSLocation) ([]ReservationConflict, error) {
+	for dc, location := range dcLocations {
+		cidrs, err := lister.ListSubnetCIDRs(location.Account, location.Region)
+		if err != nil {
+			return nil, err
+		}
+		err = p.reserveExternalCIDRs(dc, reservationSourceAWS, cidrs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return p.findReservationConflicts()
+}
@@ -0,0 +1,80 @@
+package ipam
+
+import (
+	"strings"
+)
+
+// AzureVNetClient reads and manages the subnets of an Azure virtual network.
+// It's usually backed by the Azure Network SDK (armnetwork.SubnetsClient).
+type AzureVNetClient interface {
+	ListSubnets(vnet AzureVNet) ([]AzureSubnet, error)
+	CreateSubnet(vnet AzureVNet, subnet AzureSubnet) error
+}
+
+// AzureVNet identifies the virtual network of a datacenter in Azure.
+type AzureVNet struct {
+	Subscription  string
+	ResourceGroup string
+	Name          string
+}
+
+// AzureSubnet is a subnet of an Azure virtual network.
+type AzureSubnet struct {
+	Name          string
+	AddressPrefix string
+}
+
+// SyncAzureVNets registers the existing subnets of each datacenter virtual network as external reservations and
+// returns the current allocations that collide with them. Subnets matching exactly a prefix allocation of the
+// datacenter are the ones created for that allocation, so they are not reserved.
+func SyncAzureVNets(p IPAM, client AzureVNetClient, dcVNets map[string]AzureVNet) ([]ReservationConflict, error) {
+	for dc, vnet := range dcVNets {
+		subnets, err := client.ListSubnets(vnet)
+		if err != nil {
+			return nil, err
+		}
+		cidrs := []string{}
+		for _, subnet := range subnets {
+			cidrs = append(cidrs, subnet.AddressPrefix)
+		}
+		err = p.reserveExternalCIDRs(dc, reservationSourceAzure, cidrs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return p.findReservationConflicts()
+}
+
+// AzureSubnetCreationHook returns an allocation hook creating an Azure subnet for every new prefix allocation
+// made in a datacenter with a virtual network configured.
+func AzureSubnetCreationHook(client AzureVNetClient, dcVNets map[string]AzureVNet) AllocationHook {
+	return func(allocation IPAMAllocation) error {
+		vnet, hasVNet := dcVNets[allocation.Datacenter]
+		if !hasVNet || allocation.Type != "prefix" {
+			return nil
+		}
+		return client.CreateSubnet(vnet, AzureSubnet{
+			Name:          azureSubnetName(allocation),
+			AddressPrefix: allocation.CIDR,
+		})
+	}
+}
+
+// azureSubnetName builds a subnet name valid in Azure (letters, digits, underscores, periods and hyphens, up to 80
+// characters, not ending with a period or hyphen) from the pool and cluster names.
+func azureSubnetName(allocation IPAMAllocation) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '.', r == '-':
+			return r
+		default:
+			return '-'
+		}
+	}, externalName(allocation))
+
+	if len(name) > 80 {
+		name = name[:80]
+	}
+	return strings.TrimRight(name, ".-")
+}
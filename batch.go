@@ -0,0 +1,104 @@
+package ipam
+
+// AllocateBatch allocates the pool for the given clusters in a single pass, creating the clusters that don't exist
+// yet (see addAllocation). The current allocations are compiled only once per purpose for the whole batch, and
+// nothing is allocated if any of the clusters cannot be served. Clusters already allocated for the pool (or one of
+// its purposes), or in a datacenter not configured in the pool, are skipped. It returns the new allocations.
+func (p IPAM) AllocateBatch(ipamPool IPAMPool, clusters []ClusterRef) ([]IPAMAllocation, error) {
+	return p.allocateBatch(ipamPool, clusters, false)
+}
+
+// ForceAllocateBatch allocates the batch even if it makes more new allocations than allowed by WithMaxNewAllocations.
+func (p IPAM) ForceAllocateBatch(ipamPool IPAMPool, clusters []ClusterRef) ([]IPAMAllocation, error) {
+	return p.allocateBatch(ipamPool, clusters, true)
+}
+
+func (p IPAM) allocateBatch(ipamPool IPAMPool, clusters []ClusterRef, force bool) ([]IPAMAllocation, error) {
+	purposePools, err := ipamPool.purposePools()
+	if err != nil {
+		return nil, err
+	}
+
+	existingClusters := map[ClusterRef]Cluster{}
+	for dc, dcClusters := range p.datacenterAllocations {
+		for _, dcCluster := range dcClusters {
+			existingClusters[dcCluster.ref(dc)] = dcCluster
+		}
+	}
+
+	newClustersAllocations := []IPAMAllocation{}
+	for _, purposePool := range purposePools {
+		purposePool, err := purposePool.withResolvedAllocationSizes()
+		if err != nil {
+			return nil, err
+		}
+		purposeAllocations, err := p.generateBatchAllocations(purposePool, clusters, existingClusters)
+		if err != nil {
+			return nil, err
+		}
+		err = p.checkPlacementConstraints(purposePool, purposeAllocations)
+		if err != nil {
+			return nil, err
+		}
+		newClustersAllocations = append(newClustersAllocations, purposeAllocations...)
+	}
+
+	if !force {
+		err = p.checkMaxNewAllocations(ipamPool, newClustersAllocations)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = p.checkTenantQuota(ipamPool.Tenant, newClustersAllocations)
+	if err != nil {
+		return nil, err
+	}
+	err = p.assignAllocationIDs(newClustersAllocations)
+	if err != nil {
+		return nil, err
+	}
+	err = p.addNewAllocations(newClustersAllocations)
+	if err != nil {
+		return nil, err
+	}
+
+	return newClustersAllocations, nil
+}
+
+// generateBatchAllocations returns the new allocations of a pool without purposes for the clusters of a batch.
+func (p IPAM) generateBatchAllocations(ipamPool IPAMPool, clusters []ClusterRef, existingClusters map[ClusterRef]Cluster) ([]IPAMAllocation, error) {
+	p.trackUniqueIPAMPool(ipamPool)
+	dcIPAMPoolUsageMap, err := p.compileCurrentAllocationsForPool(ipamPool)
+	if err != nil {
+		return nil, err
+	}
+
+	newClustersAllocations := []IPAMAllocation{}
+	batchClusters := map[ClusterRef]struct{}{}
+	for _, clusterRef := range clusters {
+		if _, isDuplicated := batchClusters[clusterRef]; isDuplicated {
+			continue
+		}
+		batchClusters[clusterRef] = struct{}{}
+
+		cluster, exists := existingClusters[clusterRef]
+		if !exists {
+			cluster = Cluster{Name: clusterRef.Name, Tenant: clusterRef.Tenant, IPAMAllocations: []IPAMAllocation{}}
+		}
+		newClustersAllocation, err := p.generateNewAllocationForCluster(ipamPool, clusterRef.Datacenter, cluster, dcIPAMPoolUsageMap)
+		if err != nil {
+			return nil, err
+		}
+		if newClustersAllocation == nil {
+			continue
+		}
+		newClustersAllocations = append(newClustersAllocations, *newClustersAllocation)
+		if ipamPool.UniqueAcrossDatacenters {
+			err := markAllocationsInOtherDatacentersAsUsed(ipamPool, []IPAMAllocation{*newClustersAllocation}, dcIPAMPoolUsageMap)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return newClustersAllocations, nil
+}
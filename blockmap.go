@@ -0,0 +1,63 @@
+package ipam
+
+import (
+	"bytes"
+	"net"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RenderClusterBlocks renders the blocks of every cluster as YAML keyed by "<datacenter>/<cluster>" (clusters of a
+// tenant are "<datacenter>/<tenant>/<cluster>"), then by (qualified) pool name, with one block per line. Keys and blocks are sorted, so the output is stable and can be
+// committed to Git to review allocation changes as diffs, e.g.
+//
+//	aws-eu-1/c1:
+//	  pool1:
+//	    - 192.168.1.0/28
+func RenderClusterBlocks(p IPAM) ([]byte, error) {
+	clusterBlocks := map[string]map[string][]string{}
+	for dc, dcClusters := range p.datacenterAllocations {
+		for _, dcCluster := range dcClusters {
+			poolBlocks := map[string][]string{}
+			for _, ipamAllocation := range dcCluster.IPAMAllocations {
+				poolName := ipamAllocation.qualifiedIPAMPoolName()
+				poolBlocks[poolName] = append(poolBlocks[poolName], allocationBlocks(ipamAllocation)...)
+			}
+			for _, blocks := range poolBlocks {
+				sortBlocks(blocks)
+			}
+			clusterBlocks[dc+"/"+dcCluster.ref(dc).qualifiedName()] = poolBlocks
+		}
+	}
+
+	// yaml.v3 sorts the map keys
+	out := bytes.Buffer{}
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(clusterBlocks); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// sortBlocks sorts CIDRs and address ranges by their first address; invalid blocks go last.
+func sortBlocks(blocks []string) {
+	firstIPs := make(map[string]net.IP, len(blocks))
+	for _, block := range blocks {
+		firstIP, _, err := blockBounds(block)
+		if err == nil {
+			firstIPs[block] = firstIP
+		}
+	}
+	sort.SliceStable(blocks, func(i, j int) bool {
+		firstIPI, firstIPJ := firstIPs[blocks[i]], firstIPs[blocks[j]]
+		if firstIPI == nil || firstIPJ == nil {
+			return firstIPJ == nil && firstIPI != nil
+		}
+		return bytes.Compare(firstIPI, firstIPJ) < 0
+	})
+}
@@ -0,0 +1,85 @@
+package ipam
+
+// CapacityDetail tells, per datacenter of a pool, how many allocations are needed and how many fit.
+type CapacityDetail struct {
+	Datacenters map[string]DatacenterCapacity
+	// Purposes are the capacity details of the purposes of the pool, if it has any
+	Purposes map[string]CapacityDetail
+}
+
+// DatacenterCapacity is the capacity of a pool in one datacenter.
+type DatacenterCapacity struct {
+	// Required counts the existing clusters without an allocation of the pool plus the new clusters
+	Required int
+	// Available is the number of allocations of the pool that still fit in the datacenter
+	Available int
+	// Shortfall is the number of required allocations that don't fit
+	Shortfall int
+}
+
+// CanAllocate tells, without changing anything, whether the pool has room for newClusters more clusters in every
+// datacenter it's configured for, on top of the existing clusters that don't have an allocation of the pool yet. For
+// a pool with purposes, every purpose must have room. An error is returned when the pool settings or the current
+// allocations of the pool are invalid.
+func (p IPAM) CanAllocate(ipamPool IPAMPool, newClusters int) (bool, CapacityDetail, error) {
+	purposePools, err := ipamPool.purposePools()
+	if err != nil {
+		return false, CapacityDetail{}, err
+	}
+
+	detail := CapacityDetail{Datacenters: map[string]DatacenterCapacity{}}
+	canAllocate := true
+	for _, purposePool := range purposePools {
+		canAllocatePurpose, purposeDetail, err := p.canAllocatePurpose(purposePool, newClusters)
+		if err != nil {
+			return false, CapacityDetail{}, err
+		}
+		canAllocate = canAllocate && canAllocatePurpose
+		if purposePool.purpose == "" {
+			detail.Datacenters = purposeDetail.Datacenters
+			continue
+		}
+		if detail.Purposes == nil {
+			detail.Purposes = map[string]CapacityDetail{}
+		}
+		detail.Purposes[purposePool.purpose] = purposeDetail
+	}
+	return canAllocate, detail, nil
+}
+
+// canAllocatePurpose is CanAllocate for a pool without purposes, or one of the purposes of a pool.
+func (p IPAM) canAllocatePurpose(ipamPool IPAMPool, newClusters int) (bool, CapacityDetail, error) {
+	ipamPool, err := ipamPool.withResolvedAllocationSizes()
+	if err != nil {
+		return false, CapacityDetail{}, err
+	}
+	dcIPAMPoolUsageMap, err := p.compileCurrentAllocationsForPool(ipamPool)
+	if err != nil {
+		return false, CapacityDetail{}, err
+	}
+
+	detail := CapacityDetail{Datacenters: map[string]DatacenterCapacity{}}
+	canAllocate := true
+	for _, dc := range sortedKeys(ipamPool.Datacenters) {
+		dcIPAMPoolCfg := ipamPool.Datacenters[dc]
+		dcCapacity := DatacenterCapacity{Required: newClusters}
+		for _, dcCluster := range p.datacenterAllocations[dc] {
+			if !p.hasAllocation(dcCluster.ref(dc), ipamPool.qualifiedName()) {
+				dcCapacity.Required++
+			}
+		}
+
+		dcCapacity.Available, err = remainingAllocationsOfPool(dc, dcIPAMPoolCfg, dcIPAMPoolUsageMap)
+		if err != nil {
+			return false, CapacityDetail{}, err
+		}
+
+		if dcCapacity.Required > dcCapacity.Available {
+			dcCapacity.Shortfall = dcCapacity.Required - dcCapacity.Available
+			canAllocate = false
+		}
+		detail.Datacenters[dc] = dcCapacity
+	}
+
+	return canAllocate, detail, nil
+}
@@ -0,0 +1,81 @@
+package ipam
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	cefVendor  = "hbernardo"
+	cefProduct = "ipam"
+	cefVersion = "1.0"
+
+	// syslogFacilityLogAudit is the syslog facility 13 (log audit)
+	syslogFacilityLogAudit = 13
+	syslogSeverityInfo     = 6
+)
+
+// CEFSink writes allocation events as CEF (ArcSight Common Event Format) messages in RFC 5424 syslog lines, e.g. to
+// a syslog collector connection or a file tailed by a SIEM agent.
+type CEFSink struct {
+	w        io.Writer
+	hostname string
+	appName  string
+}
+
+// NewCEFSink returns a sink writing to w, with the hostname of the machine as syslog hostname.
+func NewCEFSink(w io.Writer) *CEFSink {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	return &CEFSink{w: w, hostname: hostname, appName: cefProduct}
+}
+
+func (s *CEFSink) Send(event AllocationEvent) error {
+	_, err := fmt.Fprintf(s.w, "<%d>1 %s %s %s - %s - %s\n",
+		syslogFacilityLogAudit*8+syslogSeverityInfo,
+		event.Time.UTC().Format(time.RFC3339Nano),
+		s.hostname,
+		s.appName,
+		strings.ToUpper(event.Type),
+		cefMessage(event),
+	)
+	return err
+}
+
+// cefMessage formats the event as "CEF:0|vendor|product|version|signature|name|severity|extensions", with the
+// allocation in custom string extensions.
+func cefMessage(event AllocationEvent) string {
+	allocation := event.Allocation
+	extensions := []string{
+		"rt=" + fmt.Sprint(event.Time.UnixNano()/int64(time.Millisecond)),
+		"act=" + escapeCEFExtension(event.Type),
+		"cs1Label=pool cs1=" + escapeCEFExtension(allocation.IPAMPoolName),
+		"cs2Label=tenant cs2=" + escapeCEFExtension(allocation.IPAMPoolTenant),
+		"cs3Label=datacenter cs3=" + escapeCEFExtension(allocation.Datacenter),
+		"cs4Label=cluster cs4=" + escapeCEFExtension(allocation.clusterRef().qualifiedName()),
+		"cs5Label=addresses cs5=" + escapeCEFExtension(strings.Join(allocationBlocks(allocation), ",")),
+	}
+
+	return fmt.Sprintf("CEF:0|%s|%s|%s|%s|%s|%d|%s",
+		escapeCEFHeader(cefVendor),
+		escapeCEFHeader(cefProduct),
+		escapeCEFHeader(cefVersion),
+		escapeCEFHeader("allocation-"+event.Type),
+		escapeCEFHeader("IP allocation "+event.Type),
+		3,
+		strings.Join(extensions, " "),
+	)
+}
+
+func escapeCEFHeader(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `|`, `\|`).Replace(value)
+}
+
+func escapeCEFExtension(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`).Replace(value)
+}
@@ -0,0 +1,31 @@
+package ipam
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCEFSink(t *testing.T) {
+	out := strings.Builder{}
+	sink := NewCEFSink(&out)
+	sink.hostname = "ipam-1"
+
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {{Name: "c1", IPAMAllocations: []IPAMAllocation{}}},
+	}, WithClock(newManualClock(time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC))), WithEventSink(sink))
+	err := ipam.Apply(IPAMPool{
+		Name:   "pool1",
+		Tenant: "team=a",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/24", AllocationPrefix: 28},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "<110>1 2021-06-01T00:00:00Z ipam-1 ipam - ALLOCATED - "+
+		"CEF:0|hbernardo|ipam|1.0|allocation-allocated|IP allocation allocated|3|"+
+		"rt=1622505600000 act=allocated cs1Label=pool cs1=pool1 cs2Label=tenant cs2=team\\=a "+
+		"cs3Label=datacenter cs3=aws-eu-1 cs4Label=cluster cs4=c1 cs5Label=addresses cs5=10.0.0.0/28\n", out.String())
+}
@@ -0,0 +1,17 @@
+package ipam
+
+import (
+	"time"
+)
+
+// Clock provides the current time to the time-dependent features (pending allocations, holds, address history), so
+// they can be made deterministic in tests and simulations.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
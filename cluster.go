@@ -0,0 +1,211 @@
+package ipam
+
+import (
+	"fmt"
+)
+
+// DescribeAllocation sets the description of the allocation of a pool for a cluster, recording why the block was
+// allocated. The allocations of a pool purpose are designated by "<pool>:<purpose>".
+func (p IPAM) DescribeAllocation(cluster ClusterRef, ipamPoolTenant, ipamPoolName, description string) error {
+	clusterIndex := p.clusterIndex(cluster)
+	if clusterIndex < 0 {
+		return fmt.Errorf("cluster %s not found in datacenter %s", cluster.qualifiedName(), cluster.Datacenter)
+	}
+	dcCluster := p.datacenterAllocations[cluster.Datacenter][clusterIndex]
+	for i, clusterAllocation := range dcCluster.IPAMAllocations {
+		if clusterAllocation.qualifiedIPAMPoolName() == qualifiedIPAMPoolName(ipamPoolTenant, ipamPoolName) {
+			dcCluster.IPAMAllocations[i].Description = description
+			return nil
+		}
+	}
+	return fmt.Errorf("cluster %s has no allocation of pool %s", cluster.qualifiedName(), qualifiedIPAMPoolName(ipamPoolTenant, ipamPoolName))
+}
+
+// RenameCluster transfers the allocations (and pending allocations) of a cluster of a datacenter, given by its
+// qualified name, to its new name in the same tenant, so the next apply doesn't allocate the pools again for the new
+// name. The address history records the old name as an alias.
+func (p IPAM) RenameCluster(dc, oldName, newName string) error {
+	cluster := clusterRefOf(dc, oldName)
+	if newName == "" {
+		return fmt.Errorf("cluster name cannot be empty")
+	}
+	renamedCluster := cluster
+	renamedCluster.Name = newName
+	if p.clusterIndex(renamedCluster) >= 0 {
+		return fmt.Errorf("cluster %s already exists in datacenter %s", renamedCluster.qualifiedName(), cluster.Datacenter)
+	}
+	clusterIndex := p.clusterIndex(cluster)
+	if clusterIndex < 0 {
+		return fmt.Errorf("cluster %s not found in datacenter %s", cluster.qualifiedName(), cluster.Datacenter)
+	}
+
+	dcCluster := &p.datacenterAllocations[cluster.Datacenter][clusterIndex]
+	dcCluster.Name = newName
+	for i := range dcCluster.IPAMAllocations {
+		dcCluster.IPAMAllocations[i].Cluster = newName
+	}
+
+	for key, pending := range p.pendingAllocations {
+		if key.cluster != cluster {
+			continue
+		}
+		delete(p.pendingAllocations, key)
+		key.cluster = renamedCluster
+		pending.Cluster = renamedCluster
+		p.pendingAllocations[key] = pending
+	}
+
+	p.addressHistory.recordClusterRename(cluster, newName)
+	return nil
+}
+
+// clusterIndex returns the index of the cluster in its datacenter, or -1 if it doesn't exist.
+func (p IPAM) clusterIndex(cluster ClusterRef) int {
+	for i, dcCluster := range p.datacenterAllocations[cluster.Datacenter] {
+		if dcCluster.ref(cluster.Datacenter) == cluster {
+			return i
+		}
+	}
+	return -1
+}
+
+// ClusterMovePlan tells how the addresses of a cluster moved to another datacenter are renumbered.
+type ClusterMovePlan struct {
+	Cluster        string
+	ClusterTenant  string
+	FromDatacenter string
+	ToDatacenter   string
+	Renumberings   []Renumbering
+}
+
+// Renumbering maps a released allocation to the allocation replacing it, if any.
+type Renumbering struct {
+	OldAllocation IPAMAllocation
+	NewAllocation *IPAMAllocation
+}
+
+// MoveCluster moves a cluster, given by its qualified name, to another datacenter. Its allocations are bound to the
+// pools of the old datacenter, so they are all released, kept as tombstones, and replaced by equivalent allocations
+// of the given pools (one per purpose) in the target datacenter. Every allocation of the cluster must come from one of
+// the pools, so none is lost. Nothing changes if a pool cannot be allocated in the target datacenter, or if an
+// approval hook rejects the move.
+func (p IPAM) MoveCluster(clusterName, fromDC, toDC string, ipamPools ...IPAMPool) (ClusterMovePlan, error) {
+	clusterRef := clusterRefOf(fromDC, clusterName)
+	if fromDC == toDC {
+		return ClusterMovePlan{}, fmt.Errorf("cluster %s is already in datacenter %s", clusterRef.qualifiedName(), toDC)
+	}
+	clusterIndex := p.clusterIndex(clusterRef)
+	if clusterIndex < 0 {
+		return ClusterMovePlan{}, fmt.Errorf("cluster %s not found in datacenter %s", clusterRef.qualifiedName(), fromDC)
+	}
+	movedClusterRef := clusterRef
+	movedClusterRef.Datacenter = toDC
+	if p.clusterIndex(movedClusterRef) >= 0 {
+		return ClusterMovePlan{}, fmt.Errorf("cluster %s already exists in datacenter %s", clusterRef.qualifiedName(), toDC)
+	}
+	cluster := p.datacenterAllocations[fromDC][clusterIndex]
+
+	if len(ipamPools) == 0 {
+		return ClusterMovePlan{}, fmt.Errorf("no pool given to move cluster %s", clusterRef.qualifiedName())
+	}
+	movedPoolAllocations := map[string][]IPAMAllocation{}
+	purposePools := []IPAMPool{}
+	for _, ipamPool := range ipamPools {
+		poolName := qualifiedIPAMPoolName(ipamPool.Tenant, ipamPool.Name)
+		if _, isDuplicated := movedPoolAllocations[poolName]; isDuplicated {
+			return ClusterMovePlan{}, fmt.Errorf("pool %s is given more than once", poolName)
+		}
+		movedPoolAllocations[poolName] = []IPAMAllocation{}
+		poolPurposePools, err := ipamPool.purposePools()
+		if err != nil {
+			return ClusterMovePlan{}, err
+		}
+		purposePools = append(purposePools, poolPurposePools...)
+	}
+	for _, oldAllocation := range cluster.IPAMAllocations {
+		poolName := qualifiedIPAMPoolName(oldAllocation.IPAMPoolTenant, oldAllocation.IPAMPoolName)
+		if _, isMoved := movedPoolAllocations[poolName]; !isMoved {
+			return ClusterMovePlan{}, fmt.Errorf("cluster %s has an allocation of pool %s, which the move would lose", clusterRef.qualifiedName(), oldAllocation.qualifiedIPAMPoolName())
+		}
+		movedPoolAllocations[poolName] = append(movedPoolAllocations[poolName], oldAllocation)
+	}
+
+	// the new allocations are checked against a copy where the cluster is already moved, so a failure leaves the
+	// IPAM unchanged
+	simulation := p
+	simulation.datacenterAllocations = copyDatacenterAllocations(p.datacenterAllocations)
+	simulation.relocateCluster(clusterRef, toDC)
+	newAllocations := []IPAMAllocation{}
+	for _, purposePool := range purposePools {
+		if _, isDCConfigured := purposePool.Datacenters[toDC]; !isDCConfigured {
+			return ClusterMovePlan{}, fmt.Errorf("pool %s is not configured for datacenter %s", purposePool.qualifiedName(), toDC)
+		}
+		purposePool, err := purposePool.withResolvedAllocationSizes()
+		if err != nil {
+			return ClusterMovePlan{}, err
+		}
+		dcIPAMPoolUsageMap, err := simulation.compileCurrentAllocationsForPool(purposePool)
+		if err != nil {
+			return ClusterMovePlan{}, err
+		}
+		newAllocation, err := simulation.generateNewAllocationForCluster(purposePool, toDC, Cluster{Name: cluster.Name, Tenant: cluster.Tenant}, dcIPAMPoolUsageMap)
+		if err != nil {
+			return ClusterMovePlan{}, err
+		}
+		err = simulation.checkNewAllocations(purposePool, []IPAMAllocation{*newAllocation})
+		if err != nil {
+			return ClusterMovePlan{}, err
+		}
+		simulation.addAllocation(*newAllocation)
+		newAllocations = append(newAllocations, *newAllocation)
+	}
+	for _, ipamPool := range ipamPools {
+		ipamPool := ipamPool
+		err := p.requestApproval(DestructiveOperation{
+			Kind:        DestructiveReallocation,
+			IPAMPool:    &ipamPool,
+			Allocations: movedPoolAllocations[qualifiedIPAMPoolName(ipamPool.Tenant, ipamPool.Name)],
+		})
+		if err != nil {
+			return ClusterMovePlan{}, err
+		}
+	}
+
+	plan := ClusterMovePlan{Cluster: cluster.Name, ClusterTenant: cluster.Tenant, FromDatacenter: fromDC, ToDatacenter: toDC, Renumberings: []Renumbering{}}
+	for _, oldAllocation := range cluster.IPAMAllocations {
+		allocationRenumbering := Renumbering{OldAllocation: oldAllocation}
+		for i := range newAllocations {
+			if newAllocations[i].qualifiedIPAMPoolName() == oldAllocation.qualifiedIPAMPoolName() {
+				allocationRenumbering.NewAllocation = &newAllocations[i]
+			}
+		}
+		plan.Renumberings = append(plan.Renumberings, allocationRenumbering)
+	}
+
+	err := p.removeReleasedAllocations(cluster.IPAMAllocations, fmt.Sprintf("move of cluster %s to datacenter %s", clusterRef.qualifiedName(), toDC))
+	if err != nil {
+		return ClusterMovePlan{}, err
+	}
+	p.relocateCluster(clusterRef, toDC)
+	for key := range p.pendingAllocations {
+		if key.cluster == clusterRef {
+			delete(p.pendingAllocations, key)
+		}
+	}
+
+	if err := p.addNewAllocations(newAllocations); err != nil {
+		return plan, err
+	}
+	// the allocations left behind in the old datacenter may serve the pending allocations there
+	return plan, p.completeRelease(cluster.IPAMAllocations)
+}
+
+// relocateCluster moves the cluster, without its allocations, to another datacenter.
+func (p IPAM) relocateCluster(clusterRef ClusterRef, toDC string) {
+	clusterIndex := p.clusterIndex(clusterRef)
+	fromClusters := p.datacenterAllocations[clusterRef.Datacenter]
+	cluster := fromClusters[clusterIndex]
+	cluster.IPAMAllocations = []IPAMAllocation{}
+	p.datacenterAllocations[clusterRef.Datacenter] = append(fromClusters[:clusterIndex:clusterIndex], fromClusters[clusterIndex+1:]...)
+	p.datacenterAllocations[toDC] = append(p.datacenterAllocations[toDC], cluster)
+}
@@ -0,0 +1,89 @@
+// Command ipamctl runs IPAM tasks from the command line, e.g. in GitOps pipelines.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/hbernardo/ipam"
+)
+
+const usage = `usage: ipamctl <command> [arguments]
+
+commands:
+  lint <file|directory>...             validate the IPAM pool definitions of YAML files
+  diff [-json] <state-a> <state-b>     report the allocations added, removed or changed between two state snapshots
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "lint":
+		os.Exit(lint(os.Args[2:]))
+	case "diff":
+		os.Exit(diff(os.Args[2:]))
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+// lint prints the issues of the pool definitions and returns the exit code: 0 if there is none, 1 otherwise.
+func lint(paths []string) int {
+	if len(paths) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+
+	issues, err := ipam.LintIPAMPoolFiles(paths)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	for _, issue := range issues {
+		fmt.Println(issue)
+	}
+	if len(issues) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// diff prints the allocation differences between two state snapshots, one per line or as JSON, and returns the exit
+// code: 0 if there is none, 1 otherwise.
+func diff(args []string) int {
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the differences as JSON")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+
+	diffs, err := ipam.DiffStateFiles(flags.Arg(0), flags.Arg(1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(diffs); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	} else {
+		for _, diff := range diffs {
+			fmt.Println(diff)
+		}
+	}
+	if len(diffs) > 0 {
+		return 1
+	}
+	return 0
+}
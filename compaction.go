@@ -0,0 +1,169 @@
+package ipam
+
+import (
+	"bytes"
+	"math/big"
+	"net"
+	"sort"
+)
+
+// CompactionThresholds tells when a datacenter pool is too fragmented.
+type CompactionThresholds struct {
+	// MaxFragmentation is the highest accepted share of the free addresses of a datacenter pool lying outside its
+	// largest free block, between 0 (all the free space is contiguous) and 1
+	MaxFragmentation float64
+}
+
+// CompactionPlan is an ordered migration plan restoring a large contiguous free block in a datacenter pool. Each
+// renumbering moves the allocation of a cluster into space which is free once the previous renumberings are done.
+type CompactionPlan struct {
+	Datacenter          string
+	IPAMPool            string
+	FragmentationBefore float64
+	FragmentationAfter  float64
+	Renumberings        []Renumbering
+}
+
+// PlanCompaction proposes, for every datacenter pool more fragmented than the thresholds, the renumberings moving
+// the allocations at the far end of the pool (the high end, or the low end for pools allocating from high) into the
+// holes left at the other end, one at a time, stopping as soon as the fragmentation is back under the threshold.
+// The plan is never applied: clusters have to be renumbered by their owners.
+func (p IPAM) PlanCompaction(ipamPool IPAMPool, thresholds CompactionThresholds) ([]CompactionPlan, error) {
+	ipamPool, err := ipamPool.withResolvedAllocationSizes()
+	if err != nil {
+		return nil, err
+	}
+	dcIPAMPoolUsageMap, err := p.compileCurrentAllocationsForPool(ipamPool)
+	if err != nil {
+		return nil, err
+	}
+
+	plans := []CompactionPlan{}
+	for _, dc := range sortedKeys(ipamPool.Datacenters) {
+		dcIPAMPoolCfg := ipamPool.Datacenters[dc]
+		fragmentation, err := fragmentationOfPool(dc, dcIPAMPoolCfg, dcIPAMPoolUsageMap)
+		if err != nil {
+			return nil, err
+		}
+		if fragmentation <= thresholds.MaxFragmentation {
+			continue
+		}
+		plan := CompactionPlan{
+			Datacenter:          dc,
+			IPAMPool:            ipamPool.qualifiedName(),
+			FragmentationBefore: fragmentation,
+			FragmentationAfter:  fragmentation,
+			Renumberings:        []Renumbering{},
+		}
+
+		fromHigh := dcIPAMPoolCfg.Type == "range" && dcIPAMPoolCfg.AllocateFrom == allocateFromHigh
+		for _, oldAllocation := range p.allocationsFromFarEnd(ipamPool, dc, fromHigh) {
+			if plan.FragmentationAfter <= thresholds.MaxFragmentation {
+				break
+			}
+			newAllocation, err := p.compactAllocation(ipamPool, dcIPAMPoolCfg, oldAllocation, fromHigh, dcIPAMPoolUsageMap)
+			if err != nil {
+				return nil, err
+			}
+			if newAllocation == nil {
+				break
+			}
+			plan.Renumberings = append(plan.Renumberings, Renumbering{OldAllocation: oldAllocation, NewAllocation: newAllocation})
+			plan.FragmentationAfter, err = fragmentationOfPool(dc, dcIPAMPoolCfg, dcIPAMPoolUsageMap)
+			if err != nil {
+				return nil, err
+			}
+		}
+		plans = append(plans, plan)
+	}
+
+	return plans, nil
+}
+
+// allocationsFromFarEnd returns the allocations of the pool in the datacenter, starting with the one farthest from
+// the end the pool allocates from.
+func (p IPAM) allocationsFromFarEnd(ipamPool IPAMPool, dc string, fromHigh bool) []IPAMAllocation {
+	allocations := []IPAMAllocation{}
+	for _, dcCluster := range p.datacenterAllocations[dc] {
+		for _, clusterAllocation := range dcCluster.IPAMAllocations {
+			if clusterAllocation.isFromPool(ipamPool) {
+				allocations = append(allocations, clusterAllocation)
+			}
+		}
+	}
+	sort.SliceStable(allocations, func(i, j int) bool {
+		iFirst, iLast := allocationBounds(allocations[i])
+		jFirst, jLast := allocationBounds(allocations[j])
+		if fromHigh {
+			return bytes.Compare(iFirst, jFirst) < 0
+		}
+		return bytes.Compare(iLast, jLast) > 0
+	})
+	return allocations
+}
+
+// compactAllocation moves an allocation into the free space closest to the end the pool allocates from, updating
+// the usage, and returns the new allocation. Nothing changes, and nil is returned, if there is no such space
+// entirely before (after, for pools allocating from high) the allocation.
+func (p IPAM) compactAllocation(ipamPool IPAMPool, dcIPAMPoolCfg IPAMPoolDatacenterSettings, oldAllocation IPAMAllocation, fromHigh bool, dcIPAMPoolUsageMap datacenterIPAMPoolUsageMap) (*IPAMAllocation, error) {
+	err := markAllocationAsFree(oldAllocation, dcIPAMPoolUsageMap)
+	if err != nil {
+		return nil, err
+	}
+	cluster := Cluster{Name: oldAllocation.Cluster, Tenant: oldAllocation.ClusterTenant}
+	newAllocation, err := p.generateNewAllocationForCluster(ipamPool, oldAllocation.Datacenter, cluster, dcIPAMPoolUsageMap)
+	if err != nil {
+		return nil, err
+	}
+	newAllocation.Description = oldAllocation.Description
+	newAllocation.Labels = oldAllocation.Labels
+
+	oldFirst, oldLast := allocationBounds(oldAllocation)
+	newFirst, newLast := allocationBounds(*newAllocation)
+	isCompacted := bytes.Compare(newLast, oldFirst) < 0
+	if fromHigh {
+		isCompacted = bytes.Compare(newFirst, oldLast) > 0
+	}
+	if isCompacted {
+		return newAllocation, nil
+	}
+
+	if err := markAllocationAsFree(*newAllocation, dcIPAMPoolUsageMap); err != nil {
+		return nil, err
+	}
+	return nil, markAllocationAsUsed(oldAllocation, dcIPAMPoolUsageMap)
+}
+
+// allocationBounds returns the lowest and highest addresses (in 16-byte form) of an allocation.
+func allocationBounds(allocation IPAMAllocation) (net.IP, net.IP) {
+	var allocationFirst, allocationLast net.IP
+	for _, block := range allocationBlocks(allocation) {
+		first, last, err := blockBounds(block)
+		if err != nil {
+			continue
+		}
+		if allocationFirst == nil || bytes.Compare(first, allocationFirst) < 0 {
+			allocationFirst = first
+		}
+		if allocationLast == nil || bytes.Compare(last, allocationLast) > 0 {
+			allocationLast = last
+		}
+	}
+	return allocationFirst, allocationLast
+}
+
+// fragmentationOfPool returns the share of the free addresses of the datacenter pool lying outside its largest
+// free block.
+func fragmentationOfPool(dc string, dcIPAMPoolCfg IPAMPoolDatacenterSettings, dcIPAMPoolUsageMap datacenterIPAMPoolUsageMap) (float64, error) {
+	freeCount, largestFreeBlock, err := freeSpaceOfPool(dc, dcIPAMPoolCfg, dcIPAMPoolUsageMap)
+	if err != nil {
+		return 0, err
+	}
+
+	if freeCount.Sign() == 0 {
+		return 0, nil
+	}
+	fragmented := new(big.Int).Sub(freeCount, largestFreeBlock)
+	fragmentation, _ := new(big.Float).Quo(new(big.Float).SetInt(fragmented), new(big.Float).SetInt(freeCount)).Float64()
+	return fragmentation, nil
+}
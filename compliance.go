@@ -0,0 +1,130 @@
+package ipam
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// ComplianceExportOptions configures ExportCompliance.
+type ComplianceExportOptions struct {
+	// SigningKey is the HMAC-SHA256 key signing the export
+	SigningKey []byte
+	// Retention drops the records released longer than Retention ago; zero keeps every record
+	Retention time.Duration
+	// RedactClusters replaces cluster names by a keyed hash, so records of the same cluster can still be
+	// correlated without disclosing its name
+	RedactClusters bool
+}
+
+type complianceExport struct {
+	complianceExportPayload
+	// Signature is the hex encoded HMAC-SHA256 of the JSON encoded payload
+	Signature string `json:"signature"`
+}
+
+type complianceExportPayload struct {
+	GeneratedAt time.Time          `json:"generatedAt"`
+	Retention   string             `json:"retention,omitempty"`
+	Records     []complianceRecord `json:"records"`
+	// Datacenters holds the metadata of the datacenters of the records, when set
+	Datacenters map[string]Datacenter `json:"datacenters,omitempty"`
+}
+
+type complianceRecord struct {
+	Datacenter     string     `json:"datacenter"`
+	Cluster        string     `json:"cluster"`
+	ClusterTenant  string     `json:"clusterTenant,omitempty"`
+	ClusterAliases []string   `json:"clusterAliases,omitempty"`
+	IPAMPoolName   string     `json:"pool"`
+	IPAMPoolTenant string     `json:"tenant,omitempty"`
+	Block          string     `json:"block"`
+	AllocatedAt    time.Time  `json:"allocatedAt"`
+	ReleasedAt     *time.Time `json:"releasedAt,omitempty"`
+}
+
+// ExportCompliance generates a signed and timestamped JSON export of the address history, suitable for auditors.
+func (p IPAM) ExportCompliance(options ComplianceExportOptions, now time.Time) ([]byte, error) {
+	if len(options.SigningKey) == 0 {
+		return nil, fmt.Errorf("signing key cannot be empty")
+	}
+
+	payload := complianceExportPayload{
+		GeneratedAt: now.UTC(),
+		Records:     []complianceRecord{},
+	}
+	if options.Retention > 0 {
+		payload.Retention = options.Retention.String()
+	}
+	for _, record := range p.addressHistory.records {
+		if options.Retention > 0 && !record.ReleasedAt.IsZero() && now.Sub(record.ReleasedAt) > options.Retention {
+			continue
+		}
+		complianceRecord := complianceRecord{
+			Datacenter:     record.Datacenter,
+			Cluster:        record.Cluster,
+			ClusterTenant:  record.ClusterTenant,
+			ClusterAliases: record.ClusterAliases,
+			IPAMPoolName:   record.IPAMPoolName,
+			IPAMPoolTenant: record.IPAMPoolTenant,
+			Block:          record.Block,
+			AllocatedAt:    record.AllocatedAt.UTC(),
+		}
+		if !record.ReleasedAt.IsZero() {
+			releasedAt := record.ReleasedAt.UTC()
+			complianceRecord.ReleasedAt = &releasedAt
+		}
+		if options.RedactClusters {
+			complianceRecord.Cluster = redactCluster(options.SigningKey, record.Cluster)
+			complianceRecord.ClusterAliases = nil
+			for _, alias := range record.ClusterAliases {
+				complianceRecord.ClusterAliases = append(complianceRecord.ClusterAliases, redactCluster(options.SigningKey, alias))
+			}
+		}
+		payload.Records = append(payload.Records, complianceRecord)
+		if dc, hasMetadata := p.datacenters[record.Datacenter]; hasMetadata {
+			if payload.Datacenters == nil {
+				payload.Datacenters = map[string]Datacenter{}
+			}
+			payload.Datacenters[record.Datacenter] = dc
+		}
+	}
+
+	signedPayload, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(complianceExport{
+		complianceExportPayload: payload,
+		Signature:               complianceHMAC(options.SigningKey, signedPayload),
+	}, "", "  ")
+}
+
+// VerifyComplianceExport checks the signature of a compliance export.
+func VerifyComplianceExport(data, signingKey []byte) error {
+	export := complianceExport{}
+	if err := json.Unmarshal(data, &export); err != nil {
+		return err
+	}
+	signedPayload, err := json.Marshal(export.complianceExportPayload)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(complianceHMAC(signingKey, signedPayload)), []byte(export.Signature)) {
+		return fmt.Errorf("compliance export signature mismatch")
+	}
+	return nil
+}
+
+func redactCluster(signingKey []byte, cluster string) string {
+	return "redacted-" + complianceHMAC(signingKey, []byte(cluster))[:16]
+}
+
+func complianceHMAC(key, data []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
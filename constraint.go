@@ -0,0 +1,403 @@
+package ipam
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// placementConstraint is a parsed constraint of a pool, a boolean expression over the cluster being allocated and
+// the settings of the pool in its datacenter, e.g. "cluster.labels['tier'] == 'edge' implies allocationRange <= 16".
+//
+// Expressions support string ('edge' or "edge"), integer and boolean literals, the comparisons ==, !=, <, <=, >
+// and >=, the logical operators !, &&, || and implies (from the highest to the lowest precedence) and parentheses.
+// The variables are listed in constraintVariables; a label the cluster doesn't have is the empty string.
+type placementConstraint struct {
+	// op is the operator of the node: a comparison, a logical operator, "literal" or "variable"
+	op       string
+	operands []*placementConstraint
+	// value is the value of literals
+	value interface{}
+	// variable and key (the label key of cluster.labels) name the value of variables
+	variable string
+	key      string
+}
+
+// constraintEnv is what the variables of a constraint are evaluated against.
+type constraintEnv struct {
+	ipamPool      IPAMPool
+	cluster       Cluster
+	dc            string
+	dcIPAMPoolCfg IPAMPoolDatacenterSettings
+}
+
+// constraintVariables returns the value of each variable of the constraints, given the label key for cluster.labels.
+var constraintVariables = map[string]func(env constraintEnv, key string) interface{}{
+	"cluster.name":       func(env constraintEnv, _ string) interface{} { return env.cluster.Name },
+	"cluster.tenant":     func(env constraintEnv, _ string) interface{} { return env.cluster.Tenant },
+	"cluster.priority":   func(env constraintEnv, _ string) interface{} { return int64(env.cluster.Priority) },
+	"cluster.labels":     func(env constraintEnv, key string) interface{} { return env.cluster.Labels[key] },
+	"datacenter":         func(env constraintEnv, _ string) interface{} { return env.dc },
+	"pool":               func(env constraintEnv, _ string) interface{} { return env.ipamPool.Name },
+	"tenant":             func(env constraintEnv, _ string) interface{} { return env.ipamPool.Tenant },
+	"purpose":            func(env constraintEnv, _ string) interface{} { return env.ipamPool.purpose },
+	"type":               func(env constraintEnv, _ string) interface{} { return env.dcIPAMPoolCfg.Type },
+	"poolCidr":           func(env constraintEnv, _ string) interface{} { return env.dcIPAMPoolCfg.PoolCIDR },
+	"allocationPrefix":   func(env constraintEnv, _ string) interface{} { return int64(env.dcIPAMPoolCfg.AllocationPrefix) },
+	"allocationRange":    func(env constraintEnv, _ string) interface{} { return int64(env.dcIPAMPoolCfg.AllocationRange) },
+	"allocateFrom":       func(env constraintEnv, _ string) interface{} { return env.dcIPAMPoolCfg.AllocateFrom },
+	"firstAddressOffset": func(env constraintEnv, _ string) interface{} { return int64(env.dcIPAMPoolCfg.FirstAddressOffset) },
+	"mtu":                func(env constraintEnv, _ string) interface{} { return int64(env.dcIPAMPoolCfg.MTU) },
+}
+
+// checkPlacementConstraints fails if the settings of the pool break one of its constraints for the cluster of any of
+// the new allocations.
+func (p IPAM) checkPlacementConstraints(ipamPool IPAMPool, newAllocations []IPAMAllocation) error {
+	if len(ipamPool.Constraints) == 0 {
+		return nil
+	}
+	constraints := make([]*placementConstraint, 0, len(ipamPool.Constraints))
+	for _, expression := range ipamPool.Constraints {
+		constraint, err := parsePlacementConstraint(expression)
+		if err != nil {
+			return fmt.Errorf("pool %s: %v", ipamPool.qualifiedName(), err)
+		}
+		constraints = append(constraints, constraint)
+	}
+
+	for _, newAllocation := range newAllocations {
+		env := constraintEnv{
+			ipamPool:      ipamPool,
+			cluster:       p.allocatedCluster(newAllocation),
+			dc:            newAllocation.Datacenter,
+			dcIPAMPoolCfg: ipamPool.Datacenters[newAllocation.Datacenter],
+		}
+		for i, constraint := range constraints {
+			isSatisfied, err := constraint.isSatisfied(env)
+			if err != nil {
+				return fmt.Errorf("pool %s constraint %q: %v", ipamPool.qualifiedName(), ipamPool.Constraints[i], err)
+			}
+			if !isSatisfied {
+				return fmt.Errorf("%w: cluster %s in datacenter %s breaks constraint %q of pool %s", errPlacementConstraintViolated,
+					env.cluster.ref(env.dc).qualifiedName(), env.dc, ipamPool.Constraints[i], ipamPool.qualifiedName())
+			}
+		}
+	}
+	return nil
+}
+
+// allocatedCluster returns the cluster a new allocation is for. The clusters which don't exist yet, e.g. the ones
+// created by AllocateBatch or ConfirmHold, are created without labels by addAllocation.
+func (p IPAM) allocatedCluster(newAllocation IPAMAllocation) Cluster {
+	clusterIndex := p.clusterIndex(newAllocation.clusterRef())
+	if clusterIndex < 0 {
+		return Cluster{Name: newAllocation.Cluster, Tenant: newAllocation.ClusterTenant}
+	}
+	return p.datacenterAllocations[newAllocation.Datacenter][clusterIndex]
+}
+
+// isSatisfied evaluates the constraint, which must be boolean.
+func (c *placementConstraint) isSatisfied(env constraintEnv) (bool, error) {
+	value, err := c.eval(env)
+	if err != nil {
+		return false, err
+	}
+	isSatisfied, isBool := value.(bool)
+	if !isBool {
+		return false, fmt.Errorf("constraint is not a boolean expression")
+	}
+	return isSatisfied, nil
+}
+
+func (c *placementConstraint) eval(env constraintEnv) (interface{}, error) {
+	switch c.op {
+	case "literal":
+		return c.value, nil
+	case "variable":
+		return constraintVariables[c.variable](env, c.key), nil
+	case "!":
+		operand, err := c.operands[0].isSatisfied(env)
+		return !operand, err
+	case "&&", "||", "implies":
+		left, err := c.operands[0].isSatisfied(env)
+		if err != nil {
+			return nil, err
+		}
+		// the right operand is only evaluated when it decides the result
+		switch {
+		case c.op == "&&" && !left:
+			return false, nil
+		case c.op == "||" && left:
+			return true, nil
+		case c.op == "implies" && !left:
+			return true, nil
+		}
+		return c.operands[1].isSatisfied(env)
+	}
+
+	left, err := c.operands[0].eval(env)
+	if err != nil {
+		return nil, err
+	}
+	right, err := c.operands[1].eval(env)
+	if err != nil {
+		return nil, err
+	}
+	return compareConstraintValues(c.op, left, right)
+}
+
+func compareConstraintValues(op string, left, right interface{}) (bool, error) {
+	cmp := 0
+	switch leftValue := left.(type) {
+	case int64:
+		rightValue, isInt := right.(int64)
+		if !isInt {
+			return false, fmt.Errorf("cannot compare %v with %#v", left, right)
+		}
+		if leftValue < rightValue {
+			cmp = -1
+		} else if leftValue > rightValue {
+			cmp = 1
+		}
+	case string:
+		rightValue, isString := right.(string)
+		if !isString {
+			return false, fmt.Errorf("cannot compare %q with %#v", left, right)
+		}
+		cmp = strings.Compare(leftValue, rightValue)
+	case bool:
+		rightValue, isBool := right.(bool)
+		if !isBool || (op != "==" && op != "!=") {
+			return false, fmt.Errorf("cannot compare %v with %#v using %s", left, right, op)
+		}
+		if leftValue != rightValue {
+			cmp = 1
+		}
+	}
+
+	switch op {
+	case "==":
+		return cmp == 0, nil
+	case "!=":
+		return cmp != 0, nil
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	default:
+		return cmp >= 0, nil
+	}
+}
+
+// parsePlacementConstraint parses a constraint expression, rejecting unknown variables so typos are caught before
+// the pool is applied.
+func parsePlacementConstraint(expression string) (*placementConstraint, error) {
+	tokens, err := constraintTokens(expression)
+	if err != nil {
+		return nil, err
+	}
+	parser := &constraintParser{tokens: tokens}
+	constraint, err := parser.parseImplies()
+	if err != nil {
+		return nil, err
+	}
+	if parser.peek() != "" {
+		return nil, fmt.Errorf("unexpected %q in constraint %q", parser.peek(), expression)
+	}
+	return constraint, nil
+}
+
+// constraintOperators are the operator tokens, the two character ones first so they are matched before their prefix.
+var constraintOperators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", "[", "]", "."}
+
+// constraintTokens splits an expression into operators, identifiers, numbers and quoted strings (with their quotes).
+func constraintTokens(expression string) ([]string, error) {
+	tokens := []string{}
+	runes := []rune(expression)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '\'' || r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != r {
+				end++
+			}
+			if end == len(runes) {
+				return nil, fmt.Errorf("unterminated string in constraint %q", expression)
+			}
+			tokens = append(tokens, string(runes[i:end+1]))
+			i = end + 1
+		case unicode.IsLetter(r) || r == '_' || unicode.IsDigit(r):
+			end := i
+			for end < len(runes) && (unicode.IsLetter(runes[end]) || runes[end] == '_' || unicode.IsDigit(runes[end])) {
+				end++
+			}
+			tokens = append(tokens, string(runes[i:end]))
+			i = end
+		default:
+			operator := ""
+			for _, candidate := range constraintOperators {
+				if strings.HasPrefix(string(runes[i:]), candidate) {
+					operator = candidate
+					break
+				}
+			}
+			if operator == "" {
+				return nil, fmt.Errorf("unexpected %q in constraint %q", r, expression)
+			}
+			tokens = append(tokens, operator)
+			i += len([]rune(operator))
+		}
+	}
+	return tokens, nil
+}
+
+type constraintParser struct {
+	tokens []string
+	next   int
+}
+
+// peek returns the next token, or "" at the end of the expression.
+func (p *constraintParser) peek() string {
+	if p.next == len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.next]
+}
+
+func (p *constraintParser) expect(token string) error {
+	if p.peek() != token {
+		return fmt.Errorf("expected %q, found %q", token, p.peek())
+	}
+	p.next++
+	return nil
+}
+
+// parseImplies parses "a implies b", which is right associative: "a implies b implies c" is "a implies (b implies c)".
+func (p *constraintParser) parseImplies() (*placementConstraint, error) {
+	left, err := p.parseBinary("||")
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != "implies" {
+		return left, nil
+	}
+	p.next++
+	right, err := p.parseImplies()
+	if err != nil {
+		return nil, err
+	}
+	return &placementConstraint{op: "implies", operands: []*placementConstraint{left, right}}, nil
+}
+
+// parseBinary parses a chain of the left associative logical operator, "&&" binding tighter than "||".
+func (p *constraintParser) parseBinary(op string) (*placementConstraint, error) {
+	parseOperand := p.parseUnary
+	if op == "||" {
+		parseOperand = func() (*placementConstraint, error) { return p.parseBinary("&&") }
+	}
+	left, err := parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == op {
+		p.next++
+		right, err := parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		left = &placementConstraint{op: op, operands: []*placementConstraint{left, right}}
+	}
+	return left, nil
+}
+
+func (p *constraintParser) parseUnary() (*placementConstraint, error) {
+	if p.peek() == "!" {
+		p.next++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &placementConstraint{op: "!", operands: []*placementConstraint{operand}}, nil
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	switch op := p.peek(); op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		p.next++
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return &placementConstraint{op: op, operands: []*placementConstraint{left, right}}, nil
+	}
+	return left, nil
+}
+
+func (p *constraintParser) parseOperand() (*placementConstraint, error) {
+	token := p.peek()
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end of constraint")
+	case token == "(":
+		p.next++
+		constraint, err := p.parseImplies()
+		if err != nil {
+			return nil, err
+		}
+		return constraint, p.expect(")")
+	case strings.HasPrefix(token, "'") || strings.HasPrefix(token, "\""):
+		p.next++
+		return &placementConstraint{op: "literal", value: token[1 : len(token)-1]}, nil
+	case token == "true" || token == "false":
+		p.next++
+		return &placementConstraint{op: "literal", value: token == "true"}, nil
+	case unicode.IsDigit([]rune(token)[0]):
+		p.next++
+		value, err := strconv.ParseInt(token, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", token)
+		}
+		return &placementConstraint{op: "literal", value: value}, nil
+	case unicode.IsLetter([]rune(token)[0]) || token[0] == '_':
+		return p.parseVariable()
+	}
+	return nil, fmt.Errorf("unexpected %q", token)
+}
+
+// parseVariable parses a dotted variable name, followed by the quoted label key for cluster.labels.
+func (p *constraintParser) parseVariable() (*placementConstraint, error) {
+	variable := p.peek()
+	p.next++
+	for p.peek() == "." {
+		p.next++
+		variable += "." + p.peek()
+		p.next++
+	}
+	if _, isKnown := constraintVariables[variable]; !isKnown {
+		return nil, fmt.Errorf("unknown variable %q%s", variable, suggestion(variable, sortedKeys(constraintVariables)))
+	}
+
+	constraint := &placementConstraint{op: "variable", variable: variable}
+	if variable != "cluster.labels" {
+		return constraint, nil
+	}
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+	key := p.peek()
+	if !strings.HasPrefix(key, "'") && !strings.HasPrefix(key, "\"") {
+		return nil, fmt.Errorf("expected a quoted label key, found %q", key)
+	}
+	p.next++
+	constraint.key = key[1 : len(key)-1]
+	return constraint, p.expect("]")
+}
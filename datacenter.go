@@ -0,0 +1,144 @@
+package ipam
+
+import (
+	"fmt"
+)
+
+// SetDatacenter sets the metadata of a datacenter.
+func (p IPAM) SetDatacenter(dc Datacenter) error {
+	if dc.Name == "" {
+		return fmt.Errorf("datacenter name cannot be empty")
+	}
+	p.datacenters[dc.Name] = dc
+	return nil
+}
+
+// datacenter returns the metadata of a datacenter, which only has a name if it was never set.
+func (p IPAM) datacenter(name string) Datacenter {
+	if dc, exists := p.datacenters[name]; exists {
+		return dc
+	}
+	return Datacenter{Name: name}
+}
+
+// RenameDatacenter renames a datacenter in the allocations, reservations, metadata, pending allocations and address
+// history.
+func (p IPAM) RenameDatacenter(oldName, newName string) error {
+	if _, exists := p.datacenterAllocations[oldName]; !exists {
+		return fmt.Errorf("datacenter %s not found", oldName)
+	}
+	if newName == "" {
+		return fmt.Errorf("datacenter name cannot be empty")
+	}
+	if _, exists := p.datacenterAllocations[newName]; exists {
+		return fmt.Errorf("datacenter %s already exists", newName)
+	}
+
+	p.moveDatacenter(oldName, newName)
+	return nil
+}
+
+// MergeDatacenters moves the clusters of the src datacenter into the dst datacenter, which keeps its metadata. It
+// fails without changing anything if both datacenters have a cluster with the same name, or if allocations of
+// both datacenters overlap.
+func (p IPAM) MergeDatacenters(src, dst string) error {
+	srcClusters, exists := p.datacenterAllocations[src]
+	if !exists {
+		return fmt.Errorf("datacenter %s not found", src)
+	}
+	dstClusters, exists := p.datacenterAllocations[dst]
+	if !exists {
+		return fmt.Errorf("datacenter %s not found", dst)
+	}
+	if src == dst {
+		return fmt.Errorf("cannot merge datacenter %s into itself", src)
+	}
+
+	dstClusterRefs := map[ClusterRef]struct{}{}
+	for _, dstCluster := range dstClusters {
+		dstClusterRefs[dstCluster.ref(dst)] = struct{}{}
+	}
+	for _, srcCluster := range srcClusters {
+		if _, exists := dstClusterRefs[srcCluster.ref(dst)]; exists {
+			return fmt.Errorf("cluster %s exists in both datacenters %s and %s", srcCluster.ref(src).qualifiedName(), src, dst)
+		}
+	}
+
+	for _, srcCluster := range srcClusters {
+		for _, srcAllocation := range srcCluster.IPAMAllocations {
+			for _, dstCluster := range dstClusters {
+				for _, dstAllocation := range dstCluster.IPAMAllocations {
+					overlaps, err := allocationsOverlap(srcAllocation, dstAllocation)
+					if err != nil {
+						return err
+					}
+					if overlaps {
+						return fmt.Errorf("allocation of pool %s for cluster %s overlaps allocation of pool %s for cluster %s",
+							srcAllocation.qualifiedIPAMPoolName(), srcCluster.ref(src).qualifiedName(), dstAllocation.qualifiedIPAMPoolName(), dstCluster.ref(dst).qualifiedName())
+					}
+				}
+			}
+		}
+	}
+
+	p.moveDatacenter(src, dst)
+	return nil
+}
+
+// moveDatacenter moves everything recorded for the src datacenter to the dst datacenter.
+func (p IPAM) moveDatacenter(src, dst string) {
+	for _, srcCluster := range p.datacenterAllocations[src] {
+		for i := range srcCluster.IPAMAllocations {
+			srcCluster.IPAMAllocations[i].Datacenter = dst
+		}
+		p.datacenterAllocations[dst] = append(p.datacenterAllocations[dst], srcCluster)
+	}
+	delete(p.datacenterAllocations, src)
+
+	for source, reservations := range p.datacenterReservations[src] {
+		dstReservations := p.datacenterReservations[dst][source]
+		for _, reservation := range reservations {
+			if !containsString(dstReservations, reservation) {
+				dstReservations = append(dstReservations, reservation)
+			}
+		}
+		p.setReservations(dst, source, dstReservations)
+	}
+	delete(p.datacenterReservations, src)
+
+	if srcMetadata, hasMetadata := p.datacenters[src]; hasMetadata {
+		if _, hasMetadata := p.datacenters[dst]; !hasMetadata {
+			srcMetadata.Name = dst
+			p.datacenters[dst] = srcMetadata
+		}
+		delete(p.datacenters, src)
+	}
+
+	for key, pending := range p.pendingAllocations {
+		if key.cluster.Datacenter != src {
+			continue
+		}
+		delete(p.pendingAllocations, key)
+		key.cluster.Datacenter = dst
+		pending.Cluster.Datacenter = dst
+		p.pendingAllocations[key] = pending
+	}
+
+	for i, record := range p.addressHistory.records {
+		if record.Datacenter == src {
+			p.addressHistory.records[i].Datacenter = dst
+		}
+	}
+}
+
+func allocationsOverlap(a, b IPAMAllocation) (bool, error) {
+	for _, aBlock := range allocationBlocks(a) {
+		for _, bBlock := range allocationBlocks(b) {
+			overlaps, err := blocksOverlap(aBlock, bBlock)
+			if err != nil || overlaps {
+				return overlaps, err
+			}
+		}
+	}
+	return false, nil
+}
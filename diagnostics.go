@@ -0,0 +1,123 @@
+package ipam
+
+import (
+	"fmt"
+	"math/big"
+	"reflect"
+)
+
+// defaultUtilizationWarningPercent is the utilization of a datacenter pool above which applying it reports a
+// diagnostic, so pools are grown before they are exhausted.
+const defaultUtilizationWarningPercent = 85
+
+// Diagnostic is a non-fatal finding about a pool, reported by ApplyWithDiagnostics for callers to display while the
+// apply goes on.
+type Diagnostic struct {
+	// IPAMPool is the qualified name of the pool
+	IPAMPool   string `json:"ipamPool"`
+	Datacenter string `json:"datacenter,omitempty"`
+	// Cluster is the qualified name of the cluster the finding is about, if any
+	Cluster string `json:"cluster,omitempty"`
+	Message string `json:"message"`
+}
+
+func (d Diagnostic) String() string {
+	location := "pool " + d.IPAMPool
+	if d.Datacenter != "" {
+		location += " datacenter " + d.Datacenter
+	}
+	if d.Cluster != "" {
+		location += " cluster " + d.Cluster
+	}
+	return location + ": " + d.Message
+}
+
+// ApplyWithDiagnostics applies the IPAM pool like Apply and returns the diagnostics of the pool after the apply,
+// e.g. the datacenters close to exhaustion. The diagnostics are also returned when the apply fails.
+func (p IPAM) ApplyWithDiagnostics(ipamPool IPAMPool) ([]Diagnostic, error) {
+	applyErr := p.Apply(ipamPool)
+	diagnostics, err := p.diagnose(ipamPool)
+	if applyErr != nil {
+		return diagnostics, applyErr
+	}
+	return diagnostics, err
+}
+
+// diagnose reports the datacenters of the pool (and of its purposes) whose utilization is above
+// utilizationWarningPercent and the range allocations of the pool whose address ranges are in the legacy format,
+// not sorted and merged.
+func (p IPAM) diagnose(ipamPool IPAMPool) ([]Diagnostic, error) {
+	purposePools, err := ipamPool.purposePools()
+	if err != nil {
+		return nil, err
+	}
+	warningPercent := p.utilizationWarningPercent
+	if warningPercent == 0 {
+		warningPercent = defaultUtilizationWarningPercent
+	}
+
+	diagnostics := []Diagnostic{}
+	for _, purposePool := range purposePools {
+		purposePool, err := purposePool.withResolvedAllocationSizes()
+		if err != nil {
+			return nil, err
+		}
+		dcIPAMPoolUsageMap, err := p.compileCurrentAllocationsForPool(purposePool)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, dc := range sortedKeys(purposePool.Datacenters) {
+			dcIPAMPoolCfg := purposePool.Datacenters[dc]
+			utilization, err := utilizationOfPool(dc, dcIPAMPoolCfg, dcIPAMPoolUsageMap)
+			if err != nil {
+				return nil, err
+			}
+			if utilization > warningPercent {
+				diagnostics = append(diagnostics, Diagnostic{
+					IPAMPool:   purposePool.qualifiedName(),
+					Datacenter: dc,
+					Message:    fmt.Sprintf("datacenter pool at %.0f%% utilization", utilization),
+				})
+			}
+
+			for _, dcCluster := range p.datacenterAllocations[dc] {
+				for _, ipamAllocation := range dcCluster.IPAMAllocations {
+					if !ipamAllocation.isFromPool(purposePool) || ipamAllocation.Type != "range" {
+						continue
+					}
+					ips, err := getUsedIPsFromAddressRanges(ipamAllocation.Addresses)
+					if err != nil {
+						return nil, err
+					}
+					if addressRanges := addressRangesFromIPs(ips); !reflect.DeepEqual(addressRanges, ipamAllocation.Addresses) {
+						diagnostics = append(diagnostics, Diagnostic{
+							IPAMPool:   purposePool.qualifiedName(),
+							Datacenter: dc,
+							Cluster:    dcCluster.ref(dc).qualifiedName(),
+							Message:    fmt.Sprintf("allocation uses the legacy range format %v instead of %v", ipamAllocation.Addresses, addressRanges),
+						})
+					}
+				}
+			}
+		}
+	}
+	return diagnostics, nil
+}
+
+// utilizationOfPool returns the percentage of the addresses (range pools) or subnets of the allocation prefix
+// (prefix pools) of a datacenter pool which aren't free. It is computed from the used ones, without enumerating the
+// pool, so it works for pools of any size.
+func utilizationOfPool(dc string, dcIPAMPoolCfg IPAMPoolDatacenterSettings, dcIPAMPoolUsageMap datacenterIPAMPoolUsageMap) (float64, error) {
+	total, err := totalCapacityOfPool(dcIPAMPoolCfg)
+	if err != nil || total.Sign() == 0 {
+		return 0, err
+	}
+	used, err := usedCapacityOfPool(dc, dcIPAMPoolCfg, dcIPAMPoolUsageMap)
+	if err != nil {
+		return 0, err
+	}
+	usedPercent := new(big.Float).Mul(new(big.Float).SetInt(used), big.NewFloat(100))
+	utilization, _ := usedPercent.Quo(usedPercent, new(big.Float).SetInt(total)).Float64()
+	return utilization, nil
+}
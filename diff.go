@@ -0,0 +1,122 @@
+package ipam
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	allocationAdded   = "added"
+	allocationRemoved = "removed"
+	allocationChanged = "changed"
+)
+
+// AllocationDiff is an allocation added, removed or changed between two state snapshots. An allocation is identified
+// by its datacenter, cluster and pool.
+type AllocationDiff struct {
+	Datacenter string `json:"datacenter"`
+	// Cluster and IPAMPool are tenant qualified names
+	Cluster  string `json:"cluster"`
+	IPAMPool string `json:"pool"`
+	// Change is "added", "removed" or "changed"
+	Change string `json:"change"`
+	// Before is nil for added allocations, and After for removed ones
+	Before *IPAMAllocation `json:"before,omitempty"`
+	After  *IPAMAllocation `json:"after,omitempty"`
+}
+
+func (d AllocationDiff) String() string {
+	location := d.Change + " " + d.Datacenter + " cluster " + d.Cluster + " pool " + d.IPAMPool + ": "
+	switch d.Change {
+	case allocationAdded:
+		return location + strings.Join(allocationBlocks(*d.After), ", ")
+	case allocationRemoved:
+		return location + strings.Join(allocationBlocks(*d.Before), ", ")
+	}
+	before, after := strings.Join(allocationBlocks(*d.Before), ", "), strings.Join(allocationBlocks(*d.After), ", ")
+	if before == after {
+		return location + after + " (blocks unchanged)"
+	}
+	return location + before + " -> " + after
+}
+
+// DiffStateFiles compares the allocations of two state snapshots written by MarshalState, e.g. for change reviews.
+// The differences are sorted by datacenter, cluster and pool.
+func DiffStateFiles(pathA, pathB string) ([]AllocationDiff, error) {
+	states := make([]IPAM, 2)
+	for i, path := range []string{pathA, pathB} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		states[i], err = unmarshalState(data, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return diffStates(states[0], states[1]), nil
+}
+
+// diffStates returns the allocations added, removed or changed from state a to state b.
+func diffStates(a, b IPAM) []AllocationDiff {
+	allocationsA, allocationsB := allocationsByKey(a), allocationsByKey(b)
+
+	diffs := []AllocationDiff{}
+	for key, allocationA := range allocationsA {
+		allocationA := allocationA
+		allocationB, exists := allocationsB[key]
+		switch {
+		case !exists:
+			diffs = append(diffs, newAllocationDiff(key, allocationRemoved, &allocationA, nil))
+		case !reflect.DeepEqual(allocationA, allocationB):
+			diffs = append(diffs, newAllocationDiff(key, allocationChanged, &allocationA, &allocationB))
+		}
+	}
+	for key, allocationB := range allocationsB {
+		allocationB := allocationB
+		if _, exists := allocationsA[key]; !exists {
+			diffs = append(diffs, newAllocationDiff(key, allocationAdded, nil, &allocationB))
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		if diffs[i].Datacenter != diffs[j].Datacenter {
+			return diffs[i].Datacenter < diffs[j].Datacenter
+		}
+		if diffs[i].Cluster != diffs[j].Cluster {
+			return diffs[i].Cluster < diffs[j].Cluster
+		}
+		return diffs[i].IPAMPool < diffs[j].IPAMPool
+	})
+	return diffs
+}
+
+type allocationKey struct {
+	cluster  ClusterRef
+	ipamPool string
+}
+
+func allocationsByKey(p IPAM) map[allocationKey]IPAMAllocation {
+	allocations := map[allocationKey]IPAMAllocation{}
+	for dc, dcClusters := range p.datacenterAllocations {
+		for _, dcCluster := range dcClusters {
+			for _, ipamAllocation := range dcCluster.IPAMAllocations {
+				allocations[allocationKey{cluster: dcCluster.ref(dc), ipamPool: ipamAllocation.qualifiedIPAMPoolName()}] = ipamAllocation
+			}
+		}
+	}
+	return allocations
+}
+
+func newAllocationDiff(key allocationKey, change string, before, after *IPAMAllocation) AllocationDiff {
+	return AllocationDiff{
+		Datacenter: key.cluster.Datacenter,
+		Cluster:    key.cluster.qualifiedName(),
+		IPAMPool:   key.ipamPool,
+		Change:     change,
+		Before:     before,
+		After:      after,
+	}
+}
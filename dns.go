@@ -0,0 +1,90 @@
+package ipam
+
+import (
+	"net"
+	"strings"
+)
+
+// DNSProvider creates, updates and deletes forward DNS records, e.g. backed by Route53, Cloud DNS or RFC2136 dynamic
+// updates.
+type DNSProvider interface {
+	UpsertRecord(record DNSRecord) error
+	DeleteRecord(record DNSRecord) error
+}
+
+// DNSRecord is the A or AAAA record of an allocated address.
+type DNSRecord struct {
+	Name  string
+	Type  string
+	Value string
+	TTL   uint32
+}
+
+// dnsSink is an event sink keeping an A/AAAA record for every allocation of a single address (e.g. a VIP) whose
+// nameLabel label holds a host name, like the hostname annotation of external-dns. The record is upserted when the
+// allocation is made or labeled, and deleted when the label is removed or changed, or the allocation released.
+type dnsSink struct {
+	provider  DNSProvider
+	nameLabel string
+	ttl       uint32
+}
+
+// NewDNSSink returns an event sink keeping the DNS records of the single address allocations named by their
+// nameLabel label, to be registered with WithEventSink.
+func NewDNSSink(provider DNSProvider, nameLabel string, ttl uint32) EventSink {
+	return &dnsSink{provider: provider, nameLabel: nameLabel, ttl: ttl}
+}
+
+func (s *dnsSink) Send(event AllocationEvent) error {
+	switch event.Type {
+	case AllocationEventAllocated:
+		return s.upsert(event.Allocation, event.Allocation.Labels)
+	case AllocationEventReleased:
+		return s.delete(event.Allocation, event.Allocation.Labels)
+	case AllocationEventLabeled:
+		if event.PreviousLabels[s.nameLabel] == event.Allocation.Labels[s.nameLabel] {
+			return nil
+		}
+		if err := s.delete(event.Allocation, event.PreviousLabels); err != nil {
+			return err
+		}
+		return s.upsert(event.Allocation, event.Allocation.Labels)
+	}
+	return nil
+}
+
+func (s *dnsSink) upsert(allocation IPAMAllocation, labels map[string]string) error {
+	record, hasRecord := s.record(allocation, labels)
+	if !hasRecord {
+		return nil
+	}
+	return s.provider.UpsertRecord(record)
+}
+
+func (s *dnsSink) delete(allocation IPAMAllocation, labels map[string]string) error {
+	record, hasRecord := s.record(allocation, labels)
+	if !hasRecord {
+		return nil
+	}
+	return s.provider.DeleteRecord(record)
+}
+
+// record returns the record of the allocation when it has a single address and the labels name it.
+func (s *dnsSink) record(allocation IPAMAllocation, labels map[string]string) (DNSRecord, bool) {
+	name := labels[s.nameLabel]
+	if name == "" || allocation.Type != "range" || len(allocation.Addresses) != 1 || !isSingleAddressRange(allocation.Addresses[0]) {
+		return DNSRecord{}, false
+	}
+	ip := checkIPv4(net.ParseIP(strings.SplitN(allocation.Addresses[0], "-", 2)[0]))
+
+	recordType := "AAAA"
+	if len(ip) == net.IPv4len {
+		recordType = "A"
+	}
+	return DNSRecord{
+		Name:  fqdn(name),
+		Type:  recordType,
+		Value: ip.String(),
+		TTL:   s.ttl,
+	}, true
+}
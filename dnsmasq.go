@@ -0,0 +1,70 @@
+package ipam
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// RenderDnsmasqConfig generates dnsmasq configuration lines for the range allocations of a datacenter: a
+// "dhcp-range" (tagged with the cluster name) per allocated address range, and a "host-record" for allocations
+// of a single address, named "<cluster>-<pool>" plus the optional domain. The clusters of a tenant are named
+// "<tenant>-<cluster>".
+func RenderDnsmasqConfig(p IPAM, dc string, ipamPools []IPAMPool, domain, leaseTime string) (string, error) {
+	config := strings.Builder{}
+
+	for _, ipamPool := range sortedIPAMPools(ipamPools) {
+		dcIPAMPoolCfg, isDCConfigured := ipamPool.Datacenters[dc]
+		if !isDCConfigured || dcIPAMPoolCfg.Type != "range" {
+			continue
+		}
+		_, poolSubnet, err := net.ParseCIDR(dcIPAMPoolCfg.PoolCIDR)
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(&config, "# pool %s\n", ipamPool.qualifiedName())
+		for _, dcCluster := range p.datacenterAllocations[dc] {
+			for _, ipamAllocation := range dcCluster.IPAMAllocations {
+				if !ipamAllocation.isFromPool(ipamPool) || ipamAllocation.Type != "range" {
+					continue
+				}
+				tag := strings.ReplaceAll(dcCluster.ref(dc).qualifiedName(), "/", "-")
+				if len(ipamAllocation.Addresses) == 1 && isSingleAddressRange(ipamAllocation.Addresses[0]) {
+					hostName := fmt.Sprintf("%s-%s", tag, ipamAllocation.IPAMPoolName)
+					if domain != "" {
+						hostName = fmt.Sprintf("%s.%s", hostName, domain)
+					}
+					ip := strings.SplitN(ipamAllocation.Addresses[0], "-", 2)[0]
+					fmt.Fprintf(&config, "host-record=%s,%s\n", hostName, ip)
+					continue
+				}
+				for _, addressRange := range ipamAllocation.Addresses {
+					fmt.Fprintf(&config, "%s\n", dnsmasqDHCPRange(tag, addressRange, poolSubnet, leaseTime))
+				}
+			}
+		}
+	}
+
+	return config.String(), nil
+}
+
+func dnsmasqDHCPRange(tag, addressRange string, poolSubnet *net.IPNet, leaseTime string) string {
+	ipRange := strings.SplitN(addressRange, "-", 2)
+	fields := []string{"set:" + tag, ipRange[0], ipRange[len(ipRange)-1]}
+	if poolSubnet.IP.To4() != nil {
+		fields = append(fields, net.IP(poolSubnet.Mask).String())
+	} else {
+		prefixLen, _ := poolSubnet.Mask.Size()
+		fields = append(fields, fmt.Sprint(prefixLen))
+	}
+	if leaseTime != "" {
+		fields = append(fields, leaseTime)
+	}
+	return "dhcp-range=" + strings.Join(fields, ",")
+}
+
+func isSingleAddressRange(addressRange string) bool {
+	ipRange := strings.SplitN(addressRange, "-", 2)
+	return len(ipRange) == 2 && net.ParseIP(ipRange[0]).Equal(net.ParseIP(ipRange[1]))
+}
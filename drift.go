@@ -0,0 +1,148 @@
+package ipam
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+)
+
+// Kinds of AllocationDrift.
+const (
+	DriftMissingAllocation = "MissingAllocation"
+	DriftExtraAllocation   = "ExtraAllocation"
+	DriftSizeMismatch      = "SizeMismatch"
+)
+
+// AllocationDrift is a difference between the stored allocations of a cluster and what applying the IPAM pools
+// would produce.
+type AllocationDrift struct {
+	Kind       string
+	Datacenter string
+	// Cluster is the qualified name of the cluster
+	Cluster string
+	// IPAMPool is the qualified name of the pool
+	IPAMPool string
+	// Allocation is the stored allocation, unset for missing allocations
+	Allocation *IPAMAllocation
+	Message    string
+}
+
+// DetectDrift compares the stored allocations against the IPAM pools and returns the clusters missing an
+// allocation of a pool, the allocations of pools (or pool datacenters) that aren't configured anymore and the
+// allocations whose type or size differs from the pool configuration. The purposes of the pools are compared as
+// pools of their own.
+func (p IPAM) DetectDrift(ipamPools []IPAMPool) ([]AllocationDrift, error) {
+	drifts := []AllocationDrift{}
+
+	purposePools := []IPAMPool{}
+	ipamPoolsByName := map[string]IPAMPool{}
+	for _, ipamPool := range ipamPools {
+		poolPurposePools, err := ipamPool.purposePools()
+		if err != nil {
+			return nil, err
+		}
+		for _, purposePool := range poolPurposePools {
+			purposePool, err := purposePool.withResolvedAllocationSizes()
+			if err != nil {
+				return nil, err
+			}
+			purposePools = append(purposePools, purposePool)
+			ipamPoolsByName[purposePool.qualifiedName()] = purposePool
+		}
+	}
+
+	for dc, dcClusters := range p.datacenterAllocations {
+		for _, dcCluster := range dcClusters {
+			allocatedPools := map[string]struct{}{}
+			for i := range dcCluster.IPAMAllocations {
+				ipamAllocation := dcCluster.IPAMAllocations[i]
+				poolName := ipamAllocation.qualifiedIPAMPoolName()
+				allocatedPools[poolName] = struct{}{}
+
+				drift := AllocationDrift{
+					Datacenter: dc,
+					Cluster:    dcCluster.ref(dc).qualifiedName(),
+					IPAMPool:   poolName,
+					Allocation: &ipamAllocation,
+				}
+				ipamPool, isPoolConfigured := ipamPoolsByName[poolName]
+				dcIPAMPoolCfg, isDCConfigured := ipamPool.Datacenters[dc]
+				if !isPoolConfigured || !isDCConfigured {
+					drift.Kind = DriftExtraAllocation
+					drift.Message = fmt.Sprintf("pool %s is not configured for datacenter %s", poolName, dc)
+					drifts = append(drifts, drift)
+					continue
+				}
+
+				message, err := allocationSizeMismatch(ipamAllocation, dcIPAMPoolCfg)
+				if err != nil {
+					return nil, err
+				}
+				if message != "" {
+					drift.Kind = DriftSizeMismatch
+					drift.Message = message
+					drifts = append(drifts, drift)
+				}
+			}
+
+			for _, ipamPool := range purposePools {
+				if _, isDCConfigured := ipamPool.Datacenters[dc]; !isDCConfigured {
+					continue
+				}
+				if _, isAllocated := allocatedPools[ipamPool.qualifiedName()]; isAllocated {
+					continue
+				}
+				drifts = append(drifts, AllocationDrift{
+					Kind:       DriftMissingAllocation,
+					Datacenter: dc,
+					Cluster:    dcCluster.ref(dc).qualifiedName(),
+					IPAMPool:   ipamPool.qualifiedName(),
+					Message:    fmt.Sprintf("cluster has no allocation of pool %s", ipamPool.qualifiedName()),
+				})
+			}
+		}
+	}
+
+	sort.SliceStable(drifts, func(i, j int) bool {
+		if drifts[i].Datacenter != drifts[j].Datacenter {
+			return drifts[i].Datacenter < drifts[j].Datacenter
+		}
+		if drifts[i].Cluster != drifts[j].Cluster {
+			return drifts[i].Cluster < drifts[j].Cluster
+		}
+		return drifts[i].IPAMPool < drifts[j].IPAMPool
+	})
+
+	return drifts, nil
+}
+
+// allocationSizeMismatch describes how the allocation differs from the pool datacenter configuration, or returns
+// an empty string if it matches.
+func allocationSizeMismatch(ipamAllocation IPAMAllocation, dcIPAMPoolCfg IPAMPoolDatacenterSettings) (string, error) {
+	if ipamAllocation.Type != dcIPAMPoolCfg.Type {
+		return fmt.Sprintf("allocation type is %s but pool type is %s", ipamAllocation.Type, dcIPAMPoolCfg.Type), nil
+	}
+
+	switch dcIPAMPoolCfg.Type {
+	case "range":
+		size, err := allocationSize(ipamAllocation)
+		if err != nil {
+			return "", err
+		}
+		if size.Cmp(big.NewInt(int64(dcIPAMPoolCfg.AllocationRange))) != 0 {
+			return fmt.Sprintf("allocation has %s addresses but pool allocation range is %d", size, dcIPAMPoolCfg.AllocationRange), nil
+		}
+	case "prefix":
+		_, subnet, err := net.ParseCIDR(ipamAllocation.CIDR)
+		if err != nil {
+			return "", err
+		}
+		prefixLen, _ := subnet.Mask.Size()
+		if prefixLen != int(dcIPAMPoolCfg.AllocationPrefix) {
+			return fmt.Sprintf("allocation prefix is %d but pool allocation prefix is %d", prefixLen, dcIPAMPoolCfg.AllocationPrefix), nil
+		}
+	}
+
+	return "", nil
+}
@@ -0,0 +1,61 @@
+package ipam
+
+import (
+	"time"
+)
+
+// Types of AllocationEvent.
+const (
+	AllocationEventAllocated = "allocated"
+	AllocationEventReleased  = "released"
+	AllocationEventLabeled   = "labeled"
+)
+
+// AllocationEvent reports a change of the allocations, to be sent to audit and streaming sinks.
+type AllocationEvent struct {
+	Type       string
+	Time       time.Time
+	Allocation IPAMAllocation
+	// PreviousLabels are the labels of the allocation before a labeled event
+	PreviousLabels map[string]string
+}
+
+// EventSink delivers allocation events to an external system (SIEM, message broker...). It is sent an allocated
+// event for every new, restored or imported allocation, a released event for every allocation released, moved away
+// or replaced by an import, and a labeled event when the labels of an allocation change.
+type EventSink interface {
+	Send(event AllocationEvent) error
+}
+
+// WithEventSink makes the IPAM send its allocation events to the sink.
+func WithEventSink(sink EventSink) Option {
+	return func(p *IPAM) {
+		p.eventSinks = append(p.eventSinks, sink)
+	}
+}
+
+// sendEvents sends an event of the given type per allocation to every sink. The allocations already changed, so all
+// the events are sent even if a sink fails, and the first error is returned.
+func (p IPAM) sendEvents(eventType string, allocations []IPAMAllocation) error {
+	var firstErr error
+	now := p.clock.Now()
+	for _, allocation := range allocations {
+		err := p.sendEvent(AllocationEvent{Type: eventType, Time: now, Allocation: allocation})
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// sendEvent sends the event to every sink, even if one fails, and returns the first error.
+func (p IPAM) sendEvent(event AllocationEvent) error {
+	var firstErr error
+	for _, sink := range p.eventSinks {
+		err := sink.Send(event)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
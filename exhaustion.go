@@ -0,0 +1,78 @@
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+)
+
+// ExhaustionError is returned when a datacenter pool has no room left for a new allocation, e.g. by Apply. Callers
+// can get it with errors.As to report how short the pool is. All the sizes are numbers of addresses.
+type ExhaustionError struct {
+	Datacenter string
+	// Cluster is the qualified name of the cluster the allocation is for, empty for holds
+	Cluster string
+	// IPAMPool is the qualified name of the pool
+	IPAMPool string
+	// RequiredSize is the size of the allocation that cannot be made
+	RequiredSize *big.Int
+	// LargestFreeBlock is the size of the largest contiguous free block (range pools) or free subnet of the
+	// allocation prefix (prefix pools)
+	LargestFreeBlock *big.Int
+	// FreeCount is the number of free addresses, counting only the free subnets of the allocation prefix for prefix
+	// pools
+	FreeCount *big.Int
+	// Err is the cause: not enough free IPs (range pools) or no free subnet (prefix pools)
+	Err error
+}
+
+func (e *ExhaustionError) Error() string {
+	return fmt.Sprintf("%v %s in datacenter %s: %s addresses required, %s addresses free, largest free block of %s addresses",
+		e.Err, e.IPAMPool, e.Datacenter, e.RequiredSize, e.FreeCount, e.LargestFreeBlock)
+}
+
+func (e *ExhaustionError) Unwrap() error {
+	return e.Err
+}
+
+func isExhaustionError(err error) bool {
+	return errors.Is(err, errNoFreeSubnet) || errors.Is(err, errNotEnoughFreeIPs)
+}
+
+// newExhaustionError describes how short the datacenter pool is for a new allocation of the cluster.
+func newExhaustionError(ipamPool IPAMPool, cluster ClusterRef, dcIPAMPoolCfg IPAMPoolDatacenterSettings, dcIPAMPoolUsageMap datacenterIPAMPoolUsageMap, err error) error {
+	dc := cluster.Datacenter
+	exhaustionErr := &ExhaustionError{
+		Datacenter: dc,
+		Cluster:    cluster.qualifiedName(),
+		IPAMPool:   ipamPool.qualifiedName(),
+		Err:        err,
+	}
+
+	freeCount, longestFreeRun, err := freeSpaceOfPool(dc, dcIPAMPoolCfg, dcIPAMPoolUsageMap)
+	if err != nil {
+		return err
+	}
+	switch dcIPAMPoolCfg.Type {
+	case "range":
+		exhaustionErr.RequiredSize = big.NewInt(int64(dcIPAMPoolCfg.AllocationRange))
+		exhaustionErr.FreeCount = freeCount
+		exhaustionErr.LargestFreeBlock = longestFreeRun
+	case "prefix":
+		_, poolSubnet, err := net.ParseCIDR(dcIPAMPoolCfg.PoolCIDR)
+		if err != nil {
+			return err
+		}
+		_, bits := poolSubnet.Mask.Size()
+		subnetSize := new(big.Int).Lsh(big.NewInt(1), uint(bits-int(dcIPAMPoolCfg.AllocationPrefix)))
+		exhaustionErr.RequiredSize = subnetSize
+		exhaustionErr.FreeCount = freeCount.Mul(freeCount, subnetSize)
+		exhaustionErr.LargestFreeBlock = big.NewInt(0)
+		if freeCount.Sign() > 0 {
+			exhaustionErr.LargestFreeBlock.Set(subnetSize)
+		}
+	}
+
+	return exhaustionErr
+}
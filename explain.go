@@ -0,0 +1,166 @@
+package ipam
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+)
+
+// maxExplainedFreeBlocks caps the free blocks listed by an explanation, since large pools can have a lot of them.
+const maxExplainedFreeBlocks = 32
+
+// AllocationExplanation tells why a cluster received the block it did from a pool, or why it can't be served.
+type AllocationExplanation struct {
+	Datacenter string
+	// Cluster is the qualified name of the cluster
+	Cluster  string
+	IPAMPool string
+	// Strategy describes how the pool picks the blocks it allocates
+	Strategy string
+	// Allocation is the allocation of the cluster, if it has (or would get) one
+	Allocation *IPAMAllocation
+	// IsPlanned tells the allocation doesn't exist yet and would be made by the next apply of the pool
+	IsPlanned bool
+	// FreeBlocks are the free blocks of the pool before the next apply (at most maxExplainedFreeBlocks)
+	FreeBlocks []string
+	// Exclusions are the blocks of the pool which are not available to the cluster, and why
+	Exclusions []AllocationExclusion
+	// Reason tells why the cluster cannot be served, when it can't
+	Reason string
+}
+
+// AllocationExclusion is a block of a pool a cluster cannot get.
+type AllocationExclusion struct {
+	Block  string
+	Reason string
+}
+
+// Explain reports how the pool allocates for a cluster of a datacenter, given by its qualified name: its current
+// allocation, or the one the next apply would make, with the blocks skipped on the way and the free blocks considered.
+// Pools with purposes are refused, see IPAMPool.ForPurpose.
+func (p IPAM) Explain(dc, clusterName string, ipamPool IPAMPool) (AllocationExplanation, error) {
+	if err := ipamPool.checkSinglePurpose(); err != nil {
+		return AllocationExplanation{}, err
+	}
+	cluster := clusterRefOf(dc, clusterName)
+	if p.clusterIndex(cluster) < 0 {
+		return AllocationExplanation{}, fmt.Errorf("cluster %s not found in datacenter %s", cluster.qualifiedName(), dc)
+	}
+
+	ipamPool, err := ipamPool.withResolvedAllocationSizes()
+	if err != nil {
+		return AllocationExplanation{}, err
+	}
+	explanation := AllocationExplanation{
+		Datacenter: dc,
+		Cluster:    cluster.qualifiedName(),
+		IPAMPool:   ipamPool.qualifiedName(),
+		FreeBlocks: []string{},
+		Exclusions: []AllocationExclusion{},
+	}
+	dcIPAMPoolCfg, isDCConfigured := ipamPool.Datacenters[dc]
+	if !isDCConfigured {
+		explanation.Reason = fmt.Sprintf("pool is not configured for datacenter %s", dc)
+		return explanation, nil
+	}
+	explanation.Strategy = allocationStrategy(dcIPAMPoolCfg)
+
+	// only the datacenter of the cluster matters, and an exhausted pool in another datacenter must not hide it
+	dcIPAMPool := ipamPool
+	dcIPAMPool.Datacenters = map[string]IPAMPoolDatacenterSettings{dc: dcIPAMPoolCfg}
+	dcIPAMPoolUsageMap, err := p.compileCurrentAllocationsForPool(dcIPAMPool)
+	if err == errIncompatiblePool {
+		explanation.Reason = err.Error()
+		return explanation, nil
+	}
+	if err != nil {
+		return AllocationExplanation{}, err
+	}
+
+	explanation.FreeBlocks, err = freeBlocksOfPool(dc, dcIPAMPoolCfg, dcIPAMPoolUsageMap, maxExplainedFreeBlocks)
+	if err != nil {
+		return AllocationExplanation{}, err
+	}
+
+	for _, dcCluster := range p.datacenterAllocations[dc] {
+		for _, ipamAllocation := range dcCluster.IPAMAllocations {
+			if !ipamAllocation.isFromPool(ipamPool) {
+				continue
+			}
+			if dcCluster.ref(dc) == cluster {
+				allocation := ipamAllocation
+				explanation.Allocation = &allocation
+				continue
+			}
+			for _, block := range allocationBlocks(ipamAllocation) {
+				explanation.Exclusions = append(explanation.Exclusions, AllocationExclusion{Block: block, Reason: fmt.Sprintf("allocated to cluster %s", dcCluster.ref(dc).qualifiedName())})
+			}
+		}
+	}
+	if dcIPAMPoolCfg.FirstAddressOffset > 0 {
+		offsetBlock, err := firstAddressOffsetBlock(dcIPAMPoolCfg)
+		if err != nil {
+			return AllocationExplanation{}, err
+		}
+		explanation.Exclusions = append(explanation.Exclusions, AllocationExclusion{Block: offsetBlock, Reason: "first address offset"})
+	}
+	_, poolSubnet, err := net.ParseCIDR(dcIPAMPoolCfg.PoolCIDR)
+	if err != nil {
+		return AllocationExplanation{}, err
+	}
+	for _, reservation := range p.reservations(dc) {
+		if blockOverlaps(reservation, poolSubnet) {
+			explanation.Exclusions = append(explanation.Exclusions, AllocationExclusion{Block: reservation, Reason: "external reservation"})
+		}
+	}
+
+	if explanation.Allocation != nil {
+		return explanation, nil
+	}
+
+	newAllocations, err := p.plan(dcIPAMPool)
+	if isExhaustionError(err) {
+		explanation.Reason = err.Error()
+		return explanation, nil
+	}
+	if err != nil {
+		return AllocationExplanation{}, err
+	}
+	// the planned allocations are in allocation order, so the ones before the cluster are served first
+	for i, newAllocation := range newAllocations {
+		if newAllocation.clusterRef() == cluster {
+			explanation.Allocation = &newAllocations[i]
+			explanation.IsPlanned = true
+			break
+		}
+		for _, block := range allocationBlocks(newAllocation) {
+			explanation.Exclusions = append(explanation.Exclusions, AllocationExclusion{Block: block, Reason: fmt.Sprintf("planned for cluster %s, which is served first", newAllocation.clusterRef().qualifiedName())})
+		}
+	}
+
+	return explanation, nil
+}
+
+func allocationStrategy(dcIPAMPoolCfg IPAMPoolDatacenterSettings) string {
+	switch dcIPAMPoolCfg.Type {
+	case "range":
+		if dcIPAMPoolCfg.AllocateFrom == allocateFromHigh {
+			return fmt.Sprintf("highest %d free addresses", dcIPAMPoolCfg.AllocationRange)
+		}
+		return fmt.Sprintf("lowest %d free addresses", dcIPAMPoolCfg.AllocationRange)
+	case "prefix":
+		return fmt.Sprintf("first free /%d subnet", dcIPAMPoolCfg.AllocationPrefix)
+	}
+	return ""
+}
+
+// firstAddressOffsetBlock returns the address range skipped at the start of the pool.
+func firstAddressOffsetBlock(dcIPAMPoolCfg IPAMPoolDatacenterSettings) (string, error) {
+	poolIP, poolSubnet, err := net.ParseCIDR(dcIPAMPoolCfg.PoolCIDR)
+	if err != nil {
+		return "", err
+	}
+	poolStartInt, bits := ipToInt(checkIPv4(poolIP.Mask(poolSubnet.Mask)))
+	lastSkippedInt := new(big.Int).Add(poolStartInt, big.NewInt(int64(dcIPAMPoolCfg.FirstAddressOffset)-1))
+	return fmt.Sprintf("%s-%s", intToIP(poolStartInt, bits), intToIP(lastSkippedInt, bits)), nil
+}
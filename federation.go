@@ -0,0 +1,104 @@
+package ipam
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// Federation aggregates regional IPAMs owning disjoint sets of datacenters into a global read-only view.
+type Federation struct {
+	regions map[string]IPAM
+}
+
+// FederationConflict is an allocation overlapping an allocation of another region.
+type FederationConflict struct {
+	Region     string
+	Allocation IPAMAllocation
+	// OtherRegion and OtherAllocation are the overlapping allocation of another region
+	OtherRegion     string
+	OtherAllocation IPAMAllocation
+}
+
+// NewFederation returns the federation of the regional IPAMs, by region. It fails if a datacenter is owned by more
+// than one region.
+func NewFederation(regions map[string]IPAM) (Federation, error) {
+	dcOwners := map[string]string{}
+	regionNames := sortedKeys(regions)
+	for _, region := range regionNames {
+		for dc := range regions[region].datacenterAllocations {
+			if owner, isOwned := dcOwners[dc]; isOwned {
+				return Federation{}, fmt.Errorf("datacenter %s is owned by regions %s and %s", dc, owner, region)
+			}
+			dcOwners[dc] = region
+		}
+	}
+	return Federation{regions: regions}, nil
+}
+
+// Aggregate returns a copy of the allocations of every region, so the global view can be queried and exported
+// like a regional one without affecting the regions.
+func (f Federation) Aggregate() IPAM {
+	global := New(map[string][]Cluster{})
+	for _, regional := range f.regions {
+		for dc, dcClusters := range copyDatacenterAllocations(regional.datacenterAllocations) {
+			global.datacenterAllocations[dc] = dcClusters
+		}
+		for dc, metadata := range regional.datacenters {
+			global.datacenters[dc] = metadata
+		}
+	}
+	return global
+}
+
+// GlobalConflicts returns the allocations overlapping allocations of another region. Since pools reuse their
+// space in every datacenter, this is only meaningful for address spaces meant to be globally unique.
+func (f Federation) GlobalConflicts() ([]FederationConflict, error) {
+	type regionalBlock struct {
+		region     string
+		allocation IPAMAllocation
+		first      net.IP
+		last       net.IP
+	}
+
+	blocks := []regionalBlock{}
+	for _, region := range sortedKeys(f.regions) {
+		for _, ipamAllocation := range f.regions[region].Allocations() {
+			for _, block := range allocationBlocks(ipamAllocation) {
+				first, last, err := blockBounds(block)
+				if err != nil {
+					return nil, err
+				}
+				blocks = append(blocks, regionalBlock{region: region, allocation: ipamAllocation, first: first, last: last})
+			}
+		}
+	}
+	sort.SliceStable(blocks, func(i, j int) bool {
+		return bytes.Compare(blocks[i].first, blocks[j].first) < 0
+	})
+
+	conflicts := []FederationConflict{}
+	// sweep the blocks by start address, keeping the blocks that may still overlap the next ones
+	active := []regionalBlock{}
+	for _, block := range blocks {
+		stillActive := active[:0]
+		for _, activeBlock := range active {
+			if bytes.Compare(activeBlock.last, block.first) < 0 {
+				continue
+			}
+			stillActive = append(stillActive, activeBlock)
+			if activeBlock.region != block.region {
+				conflicts = append(conflicts, FederationConflict{
+					Region:          activeBlock.region,
+					Allocation:      activeBlock.allocation,
+					OtherRegion:     block.region,
+					OtherAllocation: block.allocation,
+				})
+			}
+		}
+		active = append(stillActive, block)
+	}
+
+	return conflicts, nil
+}
@@ -0,0 +1,186 @@
+package ipam
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net"
+	"strings"
+)
+
+type firewallEntry struct {
+	Pool string
+	// Address is either a CIDR (prefix allocations) or a "first-last" address range (range allocations)
+	Address string
+	IPv6    bool
+}
+
+type firewallGroup struct {
+	Cluster string
+	Entries []firewallEntry
+}
+
+// RenderFirewallObjects generates one firewall address group per cluster of a datacenter, containing all its
+// allocations, so security rules can reference clusters by name ("<tenant>-<cluster>" for clusters of a tenant).
+// Supported formats are "ipset" (ipset restore input), "fortigate" (FortiOS CLI) and "pfsense" (pfSense aliases XML).
+func RenderFirewallObjects(p IPAM, dc, format string) (string, error) {
+	groups := []firewallGroup{}
+	for _, dcCluster := range p.datacenterAllocations[dc] {
+		group := firewallGroup{Cluster: strings.ReplaceAll(dcCluster.ref(dc).qualifiedName(), "/", "-")}
+		for _, ipamAllocation := range dcCluster.IPAMAllocations {
+			addresses := ipamAllocation.Addresses
+			if ipamAllocation.Type == "prefix" {
+				addresses = []string{ipamAllocation.CIDR}
+			}
+			for _, address := range addresses {
+				firstIP := net.ParseIP(strings.SplitN(strings.SplitN(address, "/", 2)[0], "-", 2)[0])
+				if firstIP == nil {
+					return "", fmt.Errorf("wrong ip format")
+				}
+				group.Entries = append(group.Entries, firewallEntry{
+					Pool:    strings.ReplaceAll(ipamAllocation.qualifiedIPAMPoolName(), "/", "-"),
+					Address: address,
+					IPv6:    firstIP.To4() == nil,
+				})
+			}
+		}
+		if len(group.Entries) > 0 {
+			groups = append(groups, group)
+		}
+	}
+
+	switch format {
+	case "ipset":
+		return renderIPSets(groups), nil
+	case "fortigate":
+		return renderFortiGateAddresses(groups), nil
+	case "pfsense":
+		return renderPfSenseAliases(groups)
+	default:
+		return "", fmt.Errorf("unsupported firewall format %q", format)
+	}
+}
+
+func renderIPSets(groups []firewallGroup) string {
+	config := strings.Builder{}
+	for _, group := range groups {
+		for _, isIPv6 := range []bool{false, true} {
+			setName, family := firewallObjectName("ipam-"+group.Cluster, 31), "inet"
+			if isIPv6 {
+				setName, family = firewallObjectName("ipam6-"+group.Cluster, 31), "inet6"
+			}
+			entries := filterFirewallEntries(group.Entries, isIPv6)
+			if len(entries) == 0 {
+				continue
+			}
+			fmt.Fprintf(&config, "create %s hash:net family %s -exist\n", setName, family)
+			fmt.Fprintf(&config, "flush %s\n", setName)
+			for _, entry := range entries {
+				fmt.Fprintf(&config, "add %s %s\n", setName, entry.Address)
+			}
+		}
+	}
+	return config.String()
+}
+
+func renderFortiGateAddresses(groups []firewallGroup) string {
+	config := strings.Builder{}
+	for _, isIPv6 := range []bool{false, true} {
+		suffix := ""
+		if isIPv6 {
+			suffix = "6"
+		}
+		addresses := strings.Builder{}
+		addressGroups := strings.Builder{}
+		for _, group := range groups {
+			entries := filterFirewallEntries(group.Entries, isIPv6)
+			if len(entries) == 0 {
+				continue
+			}
+			members := []string{}
+			for i, entry := range entries {
+				name := fmt.Sprintf("ipam-%s-%s-%d", group.Cluster, entry.Pool, i+1)
+				members = append(members, fmt.Sprintf("%q", name))
+				fmt.Fprintf(&addresses, "    edit %q\n", name)
+				if ipRange := strings.SplitN(entry.Address, "-", 2); len(ipRange) == 2 {
+					fmt.Fprintf(&addresses, "        set type iprange\n")
+					fmt.Fprintf(&addresses, "        set start-ip %s\n", ipRange[0])
+					fmt.Fprintf(&addresses, "        set end-ip %s\n", ipRange[1])
+				} else if isIPv6 {
+					fmt.Fprintf(&addresses, "        set ip6 %s\n", entry.Address)
+				} else {
+					_, subnet, _ := net.ParseCIDR(entry.Address)
+					fmt.Fprintf(&addresses, "        set subnet %s %s\n", subnet.IP, net.IP(subnet.Mask))
+				}
+				fmt.Fprintf(&addresses, "    next\n")
+			}
+			fmt.Fprintf(&addressGroups, "    edit %q\n", "ipam-"+group.Cluster)
+			fmt.Fprintf(&addressGroups, "        set member %s\n", strings.Join(members, " "))
+			fmt.Fprintf(&addressGroups, "    next\n")
+		}
+		if addresses.Len() == 0 {
+			continue
+		}
+		fmt.Fprintf(&config, "config firewall address%s\n%send\n", suffix, addresses.String())
+		fmt.Fprintf(&config, "config firewall addrgrp%s\n%send\n", suffix, addressGroups.String())
+	}
+	return config.String()
+}
+
+type pfSenseAliases struct {
+	XMLName xml.Name       `xml:"aliases"`
+	Aliases []pfSenseAlias `xml:"alias"`
+}
+
+type pfSenseAlias struct {
+	Name    string `xml:"name"`
+	Type    string `xml:"type"`
+	Address string `xml:"address"`
+	Descr   string `xml:"descr"`
+}
+
+func renderPfSenseAliases(groups []firewallGroup) (string, error) {
+	aliases := pfSenseAliases{}
+	for _, group := range groups {
+		addresses := []string{}
+		for _, entry := range group.Entries {
+			addresses = append(addresses, entry.Address)
+		}
+		aliases.Aliases = append(aliases.Aliases, pfSenseAlias{
+			// pfSense alias names only accept letters, digits and underscores
+			Name:    strings.ReplaceAll(firewallObjectName("ipam_"+group.Cluster, 31), "-", "_"),
+			Type:    "network",
+			Address: strings.Join(addresses, " "),
+			Descr:   fmt.Sprintf("IPAM allocations of cluster %s", group.Cluster),
+		})
+	}
+	config, err := xml.MarshalIndent(aliases, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	return string(config) + "\n", nil
+}
+
+func filterFirewallEntries(entries []firewallEntry, isIPv6 bool) []firewallEntry {
+	filteredEntries := []firewallEntry{}
+	for _, entry := range entries {
+		if entry.IPv6 == isIPv6 {
+			filteredEntries = append(filteredEntries, entry)
+		}
+	}
+	return filteredEntries
+}
+
+// firewallObjectName keeps only the characters accepted by most firewalls in object names and truncates the name
+// to maxLen characters.
+func firewallObjectName(name string, maxLen int) string {
+	name = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, name)
+	if len(name) > maxLen {
+		name = name[:maxLen]
+	}
+	return name
+}
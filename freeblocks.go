@@ -0,0 +1,52 @@
+package ipam
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// FreeBlocks returns, in address order, the free address ranges (range pools) or free subnets of the allocation
+// prefix (prefix pools) of the pool in a datacenter, so tools can show the holes of the address space without
+// recomputing them from the allocations. Pools with purposes are refused, see IPAMPool.ForPurpose.
+func (p IPAM) FreeBlocks(dc string, ipamPool IPAMPool) ([]string, error) {
+	if err := ipamPool.checkSinglePurpose(); err != nil {
+		return nil, err
+	}
+	ipamPool, err := ipamPool.withResolvedAllocationSizes()
+	if err != nil {
+		return nil, err
+	}
+	dcIPAMPoolCfg, isDCConfigured := ipamPool.Datacenters[dc]
+	if !isDCConfigured {
+		return nil, fmt.Errorf("pool %s is not configured for datacenter %s", ipamPool.qualifiedName(), dc)
+	}
+	dcIPAMPoolUsageMap, err := p.compileCurrentAllocationsForPool(ipamPool)
+	if err != nil {
+		return nil, err
+	}
+	return freeBlocksOfPool(dc, dcIPAMPoolCfg, dcIPAMPoolUsageMap, 0)
+}
+
+// freeBlocksOfPool returns the free address ranges (range pools) or free subnets of the allocation prefix (prefix
+// pools) of a datacenter pool, up to limit blocks (all of them when limit isn't positive).
+func freeBlocksOfPool(dc string, dcIPAMPoolCfg IPAMPoolDatacenterSettings, dcIPAMPoolUsageMap datacenterIPAMPoolUsageMap, limit int) ([]string, error) {
+	units, err := datacenterPoolUnits(dcIPAMPoolCfg)
+	if err != nil {
+		return nil, err
+	}
+	freeBlocks := []string{}
+	isFull := func() bool {
+		return limit > 0 && len(freeBlocks) >= limit
+	}
+	units.forEachFreeRun(dc, dcIPAMPoolUsageMap, false, func(first, last *big.Int) bool {
+		if dcIPAMPoolCfg.Type == "range" {
+			freeBlocks = append(freeBlocks, fmt.Sprintf("%s-%s", units.ip(first), units.ip(last)))
+			return !isFull()
+		}
+		for unit := new(big.Int).Set(first); unit.Cmp(last) <= 0 && !isFull(); unit.Add(unit, big.NewInt(1)) {
+			freeBlocks = append(freeBlocks, units.subnet(unit).String())
+		}
+		return !isFull()
+	})
+	return freeBlocks, nil
+}
@@ -0,0 +1,177 @@
+package ipam
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+)
+
+// poolUnits numbers the units of a datacenter pool, its addresses (range pools) or its subnets of the allocation
+// prefix (prefix pools), from 0 at the start of the pool. The free space of the pool is computed as runs of free
+// units between the used ones, so it costs as much as the used space, whatever the pool size.
+type poolUnits struct {
+	// start is the first address of the pool, in 16-byte integer form
+	start *big.Int
+	// unitBits is the number of host bits of a unit, 0 for addresses
+	unitBits uint
+	count    *big.Int
+}
+
+// newPoolUnits numbers the subnets of the given prefix of a pool, which are addresses for the full-length prefix.
+func newPoolUnits(poolCIDR string, unitPrefix int) (poolUnits, error) {
+	_, poolSubnet, err := net.ParseCIDR(poolCIDR)
+	if err != nil {
+		return poolUnits{}, err
+	}
+	poolPrefix, bits := poolSubnet.Mask.Size()
+	if unitPrefix < poolPrefix || unitPrefix > bits {
+		return poolUnits{}, fmt.Errorf("invalid prefix for subnet")
+	}
+	start, _ := ipToInt(poolSubnet.IP.To16())
+	return poolUnits{
+		start:    start,
+		unitBits: uint(bits - unitPrefix),
+		count:    new(big.Int).Lsh(big.NewInt(1), uint(unitPrefix-poolPrefix)),
+	}, nil
+}
+
+// datacenterPoolUnits numbers the addresses (range pools) or the subnets of the allocation prefix (prefix pools) of
+// a datacenter pool.
+func datacenterPoolUnits(dcIPAMPoolCfg IPAMPoolDatacenterSettings) (poolUnits, error) {
+	switch dcIPAMPoolCfg.Type {
+	case "range":
+		_, poolSubnet, err := net.ParseCIDR(dcIPAMPoolCfg.PoolCIDR)
+		if err != nil {
+			return poolUnits{}, err
+		}
+		_, bits := poolSubnet.Mask.Size()
+		return newPoolUnits(dcIPAMPoolCfg.PoolCIDR, bits)
+	case "prefix":
+		return newPoolUnits(dcIPAMPoolCfg.PoolCIDR, int(dcIPAMPoolCfg.AllocationPrefix))
+	}
+	return poolUnits{}, fmt.Errorf("unsupported pool type %q", dcIPAMPoolCfg.Type)
+}
+
+// ip returns the first address of a unit.
+func (u poolUnits) ip(unit *big.Int) net.IP {
+	ipInt := new(big.Int).Add(u.start, new(big.Int).Lsh(unit, u.unitBits))
+	return checkIPv4(intToIP(ipInt, 8*net.IPv6len))
+}
+
+// subnet returns the subnet of a unit.
+func (u poolUnits) subnet(unit *big.Int) *net.IPNet {
+	ip := u.ip(unit)
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip)-int(u.unitBits), 8*len(ip))}
+}
+
+// overlapping returns the first and last units overlapping the addresses from first to last (in 16-byte integer
+// form), false if none does.
+func (u poolUnits) overlapping(first, last *big.Int) (*big.Int, *big.Int, bool) {
+	firstUnit, lastUnit := new(big.Int).Sub(first, u.start), new(big.Int).Sub(last, u.start)
+	if lastUnit.Sign() < 0 {
+		return nil, nil, false
+	}
+	if firstUnit.Sign() < 0 {
+		firstUnit.SetInt64(0)
+	}
+	firstUnit.Rsh(firstUnit, u.unitBits)
+	lastUnit.Rsh(lastUnit, u.unitBits)
+	if firstUnit.Cmp(u.count) >= 0 {
+		return nil, nil, false
+	}
+	if lastUnit.Cmp(u.count) >= 0 {
+		lastUnit.Sub(u.count, big.NewInt(1))
+	}
+	return firstUnit, lastUnit, true
+}
+
+// usedRuns returns the sorted and merged runs of used units of the pool in a datacenter.
+func (u poolUnits) usedRuns(dc string, dcIPAMPoolUsageMap datacenterIPAMPoolUsageMap) [][2]*big.Int {
+	runs := [][2]*big.Int{}
+	addRun := func(first, last *big.Int) {
+		if firstUnit, lastUnit, isInPool := u.overlapping(first, last); isInPool {
+			runs = append(runs, [2]*big.Int{firstUnit, lastUnit})
+		}
+	}
+	if usage, hasUsage := dcIPAMPoolUsageMap[dc]; hasUsage {
+		for value := range usage.values {
+			first, last, err := usageBounds(value)
+			if err != nil {
+				continue
+			}
+			addRun(first, last)
+		}
+		for _, usedRange := range usage.ranges {
+			addRun(usedRange[0], usedRange[1])
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i][0].Cmp(runs[j][0]) < 0
+	})
+
+	merged := [][2]*big.Int{}
+	for _, run := range runs {
+		if len(merged) > 0 {
+			previous := &merged[len(merged)-1]
+			if new(big.Int).Add(previous[1], big.NewInt(1)).Cmp(run[0]) >= 0 {
+				if run[1].Cmp(previous[1]) > 0 {
+					previous[1] = new(big.Int).Set(run[1])
+				}
+				continue
+			}
+		}
+		merged = append(merged, [2]*big.Int{run[0], new(big.Int).Set(run[1])})
+	}
+	return merged
+}
+
+// forEachFreeRun calls fn with the first and last units of every run of free units of the pool in a datacenter, in
+// ascending order (descending when reverse is set), until fn returns false.
+func (u poolUnits) forEachFreeRun(dc string, dcIPAMPoolUsageMap datacenterIPAMPoolUsageMap, reverse bool, fn func(first, last *big.Int) bool) {
+	freeRuns := [][2]*big.Int{}
+	next := new(big.Int)
+	for _, usedRun := range u.usedRuns(dc, dcIPAMPoolUsageMap) {
+		if next.Cmp(usedRun[0]) < 0 {
+			freeRuns = append(freeRuns, [2]*big.Int{next, new(big.Int).Sub(usedRun[0], big.NewInt(1))})
+		}
+		next = new(big.Int).Add(usedRun[1], big.NewInt(1))
+	}
+	if next.Cmp(u.count) < 0 {
+		freeRuns = append(freeRuns, [2]*big.Int{next, new(big.Int).Sub(u.count, big.NewInt(1))})
+	}
+
+	for i := range freeRuns {
+		if reverse {
+			i = len(freeRuns) - 1 - i
+		}
+		if !fn(freeRuns[i][0], freeRuns[i][1]) {
+			return
+		}
+	}
+}
+
+// runLength returns the number of units from first to last.
+func runLength(first, last *big.Int) *big.Int {
+	length := new(big.Int).Sub(last, first)
+	return length.Add(length, big.NewInt(1))
+}
+
+// freeSpaceOfPool returns the number of free units of a datacenter pool and the length of its longest run of free
+// units.
+func freeSpaceOfPool(dc string, dcIPAMPoolCfg IPAMPoolDatacenterSettings, dcIPAMPoolUsageMap datacenterIPAMPoolUsageMap) (*big.Int, *big.Int, error) {
+	units, err := datacenterPoolUnits(dcIPAMPoolCfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	freeCount, longestFreeRun := new(big.Int), new(big.Int)
+	units.forEachFreeRun(dc, dcIPAMPoolUsageMap, false, func(first, last *big.Int) bool {
+		length := runLength(first, last)
+		freeCount.Add(freeCount, length)
+		if length.Cmp(longestFreeRun) > 0 {
+			longestFreeRun.Set(length)
+		}
+		return true
+	})
+	return freeCount, longestFreeRun, nil
+}
@@ -0,0 +1,95 @@
+package ipam
+
+import (
+	"strings"
+)
+
+// GCPSubnetworkClient reads and manages the subnetworks of a GCP project region.
+// It's usually backed by the Compute Engine API (compute.SubnetworksClient).
+type GCPSubnetworkClient interface {
+	ListSubnetworks(project, region string) ([]GCPSubnetwork, error)
+	AddSecondaryRange(project, region, subnetwork string, secondaryRange GCPSecondaryRange) error
+}
+
+// GCPLocation identifies where the subnetworks of a datacenter live in GCP. Subnetwork is the one receiving the
+// secondary ranges created for new prefix allocations.
+type GCPLocation struct {
+	Project    string
+	Region     string
+	Subnetwork string
+}
+
+// GCPSubnetwork is a subnetwork of a GCP VPC network, with its secondary ranges.
+type GCPSubnetwork struct {
+	Name              string
+	IPCIDRRange       string
+	SecondaryIPRanges []GCPSecondaryRange
+}
+
+// GCPSecondaryRange is a secondary range of a GCP subnetwork.
+type GCPSecondaryRange struct {
+	RangeName   string
+	IPCIDRRange string
+}
+
+// SyncGCPSubnetworks registers the primary and secondary ranges of the subnetworks of each datacenter as external
+// reservations and returns the current allocations that collide with them. Ranges matching exactly a prefix
+// allocation of the datacenter are the ones created for that allocation, so they are not reserved.
+func SyncGCPSubnetworks(p IPAM, client GCPSubnetworkClient, dcLocations map[string]GCPLocation) ([]ReservationConflict, error) {
+	for dc, location := range dcLocations {
+		subnetworks, err := client.ListSubnetworks(location.Project, location.Region)
+		if err != nil {
+			return nil, err
+		}
+		cidrs := []string{}
+		for _, subnetwork := range subnetworks {
+			cidrs = append(cidrs, subnetwork.IPCIDRRange)
+			for _, secondaryRange := range subnetwork.SecondaryIPRanges {
+				cidrs = append(cidrs, secondaryRange.IPCIDRRange)
+			}
+		}
+		err = p.reserveExternalCIDRs(dc, reservationSourceGCP, cidrs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return p.findReservationConflicts()
+}
+
+// GCPSecondaryRangeCreationHook returns an allocation hook adding a secondary range to the datacenter subnetwork
+// for every new prefix allocation, e.g. to be used as pods or services range of GKE clusters.
+func GCPSecondaryRangeCreationHook(client GCPSubnetworkClient, dcLocations map[string]GCPLocation) AllocationHook {
+	return func(allocation IPAMAllocation) error {
+		location, hasLocation := dcLocations[allocation.Datacenter]
+		if !hasLocation || location.Subnetwork == "" || allocation.Type != "prefix" {
+			return nil
+		}
+		return client.AddSecondaryRange(location.Project, location.Region, location.Subnetwork, GCPSecondaryRange{
+			RangeName:   gcpSecondaryRangeName(allocation),
+			IPCIDRRange: allocation.CIDR,
+		})
+	}
+}
+
+// gcpSecondaryRangeName builds a RFC1035 compliant range name (as required by GCP) from the pool and cluster names.
+func gcpSecondaryRangeName(allocation IPAMAllocation) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		default:
+			return '-'
+		}
+	}, externalName(allocation))
+
+	if name == "" || name[0] < 'a' || name[0] > 'z' {
+		name = "r-" + name
+	}
+	if len(name) > 63 {
+		name = name[:63]
+	}
+	return strings.TrimRight(name, "-")
+}
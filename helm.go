@@ -0,0 +1,83 @@
+package ipam
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultHelmValuesKeys maps the conventional pool names to the values of common cluster bootstrapping charts.
+var defaultHelmValuesKeys = map[string]string{
+	"pods":           "podCIDR",
+	"services":       "servicesCIDR",
+	"load-balancers": "loadBalancerRange",
+}
+
+// RenderClusterHelmValues renders the allocations of a cluster as a Helm values.yaml fragment. valuesKeys maps the
+// (qualified) pool names to the values receiving their allocation; dotted keys (e.g. "networking.podCIDR") are
+// nested. Prefix allocations are rendered as their CIDR and range allocations as the list of their address ranges.
+// Allocations of pools without a values key are left out.
+func RenderClusterHelmValues(p IPAM, cluster ClusterRef, valuesKeys map[string]string) ([]byte, error) {
+	clusterIndex := p.clusterIndex(cluster)
+	if clusterIndex < 0 {
+		return nil, fmt.Errorf("cluster %s not found in datacenter %s", cluster.qualifiedName(), cluster.Datacenter)
+	}
+
+	values := map[string]interface{}{}
+	for _, ipamAllocation := range p.datacenterAllocations[cluster.Datacenter][clusterIndex].IPAMAllocations {
+		valuesKey, isMapped := valuesKeys[ipamAllocation.qualifiedIPAMPoolName()]
+		if !isMapped {
+			continue
+		}
+		var value interface{} = ipamAllocation.CIDR
+		if ipamAllocation.Type == "range" {
+			value = ipamAllocation.Addresses
+		}
+		err := setHelmValue(values, valuesKey, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// yaml.v3 sorts the map keys
+	out := bytes.Buffer{}
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(values); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// setHelmValue sets the value at the dotted key path, creating the intermediate maps.
+func setHelmValue(values map[string]interface{}, key string, value interface{}) error {
+	path := strings.Split(key, ".")
+	for i, part := range path {
+		if part == "" {
+			return fmt.Errorf("invalid values key %q", key)
+		}
+		if i == len(path)-1 {
+			if _, isSet := values[part]; isSet {
+				return fmt.Errorf("values key %q is set more than once", key)
+			}
+			values[part] = value
+			return nil
+		}
+		nested, isSet := values[part]
+		if !isSet {
+			nested = map[string]interface{}{}
+			values[part] = nested
+		}
+		nestedValues, isMap := nested.(map[string]interface{})
+		if !isMap {
+			return fmt.Errorf("values key %q conflicts with %q", key, strings.Join(path[:i+1], "."))
+		}
+		values = nestedValues
+	}
+	return nil
+}
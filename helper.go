@@ -1,38 +1,146 @@
 package ipam
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"math/big"
 	"net"
+	"sort"
+	"strings"
 )
 
 var (
-	errIncompatiblePool = fmt.Errorf("pool is incompatible with current cluster allocation")
+	errIncompatiblePool    = fmt.Errorf("pool is incompatible with current cluster allocation")
+	errTenantQuotaExceeded = fmt.Errorf("tenant quota exceeded")
+	errNoFreeSubnet        = fmt.Errorf("cannot find free subnet")
+	errNotEnoughFreeIPs    = fmt.Errorf("there is no enough free IPs available for pool")
+	// errTooManyNewAllocations is returned when an apply or batch exceeds maxNewAllocationsPerApply and isn't forced
+	errTooManyNewAllocations = fmt.Errorf("too many new allocations")
+	// errUsageLimitExceeded is returned when the usage of a pool in a datacenter exceeds the MaxUsageEntries limit
+	errUsageLimitExceeded    = fmt.Errorf("usage limit exceeded")
+	errDuplicateAllocationID = fmt.Errorf("allocation ID is already taken")
+	errImportConflict        = fmt.Errorf("imported allocations conflict with existing allocations")
+	errPHPIPAMConflict       = fmt.Errorf("phpIPAM entry conflicts with the exported allocation")
+	errNotApproved           = fmt.Errorf("operation not approved")
+	// errStateChecksumMismatch is returned when a persisted state doesn't match its checksum
+	errStateChecksumMismatch = fmt.Errorf("state checksum mismatch")
+	// errPlacementConstraintViolated is returned when the settings of a pool break one of its constraints for a cluster
+	errPlacementConstraintViolated = fmt.Errorf("placement constraint violated")
+	// errPoolHasPurposes is returned by the operations about a single block of a pool when given a pool with purposes
+	errPoolHasPurposes = fmt.Errorf("pool has purposes")
 )
 
-type datacenterIPAMPoolUsageMap map[string]map[string]struct{}
+// datacenterIPAMPoolUsageMap holds the usage of a pool per datacenter.
+type datacenterIPAMPoolUsageMap map[string]*ipamPoolUsage
+
+// ipamPoolUsage holds the used IPs (for range allocation type) or subnets (for prefix allocation type) of a pool in a
+// datacenter, plus the used address ranges (e.g. reservations), which are kept as bounds so marking a large range
+// never enumerates its addresses.
+type ipamPoolUsage struct {
+	values map[string]struct{}
+	// ranges are the inclusive bounds, in 16-byte integer form, of the used address ranges
+	ranges [][2]*big.Int
+}
 
 func newDatacenterIPAMPoolUsageMap() datacenterIPAMPoolUsageMap {
 	return make(datacenterIPAMPoolUsageMap)
 }
 
+func (m datacenterIPAMPoolUsageMap) datacenter(dc string) *ipamPoolUsage {
+	usage, hasUsage := m[dc]
+	if !hasUsage {
+		usage = &ipamPoolUsage{values: map[string]struct{}{}}
+		m[dc] = usage
+	}
+	return usage
+}
+
 func (m datacenterIPAMPoolUsageMap) setUsed(dc string, value string) {
-	_, hasUsedValues := m[dc]
-	if !hasUsedValues {
-		m[dc] = map[string]struct{}{}
+	m.datacenter(dc).values[value] = struct{}{}
+}
+
+// setUsedRange marks the IPs (for range allocation type), or the subnets overlapping (for prefix allocation type),
+// the addresses of a network as used.
+func (m datacenterIPAMPoolUsageMap) setUsedRange(dc string, network *net.IPNet) {
+	first, last := addressRange(network)
+	firstInt, _ := ipToInt(first.To16())
+	lastInt, _ := ipToInt(last.To16())
+	m.setUsedBounds(dc, firstInt, lastInt)
+}
+
+// setUsedBounds marks the addresses from first to last, in 16-byte integer form, as used like setUsedRange.
+func (m datacenterIPAMPoolUsageMap) setUsedBounds(dc string, first, last *big.Int) {
+	usage := m.datacenter(dc)
+	usage.ranges = append(usage.ranges, [2]*big.Int{first, last})
+}
+
+func (m datacenterIPAMPoolUsageMap) setFree(dc string, value string) {
+	if usage, hasUsage := m[dc]; hasUsage {
+		delete(usage.values, value)
 	}
-	m[dc][value] = struct{}{}
 }
 
 func (m datacenterIPAMPoolUsageMap) isUsed(dc string, value string) bool {
-	usedValues, hasUsedValues := m[dc]
-	if hasUsedValues {
-		_, isUsed := usedValues[value]
-		return isUsed
+	usage, hasUsage := m[dc]
+	if !hasUsage {
+		return false
+	}
+	if _, isUsed := usage.values[value]; isUsed {
+		return true
+	}
+	if len(usage.ranges) == 0 {
+		return false
+	}
+	first, last, err := usageBounds(value)
+	if err != nil {
+		return false
+	}
+	for _, usedRange := range usage.ranges {
+		if first.Cmp(usedRange[1]) <= 0 && usedRange[0].Cmp(last) <= 0 {
+			return true
+		}
 	}
 	return false
 }
 
+// copyDatacenter returns a copy of the usage of a datacenter, to be marked further without changing the original.
+func (m datacenterIPAMPoolUsageMap) copyDatacenter(dc string) datacenterIPAMPoolUsageMap {
+	usageMap := newDatacenterIPAMPoolUsageMap()
+	usage := usageMap.datacenter(dc)
+	if original, hasUsage := m[dc]; hasUsage {
+		for value := range original.values {
+			usage.values[value] = struct{}{}
+		}
+		usage.ranges = append(usage.ranges, original.ranges...)
+	}
+	return usageMap
+}
+
+// bigIntToInt converts a non-negative big integer to an int, capped at the largest int.
+func bigIntToInt(n *big.Int) int {
+	maxInt := int64(^uint(0) >> 1)
+	if !n.IsInt64() || n.Int64() > maxInt {
+		return int(maxInt)
+	}
+	return int(n.Int64())
+}
+
+// usageBounds returns the first and last addresses, in 16-byte integer form, of a used IP or subnet.
+func usageBounds(value string) (*big.Int, *big.Int, error) {
+	if ip := net.ParseIP(value); ip != nil {
+		ipInt, _ := ipToInt(ip.To16())
+		return ipInt, new(big.Int).Set(ipInt), nil
+	}
+	first, last, err := blockBounds(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	firstInt, _ := ipToInt(first)
+	lastInt, _ := ipToInt(last)
+	return firstInt, lastInt, nil
+}
+
 func ipToInt(ip net.IP) (*big.Int, int) {
 	val := &big.Int{}
 	val.SetBytes([]byte(ip))
@@ -107,6 +215,19 @@ func incIP(IP net.IP) net.IP {
 	return incIP
 }
 
+func decIP(IP net.IP) net.IP {
+	IP = checkIPv4(IP)
+	decIP := make([]byte, len(IP))
+	copy(decIP, IP)
+	for j := len(decIP) - 1; j >= 0; j-- {
+		decIP[j]--
+		if decIP[j] < 255 {
+			break
+		}
+	}
+	return decIP
+}
+
 func checkIPv4(ip net.IP) net.IP {
 	// Go for some reason allocs IPv6len for IPv4 so we have to correct it
 	if v4 := ip.To4(); v4 != nil {
@@ -119,3 +240,101 @@ func isTheNextIP(ipToCheck string, previousIP string) bool {
 	nextIP := incIP(net.ParseIP(previousIP))
 	return nextIP.Equal(net.ParseIP(ipToCheck))
 }
+
+// sortedIPAMPools returns a copy of the pools sorted by qualified name, for generating deterministic outputs.
+func sortedIPAMPools(ipamPools []IPAMPool) []IPAMPool {
+	sortedPools := make([]IPAMPool, len(ipamPools))
+	copy(sortedPools, ipamPools)
+	sort.SliceStable(sortedPools, func(i, j int) bool {
+		return sortedPools[i].qualifiedName() < sortedPools[j].qualifiedName()
+	})
+	return sortedPools
+}
+
+// copyDatacenterAllocations deep copies datacenter allocations, so the copy can be modified independently.
+func copyDatacenterAllocations(dcAllocations map[string][]Cluster) map[string][]Cluster {
+	dcAllocationsCopy := make(map[string][]Cluster, len(dcAllocations))
+	for dc, dcClusters := range dcAllocations {
+		dcClustersCopy := make([]Cluster, len(dcClusters))
+		for i, dcCluster := range dcClusters {
+			dcClustersCopy[i] = dcCluster
+			dcClustersCopy[i].IPAMAllocations = make([]IPAMAllocation, len(dcCluster.IPAMAllocations))
+			for j, ipamAllocation := range dcCluster.IPAMAllocations {
+				dcClustersCopy[i].IPAMAllocations[j] = ipamAllocation
+				if ipamAllocation.Addresses != nil {
+					dcClustersCopy[i].IPAMAllocations[j].Addresses = append([]string{}, ipamAllocation.Addresses...)
+				}
+			}
+		}
+		dcAllocationsCopy[dc] = dcClustersCopy
+	}
+	return dcAllocationsCopy
+}
+
+// externalName names the resources created in external systems for an allocation after its pool and cluster,
+// e.g. "team-a-pool1:pods-team-b-c1".
+func externalName(allocation IPAMAllocation) string {
+	return strings.ReplaceAll(allocation.qualifiedIPAMPoolName()+"/"+allocation.clusterRef().qualifiedName(), "/", "-")
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// markAllocationAsUsed marks the IPs (for range allocation type) or the subnet (for prefix allocation type) of the
+// allocation as used.
+func markAllocationAsUsed(allocation IPAMAllocation, dcIPAMPoolUsageMap datacenterIPAMPoolUsageMap) error {
+	switch allocation.Type {
+	case "range":
+		ips, err := getUsedIPsFromAddressRanges(allocation.Addresses)
+		if err != nil {
+			return err
+		}
+		for _, ip := range ips {
+			dcIPAMPoolUsageMap.setUsed(allocation.Datacenter, ip)
+		}
+	case "prefix":
+		dcIPAMPoolUsageMap.setUsed(allocation.Datacenter, allocation.CIDR)
+	}
+	return nil
+}
+
+// markAllocationAsFree reverts markAllocationAsUsed.
+func markAllocationAsFree(allocation IPAMAllocation, dcIPAMPoolUsageMap datacenterIPAMPoolUsageMap) error {
+	switch allocation.Type {
+	case "range":
+		ips, err := getUsedIPsFromAddressRanges(allocation.Addresses)
+		if err != nil {
+			return err
+		}
+		for _, ip := range ips {
+			dcIPAMPoolUsageMap.setFree(allocation.Datacenter, ip)
+		}
+	case "prefix":
+		dcIPAMPoolUsageMap.setFree(allocation.Datacenter, allocation.CIDR)
+	}
+	return nil
+}
+
+// decodeJSON decodes a JSON document into v, rejecting unknown fields in strict mode.
+func decodeJSON(data []byte, v interface{}, strict bool) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	return decoder.Decode(v)
+}
@@ -0,0 +1,170 @@
+package ipam
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AddressHistoryRecord tells which cluster owned a block of addresses and when.
+type AddressHistoryRecord struct {
+	Datacenter    string
+	Cluster       string
+	ClusterTenant string
+	// ClusterAliases are the former names of the cluster, oldest first
+	ClusterAliases []string
+	IPAMPoolName   string
+	IPAMPoolTenant string
+	Purpose        string
+	// Block is the allocated CIDR (prefix allocations) or address range (range allocations)
+	Block       string
+	AllocatedAt time.Time
+	// ReleasedAt is zero while the block is still allocated
+	ReleasedAt time.Time
+}
+
+type addressHistory struct {
+	records []AddressHistoryRecord
+}
+
+func newAddressHistory() *addressHistory {
+	return &addressHistory{records: []AddressHistoryRecord{}}
+}
+
+func (h *addressHistory) recordAllocation(allocation IPAMAllocation, at time.Time) {
+	for _, block := range allocationBlocks(allocation) {
+		h.records = append(h.records, AddressHistoryRecord{
+			Datacenter:     allocation.Datacenter,
+			Cluster:        allocation.Cluster,
+			ClusterTenant:  allocation.ClusterTenant,
+			IPAMPoolName:   allocation.IPAMPoolName,
+			IPAMPoolTenant: allocation.IPAMPoolTenant,
+			Purpose:        allocation.Purpose,
+			Block:          block,
+			AllocatedAt:    at,
+		})
+	}
+}
+
+func (h *addressHistory) recordRelease(allocation IPAMAllocation, at time.Time) {
+	blocks := map[string]struct{}{}
+	for _, block := range allocationBlocks(allocation) {
+		blocks[block] = struct{}{}
+	}
+	for i, record := range h.records {
+		if _, isReleased := blocks[record.Block]; !isReleased || !record.ReleasedAt.IsZero() {
+			continue
+		}
+		if record.clusterRef() == allocation.clusterRef() && record.IPAMPoolName == allocation.IPAMPoolName &&
+			record.IPAMPoolTenant == allocation.IPAMPoolTenant && record.Purpose == allocation.Purpose {
+			h.records[i].ReleasedAt = at
+		}
+	}
+}
+
+// recordClusterRename moves the records of a cluster to its new name, keeping the old name as an alias.
+func (h *addressHistory) recordClusterRename(cluster ClusterRef, newName string) {
+	for i, record := range h.records {
+		if record.clusterRef() == cluster {
+			h.records[i].Cluster = newName
+			h.records[i].ClusterAliases = append(record.ClusterAliases, cluster.Name)
+		}
+	}
+}
+
+func (r AddressHistoryRecord) clusterRef() ClusterRef {
+	return ClusterRef{Datacenter: r.Datacenter, Tenant: r.ClusterTenant, Name: r.Cluster}
+}
+
+// History returns the ownership records of the blocks containing an IP, or overlapping a CIDR, oldest first.
+func (p IPAM) History(address string) ([]AddressHistoryRecord, error) {
+	var queryNet *net.IPNet
+	if strings.Contains(address, "/") {
+		var err error
+		_, queryNet, err = net.ParseCIDR(address)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, fmt.Errorf("wrong ip format")
+		}
+		ip = checkIPv4(ip)
+		queryNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))}
+	}
+
+	records := []AddressHistoryRecord{}
+	for _, record := range p.addressHistory.records {
+		if blockOverlaps(record.Block, queryNet) {
+			records = append(records, record)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].AllocatedAt.Before(records[j].AllocatedAt)
+	})
+	return records, nil
+}
+
+// allocationBlocks returns the CIDR of a prefix allocation, or the address ranges of a range allocation.
+func allocationBlocks(allocation IPAMAllocation) []string {
+	if allocation.Type == "prefix" {
+		return []string{allocation.CIDR}
+	}
+	return allocation.Addresses
+}
+
+// blockOverlaps tells whether a CIDR or "first-last" address range overlaps the network.
+func blockOverlaps(block string, network *net.IPNet) bool {
+	if _, blockNet, err := net.ParseCIDR(block); err == nil {
+		return networksOverlap(blockNet, network)
+	}
+
+	ipRange := strings.SplitN(block, "-", 2)
+	if len(ipRange) != 2 {
+		return false
+	}
+	firstIP, lastIP := net.ParseIP(ipRange[0]), net.ParseIP(ipRange[1])
+	if firstIP == nil || lastIP == nil {
+		return false
+	}
+	networkFirstIP, networkLastIP := addressRange(&net.IPNet{IP: checkIPv4(network.IP), Mask: network.Mask})
+	firstIP, lastIP = checkIPv4(firstIP), checkIPv4(lastIP)
+	if len(firstIP) != len(networkFirstIP) {
+		return false
+	}
+	return bytes.Compare(firstIP, networkLastIP) <= 0 && bytes.Compare(networkFirstIP, lastIP) <= 0
+}
+
+// blockBounds returns the first and last addresses (in 16-byte form) of a CIDR or "first-last" address range.
+func blockBounds(block string) (net.IP, net.IP, error) {
+	if _, blockNet, err := net.ParseCIDR(block); err == nil {
+		first, last := addressRange(blockNet)
+		return first.To16(), last.To16(), nil
+	}
+	ipRange := strings.SplitN(block, "-", 2)
+	if len(ipRange) != 2 {
+		return nil, nil, fmt.Errorf("wrong ip range format")
+	}
+	first, last := net.ParseIP(ipRange[0]), net.ParseIP(ipRange[1])
+	if first == nil || last == nil {
+		return nil, nil, fmt.Errorf("wrong ip format")
+	}
+	return first.To16(), last.To16(), nil
+}
+
+// blocksOverlap tells whether two CIDRs or "first-last" address ranges overlap.
+func blocksOverlap(a, b string) (bool, error) {
+	aFirst, aLast, err := blockBounds(a)
+	if err != nil {
+		return false, err
+	}
+	bFirst, bLast, err := blockBounds(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Compare(aFirst, bLast) <= 0 && bytes.Compare(bFirst, aLast) <= 0, nil
+}
@@ -0,0 +1,164 @@
+package ipam
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// allocationHold keeps a block of a pool aside for a cluster that is about to be created, until it's confirmed or
+// expires.
+type allocationHold struct {
+	Token string
+	// Allocation is the held block, which doesn't belong to any cluster yet
+	Allocation IPAMAllocation
+	ExpiresAt  time.Time
+}
+
+// Hold reserves a block of the pool in a datacenter for ttl, so planning and creating a cluster don't race with
+// other allocations. The held block counts against the tenant quota of the pool. It returns the token confirming the
+// hold. Every allocation of a pool has the allocation size of
+// the pool in the datacenter, so size, the number of addresses to hold, must match it; nil holds that size. Pools with
+// purposes are refused, see IPAMPool.ForPurpose.
+func (p IPAM) Hold(dc string, ipamPool IPAMPool, size *big.Int, ttl time.Duration) (string, error) {
+	if ttl <= 0 {
+		return "", fmt.Errorf("hold ttl must be positive")
+	}
+	if err := ipamPool.checkSinglePurpose(); err != nil {
+		return "", err
+	}
+	p.releaseExpiredHolds()
+
+	ipamPool, err := ipamPool.withResolvedAllocationSizes()
+	if err != nil {
+		return "", err
+	}
+	if _, isDCConfigured := ipamPool.Datacenters[dc]; !isDCConfigured {
+		return "", fmt.Errorf("pool %s is not configured for datacenter %s", ipamPool.qualifiedName(), dc)
+	}
+	dcIPAMPoolUsageMap, err := p.compileCurrentAllocationsForPool(ipamPool)
+	if err != nil {
+		return "", err
+	}
+	heldAllocation, err := p.generateNewAllocationForCluster(ipamPool, dc, Cluster{}, dcIPAMPoolUsageMap)
+	if err != nil {
+		return "", err
+	}
+	if size != nil {
+		allocationSize, err := allocationSize(*heldAllocation)
+		if err != nil {
+			return "", err
+		}
+		if size.Cmp(allocationSize) != 0 {
+			return "", fmt.Errorf("hold size %s doesn't match the allocation size %s of pool %s in datacenter %s", size, allocationSize, ipamPool.qualifiedName(), dc)
+		}
+	}
+	err = p.checkTenantQuota(ipamPool.Tenant, []IPAMAllocation{*heldAllocation})
+	if err != nil {
+		return "", err
+	}
+
+	token, err := newRandomToken()
+	if err != nil {
+		return "", err
+	}
+	p.holds[token] = allocationHold{
+		Token:      token,
+		Allocation: *heldAllocation,
+		ExpiresAt:  p.clock.Now().Add(ttl),
+	}
+	return token, nil
+}
+
+// ConfirmHold turns a hold of the pool into the allocation of the pool for the cluster, which must be in the
+// datacenter of the hold. The held block was chosen before the cluster was known, so it's checked against the
+// anti-affinity, the placement constraints and the tenant quota of the pool for the cluster. The hold is kept until
+// the allocation is made, so a failed confirmation can be retried, e.g. for another cluster.
+func (p IPAM) ConfirmHold(token string, cluster ClusterRef, ipamPool IPAMPool) (IPAMAllocation, error) {
+	if err := ipamPool.checkSinglePurpose(); err != nil {
+		return IPAMAllocation{}, err
+	}
+	p.releaseExpiredHolds()
+
+	hold, exists := p.holds[token]
+	if !exists {
+		return IPAMAllocation{}, fmt.Errorf("hold not found or expired")
+	}
+	allocation := hold.Allocation
+	if !allocation.isFromPool(ipamPool) {
+		return IPAMAllocation{}, fmt.Errorf("hold is for pool %s, not %s", allocation.qualifiedIPAMPoolName(), ipamPool.qualifiedName())
+	}
+	if cluster.Datacenter != allocation.Datacenter {
+		return IPAMAllocation{}, fmt.Errorf("hold is for datacenter %s, not %s", allocation.Datacenter, cluster.Datacenter)
+	}
+	if p.hasAllocation(cluster, allocation.qualifiedIPAMPoolName()) {
+		return IPAMAllocation{}, fmt.Errorf("cluster %s already has an allocation of pool %s", cluster.qualifiedName(), allocation.qualifiedIPAMPoolName())
+	}
+
+	allocation.Cluster = cluster.Name
+	allocation.ClusterTenant = cluster.Tenant
+	ipamPool, err := ipamPool.withResolvedAllocationSizes()
+	if err != nil {
+		return IPAMAllocation{}, err
+	}
+	p.trackUniqueIPAMPool(ipamPool)
+	conflictingBlock, err := antiAffinityConflict(allocation, antiAffineBlocks(ipamPool, p.allocatedCluster(allocation)))
+	if err != nil {
+		return IPAMAllocation{}, err
+	}
+	if conflictingBlock != "" {
+		return IPAMAllocation{}, fmt.Errorf("held block of pool %s conflicts with the anti-affine block %s of cluster %s", ipamPool.qualifiedName(), conflictingBlock, cluster.qualifiedName())
+	}
+
+	// the held block already counts against the tenant quota, so the hold is left out while checking the allocation
+	newClustersAllocations := []IPAMAllocation{allocation}
+	delete(p.holds, token)
+	err = p.checkNewAllocations(ipamPool, newClustersAllocations)
+	if err != nil {
+		p.holds[token] = hold
+		return IPAMAllocation{}, err
+	}
+	// the allocation is made even if a hook fails, so it's returned with the error
+	err = p.addNewAllocations(newClustersAllocations)
+	return newClustersAllocations[0], err
+}
+
+// ReleaseHold gives the held block back to the pool, serving the pending allocations the block lets through.
+func (p IPAM) ReleaseHold(token string) error {
+	delete(p.holds, token)
+	return p.fulfillPendingAllocations()
+}
+
+func (p IPAM) releaseExpiredHolds() {
+	now := p.clock.Now()
+	for token, hold := range p.holds {
+		if !now.Before(hold.ExpiresAt) {
+			delete(p.holds, token)
+		}
+	}
+}
+
+// markHoldsAsUsed marks the blocks of the unexpired holds of the pool as used.
+func (p IPAM) markHoldsAsUsed(ipamPool IPAMPool, dcIPAMPoolUsageMap datacenterIPAMPoolUsageMap) error {
+	now := p.clock.Now()
+	for _, hold := range p.holds {
+		if !hold.Allocation.isFromPool(ipamPool) || !now.Before(hold.ExpiresAt) {
+			continue
+		}
+		if err := markAllocationAsUsed(hold.Allocation, dcIPAMPoolUsageMap); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newRandomToken returns a random identifier, e.g. of a hold or a tombstone.
+func newRandomToken() (string, error) {
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(tokenBytes), nil
+}
@@ -0,0 +1,100 @@
+package ipam
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// maxAllocationIDLength is the maximum length of a Kubernetes object name which must also be a DNS label.
+const maxAllocationIDLength = 63
+
+// AllocationIDPolicy derives the identifier of a new allocation, e.g. the name of the object the allocation is
+// persisted as in a CRD or SQL backend. It must be stable: the same allocation always gets the same identifier.
+type AllocationIDPolicy func(IPAMAllocation) (string, error)
+
+// DefaultAllocationID identifies an allocation by its pool, datacenter and cluster as
+// "<tenant>-<pool>-<purpose>-<dc>-<cluster tenant>-<cluster>-<hash>" (leaving out the empty parts), lowercased and
+// with any character other than letters, digits and "-" replaced by "-", so it's a valid Kubernetes object name. The
+// readable part is ambiguous (pool "a-b" of datacenter "c" reads like pool "a" of datacenter "b-c"), so it's
+// followed by a hash of the exact parts, and truncated to fit the 63 characters limit of the name.
+func DefaultAllocationID(allocation IPAMAllocation) (string, error) {
+	allParts := []string{allocation.IPAMPoolTenant, allocation.IPAMPoolName, allocation.Purpose, allocation.Datacenter, allocation.ClusterTenant, allocation.Cluster}
+	parts := []string{}
+	for _, part := range allParts {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	readableID := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(strings.Join(parts, "-")))
+
+	key, err := json.Marshal(allParts)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(key)
+	hash := hex.EncodeToString(sum[:])[:10]
+
+	if len(readableID) > maxAllocationIDLength-len(hash)-1 {
+		readableID = readableID[:maxAllocationIDLength-len(hash)-1]
+	}
+	readableID = strings.Trim(readableID, "-")
+	if readableID == "" {
+		return hash, nil
+	}
+	return readableID + "-" + hash, nil
+}
+
+// WithAllocationIDPolicy makes the IPAM identify its new allocations with the policy, e.g. DefaultAllocationID. A nil
+// policy leaves them without identifier.
+func WithAllocationIDPolicy(policy AllocationIDPolicy) Option {
+	return func(p *IPAM) {
+		p.allocationIDPolicy = policy
+	}
+}
+
+// assignAllocationIDs sets the identifier of the new allocations with the allocation ID policy, if there is one. It
+// fails if an identifier is empty or already taken by an existing allocation or another new one, before setting any.
+func (p IPAM) assignAllocationIDs(newAllocations []IPAMAllocation) error {
+	if p.allocationIDPolicy == nil {
+		return nil
+	}
+
+	takenIDs := map[string]struct{}{}
+	for _, dcClusters := range p.datacenterAllocations {
+		for _, dcCluster := range dcClusters {
+			for _, ipamAllocation := range dcCluster.IPAMAllocations {
+				if ipamAllocation.ID != "" {
+					takenIDs[ipamAllocation.ID] = struct{}{}
+				}
+			}
+		}
+	}
+
+	ids := make([]string, len(newAllocations))
+	for i, newAllocation := range newAllocations {
+		id, err := p.allocationIDPolicy(newAllocation)
+		if err != nil {
+			return err
+		}
+		if id == "" {
+			return fmt.Errorf("allocation ID policy returned an empty ID for cluster %s of pool %s", newAllocation.Cluster, newAllocation.qualifiedIPAMPoolName())
+		}
+		if _, isTaken := takenIDs[id]; isTaken {
+			return fmt.Errorf("%w: %s", errDuplicateAllocationID, id)
+		}
+		takenIDs[id] = struct{}{}
+		ids[i] = id
+	}
+	for i := range newAllocations {
+		newAllocations[i].ID = ids[i]
+	}
+	return nil
+}
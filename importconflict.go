@@ -0,0 +1,144 @@
+package ipam
+
+import (
+	"fmt"
+)
+
+// ImportConflictPolicy decides what ImportAllocations does with imported allocations conflicting with the current
+// ones.
+type ImportConflictPolicy string
+
+const (
+	// ImportConflictFail imports nothing if any imported allocation conflicts
+	ImportConflictFail ImportConflictPolicy = "fail"
+	// ImportConflictPreferExisting skips the conflicting imported allocations
+	ImportConflictPreferExisting ImportConflictPolicy = "prefer-existing"
+	// ImportConflictPreferImported releases the current allocations conflicting with imported ones, once the
+	// approval hooks approve it
+	ImportConflictPreferImported ImportConflictPolicy = "prefer-imported"
+	// ImportConflictList imports nothing and only lists the conflicts, so they can be reviewed (e.g. interactively)
+	// and the import retried with the chosen allocations
+	ImportConflictList ImportConflictPolicy = "list"
+)
+
+// ImportConflict is an imported allocation conflicting with current allocations (or allocations imported before it):
+// the allocation of the same pool for the cluster, or allocations with overlapping blocks in the datacenter.
+type ImportConflict struct {
+	Imported IPAMAllocation
+	Existing []IPAMAllocation
+}
+
+// ImportAllocations adds allocations coming from an external source (e.g. another IPAM or a tool being migrated
+// from) to the datacenter allocations, creating the clusters that don't exist yet. The conflicts are resolved by the
+// policy and returned. With ImportConflictFail the conflicts are returned along with errImportConflict.
+func (p IPAM) ImportAllocations(allocations []IPAMAllocation, policy ImportConflictPolicy) ([]ImportConflict, error) {
+	switch policy {
+	case ImportConflictFail, ImportConflictPreferExisting, ImportConflictPreferImported, ImportConflictList:
+	default:
+		return nil, fmt.Errorf("unsupported import conflict policy %q", policy)
+	}
+
+	// the conflicts are first found against a copy, so nothing is imported when the policy rejects them
+	simulation := p
+	simulation.datacenterAllocations = copyDatacenterAllocations(p.datacenterAllocations)
+	conflicts := []ImportConflict{}
+	for _, allocation := range allocations {
+		existing, err := simulation.conflictingAllocations(allocation)
+		if err != nil {
+			return nil, err
+		}
+		if len(existing) > 0 {
+			conflicts = append(conflicts, ImportConflict{Imported: allocation, Existing: existing})
+			if policy == ImportConflictPreferExisting {
+				continue
+			}
+			for _, existingAllocation := range existing {
+				simulation.removeAllocation(existingAllocation)
+			}
+		}
+		simulation.addAllocation(allocation)
+	}
+
+	switch {
+	case policy == ImportConflictList:
+		return conflicts, nil
+	case policy == ImportConflictFail && len(conflicts) > 0:
+		return conflicts, errImportConflict
+	}
+
+	if policy == ImportConflictPreferImported {
+		released := []IPAMAllocation{}
+		for _, conflict := range conflicts {
+			released = append(released, conflict.Existing...)
+		}
+		if err := p.requestApproval(DestructiveOperation{Kind: DestructiveRelease, Allocations: released}); err != nil {
+			return conflicts, err
+		}
+	}
+
+	now := p.clock.Now()
+	released, imported := []IPAMAllocation{}, []IPAMAllocation{}
+	for _, allocation := range allocations {
+		existing, err := p.conflictingAllocations(allocation)
+		if err != nil {
+			return nil, err
+		}
+		if len(existing) > 0 && policy == ImportConflictPreferExisting {
+			continue
+		}
+		for _, existingAllocation := range existing {
+			p.removeAllocation(existingAllocation)
+			p.addressHistory.recordRelease(existingAllocation, now)
+		}
+		p.addAllocation(allocation)
+		p.addressHistory.recordAllocation(allocation, now)
+		released = append(released, existing...)
+		imported = append(imported, allocation)
+	}
+
+	releasedErr := p.sendEvents(AllocationEventReleased, released)
+	if err := p.sendEvents(AllocationEventAllocated, imported); err != nil {
+		return conflicts, err
+	}
+	return conflicts, releasedErr
+}
+
+// conflictingAllocations returns the allocation of the same pool for the cluster of the allocation and the
+// allocations of its datacenter with blocks overlapping its blocks.
+func (p IPAM) conflictingAllocations(allocation IPAMAllocation) ([]IPAMAllocation, error) {
+	conflicts := []IPAMAllocation{}
+	for _, dcCluster := range p.datacenterAllocations[allocation.Datacenter] {
+		for _, clusterAllocation := range dcCluster.IPAMAllocations {
+			if dcCluster.ref(allocation.Datacenter) == allocation.clusterRef() &&
+				clusterAllocation.qualifiedIPAMPoolName() == allocation.qualifiedIPAMPoolName() {
+				conflicts = append(conflicts, clusterAllocation)
+				continue
+			}
+			overlaps, err := allocationsOverlap(allocation, clusterAllocation)
+			if err != nil {
+				return nil, err
+			}
+			if overlaps {
+				conflicts = append(conflicts, clusterAllocation)
+			}
+		}
+	}
+	return conflicts, nil
+}
+
+// removeAllocation removes the allocation of the pool of the given allocation from its cluster.
+func (p IPAM) removeAllocation(allocation IPAMAllocation) {
+	dcClusters := p.datacenterAllocations[allocation.Datacenter]
+	for i, dcCluster := range dcClusters {
+		if dcCluster.ref(allocation.Datacenter) != allocation.clusterRef() {
+			continue
+		}
+		clusterAllocations := []IPAMAllocation{}
+		for _, clusterAllocation := range dcCluster.IPAMAllocations {
+			if clusterAllocation.qualifiedIPAMPoolName() != allocation.qualifiedIPAMPoolName() {
+				clusterAllocations = append(clusterAllocations, clusterAllocation)
+			}
+		}
+		dcClusters[i].IPAMAllocations = clusterAllocations
+	}
+}
@@ -0,0 +1,97 @@
+package ipam
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// InventoryEntry is a CIDR in use in another system. When Datacenter is empty the CIDR is checked against the
+// allocations of every datacenter.
+type InventoryEntry struct {
+	CIDR        string `json:"cidr"`
+	Datacenter  string `json:"datacenter,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// InventoryOverlap is an allocation overlapping a CIDR of the inventory.
+type InventoryOverlap struct {
+	Entry      InventoryEntry
+	Allocation IPAMAllocation
+}
+
+// ReadInventoryCSV reads an inventory from CSV. The first row is the header and must have a "cidr" column;
+// "datacenter" and "description" columns are optional.
+func ReadInventoryCSV(r io.Reader) ([]InventoryEntry, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return []InventoryEntry{}, nil
+	}
+
+	columns := map[string]int{}
+	for i, column := range records[0] {
+		columns[strings.ToLower(strings.TrimSpace(column))] = i
+	}
+	if _, hasCIDR := columns["cidr"]; !hasCIDR {
+		return nil, fmt.Errorf("inventory CSV has no cidr column")
+	}
+	field := func(record []string, column string) string {
+		i, hasColumn := columns[column]
+		if !hasColumn || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	entries := []InventoryEntry{}
+	for _, record := range records[1:] {
+		entries = append(entries, InventoryEntry{
+			CIDR:        field(record, "cidr"),
+			Datacenter:  field(record, "datacenter"),
+			Description: field(record, "description"),
+		})
+	}
+	return entries, nil
+}
+
+// ReadInventoryJSON reads an inventory from a JSON list of entries.
+func ReadInventoryJSON(r io.Reader) ([]InventoryEntry, error) {
+	entries := []InventoryEntry{}
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// FindInventoryOverlaps reports every allocation overlapping a CIDR of the inventory, in inventory order.
+func (p IPAM) FindInventoryOverlaps(entries []InventoryEntry) ([]InventoryOverlap, error) {
+	overlaps := []InventoryOverlap{}
+
+	allocations := p.Allocations()
+	for _, entry := range entries {
+		_, entryNet, err := net.ParseCIDR(entry.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("wrong inventory CIDR %q: %v", entry.CIDR, err)
+		}
+		for _, ipamAllocation := range allocations {
+			if entry.Datacenter != "" && entry.Datacenter != ipamAllocation.Datacenter {
+				continue
+			}
+			isOverlapping, err := allocationOverlaps(ipamAllocation, entryNet)
+			if err != nil {
+				return nil, err
+			}
+			if isOverlapping {
+				overlaps = append(overlaps, InventoryOverlap{Entry: entry, Allocation: ipamAllocation})
+			}
+		}
+	}
+
+	return overlaps, nil
+}
@@ -1,59 +1,369 @@
 package ipam
 
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
 type IPAMPoolDatacenterSettings struct {
 	Type             string `json:"type"`
 	PoolCIDR         string `json:"poolCidr"`
 	AllocationPrefix uint8  `json:"allocationPrefix,omitempty"`
 	AllocationRange  uint32 `json:"allocationRange,omitempty"`
+	// AllocateFrom is the end of the pool range allocations are taken from: "low" (default) or "high", e.g. to
+	// keep the low addresses for static infrastructure
+	AllocateFrom string `json:"allocateFrom,omitempty"`
+	// FirstAddressOffset is the number of leading addresses of the pool CIDR which are never allocated, e.g. the
+	// addresses reserved by cloud providers at the start of their subnets
+	FirstAddressOffset uint32 `json:"firstAddressOffset,omitempty"`
+	// AllocationPercent sizes the allocations as a percentage of the pool CIDR instead of AllocationRange or
+	// AllocationPrefix, which are computed from it when the pool is applied
+	AllocationPercent float64 `json:"allocationPercent,omitempty"`
+	// Gateway, DNSServers and MTU describe the network of the datacenter pool. They are copied into every new
+	// allocation of the pool, so consumers receive the complete network configuration
+	Gateway    string   `json:"gateway,omitempty"`
+	DNSServers []string `json:"dnsServers,omitempty"`
+	MTU        uint32   `json:"mtu,omitempty"`
 }
 
+const (
+	allocateFromLow  = "low"
+	allocateFromHigh = "high"
+)
+
 type IPAMAllocation struct {
-	IPAMPoolName string
-	Cluster      string
-	Datacenter   string
-	Type         string   `json:"type"`
-	CIDR         string   `json:"cidr,omitempty"`
-	Addresses    []string `json:"addresses,omitempty"`
+	// ID is the stable identifier given to the allocation by the allocation ID policy, if any
+	ID             string `json:"id,omitempty"`
+	IPAMPoolName   string
+	IPAMPoolTenant string
+	// Purpose names the allocation among the allocations of the pool for the cluster (e.g. pods, services), when
+	// the pool defines purposes
+	Purpose       string
+	Cluster       string
+	ClusterTenant string
+	Datacenter    string
+	Type          string   `json:"type"`
+	CIDR          string   `json:"cidr,omitempty"`
+	Addresses     []string `json:"addresses,omitempty"`
+	// Description records why the block was allocated, for humans reading the exports
+	Description string `json:"description,omitempty"`
+	// Labels classify the allocation (e.g. env=staging), so automation can select allocations across pools and
+	// datacenters
+	Labels map[string]string `json:"labels,omitempty"`
+	// Gateway, DNSServers and MTU are copied from the network settings of the datacenter pool
+	Gateway    string   `json:"gateway,omitempty"`
+	DNSServers []string `json:"dnsServers,omitempty"`
+	MTU        uint32   `json:"mtu,omitempty"`
 }
 
 type IPAMPool struct {
-	Name        string
+	Name string
+	// Owner is the team or person responsible for the pool, e.g. to route the approval of destructive operations
+	Owner string `json:"owner,omitempty"`
+	// Tenant namespaces the pool, so pools with the same name can be managed independently by different tenants
+	Tenant      string                                `json:"tenant,omitempty"`
 	Datacenters map[string]IPAMPoolDatacenterSettings `json:"datacenters"`
+	// AntiAffinityPools are the (tenant qualified) names of the pools whose allocations on the same cluster must
+	// not be adjacent to, or share a /24 (/64 for IPv6) with, the allocations of this pool. It's enforced when this
+	// pool is applied.
+	AntiAffinityPools []string `json:"antiAffinityPools,omitempty"`
+	// Purposes defines several named allocations per cluster (e.g. pods, services, nodes), each with its own
+	// settings per datacenter, allocated by a single apply of the pool
+	Purposes map[string]map[string]IPAMPoolDatacenterSettings `json:"purposes,omitempty"`
+	// DatacenterTemplate holds settings whose string fields are templates (e.g. poolCidr: "10.{{ .dcIndex }}.0.0/16"),
+	// expanded into the settings of every datacenter of an inventory by expandIPAMPoolTemplates. Apply ignores it
+	DatacenterTemplate *IPAMPoolDatacenterSettings `json:"datacenterTemplate,omitempty"`
+	// UniqueAcrossDatacenters prevents a block from being allocated in more than one datacenter, while pools
+	// otherwise reuse the same space in every datacenter
+	UniqueAcrossDatacenters bool `json:"uniqueAcrossDatacenters,omitempty"`
+	// Constraints are expressions the settings of the pool must satisfy for every cluster it allocates, e.g.
+	// "cluster.labels['tier'] == 'edge' implies allocationRange <= 16", see placementConstraint
+	Constraints []string `json:"constraints,omitempty"`
+
+	// purpose is set on the pools a pool with purposes is split into, see purposePools
+	purpose string
+}
+
+// qualifiedName identifies the pool (and purpose) across tenants.
+func (ipamPool IPAMPool) qualifiedName() string {
+	return qualifiedIPAMPoolName(ipamPool.Tenant, withPurpose(ipamPool.Name, ipamPool.purpose))
+}
+
+// qualifiedIPAMPoolName identifies the allocation pool (and purpose) across tenants.
+func (a IPAMAllocation) qualifiedIPAMPoolName() string {
+	return qualifiedIPAMPoolName(a.IPAMPoolTenant, withPurpose(a.IPAMPoolName, a.Purpose))
+}
+
+func (a IPAMAllocation) isFromPool(ipamPool IPAMPool) bool {
+	return a.IPAMPoolName == ipamPool.Name && a.IPAMPoolTenant == ipamPool.Tenant && a.Purpose == ipamPool.purpose
+}
+
+func qualifiedIPAMPoolName(tenant, name string) string {
+	if tenant == "" {
+		return name
+	}
+	return tenant + "/" + name
 }
 
 type Cluster struct {
-	Name            string
+	Name string
+	// Tenant namespaces the cluster, so clusters of different tenants can have the same name in a datacenter
+	Tenant string
+	// Priority orders the clusters being allocated: when free space is limited, higher priority clusters are
+	// served first
+	Priority int32
+	// Labels classify the cluster (e.g. tier=edge), e.g. for the placement constraints of the pools
+	Labels          map[string]string `json:"labels,omitempty"`
 	IPAMAllocations []IPAMAllocation
 }
 
-type ipam struct {
+// Datacenter describes where the clusters of a datacenter run. Datacenters are identified by their name in the
+// allocations and pools, the model only adds metadata.
+type Datacenter struct {
+	Name        string `json:"name"`
+	Location    string `json:"location,omitempty"`
+	Provider    string `json:"provider,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// ClusterRef identifies a cluster in a datacenter.
+type ClusterRef struct {
+	Datacenter string
+	Tenant     string
+	Name       string
+}
+
+func (c Cluster) ref(dc string) ClusterRef {
+	return ClusterRef{Datacenter: dc, Tenant: c.Tenant, Name: c.Name}
+}
+
+// clusterRef identifies the cluster of the allocation.
+func (a IPAMAllocation) clusterRef() ClusterRef {
+	return ClusterRef{Datacenter: a.Datacenter, Tenant: a.ClusterTenant, Name: a.Cluster}
+}
+
+// qualifiedName identifies the cluster across tenants in its datacenter.
+func (c ClusterRef) qualifiedName() string {
+	return qualifiedIPAMPoolName(c.Tenant, c.Name)
+}
+
+// clusterRefOf returns the cluster of a datacenter given by its qualified name, e.g. "team-a/c1" for clusters of a
+// tenant.
+func clusterRefOf(dc, qualifiedName string) ClusterRef {
+	if tenant, name, isQualified := strings.Cut(qualifiedName, "/"); isQualified {
+		return ClusterRef{Datacenter: dc, Tenant: tenant, Name: name}
+	}
+	return ClusterRef{Datacenter: dc, Name: qualifiedName}
+}
+
+// IPAM allocates the pools to the clusters of each datacenter. It keeps its state in maps, so copies of it share the
+// same state.
+type IPAM struct {
 	datacenterAllocations map[string][]Cluster
+	// datacenters holds the metadata of the datacenters, which is optional
+	datacenters map[string]Datacenter
+	// datacenterReservations holds CIDRs used outside of this IPAM (e.g. cloud provider subnets) per datacenter and
+	// source, which are never handed out to clusters
+	datacenterReservations map[string]map[string][]string
+	// allocationHooks are called for every new allocation made by apply
+	allocationHooks []AllocationHook
+	// approvalHooks are called before destructive operations, which they can reject
+	approvalHooks []ApprovalHook
+	// eventRecorders record the outcomes of the allocations on the clusters and pools
+	eventRecorders []EventRecorder
+	// eventSinks are sent the allocated and released events
+	eventSinks []EventSink
+	// allocationIDPolicy identifies the new allocations made by apply, leaving them without ID when nil
+	allocationIDPolicy AllocationIDPolicy
+	// tenantQuotas caps the number of addresses each tenant may have allocated across all its pools
+	tenantQuotas map[string]*big.Int
+	// queuePendingAllocations makes apply record the clusters that cannot be served because the pool is exhausted
+	// as pending allocations, instead of failing
+	queuePendingAllocations bool
+	pendingAllocations      map[pendingAllocationKey]pendingAllocation
+	// pendingIPAMPools are the latest applied settings of the pools with pending allocations, by qualified name
+	pendingIPAMPools map[string]IPAMPool
+	// maxNewAllocationsPerApply makes apply and AllocateBatch reject pools that would make more new allocations at
+	// once (e.g. because a typo selects thousands of clusters), unless they are forced. Zero means no limit
+	maxNewAllocationsPerApply int
+	// applyLimits bounds the resources used to allocate a pool
+	applyLimits ApplyLimits
+	// utilizationWarningPercent is the utilization of a datacenter pool above which ApplyWithDiagnostics reports it,
+	// defaultUtilizationWarningPercent when zero
+	utilizationWarningPercent float64
+	addressHistory            *addressHistory
+	// holds are blocks kept aside for clusters about to be created, by hold token
+	holds map[string]allocationHold
+	// uniqueIPAMPools are the qualified names of the pools (and purposes) applied as unique across datacenters
+	uniqueIPAMPools map[string]struct{}
+	// tombstones are the released allocations which can still be restored, by ID
+	tombstones map[string]Tombstone
+	// tombstoneRetention is how long released allocations can be restored, defaultTombstoneRetention when zero
+	tombstoneRetention time.Duration
+	clock              Clock
+}
+
+// AllocationHook is called after a new allocation is added to a cluster. An error aborts the apply, but the
+// allocations already made are kept.
+type AllocationHook func(IPAMAllocation) error
+
+// Option configures an IPAM created by New.
+type Option func(*IPAM)
+
+// WithClock makes the IPAM read the current time from the clock instead of the system clock.
+func WithClock(clock Clock) Option {
+	return func(p *IPAM) {
+		p.clock = clock
+	}
+}
+
+// WithMaxNewAllocations makes Apply and AllocateBatch refuse to make more than maxNewAllocations at once, e.g.
+// because a typo selects thousands of clusters, while ForceApply and ForceAllocateBatch make them anyway. Zero means
+// no limit.
+func WithMaxNewAllocations(maxNewAllocations int) Option {
+	return func(p *IPAM) {
+		p.maxNewAllocationsPerApply = maxNewAllocations
+	}
+}
+
+// New returns an IPAM with the given clusters (and their current allocations) per datacenter, configured by the
+// options.
+func New(dcAllocations map[string][]Cluster, options ...Option) IPAM {
+	p := IPAM{
+		datacenterAllocations:  dcAllocations,
+		datacenters:            map[string]Datacenter{},
+		datacenterReservations: map[string]map[string][]string{},
+		tenantQuotas:           map[string]*big.Int{},
+		pendingAllocations:     map[pendingAllocationKey]pendingAllocation{},
+		pendingIPAMPools:       map[string]IPAMPool{},
+		addressHistory:         newAddressHistory(),
+		holds:                  map[string]allocationHold{},
+		uniqueIPAMPools:        map[string]struct{}{},
+		tombstones:             map[string]Tombstone{},
+		clock:                  systemClock{},
+	}
+	for _, option := range options {
+		option(&p)
+	}
+	return p
+}
+
+// Apply allocates the IPAM pool to the clusters it selects which don't have an allocation of it yet.
+func (p IPAM) Apply(ipamPool IPAMPool) error {
+	return p.applyPool(ipamPool, false)
+}
+
+// ForceApply applies the IPAM pool even if it makes more new allocations than allowed by WithMaxNewAllocations.
+func (p IPAM) ForceApply(ipamPool IPAMPool) error {
+	return p.applyPool(ipamPool, true)
+}
+
+func (p IPAM) applyPool(ipamPool IPAMPool, force bool) error {
+	if p.maxNewAllocationsPerApply > 0 && !force {
+		newClustersAllocations, err := p.plan(ipamPool)
+		if err != nil {
+			return err
+		}
+		err = p.checkMaxNewAllocations(ipamPool, newClustersAllocations)
+		if err != nil {
+			return err
+		}
+	}
+
+	purposePools, err := ipamPool.purposePools()
+	if err != nil {
+		return err
+	}
+	defer p.trackPendingIPAMPool(ipamPool)
+	for _, purposePool := range purposePools {
+		err := p.applyPurposePool(purposePool)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func newIPAM(dcAllocations map[string][]Cluster) ipam {
-	return ipam{
-		datacenterAllocations: dcAllocations,
+// checkMaxNewAllocations returns errTooManyNewAllocations when the new allocations of the pool exceed
+// maxNewAllocationsPerApply.
+func (p IPAM) checkMaxNewAllocations(ipamPool IPAMPool, newClustersAllocations []IPAMAllocation) error {
+	if p.maxNewAllocationsPerApply > 0 && len(newClustersAllocations) > p.maxNewAllocationsPerApply {
+		return fmt.Errorf("%w: pool %s would make %d new allocations, the limit is %d", errTooManyNewAllocations, ipamPool.qualifiedName(), len(newClustersAllocations), p.maxNewAllocationsPerApply)
 	}
+	return nil
 }
 
-func (p ipam) apply(ipamPool IPAMPool) error {
+// applyPurposePool applies a pool without purposes, or one of the pools a pool with purposes is split into.
+func (p IPAM) applyPurposePool(ipamPool IPAMPool) error {
+	ipamPool, err := ipamPool.withResolvedAllocationSizes()
+	if err != nil {
+		return err
+	}
+	p.trackUniqueIPAMPool(ipamPool)
+
 	dcIPAMPoolUsageMap, err := p.compileCurrentAllocationsForPool(ipamPool)
+	if err != nil {
+		p.recordApplyFailureEvents(ipamPool, err)
+		return err
+	}
+
+	newClustersAllocations, exhaustedClusters, err := p.generateNewAllocationsForPool(ipamPool, dcIPAMPoolUsageMap)
+	if err != nil {
+		p.recordApplyFailureEvents(ipamPool, err)
+		return err
+	}
+
+	err = p.commitAllocations(ipamPool, newClustersAllocations)
+	if err != nil {
+		return err
+	}
+
+	p.queuePending(ipamPool, exhaustedClusters)
+	p.recordPendingEvents(ipamPool, exhaustedClusters)
+	return nil
+}
+
+// commitAllocations checks the new allocations of a pool (see checkNewAllocations) and adds them.
+func (p IPAM) commitAllocations(ipamPool IPAMPool, newClustersAllocations []IPAMAllocation) error {
+	err := p.checkNewAllocations(ipamPool, newClustersAllocations)
+	if err != nil {
+		return err
+	}
+	return p.addNewAllocations(newClustersAllocations)
+}
+
+// checkNewAllocations checks the new allocations of a pool against its placement constraints and the tenant quota,
+// and identifies them. Nothing else changes, so a failed check leaves the IPAM as it was.
+func (p IPAM) checkNewAllocations(ipamPool IPAMPool, newClustersAllocations []IPAMAllocation) error {
+	err := p.checkPlacementConstraints(ipamPool, newClustersAllocations)
 	if err != nil {
 		return err
 	}
 
-	newClustersAllocations, err := p.generateNewAllocationsForPool(ipamPool, dcIPAMPoolUsageMap)
+	err = p.checkTenantQuota(ipamPool.Tenant, newClustersAllocations)
 	if err != nil {
 		return err
 	}
 
-	// add the new clusters allocations
+	return p.assignAllocationIDs(newClustersAllocations)
+}
+
+// addNewAllocations adds checked new allocations to their clusters, sends their allocated events and calls the
+// allocation hooks.
+func (p IPAM) addNewAllocations(newClustersAllocations []IPAMAllocation) error {
 	for _, newClusterAllocation := range newClustersAllocations {
-		dcClusters := p.datacenterAllocations[newClusterAllocation.Datacenter]
-		for i, dcCluster := range dcClusters {
-			if dcCluster.Name == newClusterAllocation.Cluster {
-				p.datacenterAllocations[newClusterAllocation.Datacenter][i].IPAMAllocations = append(p.datacenterAllocations[newClusterAllocation.Datacenter][i].IPAMAllocations, newClusterAllocation)
-				break
+		p.addAllocation(newClusterAllocation)
+		p.addressHistory.recordAllocation(newClusterAllocation, p.clock.Now())
+		p.recordAllocationEvent(newClusterAllocation)
+		delete(p.pendingAllocations, pendingAllocationKeyOf(newClusterAllocation))
+		if err := p.sendEvents(AllocationEventAllocated, []IPAMAllocation{newClusterAllocation}); err != nil {
+			return err
+		}
+		for _, hook := range p.allocationHooks {
+			if err := hook(newClusterAllocation); err != nil {
+				return err
 			}
 		}
 	}
@@ -61,7 +371,100 @@ func (p ipam) apply(ipamPool IPAMPool) error {
 	return nil
 }
 
-func (p ipam) compileCurrentAllocationsForPool(ipamPool IPAMPool) (datacenterIPAMPoolUsageMap, error) {
+// plan returns the new allocations that applying the IPAM pool would make, without applying them.
+func (p IPAM) plan(ipamPool IPAMPool) ([]IPAMAllocation, error) {
+	purposePools, err := ipamPool.purposePools()
+	if err != nil {
+		return nil, err
+	}
+
+	newClustersAllocations := []IPAMAllocation{}
+	for _, purposePool := range purposePools {
+		purposePool, err := purposePool.withResolvedAllocationSizes()
+		if err != nil {
+			return nil, err
+		}
+
+		dcIPAMPoolUsageMap, err := p.compileCurrentAllocationsForPool(purposePool)
+		if err != nil {
+			return nil, err
+		}
+
+		newPurposeAllocations, _, err := p.generateNewAllocationsForPool(purposePool, dcIPAMPoolUsageMap)
+		if err != nil {
+			return nil, err
+		}
+		newClustersAllocations = append(newClustersAllocations, newPurposeAllocations...)
+	}
+	return newClustersAllocations, nil
+}
+
+// PeekNext returns the allocation of the pool the next cluster created in the datacenter would get from the
+// current free space, without reserving it. The returned allocation has no cluster. Pools with purposes are refused,
+// see IPAMPool.ForPurpose.
+func (p IPAM) PeekNext(dc string, ipamPool IPAMPool) (IPAMAllocation, error) {
+	if err := ipamPool.checkSinglePurpose(); err != nil {
+		return IPAMAllocation{}, err
+	}
+	ipamPool, err := ipamPool.withResolvedAllocationSizes()
+	if err != nil {
+		return IPAMAllocation{}, err
+	}
+	if _, isDCConfigured := ipamPool.Datacenters[dc]; !isDCConfigured {
+		return IPAMAllocation{}, fmt.Errorf("pool %s is not configured for datacenter %s", ipamPool.qualifiedName(), dc)
+	}
+
+	dcIPAMPoolUsageMap, err := p.compileCurrentAllocationsForPool(ipamPool)
+	if err != nil {
+		return IPAMAllocation{}, err
+	}
+	nextAllocation, err := p.generateNewAllocationForCluster(ipamPool, dc, Cluster{}, dcIPAMPoolUsageMap)
+	if err != nil {
+		return IPAMAllocation{}, err
+	}
+	return *nextAllocation, nil
+}
+
+// WithAllocationHook makes the IPAM call the hook for every new allocation, e.g. to create the matching cloud provider
+// subnet.
+func WithAllocationHook(hook AllocationHook) Option {
+	return func(p *IPAM) {
+		p.allocationHooks = append(p.allocationHooks, hook)
+	}
+}
+
+// addAllocation adds the allocation to its cluster, creating the cluster if it doesn't exist yet.
+func (p IPAM) addAllocation(allocation IPAMAllocation) {
+	dcClusters := p.datacenterAllocations[allocation.Datacenter]
+	for i, dcCluster := range dcClusters {
+		if dcCluster.ref(allocation.Datacenter) == allocation.clusterRef() {
+			dcClusters[i].IPAMAllocations = append(dcClusters[i].IPAMAllocations, allocation)
+			return
+		}
+	}
+	p.datacenterAllocations[allocation.Datacenter] = append(dcClusters, Cluster{
+		Name:            allocation.Cluster,
+		Tenant:          allocation.ClusterTenant,
+		IPAMAllocations: []IPAMAllocation{allocation},
+	})
+}
+
+// hasAllocation tells whether the cluster has an allocation of the pool, given its qualified name.
+func (p IPAM) hasAllocation(cluster ClusterRef, qualifiedIPAMPoolName string) bool {
+	for _, dcCluster := range p.datacenterAllocations[cluster.Datacenter] {
+		if dcCluster.ref(cluster.Datacenter) != cluster {
+			continue
+		}
+		for _, clusterAllocation := range dcCluster.IPAMAllocations {
+			if clusterAllocation.qualifiedIPAMPoolName() == qualifiedIPAMPoolName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p IPAM) compileCurrentAllocationsForPool(ipamPool IPAMPool) (datacenterIPAMPoolUsageMap, error) {
 	dcIPAMPoolUsageMap := newDatacenterIPAMPoolUsageMap()
 
 	// Iterate current IPAM allocations to build a map of used IPs (for range allocation type)
@@ -70,7 +473,7 @@ func (p ipam) compileCurrentAllocationsForPool(ipamPool IPAMPool) (datacenterIPA
 		for _, dcCluster := range dcClusters {
 			for _, ipamAllocation := range dcCluster.IPAMAllocations {
 				dcIPAMPoolCfg, isDCConfigured := ipamPool.Datacenters[ipamAllocation.Datacenter]
-				if !isDCConfigured || ipamAllocation.IPAMPoolName != ipamPool.Name {
+				if !isDCConfigured || !ipamAllocation.isFromPool(ipamPool) {
 					// IPAM Pool + Datacenter is not configured in the IPAM pool spec, so we can skip it
 					continue
 				}
@@ -89,6 +492,10 @@ func (p ipam) compileCurrentAllocationsForPool(ipamPool IPAMPool) (datacenterIPA
 					for _, ip := range currentAllocatedIPs {
 						dcIPAMPoolUsageMap.setUsed(ipamAllocation.Datacenter, ip)
 					}
+					err = p.checkUsageLimit(ipamPool, ipamAllocation.Datacenter, dcIPAMPoolUsageMap)
+					if err != nil {
+						return nil, err
+					}
 				case "prefix":
 					// check if the current allocation is compatible with the IPAMPool being applied
 					err := checkPrefixAllocation(string(ipamAllocation.CIDR), string(dcIPAMPoolCfg.PoolCIDR), int(dcIPAMPoolCfg.AllocationPrefix))
@@ -101,57 +508,208 @@ func (p ipam) compileCurrentAllocationsForPool(ipamPool IPAMPool) (datacenterIPA
 		}
 	}
 
+	// Mark the space allocated by the pool in the other datacenters as used, when it must be unique across them
+	if ipamPool.UniqueAcrossDatacenters {
+		poolAllocations := []IPAMAllocation{}
+		for dc, dcClusters := range p.datacenterAllocations {
+			for _, dcCluster := range dcClusters {
+				for _, ipamAllocation := range dcCluster.IPAMAllocations {
+					if ipamAllocation.isFromPool(ipamPool) {
+						ipamAllocation.Datacenter = dc
+						poolAllocations = append(poolAllocations, ipamAllocation)
+					}
+				}
+			}
+		}
+		err := markAllocationsInOtherDatacentersAsUsed(ipamPool, poolAllocations, dcIPAMPoolUsageMap)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Mark the leading addresses skipped by each datacenter pool as used
+	for dc, dcIPAMPoolCfg := range ipamPool.Datacenters {
+		if dcIPAMPoolCfg.FirstAddressOffset == 0 {
+			continue
+		}
+		err := markOffsetAsUsed(dc, dcIPAMPoolCfg, dcIPAMPoolUsageMap)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Mark the blocks held for clusters about to be created as used
+	err := p.markHoldsAsUsed(ipamPool, dcIPAMPoolUsageMap)
+	if err != nil {
+		return nil, err
+	}
+
+	// Mark the external reservations of each datacenter pool as used
+	for dc := range p.datacenterReservations {
+		if _, isDCConfigured := ipamPool.Datacenters[dc]; !isDCConfigured {
+			continue
+		}
+		err := markReservationsAsUsed(dc, p.reservations(dc), dcIPAMPoolUsageMap)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, dc := range sortedKeys(dcIPAMPoolUsageMap) {
+		err := p.checkUsageLimit(ipamPool, dc, dcIPAMPoolUsageMap)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return dcIPAMPoolUsageMap, nil
 }
 
-func (p ipam) generateNewAllocationsForPool(ipamPool IPAMPool, dcIPAMPoolUsageMap datacenterIPAMPoolUsageMap) ([]IPAMAllocation, error) {
+// generateNewAllocationsForPool returns the new allocations of the pool for the clusters that don't have one yet.
+// When pending allocations are queued, the clusters that cannot be served because the pool is exhausted are
+// returned instead of failing.
+func (p IPAM) generateNewAllocationsForPool(ipamPool IPAMPool, dcIPAMPoolUsageMap datacenterIPAMPoolUsageMap) ([]IPAMAllocation, []ClusterRef, error) {
+	dcs := []string{}
+	for _, dc := range sortedKeys(p.datacenterAllocations) {
+		if _, isDCConfigured := ipamPool.Datacenters[dc]; isDCConfigured {
+			dcs = append(dcs, dc)
+		}
+	}
+	if p.applyLimits.DatacenterWorkers > 1 && !ipamPool.UniqueAcrossDatacenters {
+		return p.generateNewAllocationsConcurrently(ipamPool, dcs, dcIPAMPoolUsageMap)
+	}
+
 	newClustersAllocations := []IPAMAllocation{}
+	exhaustedClusters := []ClusterRef{}
+	for _, dc := range dcs {
+		dcNewClustersAllocations, dcExhaustedClusters, err := p.generateNewAllocationsForDatacenter(ipamPool, dc, dcIPAMPoolUsageMap)
+		if err != nil {
+			return nil, nil, err
+		}
+		newClustersAllocations = append(newClustersAllocations, dcNewClustersAllocations...)
+		exhaustedClusters = append(exhaustedClusters, dcExhaustedClusters...)
+	}
+	return newClustersAllocations, exhaustedClusters, nil
+}
 
-	for dc, dcClusters := range p.datacenterAllocations {
-		for _, cluster := range dcClusters {
-			dcIPAMPoolCfg, isDCConfigured := ipamPool.Datacenters[dc]
-			if !isDCConfigured {
-				// Cluster datacenter is not configured in the IPAM pool spec, so nothing to do for it
-				continue
+// generateNewAllocationsForDatacenter returns the new allocations of the pool for the clusters of a datacenter, like
+// generateNewAllocationsForPool.
+func (p IPAM) generateNewAllocationsForDatacenter(ipamPool IPAMPool, dc string, dcIPAMPoolUsageMap datacenterIPAMPoolUsageMap) ([]IPAMAllocation, []ClusterRef, error) {
+	newClustersAllocations := []IPAMAllocation{}
+	exhaustedClusters := []ClusterRef{}
+	for _, cluster := range p.clustersInAllocationOrder(ipamPool, dc) {
+		newClustersAllocation, err := p.generateNewAllocationForCluster(ipamPool, dc, cluster, dcIPAMPoolUsageMap)
+		if isExhaustionError(err) && p.queuePendingAllocations {
+			exhaustedClusters = append(exhaustedClusters, cluster.ref(dc))
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if newClustersAllocation == nil {
+			continue
+		}
+		newClustersAllocations = append(newClustersAllocations, *newClustersAllocation)
+		err = p.checkUsageLimit(ipamPool, dc, dcIPAMPoolUsageMap)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ipamPool.UniqueAcrossDatacenters {
+			err := markAllocationsInOtherDatacentersAsUsed(ipamPool, []IPAMAllocation{*newClustersAllocation}, dcIPAMPoolUsageMap)
+			if err != nil {
+				return nil, nil, err
 			}
+		}
+	}
+	return newClustersAllocations, exhaustedClusters, nil
+}
 
-			isClusterAlreadyAllocatedForPool := false
-			for _, clusterAllocation := range cluster.IPAMAllocations {
-				if clusterAllocation.IPAMPoolName == ipamPool.Name {
-					isClusterAlreadyAllocatedForPool = true
-					break
-				}
-			}
-			if isClusterAlreadyAllocatedForPool {
-				// skip because pool is already allocated for cluster
-				continue
-			}
+// generateNewAllocationForCluster returns the new allocation of the pool for the cluster, or nil when the cluster
+// doesn't need one.
+func (p IPAM) generateNewAllocationForCluster(ipamPool IPAMPool, dc string, cluster Cluster, dcIPAMPoolUsageMap datacenterIPAMPoolUsageMap) (*IPAMAllocation, error) {
+	dcIPAMPoolCfg, isDCConfigured := ipamPool.Datacenters[dc]
+	if !isDCConfigured {
+		// Cluster datacenter is not configured in the IPAM pool spec, so nothing to do for it
+		return nil, nil
+	}
 
-			newClustersAllocation := IPAMAllocation{
-				IPAMPoolName: ipamPool.Name,
-				Cluster:      cluster.Name,
-				Datacenter:   dc,
-				Type:         dcIPAMPoolCfg.Type,
-			}
+	for _, clusterAllocation := range cluster.IPAMAllocations {
+		if clusterAllocation.isFromPool(ipamPool) {
+			// skip because pool is already allocated for cluster
+			return nil, nil
+		}
+	}
 
-			switch dcIPAMPoolCfg.Type {
-			case "range":
-				addresses, err := findFirstFreeRangesOfPool(dc, string(dcIPAMPoolCfg.PoolCIDR), int(dcIPAMPoolCfg.AllocationRange), dcIPAMPoolUsageMap)
-				if err != nil {
-					return nil, err
-				}
-				newClustersAllocation.Addresses = addresses
-			case "prefix":
-				subnetCIDR, err := findFirstFreeSubnetOfPool(dc, string(dcIPAMPoolCfg.PoolCIDR), int(dcIPAMPoolCfg.AllocationPrefix), dcIPAMPoolUsageMap)
-				if err != nil {
-					return nil, err
-				}
-				newClustersAllocation.CIDR = subnetCIDR
-			}
+	newClustersAllocation := IPAMAllocation{
+		IPAMPoolName:   ipamPool.Name,
+		IPAMPoolTenant: ipamPool.Tenant,
+		Purpose:        ipamPool.purpose,
+		Cluster:        cluster.Name,
+		ClusterTenant:  cluster.Tenant,
+		Datacenter:     dc,
+		Type:           dcIPAMPoolCfg.Type,
+		Gateway:        dcIPAMPoolCfg.Gateway,
+		DNSServers:     dcIPAMPoolCfg.DNSServers,
+		MTU:            dcIPAMPoolCfg.MTU,
+	}
 
-			newClustersAllocations = append(newClustersAllocations, newClustersAllocation)
+	// Search the free space in a copy of the usage excluding the space conflicting with the anti-affine
+	// allocations of the cluster, if any
+	searchUsageMap := dcIPAMPoolUsageMap
+	clusterAntiAffineBlocks := antiAffineBlocks(ipamPool, cluster)
+	if len(clusterAntiAffineBlocks) > 0 {
+		var err error
+		searchUsageMap, err = antiAffinityUsageMap(dc, clusterAntiAffineBlocks, dcIPAMPoolUsageMap)
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	return newClustersAllocations, nil
+	switch dcIPAMPoolCfg.Type {
+	case "range":
+		findFreeRangesOfPool := findFirstFreeRangesOfPool
+		switch dcIPAMPoolCfg.AllocateFrom {
+		case "", allocateFromLow:
+		case allocateFromHigh:
+			findFreeRangesOfPool = findLastFreeRangesOfPool
+		default:
+			return nil, fmt.Errorf("unsupported allocateFrom %q", dcIPAMPoolCfg.AllocateFrom)
+		}
+		addresses, err := findFreeRangesOfPool(dc, string(dcIPAMPoolCfg.PoolCIDR), int(dcIPAMPoolCfg.AllocationRange), searchUsageMap)
+		if err == errNotEnoughFreeIPs {
+			return nil, newExhaustionError(ipamPool, cluster.ref(dc), dcIPAMPoolCfg, searchUsageMap, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		newClustersAllocation.Addresses = addresses
+	case "prefix":
+		subnetCIDR, err := findFirstFreeSubnetOfPool(dc, string(dcIPAMPoolCfg.PoolCIDR), int(dcIPAMPoolCfg.AllocationPrefix), searchUsageMap)
+		if err == errNoFreeSubnet {
+			return nil, newExhaustionError(ipamPool, cluster.ref(dc), dcIPAMPoolCfg, searchUsageMap, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		newClustersAllocation.CIDR = subnetCIDR
+	}
+
+	if len(clusterAntiAffineBlocks) > 0 {
+		err := markAllocationAsUsed(newClustersAllocation, dcIPAMPoolUsageMap)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &newClustersAllocation, nil
+}
+
+func (p IPAM) isPrefixAllocated(dc, cidr string) bool {
+	for _, dcCluster := range p.datacenterAllocations[dc] {
+		for _, clusterAllocation := range dcCluster.IPAMAllocations {
+			if clusterAllocation.Type == "prefix" && clusterAllocation.CIDR == cidr {
+				return true
+			}
+		}
+	}
+	return false
 }
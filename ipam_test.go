@@ -1,8 +1,15 @@
 package ipam
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"math/big"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -293,7 +300,15 @@ func TestIPAMPoolReconcile(t *testing.T) {
 					},
 				},
 			},
-			expectedError: fmt.Errorf("there is no enough free IPs available for pool"),
+			expectedError: &ExhaustionError{
+				Datacenter:       "aws-eu-1",
+				Cluster:          "c2",
+				IPAMPool:         "pool1",
+				RequiredSize:     big.NewInt(9),
+				LargestFreeBlock: big.NewInt(7),
+				FreeCount:        big.NewInt(7),
+				Err:              errNotEnoughFreeIPs,
+			},
 		},
 		{
 			name: "range: apply a pool with a name that was already applied before (same pool)",
@@ -702,7 +717,15 @@ func TestIPAMPoolReconcile(t *testing.T) {
 					},
 				},
 			},
-			expectedError: fmt.Errorf("there is no enough free IPs available for pool"),
+			expectedError: &ExhaustionError{
+				Datacenter:       "aws-eu-1",
+				Cluster:          "c3",
+				IPAMPool:         "pool1",
+				RequiredSize:     big.NewInt(8),
+				LargestFreeBlock: big.NewInt(0),
+				FreeCount:        big.NewInt(0),
+				Err:              errNotEnoughFreeIPs,
+			},
 		},
 		{
 			name: "prefix: base case",
@@ -966,7 +989,15 @@ func TestIPAMPoolReconcile(t *testing.T) {
 					},
 				},
 			},
-			expectedError: fmt.Errorf("cannot find free subnet"),
+			expectedError: &ExhaustionError{
+				Datacenter:       "aws-eu-1",
+				Cluster:          "c3",
+				IPAMPool:         "pool1",
+				RequiredSize:     big.NewInt(2),
+				LargestFreeBlock: big.NewInt(0),
+				FreeCount:        big.NewInt(0),
+				Err:              errNoFreeSubnet,
+			},
 		},
 		{
 			name: "prefix: invalid allocation prefix for pool",
@@ -1242,14 +1273,3995 @@ func TestIPAMPoolReconcile(t *testing.T) {
 			},
 			expectedError: errIncompatiblePool,
 		},
-	}
-
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			ipam := newIPAM(tc.initialDatacenterAllocations)
-			err := ipam.apply(tc.ipamPool)
-			assert.Equal(t, tc.expectedError, err)
-			assert.Equal(t, tc.expectedFinalDatacenterAllocations, ipam.datacenterAllocations)
-		})
-	}
+		{
+			name: "prefix: pool with the same name from another tenant",
+			initialDatacenterAllocations: map[string][]Cluster{
+				"aws-eu-1": {
+					{
+						Name: "c1",
+						IPAMAllocations: []IPAMAllocation{
+							{
+								IPAMPoolName: "pool1",
+								Cluster:      "c1",
+								Datacenter:   "aws-eu-1",
+								Type:         "prefix",
+								CIDR:         "192.168.0.0/28",
+							},
+						},
+					},
+				},
+			},
+			ipamPool: IPAMPool{
+				Name:   "pool1",
+				Tenant: "team-a",
+				Datacenters: map[string]IPAMPoolDatacenterSettings{
+					"aws-eu-1": {
+						Type:             "prefix",
+						PoolCIDR:         "10.0.0.0/16",
+						AllocationPrefix: 24,
+					},
+				},
+			},
+			expectedFinalDatacenterAllocations: map[string][]Cluster{
+				"aws-eu-1": {
+					{
+						Name: "c1",
+						IPAMAllocations: []IPAMAllocation{
+							{
+								IPAMPoolName: "pool1",
+								Cluster:      "c1",
+								Datacenter:   "aws-eu-1",
+								Type:         "prefix",
+								CIDR:         "192.168.0.0/28",
+							},
+							{
+								IPAMPoolName:   "pool1",
+								IPAMPoolTenant: "team-a",
+								Cluster:        "c1",
+								Datacenter:     "aws-eu-1",
+								Type:           "prefix",
+								CIDR:           "10.0.0.0/24",
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "range: allocate from the high end of the pool",
+			initialDatacenterAllocations: map[string][]Cluster{
+				"aws-eu-1": {
+					{
+						Name:            "c1",
+						IPAMAllocations: []IPAMAllocation{},
+					},
+					{
+						Name: "c2",
+						IPAMAllocations: []IPAMAllocation{
+							{
+								IPAMPoolName: "pool1",
+								Cluster:      "c2",
+								Datacenter:   "aws-eu-1",
+								Type:         "range",
+								Addresses: []string{
+									"192.168.1.14-192.168.1.15",
+								},
+							},
+						},
+					},
+				},
+			},
+			ipamPool: IPAMPool{
+				Name: "pool1",
+				Datacenters: map[string]IPAMPoolDatacenterSettings{
+					"aws-eu-1": {
+						Type:            "range",
+						PoolCIDR:        "192.168.1.0/28",
+						AllocationRange: 2,
+						AllocateFrom:    "high",
+					},
+				},
+			},
+			expectedFinalDatacenterAllocations: map[string][]Cluster{
+				"aws-eu-1": {
+					{
+						Name: "c1",
+						IPAMAllocations: []IPAMAllocation{
+							{
+								IPAMPoolName: "pool1",
+								Cluster:      "c1",
+								Datacenter:   "aws-eu-1",
+								Type:         "range",
+								Addresses: []string{
+									"192.168.1.12-192.168.1.13",
+								},
+							},
+						},
+					},
+					{
+						Name: "c2",
+						IPAMAllocations: []IPAMAllocation{
+							{
+								IPAMPoolName: "pool1",
+								Cluster:      "c2",
+								Datacenter:   "aws-eu-1",
+								Type:         "range",
+								Addresses: []string{
+									"192.168.1.14-192.168.1.15",
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "range and prefix: leading addresses of the pool are skipped",
+			initialDatacenterAllocations: map[string][]Cluster{
+				"aws-eu-1": {
+					{
+						Name:            "c1",
+						IPAMAllocations: []IPAMAllocation{},
+					},
+				},
+				"azure-as-2": {
+					{
+						Name:            "c2",
+						IPAMAllocations: []IPAMAllocation{},
+					},
+				},
+			},
+			ipamPool: IPAMPool{
+				Name: "pool1",
+				Datacenters: map[string]IPAMPoolDatacenterSettings{
+					"aws-eu-1": {
+						Type:               "range",
+						PoolCIDR:           "192.168.1.0/28",
+						AllocationRange:    4,
+						FirstAddressOffset: 3,
+					},
+					"azure-as-2": {
+						Type:               "prefix",
+						PoolCIDR:           "192.168.0.0/24",
+						AllocationPrefix:   28,
+						FirstAddressOffset: 17,
+					},
+				},
+			},
+			expectedFinalDatacenterAllocations: map[string][]Cluster{
+				"aws-eu-1": {
+					{
+						Name: "c1",
+						IPAMAllocations: []IPAMAllocation{
+							{
+								IPAMPoolName: "pool1",
+								Cluster:      "c1",
+								Datacenter:   "aws-eu-1",
+								Type:         "range",
+								Addresses: []string{
+									"192.168.1.3-192.168.1.6",
+								},
+							},
+						},
+					},
+				},
+				"azure-as-2": {
+					{
+						Name: "c2",
+						IPAMAllocations: []IPAMAllocation{
+							{
+								IPAMPoolName: "pool1",
+								Cluster:      "c2",
+								Datacenter:   "azure-as-2",
+								Type:         "prefix",
+								CIDR:         "192.168.0.32/28",
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "range and prefix: allocation size as a percentage of the pool",
+			initialDatacenterAllocations: map[string][]Cluster{
+				"aws-eu-1": {
+					{
+						Name:            "c1",
+						IPAMAllocations: []IPAMAllocation{},
+					},
+				},
+				"azure-as-2": {
+					{
+						Name:            "c2",
+						IPAMAllocations: []IPAMAllocation{},
+					},
+				},
+			},
+			ipamPool: IPAMPool{
+				Name: "pool1",
+				Datacenters: map[string]IPAMPoolDatacenterSettings{
+					"aws-eu-1": {
+						Type:              "range",
+						PoolCIDR:          "192.168.1.0/26",
+						AllocationPercent: 10,
+					},
+					"azure-as-2": {
+						Type:              "prefix",
+						PoolCIDR:          "192.168.0.0/24",
+						AllocationPercent: 10,
+					},
+				},
+			},
+			expectedFinalDatacenterAllocations: map[string][]Cluster{
+				"aws-eu-1": {
+					{
+						Name: "c1",
+						IPAMAllocations: []IPAMAllocation{
+							{
+								IPAMPoolName: "pool1",
+								Cluster:      "c1",
+								Datacenter:   "aws-eu-1",
+								Type:         "range",
+								Addresses: []string{
+									"192.168.1.0-192.168.1.5",
+								},
+							},
+						},
+					},
+				},
+				"azure-as-2": {
+					{
+						Name: "c2",
+						IPAMAllocations: []IPAMAllocation{
+							{
+								IPAMPoolName: "pool1",
+								Cluster:      "c2",
+								Datacenter:   "azure-as-2",
+								Type:         "prefix",
+								CIDR:         "192.168.0.0/28",
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "prefix: clusters with the same name from different tenants",
+			initialDatacenterAllocations: map[string][]Cluster{
+				"aws-eu-1": {
+					{
+						Name:   "prod",
+						Tenant: "team-a",
+						IPAMAllocations: []IPAMAllocation{
+							{
+								IPAMPoolName:  "pool1",
+								Cluster:       "prod",
+								ClusterTenant: "team-a",
+								Datacenter:    "aws-eu-1",
+								Type:          "prefix",
+								CIDR:          "192.168.0.0/28",
+							},
+						},
+					},
+					{
+						Name:            "prod",
+						Tenant:          "team-b",
+						IPAMAllocations: []IPAMAllocation{},
+					},
+				},
+			},
+			ipamPool: IPAMPool{
+				Name: "pool1",
+				Datacenters: map[string]IPAMPoolDatacenterSettings{
+					"aws-eu-1": {
+						Type:             "prefix",
+						PoolCIDR:         "192.168.0.0/27",
+						AllocationPrefix: 28,
+					},
+				},
+			},
+			expectedFinalDatacenterAllocations: map[string][]Cluster{
+				"aws-eu-1": {
+					{
+						Name:   "prod",
+						Tenant: "team-a",
+						IPAMAllocations: []IPAMAllocation{
+							{
+								IPAMPoolName:  "pool1",
+								Cluster:       "prod",
+								ClusterTenant: "team-a",
+								Datacenter:    "aws-eu-1",
+								Type:          "prefix",
+								CIDR:          "192.168.0.0/28",
+							},
+						},
+					},
+					{
+						Name:   "prod",
+						Tenant: "team-b",
+						IPAMAllocations: []IPAMAllocation{
+							{
+								IPAMPoolName:  "pool1",
+								Cluster:       "prod",
+								ClusterTenant: "team-b",
+								Datacenter:    "aws-eu-1",
+								Type:          "prefix",
+								CIDR:          "192.168.0.16/28",
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "prefix: higher priority clusters are allocated first",
+			initialDatacenterAllocations: map[string][]Cluster{
+				"aws-eu-1": {
+					{
+						Name:            "c1",
+						IPAMAllocations: []IPAMAllocation{},
+					},
+					{
+						Name:            "c2",
+						Priority:        10,
+						IPAMAllocations: []IPAMAllocation{},
+					},
+				},
+			},
+			ipamPool: IPAMPool{
+				Name: "pool1",
+				Datacenters: map[string]IPAMPoolDatacenterSettings{
+					"aws-eu-1": {
+						Type:             "prefix",
+						PoolCIDR:         "192.168.0.0/27",
+						AllocationPrefix: 28,
+					},
+				},
+			},
+			expectedFinalDatacenterAllocations: map[string][]Cluster{
+				"aws-eu-1": {
+					{
+						Name: "c1",
+						IPAMAllocations: []IPAMAllocation{
+							{
+								IPAMPoolName: "pool1",
+								Cluster:      "c1",
+								Datacenter:   "aws-eu-1",
+								Type:         "prefix",
+								CIDR:         "192.168.0.16/28",
+							},
+						},
+					},
+					{
+						Name:     "c2",
+						Priority: 10,
+						IPAMAllocations: []IPAMAllocation{
+							{
+								IPAMPoolName: "pool1",
+								Cluster:      "c2",
+								Datacenter:   "aws-eu-1",
+								Type:         "prefix",
+								CIDR:         "192.168.0.0/28",
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ipam := New(tc.initialDatacenterAllocations)
+			err := ipam.Apply(tc.ipamPool)
+			assert.Equal(t, tc.expectedError, err)
+			assert.Equal(t, tc.expectedFinalDatacenterAllocations, ipam.datacenterAllocations)
+		})
+	}
+}
+
+type fakeAWSSubnetLister map[AWSLocation][]string
+
+func (l fakeAWSSubnetLister) ListSubnetCIDRs(account, region string) ([]string, error) {
+	return l[AWSLocation{Account: account, Region: region}], nil
+}
+
+func TestIPAMPoolReconcileWithAWSSubnets(t *testing.T) {
+	initialDatacenterAllocations := map[string][]Cluster{
+		"aws-eu-1": {
+			{
+				Name: "c1",
+				IPAMAllocations: []IPAMAllocation{
+					{
+						IPAMPoolName: "pool1",
+						Cluster:      "c1",
+						Datacenter:   "aws-eu-1",
+						Type:         "prefix",
+						CIDR:         "10.0.0.0/26",
+					},
+				},
+			},
+			{
+				Name:            "c2",
+				IPAMAllocations: []IPAMAllocation{},
+			},
+		},
+	}
+	lister := fakeAWSSubnetLister{
+		// 10.0.0.0/26 is the subnet created for the allocation of c1
+		{Account: "123", Region: "eu-west-1"}: {"10.0.0.0/26", "10.0.0.32/27", "10.0.0.64/26", "192.168.1.0/30"},
+	}
+
+	ipam := New(initialDatacenterAllocations)
+	conflicts, err := ReconcileAWSSubnets(ipam, lister, map[string]AWSLocation{
+		"aws-eu-1": {Account: "123", Region: "eu-west-1"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []ReservationConflict{
+		{
+			Datacenter:  "aws-eu-1",
+			Reservation: "10.0.0.32/27",
+			Allocation:  initialDatacenterAllocations["aws-eu-1"][0].IPAMAllocations[0],
+		},
+	}, conflicts)
+	assert.Equal(t, []string{"10.0.0.32/27", "10.0.0.64/26", "192.168.1.0/30"}, ipam.reservations("aws-eu-1"))
+
+	err = ipam.Apply(IPAMPool{
+		Name: "pool2",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {
+				Type:            "range",
+				PoolCIDR:        "192.168.1.0/28",
+				AllocationRange: 2,
+			},
+		},
+	})
+	assert.Nil(t, err)
+	err = ipam.Apply(IPAMPool{
+		Name: "pool3",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {
+				Type:             "prefix",
+				PoolCIDR:         "10.0.0.0/24",
+				AllocationPrefix: 26,
+			},
+		},
+	})
+	assert.Nil(t, err)
+
+	clusters := ipam.datacenterAllocations["aws-eu-1"]
+	assert.Equal(t, []string{"192.168.1.4-192.168.1.5"}, clusters[0].IPAMAllocations[1].Addresses)
+	assert.Equal(t, []string{"192.168.1.6-192.168.1.7"}, clusters[1].IPAMAllocations[0].Addresses)
+	assert.Equal(t, "10.0.0.128/26", clusters[0].IPAMAllocations[2].CIDR)
+	assert.Equal(t, "10.0.0.192/26", clusters[1].IPAMAllocations[1].CIDR)
+
+	// a new sync replaces the subnets reserved by the previous one, keeping the other sources
+	assert.Nil(t, ipam.Reserve("aws-eu-1", "172.16.0.0/16"))
+	lister[AWSLocation{Account: "123", Region: "eu-west-1"}] = []string{"10.0.0.0/26", "10.0.0.64/26"}
+	conflicts, err = ReconcileAWSSubnets(ipam, lister, map[string]AWSLocation{
+		"aws-eu-1": {Account: "123", Region: "eu-west-1"},
+	})
+	assert.Nil(t, err)
+	assert.Empty(t, conflicts)
+	assert.Equal(t, []string{"10.0.0.64/26", "172.16.0.0/16"}, ipam.reservations("aws-eu-1"))
+}
+
+type fakeAzureVNetClient map[AzureVNet][]AzureSubnet
+
+func (c fakeAzureVNetClient) ListSubnets(vnet AzureVNet) ([]AzureSubnet, error) {
+	return c[vnet], nil
+}
+
+func (c fakeAzureVNetClient) CreateSubnet(vnet AzureVNet, subnet AzureSubnet) error {
+	c[vnet] = append(c[vnet], subnet)
+	return nil
+}
+
+func TestIPAMPoolReconcileWithAzureVNets(t *testing.T) {
+	initialDatacenterAllocations := map[string][]Cluster{
+		"azure-we-1": {
+			{
+				Name: "c1",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pool1", Cluster: "c1", Datacenter: "azure-we-1", Type: "prefix", CIDR: "10.0.0.0/26"},
+				},
+			},
+			{Name: "c2", IPAMAllocations: []IPAMAllocation{}},
+		},
+		"aws-eu-1": {
+			{Name: "c3", IPAMAllocations: []IPAMAllocation{}},
+		},
+	}
+	vnet := AzureVNet{Subscription: "s1", ResourceGroup: "rg1", Name: "vnet1"}
+	client := fakeAzureVNetClient{
+		// pool1-c1 is the subnet created for the allocation of c1
+		vnet: {
+			{Name: "pool1-c1", AddressPrefix: "10.0.0.0/26"},
+			{Name: "gateway", AddressPrefix: "10.0.0.32/27"},
+			{Name: "bastion", AddressPrefix: "10.0.0.64/26"},
+		},
+	}
+	dcVNets := map[string]AzureVNet{"azure-we-1": vnet}
+
+	ipam := New(initialDatacenterAllocations, WithAllocationHook(AzureSubnetCreationHook(client, dcVNets)))
+	conflicts, err := SyncAzureVNets(ipam, client, dcVNets)
+	assert.Nil(t, err)
+	assert.Equal(t, []ReservationConflict{
+		{
+			Datacenter:  "azure-we-1",
+			Reservation: "10.0.0.32/27",
+			Allocation:  initialDatacenterAllocations["azure-we-1"][0].IPAMAllocations[0],
+		},
+	}, conflicts)
+	assert.Equal(t, []string{"10.0.0.32/27", "10.0.0.64/26"}, ipam.reservations("azure-we-1"))
+
+	// subnets are created for the new prefix allocations of datacenters with a virtual network only
+	err = ipam.Apply(IPAMPool{
+		Name: "pool2",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"azure-we-1": {Type: "prefix", PoolCIDR: "10.0.0.0/24", AllocationPrefix: 26},
+			"aws-eu-1":   {Type: "prefix", PoolCIDR: "10.0.0.0/24", AllocationPrefix: 26},
+		},
+	})
+	assert.Nil(t, err)
+	err = ipam.Apply(IPAMPool{
+		Name: "pool3",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"azure-we-1": {Type: "range", PoolCIDR: "192.168.1.0/28", AllocationRange: 2},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []AzureSubnet{
+		{Name: "pool1-c1", AddressPrefix: "10.0.0.0/26"},
+		{Name: "gateway", AddressPrefix: "10.0.0.32/27"},
+		{Name: "bastion", AddressPrefix: "10.0.0.64/26"},
+		{Name: "pool2-c1", AddressPrefix: "10.0.0.128/26"},
+		{Name: "pool2-c2", AddressPrefix: "10.0.0.192/26"},
+	}, client[vnet])
+	assert.Len(t, client, 1)
+
+	// the created subnets match their allocations, so a new sync doesn't reserve them
+	client[vnet] = append(client[vnet][:1], client[vnet][3:]...)
+	conflicts, err = SyncAzureVNets(ipam, client, dcVNets)
+	assert.Nil(t, err)
+	assert.Empty(t, conflicts)
+	assert.Empty(t, ipam.reservations("azure-we-1"))
+}
+
+// fakeGCPSubnetworkClient holds the subnetworks by "<project>/<region>".
+type fakeGCPSubnetworkClient map[string][]GCPSubnetwork
+
+func (c fakeGCPSubnetworkClient) ListSubnetworks(project, region string) ([]GCPSubnetwork, error) {
+	return c[project+"/"+region], nil
+}
+
+func (c fakeGCPSubnetworkClient) AddSecondaryRange(project, region, subnetwork string, secondaryRange GCPSecondaryRange) error {
+	subnetworks := c[project+"/"+region]
+	for i := range subnetworks {
+		if subnetworks[i].Name == subnetwork {
+			subnetworks[i].SecondaryIPRanges = append(subnetworks[i].SecondaryIPRanges, secondaryRange)
+			return nil
+		}
+	}
+	return fmt.Errorf("subnetwork %s not found", subnetwork)
+}
+
+func TestIPAMPoolReconcileWithGCPSubnetworks(t *testing.T) {
+	initialDatacenterAllocations := map[string][]Cluster{
+		"gcp-ew-1": {
+			{
+				Name: "c1",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pods", Cluster: "c1", Datacenter: "gcp-ew-1", Type: "prefix", CIDR: "10.1.0.0/24"},
+				},
+			},
+			{Name: "c2", IPAMAllocations: []IPAMAllocation{}},
+		},
+	}
+	client := fakeGCPSubnetworkClient{
+		"p1/europe-west1": {
+			{
+				Name:        "nodes",
+				IPCIDRRange: "10.0.0.0/24",
+				SecondaryIPRanges: []GCPSecondaryRange{
+					// pods-c1 is the range created for the allocation of c1
+					{RangeName: "pods-c1", IPCIDRRange: "10.1.0.0/24"},
+					{RangeName: "legacy", IPCIDRRange: "10.1.0.0/23"},
+				},
+			},
+		},
+	}
+	dcLocations := map[string]GCPLocation{"gcp-ew-1": {Project: "p1", Region: "europe-west1", Subnetwork: "nodes"}}
+
+	ipam := New(initialDatacenterAllocations, WithAllocationHook(GCPSecondaryRangeCreationHook(client, dcLocations)))
+	conflicts, err := SyncGCPSubnetworks(ipam, client, dcLocations)
+	assert.Nil(t, err)
+	assert.Equal(t, []ReservationConflict{
+		{
+			Datacenter:  "gcp-ew-1",
+			Reservation: "10.1.0.0/23",
+			Allocation:  initialDatacenterAllocations["gcp-ew-1"][0].IPAMAllocations[0],
+		},
+	}, conflicts)
+	assert.Equal(t, []string{"10.0.0.0/24", "10.1.0.0/23"}, ipam.reservations("gcp-ew-1"))
+
+	// the new prefix allocations get a secondary range of the datacenter subnetwork
+	err = ipam.Apply(IPAMPool{
+		Name: "services",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"gcp-ew-1": {Type: "prefix", PoolCIDR: "10.0.0.0/22", AllocationPrefix: 24},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []GCPSecondaryRange{
+		{RangeName: "pods-c1", IPCIDRRange: "10.1.0.0/24"},
+		{RangeName: "legacy", IPCIDRRange: "10.1.0.0/23"},
+		{RangeName: "services-c1", IPCIDRRange: "10.0.1.0/24"},
+		{RangeName: "services-c2", IPCIDRRange: "10.0.2.0/24"},
+	}, client["p1/europe-west1"][0].SecondaryIPRanges)
+
+	// the created ranges match their allocations, so a new sync doesn't reserve them
+	client["p1/europe-west1"][0].SecondaryIPRanges = client["p1/europe-west1"][0].SecondaryIPRanges[2:]
+	conflicts, err = SyncGCPSubnetworks(ipam, client, dcLocations)
+	assert.Nil(t, err)
+	assert.Empty(t, conflicts)
+	assert.Equal(t, []string{"10.0.0.0/24"}, ipam.reservations("gcp-ew-1"))
+}
+
+type fakeNSXTClient map[string][]NSXTIPSubnet
+
+func (c fakeNSXTClient) ListIPBlockSubnets(ipBlockID string) ([]NSXTIPSubnet, error) {
+	return c[ipBlockID], nil
+}
+
+func (c fakeNSXTClient) CreateIPBlockSubnet(ipBlockID string, subnet NSXTIPSubnet) error {
+	c[ipBlockID] = append(c[ipBlockID], subnet)
+	return nil
+}
+
+func TestIPAMPoolReconcileWithNSXTIPBlocks(t *testing.T) {
+	initialDatacenterAllocations := map[string][]Cluster{
+		"vsphere-1": {
+			{
+				Name: "c1",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pool1", Cluster: "c1", Datacenter: "vsphere-1", Type: "prefix", CIDR: "10.0.0.0/26"},
+				},
+			},
+			{Name: "c2", IPAMAllocations: []IPAMAllocation{}},
+		},
+	}
+	client := fakeNSXTClient{
+		// pool1-c1 is the subnet pushed for the allocation of c1
+		"block-1": {{DisplayName: "pool1-c1", CIDR: "10.0.0.0/26"}, {DisplayName: "edge", CIDR: "10.0.0.0/28"}},
+	}
+	dcIPBlocks := map[string]string{"vsphere-1": "block-1"}
+
+	ipam := New(initialDatacenterAllocations, WithAllocationHook(NSXTSubnetPushHook(client, dcIPBlocks)))
+	conflicts, err := SyncNSXTIPBlocks(ipam, client, dcIPBlocks)
+	assert.Nil(t, err)
+	assert.Equal(t, []ReservationConflict{
+		{
+			Datacenter:  "vsphere-1",
+			Reservation: "10.0.0.0/28",
+			Allocation:  initialDatacenterAllocations["vsphere-1"][0].IPAMAllocations[0],
+		},
+	}, conflicts)
+	assert.Equal(t, []string{"10.0.0.0/28"}, ipam.reservations("vsphere-1"))
+
+	// the new prefix allocations are pushed as subnets of the IP block, range allocations are not
+	err = ipam.Apply(IPAMPool{
+		Name: "pool2",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"vsphere-1": {Type: "prefix", PoolCIDR: "10.0.0.0/24", AllocationPrefix: 26},
+		},
+	})
+	assert.Nil(t, err)
+	err = ipam.Apply(IPAMPool{
+		Name: "pool3",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"vsphere-1": {Type: "range", PoolCIDR: "192.168.1.0/28", AllocationRange: 2},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []NSXTIPSubnet{
+		{DisplayName: "pool1-c1", CIDR: "10.0.0.0/26"},
+		{DisplayName: "edge", CIDR: "10.0.0.0/28"},
+		{DisplayName: "pool2-c1", CIDR: "10.0.0.64/26"},
+		{DisplayName: "pool2-c2", CIDR: "10.0.0.128/26"},
+	}, client["block-1"])
+
+	// the pushed subnets match their allocations, so a new sync doesn't reserve them
+	client["block-1"] = append(client["block-1"][:1], client["block-1"][2:]...)
+	conflicts, err = SyncNSXTIPBlocks(ipam, client, dcIPBlocks)
+	assert.Nil(t, err)
+	assert.Empty(t, conflicts)
+	assert.Empty(t, ipam.reservations("vsphere-1"))
+}
+
+func TestExternalResourceNames(t *testing.T) {
+	allocation := IPAMAllocation{IPAMPoolTenant: "team-a", IPAMPoolName: "pool1", Purpose: "pods", ClusterTenant: "team-b", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.0/26"}
+	assert.Equal(t, "team-a-pool1:pods-team-b-c1", externalName(allocation))
+	assert.Equal(t, "team-a-pool1-pods-team-b-c1", azureSubnetName(allocation))
+	assert.Equal(t, "team-a-pool1-pods-team-b-c1", gcpSecondaryRangeName(allocation))
+	assert.Contains(t, cefMessage(AllocationEvent{Type: AllocationEventAllocated, Allocation: allocation}), "cs4Label=cluster cs4=team-b/c1 ")
+
+	// the names of other tenants' clusters don't collide
+	otherAllocation := allocation
+	otherAllocation.ClusterTenant = "team-c"
+	assert.NotEqual(t, azureSubnetName(allocation), azureSubnetName(otherAllocation))
+	assert.NotEqual(t, gcpSecondaryRangeName(allocation), gcpSecondaryRangeName(otherAllocation))
+
+	allocation.Cluster = strings.Repeat("c", 100)
+	assert.Len(t, azureSubnetName(allocation), 80)
+	assert.Len(t, gcpSecondaryRangeName(allocation), 63)
+}
+
+func TestIPAMPoolReconcileWithTenantQuota(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c2", IPAMAllocations: []IPAMAllocation{}},
+		},
+	}, WithTenantQuota("team-a", big.NewInt(24)))
+
+	err := ipam.Apply(IPAMPool{
+		Name:   "pool1",
+		Tenant: "team-a",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "range", PoolCIDR: "192.168.1.0/24", AllocationRange: 8},
+		},
+	})
+	assert.Nil(t, err)
+
+	usage, err := ipam.tenantUsage("team-a")
+	assert.Nil(t, err)
+	assert.Equal(t, big.NewInt(16), usage)
+
+	err = ipam.Apply(IPAMPool{
+		Name:   "pool2",
+		Tenant: "team-a",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/24", AllocationPrefix: 29},
+		},
+	})
+	assert.Equal(t, errTenantQuotaExceeded, err)
+	assert.Len(t, ipam.datacenterAllocations["aws-eu-1"][0].IPAMAllocations, 1)
+
+	err = ipam.Apply(IPAMPool{
+		Name:   "pool2",
+		Tenant: "team-b",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/24", AllocationPrefix: 29},
+		},
+	})
+	assert.Nil(t, err)
+
+	// live holds count against the quota, and their confirmation doesn't count them twice
+	ipamPool := IPAMPool{
+		Name:   "pool3",
+		Tenant: "team-a",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "range", PoolCIDR: "192.168.2.0/24", AllocationRange: 6},
+		},
+	}
+	token, err := ipam.Hold("aws-eu-1", ipamPool, nil, time.Hour)
+	assert.Nil(t, err)
+	usage, err = ipam.tenantUsage("team-a")
+	assert.Nil(t, err)
+	assert.Equal(t, big.NewInt(22), usage)
+	_, err = ipam.Hold("aws-eu-1", ipamPool, nil, time.Hour)
+	assert.Equal(t, errTenantQuotaExceeded, err)
+	_, err = ipam.ConfirmHold(token, ClusterRef{Datacenter: "aws-eu-1", Name: "c1"}, ipamPool)
+	assert.Nil(t, err)
+	usage, err = ipam.tenantUsage("team-a")
+	assert.Nil(t, err)
+	assert.Equal(t, big.NewInt(22), usage)
+}
+
+func TestIPAMPoolAllocateBatch(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c2", IPAMAllocations: []IPAMAllocation{}},
+		},
+	})
+	ipamPool := IPAMPool{
+		Name: "pool1",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/24", AllocationPrefix: 26},
+		},
+	}
+
+	newAllocations, err := ipam.AllocateBatch(ipamPool, []ClusterRef{
+		{Datacenter: "aws-eu-1", Name: "c2"},
+		{Datacenter: "aws-eu-1", Name: "c3"},
+		{Datacenter: "aws-eu-1", Name: "c3"},
+		{Datacenter: "azure-as-2", Name: "c4"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []IPAMAllocation{
+		{IPAMPoolName: "pool1", Cluster: "c2", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.0/26"},
+		{IPAMPoolName: "pool1", Cluster: "c3", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.64/26"},
+	}, newAllocations)
+	assert.Equal(t, map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c2", IPAMAllocations: []IPAMAllocation{newAllocations[0]}},
+			{Name: "c3", IPAMAllocations: []IPAMAllocation{newAllocations[1]}},
+		},
+	}, ipam.datacenterAllocations)
+
+	_, err = ipam.AllocateBatch(ipamPool, []ClusterRef{
+		{Datacenter: "aws-eu-1", Name: "c4"},
+		{Datacenter: "aws-eu-1", Name: "c5"},
+		{Datacenter: "aws-eu-1", Name: "c6"},
+	})
+	assert.ErrorIs(t, err, errNoFreeSubnet)
+	assert.Len(t, ipam.datacenterAllocations["aws-eu-1"], 3)
+}
+
+func TestIPAMPoolAllocateBatchUniqueAcrossDatacenters(t *testing.T) {
+	ipam := New(map[string][]Cluster{})
+	ipamPool := IPAMPool{
+		Name:                    "pool1",
+		UniqueAcrossDatacenters: true,
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"dc1": {Type: "prefix", PoolCIDR: "10.0.0.0/16", AllocationPrefix: 24},
+			"dc2": {Type: "prefix", PoolCIDR: "10.0.0.0/16", AllocationPrefix: 24},
+		},
+	}
+
+	newAllocations, err := ipam.AllocateBatch(ipamPool, []ClusterRef{
+		{Datacenter: "dc1", Name: "c1"},
+		{Datacenter: "dc2", Name: "c2"},
+	})
+	assert.Nil(t, err)
+	assert.Len(t, newAllocations, 2)
+	assert.Equal(t, "10.0.0.0/24", newAllocations[0].CIDR)
+	assert.Equal(t, "10.0.1.0/24", newAllocations[1].CIDR)
+}
+
+func TestIPAMPoolReconcileWithPendingAllocations(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c2", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c3", IPAMAllocations: []IPAMAllocation{}},
+		},
+	}, WithPendingAllocations())
+	ipamPool := IPAMPool{
+		Name: "pool1",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/25", AllocationPrefix: 26},
+		},
+	}
+
+	err := ipam.Apply(ipamPool)
+	assert.Nil(t, err)
+	pending := ipam.pending()
+	assert.Len(t, pending, 1)
+	assert.Equal(t, ClusterRef{Datacenter: "aws-eu-1", Name: "c3"}, pending[0].Cluster)
+	assert.Empty(t, ipam.datacenterAllocations["aws-eu-1"][2].IPAMAllocations)
+
+	// pending allocations and the settings to fulfill them with are persisted
+	data, err := ipam.MarshalState()
+	assert.Nil(t, err)
+	restored, _, err := LoadState(data, []IPAMPool{ipamPool}, true, WithPendingAllocations())
+	assert.Nil(t, err)
+	assert.True(t, restored.queuePendingAllocations)
+	assert.Len(t, restored.pending(), 1)
+	assert.Equal(t, pending[0].Cluster, restored.pending()[0].Cluster)
+	assert.True(t, pending[0].Since.Equal(restored.pending()[0].Since))
+	assert.Equal(t, ipamPool, restored.pendingIPAMPools["pool1"])
+
+	// the grown pool serves the pending clusters first
+	ipamPool.Datacenters["aws-eu-1"] = IPAMPoolDatacenterSettings{Type: "prefix", PoolCIDR: "10.0.0.0/24", AllocationPrefix: 26}
+	err = ipam.Apply(ipamPool)
+	assert.Nil(t, err)
+	assert.Empty(t, ipam.pending())
+	assert.Empty(t, ipam.pendingIPAMPools)
+	assert.Equal(t, "10.0.0.128/26", ipam.datacenterAllocations["aws-eu-1"][2].IPAMAllocations[0].CIDR)
+}
+
+func TestIPAMFulfillPendingAllocationsOnRelease(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c2", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c3", IPAMAllocations: []IPAMAllocation{}},
+		},
+	}, WithPendingAllocations())
+	ipamPool := IPAMPool{
+		Name: "pool1",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/25", AllocationPrefix: 26},
+		},
+	}
+
+	token, err := ipam.Hold("aws-eu-1", ipamPool, nil, time.Minute)
+	assert.Nil(t, err)
+	err = ipam.Apply(ipamPool)
+	assert.Nil(t, err)
+	assert.Len(t, ipam.pending(), 2)
+	data, err := ipam.MarshalState()
+	assert.Nil(t, err)
+	restored, err := unmarshalState(data, true)
+	assert.Nil(t, err)
+	assert.Equal(t, ipam.holds[token].Allocation, restored.holds[token].Allocation)
+
+	// the released hold serves the oldest pending cluster
+	err = ipam.ReleaseHold(token)
+	assert.Nil(t, err)
+	pending := ipam.pending()
+	assert.Len(t, pending, 1)
+	assert.Equal(t, ClusterRef{Datacenter: "aws-eu-1", Name: "c3"}, pending[0].Cluster)
+	assert.Equal(t, "10.0.0.0/26", ipam.datacenterAllocations["aws-eu-1"][1].IPAMAllocations[0].CIDR)
+
+	// releasing a pool serves the clusters waiting for the pools anti-affine with it
+	ipam = New(map[string][]Cluster{
+		"aws-eu-1": {
+			{
+				Name: "c1",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pool2", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.192/28"},
+				},
+			},
+		},
+	}, WithPendingAllocations())
+	ipamPool.AntiAffinityPools = []string{"pool2"}
+	err = ipam.Apply(ipamPool)
+	assert.Nil(t, err)
+	assert.Len(t, ipam.pending(), 1)
+
+	_, err = ipam.Release("pool2")
+	assert.Nil(t, err)
+	assert.Empty(t, ipam.pending())
+	assert.Equal(t, []IPAMAllocation{
+		{IPAMPoolName: "pool1", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.0/26"},
+	}, ipam.datacenterAllocations["aws-eu-1"][0].IPAMAllocations)
+}
+
+func TestIPAMAddressHistory(t *testing.T) {
+	allocatedAt := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	clock := newManualClock(allocatedAt)
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c2", IPAMAllocations: []IPAMAllocation{}},
+		},
+	}, WithClock(clock))
+	err := ipam.Apply(IPAMPool{
+		Name: "pool1",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "range", PoolCIDR: "192.168.1.0/28", AllocationRange: 4},
+		},
+	})
+	assert.Nil(t, err)
+
+	records, err := ipam.History("192.168.1.5")
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+	assert.Equal(t, "c2", records[0].Cluster)
+	assert.Equal(t, "192.168.1.4-192.168.1.7", records[0].Block)
+	assert.Equal(t, allocatedAt, records[0].AllocatedAt)
+	assert.True(t, records[0].ReleasedAt.IsZero())
+
+	clock.Advance(time.Hour)
+	ipam.addressHistory.recordRelease(ipam.datacenterAllocations["aws-eu-1"][1].IPAMAllocations[0], clock.Now())
+	records, err = ipam.History("192.168.1.0/29")
+	assert.Nil(t, err)
+	assert.Len(t, records, 2)
+	assert.True(t, records[0].ReleasedAt.IsZero())
+	assert.False(t, records[1].ReleasedAt.IsZero())
+
+	records, err = ipam.History("192.168.1.9")
+	assert.Nil(t, err)
+	assert.Empty(t, records)
+}
+
+func TestIPAMExportCompliance(t *testing.T) {
+	allocatedAt := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	clock := newManualClock(allocatedAt)
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+		},
+	}, WithClock(clock))
+	for i, poolName := range []string{"pool1", "pool2"} {
+		assert.Nil(t, ipam.Apply(IPAMPool{
+			Name: poolName,
+			Datacenters: map[string]IPAMPoolDatacenterSettings{
+				"aws-eu-1": {Type: "prefix", PoolCIDR: fmt.Sprintf("10.%d.0.0/24", i), AllocationPrefix: 26},
+			},
+		}))
+	}
+	assert.Nil(t, ipam.SetDatacenter(Datacenter{Name: "aws-eu-1", Location: "Frankfurt"}))
+	clock.Advance(24 * time.Hour)
+	_, err := ipam.Release("pool1")
+	assert.Nil(t, err)
+
+	key := []byte("secret")
+	now := allocatedAt.Add(10 * 24 * time.Hour)
+	data, err := ipam.ExportCompliance(ComplianceExportOptions{SigningKey: key}, now)
+	assert.Nil(t, err)
+	assert.Nil(t, VerifyComplianceExport(data, key))
+	export := complianceExport{}
+	assert.Nil(t, json.Unmarshal(data, &export))
+	releasedAt := allocatedAt.Add(24 * time.Hour)
+	assert.Equal(t, now, export.GeneratedAt)
+	assert.Equal(t, []complianceRecord{
+		{Datacenter: "aws-eu-1", Cluster: "c1", IPAMPoolName: "pool1", Block: "10.0.0.0/26", AllocatedAt: allocatedAt, ReleasedAt: &releasedAt},
+		{Datacenter: "aws-eu-1", Cluster: "c1", IPAMPoolName: "pool2", Block: "10.1.0.0/26", AllocatedAt: allocatedAt},
+	}, export.Records)
+	assert.Equal(t, map[string]Datacenter{"aws-eu-1": {Name: "aws-eu-1", Location: "Frankfurt"}}, export.Datacenters)
+
+	// the retention drops the records released long ago, and redaction hides the cluster names
+	data, err = ipam.ExportCompliance(ComplianceExportOptions{SigningKey: key, Retention: 7 * 24 * time.Hour, RedactClusters: true}, now)
+	assert.Nil(t, err)
+	assert.Nil(t, VerifyComplianceExport(data, key))
+	export = complianceExport{}
+	assert.Nil(t, json.Unmarshal(data, &export))
+	assert.Equal(t, "168h0m0s", export.Retention)
+	assert.Len(t, export.Records, 1)
+	assert.Equal(t, "pool2", export.Records[0].IPAMPoolName)
+	assert.Regexp(t, "^redacted-[0-9a-f]{16}$", export.Records[0].Cluster)
+	assert.NotContains(t, string(data), `"c1"`)
+
+	// tampered exports and other keys are detected
+	tampered := bytes.Replace(data, []byte("10.1.0.0/26"), []byte("10.1.0.64/26"), 1)
+	assert.EqualError(t, VerifyComplianceExport(tampered, key), "compliance export signature mismatch")
+	assert.EqualError(t, VerifyComplianceExport(data, []byte("other")), "compliance export signature mismatch")
+
+	_, err = ipam.ExportCompliance(ComplianceExportOptions{}, now)
+	assert.EqualError(t, err, "signing key cannot be empty")
+}
+
+func TestFederation(t *testing.T) {
+	eu := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{
+				Name: "c1",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pods", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.0/24"},
+					{IPAMPoolName: "nodes", Cluster: "c1", Datacenter: "aws-eu-1", Type: "range", Addresses: []string{"192.168.1.0-192.168.1.3"}},
+				},
+			},
+		},
+		"aws-eu-2": {
+			// overlaps within a region are left to the pools
+			{
+				Name: "c2",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pods", Cluster: "c2", Datacenter: "aws-eu-2", Type: "prefix", CIDR: "10.0.0.0/24"},
+				},
+			},
+		},
+	})
+	assert.Nil(t, eu.SetDatacenter(Datacenter{Name: "aws-eu-1", Location: "Frankfurt"}))
+	us := New(map[string][]Cluster{
+		"aws-us-1": {
+			{
+				Name: "c3",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pods", Cluster: "c3", Datacenter: "aws-us-1", Type: "prefix", CIDR: "10.0.0.128/25"},
+					{IPAMPoolName: "nodes", Cluster: "c3", Datacenter: "aws-us-1", Type: "range", Addresses: []string{"192.168.1.4-192.168.1.7"}},
+				},
+			},
+		},
+	})
+
+	federation, err := NewFederation(map[string]IPAM{"eu": eu, "us": us})
+	assert.Nil(t, err)
+	conflicts, err := federation.GlobalConflicts()
+	assert.Nil(t, err)
+	assert.Equal(t, []FederationConflict{
+		{
+			Region:          "eu",
+			Allocation:      eu.datacenterAllocations["aws-eu-1"][0].IPAMAllocations[0],
+			OtherRegion:     "us",
+			OtherAllocation: us.datacenterAllocations["aws-us-1"][0].IPAMAllocations[0],
+		},
+		{
+			Region:          "eu",
+			Allocation:      eu.datacenterAllocations["aws-eu-2"][0].IPAMAllocations[0],
+			OtherRegion:     "us",
+			OtherAllocation: us.datacenterAllocations["aws-us-1"][0].IPAMAllocations[0],
+		},
+	}, conflicts)
+
+	// the global view has the allocations and metadata of every region, and doesn't share them
+	global := federation.Aggregate()
+	assert.Len(t, global.Allocations(), 5)
+	assert.Equal(t, Datacenter{Name: "aws-eu-1", Location: "Frankfurt"}, global.datacenter("aws-eu-1"))
+	global.datacenterAllocations["aws-us-1"][0].IPAMAllocations[0].CIDR = "10.1.0.0/25"
+	assert.Equal(t, "10.0.0.128/25", us.datacenterAllocations["aws-us-1"][0].IPAMAllocations[0].CIDR)
+
+	_, err = NewFederation(map[string]IPAM{"eu": eu, "eu-copy": eu})
+	assert.EqualError(t, err, "datacenter aws-eu-1 is owned by regions eu and eu-copy")
+}
+
+func TestIPAMDetectDrift(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{
+				Name: "c1",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pool1", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "192.168.1.0/28"},
+					{IPAMPoolName: "pool3", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.0/24"},
+				},
+			},
+			{
+				Name: "c2",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pool1", Cluster: "c2", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "192.168.1.32/27"},
+					{IPAMPoolName: "pool2", Cluster: "c2", Datacenter: "aws-eu-1", Type: "range", Addresses: []string{"192.168.2.0-192.168.2.3"}},
+				},
+			},
+		},
+	})
+
+	drifts, err := ipam.DetectDrift([]IPAMPool{
+		{
+			Name: "pool1",
+			Datacenters: map[string]IPAMPoolDatacenterSettings{
+				"aws-eu-1": {Type: "prefix", PoolCIDR: "192.168.1.0/24", AllocationPrefix: 28},
+			},
+		},
+		{
+			Name: "pool2",
+			Datacenters: map[string]IPAMPoolDatacenterSettings{
+				"aws-eu-1": {Type: "range", PoolCIDR: "192.168.2.0/24", AllocationRange: 4},
+			},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Len(t, drifts, 3)
+	assert.Equal(t, DriftMissingAllocation, drifts[0].Kind)
+	assert.Equal(t, "c1", drifts[0].Cluster)
+	assert.Equal(t, "pool2", drifts[0].IPAMPool)
+	assert.Equal(t, DriftExtraAllocation, drifts[1].Kind)
+	assert.Equal(t, "pool3", drifts[1].IPAMPool)
+	assert.Equal(t, DriftSizeMismatch, drifts[2].Kind)
+	assert.Equal(t, "c2", drifts[2].Cluster)
+	assert.Equal(t, "192.168.1.32/27", drifts[2].Allocation.CIDR)
+}
+
+func TestIPAMRenameAndMergeDatacenters(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{
+				Name: "c1",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pool1", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "192.168.1.0/28"},
+				},
+			},
+		},
+		"aws-eu-2": {
+			{
+				Name: "c2",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pool1", Cluster: "c2", Datacenter: "aws-eu-2", Type: "prefix", CIDR: "192.168.1.0/28"},
+				},
+			},
+			{
+				Name: "c3",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pool1", Cluster: "c3", Datacenter: "aws-eu-2", Type: "prefix", CIDR: "192.168.1.16/28"},
+				},
+			},
+		},
+	})
+	assert.Nil(t, ipam.SetDatacenter(Datacenter{Name: "aws-eu-1", Location: "Frankfurt"}))
+
+	assert.NotNil(t, ipam.RenameDatacenter("aws-eu-1", "aws-eu-2"))
+	assert.Nil(t, ipam.RenameDatacenter("aws-eu-1", "aws-eu-central-1"))
+	assert.NotContains(t, ipam.datacenterAllocations, "aws-eu-1")
+	assert.Equal(t, "aws-eu-central-1", ipam.datacenterAllocations["aws-eu-central-1"][0].IPAMAllocations[0].Datacenter)
+	assert.Equal(t, Datacenter{Name: "aws-eu-central-1", Location: "Frankfurt"}, ipam.datacenter("aws-eu-central-1"))
+
+	// c2 overlaps c1
+	err := ipam.MergeDatacenters("aws-eu-2", "aws-eu-central-1")
+	assert.NotNil(t, err)
+	assert.Len(t, ipam.datacenterAllocations["aws-eu-2"], 2)
+
+	ipam.datacenterAllocations["aws-eu-2"] = ipam.datacenterAllocations["aws-eu-2"][1:]
+	assert.Nil(t, ipam.MergeDatacenters("aws-eu-2", "aws-eu-central-1"))
+	assert.NotContains(t, ipam.datacenterAllocations, "aws-eu-2")
+	assert.Len(t, ipam.datacenterAllocations["aws-eu-central-1"], 2)
+	assert.Equal(t, "aws-eu-central-1", ipam.datacenterAllocations["aws-eu-central-1"][1].IPAMAllocations[0].Datacenter)
+}
+
+func TestDatacenterMetadata(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {{Name: "c1", IPAMAllocations: []IPAMAllocation{}}},
+		"dc-2":     {{Name: "c2", IPAMAllocations: []IPAMAllocation{}}},
+	})
+	assert.EqualError(t, ipam.SetDatacenter(Datacenter{Location: "Frankfurt"}), "datacenter name cannot be empty")
+	assert.Nil(t, ipam.SetDatacenter(Datacenter{Name: "aws-eu-1", Location: "Frankfurt", Provider: "aws", Description: "primary"}))
+
+	// datacenters without metadata only have a name
+	assert.Equal(t, Datacenter{Name: "aws-eu-1", Location: "Frankfurt", Provider: "aws", Description: "primary"}, ipam.datacenter("aws-eu-1"))
+	assert.Equal(t, Datacenter{Name: "dc-2"}, ipam.datacenter("dc-2"))
+
+	metrics, err := RenderPrometheusMetrics(ipam, nil, MetricsOptions{})
+	assert.Nil(t, err)
+	assert.Contains(t, metrics, `# HELP ipam_datacenter_info Metadata of the datacenter.
+# TYPE ipam_datacenter_info gauge
+ipam_datacenter_info{datacenter="aws-eu-1",location="Frankfurt",provider="aws"} 1
+`)
+	assert.NotContains(t, metrics, `datacenter="dc-2"`)
+
+	config, err := RenderTerraformLocals(ipam, "ipam")
+	assert.Nil(t, err)
+	locals := map[string]map[string]json.RawMessage{}
+	assert.Nil(t, json.Unmarshal(config, &locals))
+	datacenters := map[string]Datacenter{}
+	assert.Nil(t, json.Unmarshal(locals["locals"]["ipam_datacenters"], &datacenters))
+	assert.Equal(t, map[string]Datacenter{"aws-eu-1": ipam.datacenter("aws-eu-1"), "dc-2": {Name: "dc-2"}}, datacenters)
+
+	// the metadata is persisted with the state
+	data, err := ipam.MarshalState()
+	assert.Nil(t, err)
+	restored, err := unmarshalState(data, true)
+	assert.Nil(t, err)
+	assert.Equal(t, ipam.datacenters, restored.datacenters)
+}
+
+func TestIPAMRenameCluster(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c2", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c2", Tenant: "team-a", IPAMAllocations: []IPAMAllocation{}},
+		},
+	})
+	ipamPool := IPAMPool{
+		Name: "pool1",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "prefix", PoolCIDR: "192.168.1.0/24", AllocationPrefix: 28},
+		},
+	}
+	assert.Nil(t, ipam.Apply(ipamPool))
+
+	// clusters of a tenant are given by their qualified name and keep their tenant
+	assert.Nil(t, ipam.RenameCluster("aws-eu-1", "team-a/c2", "c3"))
+	assert.Equal(t, "team-a", ipam.datacenterAllocations["aws-eu-1"][2].Tenant)
+	assert.Equal(t, "c3", ipam.datacenterAllocations["aws-eu-1"][2].IPAMAllocations[0].Cluster)
+
+	assert.NotNil(t, ipam.RenameCluster("aws-eu-1", "c1", "c2"))
+	assert.NotNil(t, ipam.RenameCluster("aws-eu-1", "c3", "c4"))
+	assert.Nil(t, ipam.RenameCluster("aws-eu-1", "c1", "c1-new"))
+
+	newAllocations, err := ipam.plan(ipamPool)
+	assert.Nil(t, err)
+	assert.Empty(t, newAllocations)
+
+	cluster := ipam.datacenterAllocations["aws-eu-1"][0]
+	assert.Equal(t, "c1-new", cluster.Name)
+	assert.Equal(t, "c1-new", cluster.IPAMAllocations[0].Cluster)
+
+	records, err := ipam.History(cluster.IPAMAllocations[0].CIDR)
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+	assert.Equal(t, "c1-new", records[0].Cluster)
+	assert.Equal(t, []string{"c1"}, records[0].ClusterAliases)
+}
+
+func TestIPAMMoveCluster(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c2", IPAMAllocations: []IPAMAllocation{}},
+		},
+		"aws-eu-2": {
+			{Name: "c3", IPAMAllocations: []IPAMAllocation{}},
+		},
+	})
+	ipamPool := IPAMPool{
+		Name: "pool1",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "prefix", PoolCIDR: "192.168.1.0/24", AllocationPrefix: 28},
+			"aws-eu-2": {Type: "range", PoolCIDR: "10.0.0.0/24", AllocationRange: 8},
+		},
+	}
+	assert.Nil(t, ipam.Apply(ipamPool))
+	oldAllocation := ipam.datacenterAllocations["aws-eu-1"][0].IPAMAllocations[0]
+
+	_, err := ipam.MoveCluster("c1", "aws-eu-1", "aws-eu-3", ipamPool)
+	assert.NotNil(t, err)
+
+	plan, err := ipam.MoveCluster("c1", "aws-eu-1", "aws-eu-2", ipamPool)
+	assert.Nil(t, err)
+	assert.Equal(t, ClusterMovePlan{
+		Cluster:        "c1",
+		FromDatacenter: "aws-eu-1",
+		ToDatacenter:   "aws-eu-2",
+		Renumberings: []Renumbering{
+			{
+				OldAllocation: oldAllocation,
+				NewAllocation: &IPAMAllocation{
+					IPAMPoolName: "pool1",
+					Cluster:      "c1",
+					Datacenter:   "aws-eu-2",
+					Type:         "range",
+					Addresses:    []string{"10.0.0.8-10.0.0.15"},
+				},
+			},
+		},
+	}, plan)
+	assert.Len(t, ipam.datacenterAllocations["aws-eu-1"], 1)
+	assert.Len(t, ipam.datacenterAllocations["aws-eu-2"], 2)
+	assert.Equal(t, *plan.Renumberings[0].NewAllocation, ipam.datacenterAllocations["aws-eu-2"][1].IPAMAllocations[0])
+
+	records, err := ipam.History(oldAllocation.CIDR)
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+	assert.False(t, records[0].ReleasedAt.IsZero())
+	tombstones := ipam.Tombstones()
+	assert.Len(t, tombstones, 1)
+	assert.Equal(t, oldAllocation, tombstones[0].Allocation)
+	assert.Equal(t, "move of cluster c1 to datacenter aws-eu-2", tombstones[0].Reason)
+
+	// a move failing any check of the new allocation leaves everything unchanged
+	before := copyDatacenterAllocations(ipam.datacenterAllocations)
+	constrainedPool := ipamPool
+	constrainedPool.Constraints = []string{"datacenter != 'aws-eu-1'"}
+	_, err = ipam.MoveCluster("c1", "aws-eu-2", "aws-eu-1", constrainedPool)
+	assert.ErrorIs(t, err, errPlacementConstraintViolated)
+	assert.Equal(t, before, ipam.datacenterAllocations)
+	WithAllocationIDPolicy(func(IPAMAllocation) (string, error) { return "", nil })(&ipam)
+	_, err = ipam.MoveCluster("c1", "aws-eu-2", "aws-eu-1", ipamPool)
+	assert.EqualError(t, err, "allocation ID policy returned an empty ID for cluster c1 of pool pool1")
+	assert.Equal(t, before, ipam.datacenterAllocations)
+	WithAllocationIDPolicy(nil)(&ipam)
+
+	// the allocations of other pools would be lost, so the move is refused
+	assert.Nil(t, ipam.Apply(IPAMPool{
+		Name:        "pool2",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{"aws-eu-2": {Type: "prefix", PoolCIDR: "10.1.0.0/24", AllocationPrefix: 26}},
+	}))
+	before = copyDatacenterAllocations(ipam.datacenterAllocations)
+	_, err = ipam.MoveCluster("c1", "aws-eu-2", "aws-eu-1", ipamPool)
+	assert.EqualError(t, err, "cluster c1 has an allocation of pool pool2, which the move would lose")
+	assert.Equal(t, before, ipam.datacenterAllocations)
+
+	// all the allocations of the cluster move together
+	pool2 := IPAMPool{
+		Name: "pool2",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "prefix", PoolCIDR: "10.2.0.0/24", AllocationPrefix: 26},
+			"aws-eu-2": {Type: "prefix", PoolCIDR: "10.1.0.0/24", AllocationPrefix: 26},
+		},
+	}
+	_, err = ipam.MoveCluster("c1", "aws-eu-2", "aws-eu-1", ipamPool, ipamPool)
+	assert.EqualError(t, err, "pool pool1 is given more than once")
+	plan, err = ipam.MoveCluster("c1", "aws-eu-2", "aws-eu-1", ipamPool, pool2)
+	assert.Nil(t, err)
+	assert.Len(t, plan.Renumberings, 2)
+	assert.Equal(t, "pool1", plan.Renumberings[0].NewAllocation.IPAMPoolName)
+	assert.Equal(t, "pool2", plan.Renumberings[1].NewAllocation.IPAMPoolName)
+	assert.Equal(t, "10.2.0.0/26", plan.Renumberings[1].NewAllocation.CIDR)
+	assert.Len(t, ipam.Tombstones(), 3)
+}
+
+func TestIPAMMoveClusterWithPurposes(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {{Name: "c1", Labels: map[string]string{"tier": "edge"}, IPAMAllocations: []IPAMAllocation{}}},
+		"aws-eu-2": {},
+	})
+	ipamPool := IPAMPool{
+		Name: "pool1",
+		Purposes: map[string]map[string]IPAMPoolDatacenterSettings{
+			"pods": {
+				"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/24", AllocationPrefix: 26},
+				"aws-eu-2": {Type: "prefix", PoolCIDR: "10.1.0.0/24", AllocationPrefix: 26},
+			},
+			"services": {
+				"aws-eu-1": {Type: "prefix", PoolCIDR: "10.2.0.0/24", AllocationPrefix: 26},
+				"aws-eu-2": {Type: "prefix", PoolCIDR: "10.3.0.0/24", AllocationPrefix: 26},
+			},
+		},
+	}
+	assert.Nil(t, ipam.Apply(ipamPool))
+
+	plan, err := ipam.MoveCluster("c1", "aws-eu-1", "aws-eu-2", ipamPool)
+	assert.Nil(t, err)
+	assert.Len(t, plan.Renumberings, 2)
+	for _, renumbering := range plan.Renumberings {
+		assert.Equal(t, renumbering.OldAllocation.Purpose, renumbering.NewAllocation.Purpose)
+	}
+	assert.Equal(t, "10.1.0.0/26", plan.Renumberings[0].NewAllocation.CIDR)
+	assert.Equal(t, "10.3.0.0/26", plan.Renumberings[1].NewAllocation.CIDR)
+	assert.Empty(t, ipam.datacenterAllocations["aws-eu-1"])
+	assert.Equal(t, map[string]string{"tier": "edge"}, ipam.datacenterAllocations["aws-eu-2"][0].Labels)
+	assert.Len(t, ipam.datacenterAllocations["aws-eu-2"][0].IPAMAllocations, 2)
+}
+
+func TestIPAMCanAllocate(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{
+				Name: "c1",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pool1", Cluster: "c1", Datacenter: "aws-eu-1", Type: "range", Addresses: []string{"192.168.1.0-192.168.1.3"}},
+				},
+			},
+			{Name: "c2", IPAMAllocations: []IPAMAllocation{}},
+		},
+		"azure-as-2": {},
+	})
+	ipamPool := IPAMPool{
+		Name: "pool1",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1":   {Type: "range", PoolCIDR: "192.168.1.0/28", AllocationRange: 4},
+			"azure-as-2": {Type: "prefix", PoolCIDR: "192.168.0.0/24", AllocationPrefix: 26},
+		},
+	}
+
+	canAllocate, detail, err := ipam.CanAllocate(ipamPool, 2)
+	assert.Nil(t, err)
+	assert.True(t, canAllocate)
+	assert.Equal(t, DatacenterCapacity{Required: 3, Available: 3}, detail.Datacenters["aws-eu-1"])
+	assert.Equal(t, DatacenterCapacity{Required: 2, Available: 4}, detail.Datacenters["azure-as-2"])
+
+	canAllocate, detail, err = ipam.CanAllocate(ipamPool, 3)
+	assert.Nil(t, err)
+	assert.False(t, canAllocate)
+	assert.Equal(t, DatacenterCapacity{Required: 4, Available: 3, Shortfall: 1}, detail.Datacenters["aws-eu-1"])
+	assert.Len(t, ipam.datacenterAllocations["aws-eu-1"][1].IPAMAllocations, 0)
+}
+
+func TestIPAMExplain(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{
+				Name: "c1",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pool1", Cluster: "c1", Datacenter: "aws-eu-1", Type: "range", Addresses: []string{"192.168.1.2-192.168.1.3"}},
+				},
+			},
+			{Name: "c2", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c3", IPAMAllocations: []IPAMAllocation{}},
+		},
+	})
+	assert.Nil(t, ipam.Reserve("aws-eu-1", "192.168.1.8/30"))
+	ipamPool := IPAMPool{
+		Name: "pool1",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "range", PoolCIDR: "192.168.1.0/28", AllocationRange: 2, FirstAddressOffset: 2},
+		},
+	}
+
+	explanation, err := ipam.Explain("aws-eu-1", "c3", ipamPool)
+	assert.Nil(t, err)
+	assert.Equal(t, AllocationExplanation{
+		Datacenter: "aws-eu-1",
+		Cluster:    "c3",
+		IPAMPool:   "pool1",
+		Strategy:   "lowest 2 free addresses",
+		Allocation: &IPAMAllocation{
+			IPAMPoolName: "pool1",
+			Cluster:      "c3",
+			Datacenter:   "aws-eu-1",
+			Type:         "range",
+			Addresses:    []string{"192.168.1.6-192.168.1.7"},
+		},
+		IsPlanned:  true,
+		FreeBlocks: []string{"192.168.1.4-192.168.1.7", "192.168.1.12-192.168.1.15"},
+		Exclusions: []AllocationExclusion{
+			{Block: "192.168.1.2-192.168.1.3", Reason: "allocated to cluster c1"},
+			{Block: "192.168.1.0-192.168.1.1", Reason: "first address offset"},
+			{Block: "192.168.1.8/30", Reason: "external reservation"},
+			{Block: "192.168.1.4-192.168.1.5", Reason: "planned for cluster c2, which is served first"},
+		},
+	}, explanation)
+
+	ipamPool.Datacenters["aws-eu-1"] = IPAMPoolDatacenterSettings{Type: "range", PoolCIDR: "192.168.1.0/30", AllocationRange: 2}
+	explanation, err = ipam.Explain("aws-eu-1", "c3", ipamPool)
+	assert.Nil(t, err)
+	assert.Nil(t, explanation.Allocation)
+	assert.Contains(t, explanation.Reason, "there is no enough free IPs available for pool")
+}
+
+func TestIPAMStateVersioning(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{
+				Name: "c1",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pool1", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "192.168.1.0/28"},
+				},
+			},
+		},
+	})
+	assert.Nil(t, ipam.Reserve("aws-eu-1", "10.0.0.0/16"))
+	WithTenantQuota("team-a", big.NewInt(1024))(&ipam)
+
+	data, err := ipam.MarshalState()
+	assert.Nil(t, err)
+	restored, err := unmarshalState(data, true)
+	assert.Nil(t, err)
+	assert.Equal(t, ipam.datacenterAllocations, restored.datacenterAllocations)
+	assert.Equal(t, ipam.datacenterReservations, restored.datacenterReservations)
+	assert.Equal(t, 0, restored.tenantQuotas["team-a"].Cmp(big.NewInt(1024)))
+
+	// the checksum survives reformatting, but not changes of the content
+	indentedData := bytes.Buffer{}
+	assert.Nil(t, json.Indent(&indentedData, data, "", "  "))
+	_, err = unmarshalState(indentedData.Bytes(), true)
+	assert.Nil(t, err)
+	_, err = unmarshalState(bytes.Replace(data, []byte("192.168.1.0/28"), []byte("192.168.2.0/28"), 1), true)
+	assert.ErrorIs(t, err, errStateChecksumMismatch)
+	assert.EqualError(t, err, "state checksum mismatch: state was modified or corrupted")
+	_, err = unmarshalState([]byte(`{"schemaVersion": 3, "datacenterAllocations": {}}`), true)
+	assert.EqualError(t, err, "state checksum mismatch: state has no checksum")
+
+	// states older than the checksum are loaded without it
+	_, err = unmarshalState([]byte(`{"schemaVersion": 2, "datacenterAllocations": {}}`), true)
+	assert.Nil(t, err)
+
+	// version 1 states have reservations without source
+	restored, err = unmarshalState([]byte(`{"schemaVersion": 1, "datacenterAllocations": {"aws-eu-1": [{"Name": "c1", "IPAMAllocations": [{"IPAMPoolName": "pool1", "Cluster": "c1", "Datacenter": "aws-eu-1", "type": "prefix", "cidr": "192.168.1.0/28"}]}]}, "datacenterReservations": {"aws-eu-1": ["10.0.0.0/16"]}}`), true)
+	assert.Nil(t, err)
+	assert.Equal(t, ipam.datacenterAllocations, restored.datacenterAllocations)
+	assert.Equal(t, ipam.datacenterReservations, restored.datacenterReservations)
+
+	_, err = unmarshalState([]byte(`{"schemaVersion": 99, "datacenterAllocations": {}}`), false)
+	assert.EqualError(t, err, "state schema version 99 is newer than the supported version 3")
+	_, err = unmarshalState([]byte(`{"aws-eu-1": []}`), false)
+	assert.EqualError(t, err, "state has no schema version")
+
+	// unknown fields are only rejected in strict mode
+	unknownFieldState := []byte(`{"schemaVersion": 1, "datacenterAllocations": {}, "tenantQuota": {"team-a": 1024}}`)
+	_, err = unmarshalState(unknownFieldState, false)
+	assert.Nil(t, err)
+	_, err = unmarshalState(unknownFieldState, true)
+	assert.EqualError(t, err, `json: unknown field "tenantQuota"`)
+}
+
+func TestRenderClusterBlocks(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{
+				Name: "c2",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pool2", IPAMPoolTenant: "team-a", Cluster: "c2", Datacenter: "aws-eu-1", Type: "range", Addresses: []string{"192.168.1.10-192.168.1.11", "192.168.1.2-192.168.1.3"}},
+					{IPAMPoolName: "pool1", Cluster: "c2", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.16/28"},
+				},
+			},
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+		},
+	})
+
+	blocks, err := RenderClusterBlocks(ipam)
+	assert.Nil(t, err)
+	assert.Equal(t, `aws-eu-1/c1: {}
+aws-eu-1/c2:
+  pool1:
+    - 10.0.0.16/28
+  team-a/pool2:
+    - 192.168.1.2-192.168.1.3
+    - 192.168.1.10-192.168.1.11
+`, string(blocks))
+}
+
+func TestRenderSameNamedClustersOfTenants(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "prod", Tenant: "x", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "prod", Tenant: "y", IPAMAllocations: []IPAMAllocation{}},
+		},
+	})
+	ipamPool := IPAMPool{
+		Name: "pool1",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "range", PoolCIDR: "192.168.1.0/26", AllocationRange: 1},
+		},
+	}
+	assert.Nil(t, ipam.Apply(ipamPool))
+
+	blocks, err := RenderClusterBlocks(ipam)
+	assert.Nil(t, err)
+	assert.Equal(t, `aws-eu-1/x/prod:
+  pool1:
+    - 192.168.1.0-192.168.1.0
+aws-eu-1/y/prod:
+  pool1:
+    - 192.168.1.1-192.168.1.1
+`, string(blocks))
+
+	terraform, err := RenderTerraformLocals(ipam, "ipam")
+	assert.Nil(t, err)
+	assert.Contains(t, string(terraform), `"x/prod": {`)
+	assert.Contains(t, string(terraform), `"y/prod": {`)
+
+	ipSets, err := RenderFirewallObjects(ipam, "aws-eu-1", "ipset")
+	assert.Nil(t, err)
+	assert.Contains(t, ipSets, "add ipam-x-prod 192.168.1.0-192.168.1.0\n")
+	assert.Contains(t, ipSets, "add ipam-y-prod 192.168.1.1-192.168.1.1\n")
+
+	page, err := ipam.ListAllocations(AllocationFilter{Cluster: "y/prod"}, 10, "")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, page.Total)
+	assert.Equal(t, "y", page.Allocations[0].ClusterTenant)
+
+	metrics, err := RenderPrometheusMetrics(ipam, []IPAMPool{ipamPool}, MetricsOptions{Labels: []string{"cluster"}})
+	assert.Nil(t, err)
+	assert.Contains(t, metrics, `ipam_pool_allocations{cluster="x/prod"} 1`)
+	assert.Contains(t, metrics, `ipam_pool_allocations{cluster="y/prod"} 1`)
+
+	dnsmasq, err := RenderDnsmasqConfig(ipam, "aws-eu-1", []IPAMPool{ipamPool}, "", "")
+	assert.Nil(t, err)
+	assert.Contains(t, dnsmasq, "host-record=x-prod-pool1,192.168.1.0\n")
+	assert.Contains(t, dnsmasq, "host-record=y-prod-pool1,192.168.1.1\n")
+
+	records, err := RenderPTRRecords(ipam, "aws-eu-1", "{{ .QualifiedCluster }}.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "0.1.168.192.in-addr.arpa. IN PTR x-prod.example.com.\n1.1.168.192.in-addr.arpa. IN PTR y-prod.example.com.\n", records)
+
+	for _, allocation := range ipam.Allocations() {
+		tagged, isTagged := parsePHPIPAMTag(phpIPAMTag(allocation))
+		assert.True(t, isTagged)
+		assert.Equal(t, allocation.clusterRef(), tagged.clusterRef())
+		assert.Equal(t, allocation.qualifiedIPAMPoolName(), tagged.qualifiedIPAMPoolName())
+	}
+}
+
+func TestRenderDnsmasqConfig(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c2", Tenant: "team-a", IPAMAllocations: []IPAMAllocation{}},
+		},
+		"aws-eu-2": {
+			{Name: "c3", IPAMAllocations: []IPAMAllocation{}},
+		},
+	})
+	ipamPools := []IPAMPool{
+		{
+			Name: "nodes",
+			Datacenters: map[string]IPAMPoolDatacenterSettings{
+				"aws-eu-1": {Type: "range", PoolCIDR: "192.168.1.0/24", AllocationRange: 4},
+				"aws-eu-2": {Type: "range", PoolCIDR: "192.168.2.0/24", AllocationRange: 4},
+			},
+		},
+		{
+			Name: "nodes-v6",
+			Datacenters: map[string]IPAMPoolDatacenterSettings{
+				"aws-eu-1": {Type: "range", PoolCIDR: "fd00::/120", AllocationRange: 4},
+			},
+		},
+		{
+			Name: "gateway",
+			Datacenters: map[string]IPAMPoolDatacenterSettings{
+				"aws-eu-1": {Type: "range", PoolCIDR: "192.168.3.0/24", AllocationRange: 1},
+			},
+		},
+		{
+			Name: "pods",
+			Datacenters: map[string]IPAMPoolDatacenterSettings{
+				"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/16", AllocationPrefix: 24},
+			},
+		},
+	}
+	for _, ipamPool := range ipamPools {
+		assert.Nil(t, ipam.Apply(ipamPool))
+	}
+
+	// prefix pools and the allocations of other datacenters are left out
+	config, err := RenderDnsmasqConfig(ipam, "aws-eu-1", ipamPools, "example.com", "12h")
+	assert.Nil(t, err)
+	assert.Equal(t, `# pool gateway
+host-record=c1-gateway.example.com,192.168.3.0
+host-record=team-a-c2-gateway.example.com,192.168.3.1
+# pool nodes
+dhcp-range=set:c1,192.168.1.0,192.168.1.3,255.255.255.0,12h
+dhcp-range=set:team-a-c2,192.168.1.4,192.168.1.7,255.255.255.0,12h
+# pool nodes-v6
+dhcp-range=set:c1,fd00::,fd00::3,120,12h
+dhcp-range=set:team-a-c2,fd00::4,fd00::7,120,12h
+`, config)
+
+	config, err = RenderDnsmasqConfig(ipam, "aws-eu-2", ipamPools, "", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "# pool nodes\ndhcp-range=set:c3,192.168.2.0,192.168.2.3,255.255.255.0\n", config)
+}
+
+func TestRenderPTRRecords(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{
+				Name: "c1",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "lb", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.4/31"},
+					{IPAMPoolName: "nodes-v6", Cluster: "c1", Datacenter: "aws-eu-1", Type: "range", Addresses: []string{"fd00::a-fd00::b"}},
+				},
+			},
+			{
+				Name:   "c2",
+				Tenant: "team-a",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "nodes", IPAMPoolTenant: "team-a", Cluster: "c2", ClusterTenant: "team-a", Datacenter: "aws-eu-1", Type: "range", Addresses: []string{"192.168.1.1-192.168.1.1"}},
+				},
+			},
+		},
+		"aws-eu-2": {
+			{
+				Name: "c3",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pods", Cluster: "c3", Datacenter: "aws-eu-2", Type: "prefix", CIDR: "10.0.0.0/8"},
+				},
+			},
+		},
+	})
+
+	records, err := RenderPTRRecords(ipam, "aws-eu-1", "{{ .QualifiedCluster }}-{{ .Pool }}-{{ .DashedIP }}.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, `4.0.0.10.in-addr.arpa. IN PTR c1-lb-10-0-0-4.example.com.
+5.0.0.10.in-addr.arpa. IN PTR c1-lb-10-0-0-5.example.com.
+a.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa. IN PTR c1-nodes-v6-fd00--a.example.com.
+b.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa. IN PTR c1-nodes-v6-fd00--b.example.com.
+1.1.168.192.in-addr.arpa. IN PTR team-a-c2-nodes-192-168-1-1.example.com.
+`, records)
+
+	// names already ending with a dot are kept as is
+	records, err = RenderPTRRecords(ipam, "aws-eu-1", "{{ .Cluster }}.{{ .Tenant }}.example.com.")
+	assert.Nil(t, err)
+	assert.Contains(t, records, "1.1.168.192.in-addr.arpa. IN PTR c2.team-a.example.com.\n")
+
+	_, err = RenderPTRRecords(ipam, "aws-eu-2", "{{ .Cluster }}.example.com")
+	assert.EqualError(t, err, "allocation has more than 65536 addresses")
+	_, err = RenderPTRRecords(ipam, "aws-eu-1", "{{ .Cluster ")
+	assert.NotNil(t, err)
+}
+
+func TestRenderRouteExport(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{
+				Name: "c1",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pods", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.0/24"},
+					{IPAMPoolName: "nodes", Cluster: "c1", Datacenter: "aws-eu-1", Type: "range", Addresses: []string{"192.168.1.0-192.168.1.3"}},
+				},
+			},
+			{
+				Name:   "c2",
+				Tenant: "team-a",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pods", IPAMPoolTenant: "team-a", Cluster: "c2", ClusterTenant: "team-a", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.1.0.0/24"},
+					{IPAMPoolName: "pods-v6", Cluster: "c2", ClusterTenant: "team-a", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "fd00::/64"},
+				},
+			},
+		},
+	})
+	communities := map[string][]string{"pods": {"65000:100"}, "team-a/pods": {"65000:200", "65000:201"}}
+
+	// range allocations are not announced, and pools without communities are announced without
+	config, err := RenderRouteExport(ipam, "aws-eu-1", RouteExportOptions{Format: "bird", Communities: communities})
+	assert.Nil(t, err)
+	assert.Equal(t, `protocol static ipam_aws_eu_1_ipv4 {
+	ipv4;
+	# cluster c1 (pool pods)
+	route 10.0.0.0/24 blackhole {
+		bgp_community.add((65000,100));
+	};
+	# cluster team-a/c2 (pool team-a/pods)
+	route 10.1.0.0/24 blackhole {
+		bgp_community.add((65000,200));
+		bgp_community.add((65000,201));
+	};
+}
+protocol static ipam_aws_eu_1_ipv6 {
+	ipv6;
+	# cluster team-a/c2 (pool pods-v6)
+	route fd00::/64 blackhole;
+}
+`, config)
+
+	config, err = RenderRouteExport(ipam, "aws-eu-1", RouteExportOptions{Format: "frr", ASN: 65000, Communities: communities})
+	assert.Nil(t, err)
+	assert.Equal(t, `ip prefix-list IPAM-pods seq 5 permit 10.0.0.0/24
+ip prefix-list IPAM-team-a-pods seq 10 permit 10.1.0.0/24
+route-map IPAM-EXPORT-ipv4 permit 10
+ match ip address prefix-list IPAM-pods
+ set community 65000:100 additive
+route-map IPAM-EXPORT-ipv4 permit 20
+ match ip address prefix-list IPAM-team-a-pods
+ set community 65000:200 65000:201 additive
+route-map IPAM-EXPORT-ipv4 permit 30
+router bgp 65000
+ address-family ipv4 unicast
+  network 10.0.0.0/24 route-map IPAM-EXPORT-ipv4
+  network 10.1.0.0/24 route-map IPAM-EXPORT-ipv4
+ exit-address-family
+ipv6 prefix-list IPAM-pods-v6 seq 5 permit fd00::/64
+route-map IPAM-EXPORT-ipv6 permit 10
+router bgp 65000
+ address-family ipv6 unicast
+  network fd00::/64 route-map IPAM-EXPORT-ipv6
+ exit-address-family
+`, config)
+
+	_, err = RenderRouteExport(ipam, "aws-eu-1", RouteExportOptions{Format: "frr", Communities: communities})
+	assert.EqualError(t, err, "ASN is required for frr format")
+	_, err = RenderRouteExport(ipam, "aws-eu-1", RouteExportOptions{Format: "bird", Communities: map[string][]string{"pods": {"65000:70000"}}})
+	assert.EqualError(t, err, `wrong BGP community format "65000:70000"`)
+	_, err = RenderRouteExport(ipam, "aws-eu-1", RouteExportOptions{Format: "gobgp"})
+	assert.EqualError(t, err, `unsupported route export format "gobgp"`)
+}
+
+func TestRenderFirewallObjects(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{
+				Name: "c1",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pods", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.0/24"},
+					{IPAMPoolName: "nodes", Cluster: "c1", Datacenter: "aws-eu-1", Type: "range", Addresses: []string{"192.168.1.0-192.168.1.3"}},
+					{IPAMPoolName: "pods-v6", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "fd00::/64"},
+				},
+			},
+			{
+				Name:   "c2",
+				Tenant: "team-a",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pods", IPAMPoolTenant: "team-a", Cluster: "c2", ClusterTenant: "team-a", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.1.0.0/24"},
+				},
+			},
+			// clusters without allocations get no group
+			{Name: "c3", IPAMAllocations: []IPAMAllocation{}},
+		},
+	})
+
+	config, err := RenderFirewallObjects(ipam, "aws-eu-1", "ipset")
+	assert.Nil(t, err)
+	assert.Equal(t, `create ipam-c1 hash:net family inet -exist
+flush ipam-c1
+add ipam-c1 10.0.0.0/24
+add ipam-c1 192.168.1.0-192.168.1.3
+create ipam6-c1 hash:net family inet6 -exist
+flush ipam6-c1
+add ipam6-c1 fd00::/64
+create ipam-team-a-c2 hash:net family inet -exist
+flush ipam-team-a-c2
+add ipam-team-a-c2 10.1.0.0/24
+`, config)
+
+	config, err = RenderFirewallObjects(ipam, "aws-eu-1", "fortigate")
+	assert.Nil(t, err)
+	assert.Equal(t, `config firewall address
+    edit "ipam-c1-pods-1"
+        set subnet 10.0.0.0 255.255.255.0
+    next
+    edit "ipam-c1-nodes-2"
+        set type iprange
+        set start-ip 192.168.1.0
+        set end-ip 192.168.1.3
+    next
+    edit "ipam-team-a-c2-team-a-pods-1"
+        set subnet 10.1.0.0 255.255.255.0
+    next
+end
+config firewall addrgrp
+    edit "ipam-c1"
+        set member "ipam-c1-pods-1" "ipam-c1-nodes-2"
+    next
+    edit "ipam-team-a-c2"
+        set member "ipam-team-a-c2-team-a-pods-1"
+    next
+end
+config firewall address6
+    edit "ipam-c1-pods-v6-1"
+        set ip6 fd00::/64
+    next
+end
+config firewall addrgrp6
+    edit "ipam-c1"
+        set member "ipam-c1-pods-v6-1"
+    next
+end
+`, config)
+
+	config, err = RenderFirewallObjects(ipam, "aws-eu-1", "pfsense")
+	assert.Nil(t, err)
+	assert.Equal(t, `<aliases>
+	<alias>
+		<name>ipam_c1</name>
+		<type>network</type>
+		<address>10.0.0.0/24 192.168.1.0-192.168.1.3 fd00::/64</address>
+		<descr>IPAM allocations of cluster c1</descr>
+	</alias>
+	<alias>
+		<name>ipam_team_a_c2</name>
+		<type>network</type>
+		<address>10.1.0.0/24</address>
+		<descr>IPAM allocations of cluster team-a-c2</descr>
+	</alias>
+</aliases>
+`, config)
+
+	_, err = RenderFirewallObjects(ipam, "aws-eu-1", "iptables")
+	assert.EqualError(t, err, `unsupported firewall format "iptables"`)
+}
+
+func TestRenderTerraformLocals(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{
+				Name: "c1",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pods", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.0/24", Gateway: "10.0.0.1", MTU: 9000},
+					{IPAMPoolName: "nodes", IPAMPoolTenant: "team-a", Cluster: "c1", Datacenter: "aws-eu-1", Type: "range", Addresses: []string{"192.168.1.0-192.168.1.3"}, DNSServers: []string{"192.168.0.53"}},
+				},
+			},
+			{Name: "c2", Tenant: "team-a", IPAMAllocations: []IPAMAllocation{}},
+		},
+	})
+
+	config, err := RenderTerraformLocals(ipam, "ipam_allocations")
+	assert.Nil(t, err)
+	assert.Equal(t, `{
+  "locals": {
+    "ipam_allocations": {
+      "aws-eu-1": {
+        "c1": {
+          "pods": {
+            "type": "prefix",
+            "cidr": "10.0.0.0/24",
+            "gateway": "10.0.0.1",
+            "mtu": 9000
+          },
+          "team-a/nodes": {
+            "type": "range",
+            "addresses": [
+              "192.168.1.0-192.168.1.3"
+            ],
+            "dnsServers": [
+              "192.168.0.53"
+            ]
+          }
+        },
+        "team-a/c2": {}
+      }
+    },
+    "ipam_allocations_datacenters": {
+      "aws-eu-1": {
+        "name": "aws-eu-1"
+      }
+    }
+  }
+}`, string(config))
+
+	_, err = RenderTerraformLocals(ipam, "")
+	assert.EqualError(t, err, "local name cannot be empty")
+}
+
+func TestSortedIPAMPoolsOfTenants(t *testing.T) {
+	sortedPools := sortedIPAMPools([]IPAMPool{
+		{Name: "pool1", Tenant: "y"},
+		{Name: "pool2"},
+		{Name: "pool1", Tenant: "x"},
+		{Name: "pool1"},
+	})
+	qualifiedNames := []string{}
+	for _, ipamPool := range sortedPools {
+		qualifiedNames = append(qualifiedNames, ipamPool.qualifiedName())
+	}
+	assert.Equal(t, []string{"pool1", "pool2", "x/pool1", "y/pool1"}, qualifiedNames)
+}
+
+func TestIPAMHold(t *testing.T) {
+	clock := newManualClock(time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC))
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+		},
+	}, WithClock(clock))
+	ipamPool := IPAMPool{
+		Name: "pool1",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "prefix", PoolCIDR: "192.168.1.0/26", AllocationPrefix: 28},
+		},
+	}
+
+	token, err := ipam.Hold("aws-eu-1", ipamPool, nil, time.Minute)
+	assert.Nil(t, err)
+	_, err = ipam.Hold("aws-eu-2", ipamPool, nil, time.Minute)
+	assert.NotNil(t, err)
+	_, err = ipam.Hold("aws-eu-1", ipamPool, big.NewInt(32), time.Minute)
+	assert.EqualError(t, err, "hold size 32 doesn't match the allocation size 16 of pool pool1 in datacenter aws-eu-1")
+
+	// the held block is skipped by the allocations of other clusters
+	err = ipam.Apply(ipamPool)
+	assert.Nil(t, err)
+	assert.Equal(t, "192.168.1.16/28", ipam.datacenterAllocations["aws-eu-1"][0].IPAMAllocations[0].CIDR)
+
+	allocation, err := ipam.ConfirmHold(token, ClusterRef{Datacenter: "aws-eu-1", Name: "c2"}, ipamPool)
+	assert.Nil(t, err)
+	assert.Equal(t, "192.168.1.0/28", allocation.CIDR)
+	assert.Equal(t, "c2", allocation.Cluster)
+	assert.True(t, ipam.hasAllocation(ClusterRef{Datacenter: "aws-eu-1", Name: "c2"}, "pool1"))
+	_, err = ipam.ConfirmHold(token, ClusterRef{Datacenter: "aws-eu-1", Name: "c3"}, ipamPool)
+	assert.NotNil(t, err)
+
+	// expired holds give their block back to the pool
+	token, err = ipam.Hold("aws-eu-1", ipamPool, nil, time.Minute)
+	assert.Nil(t, err)
+	clock.Advance(time.Minute)
+	_, err = ipam.ConfirmHold(token, ClusterRef{Datacenter: "aws-eu-1", Name: "c3"}, ipamPool)
+	assert.NotNil(t, err)
+	token, err = ipam.Hold("aws-eu-1", ipamPool, nil, time.Minute)
+	assert.Nil(t, err)
+	allocation, err = ipam.ConfirmHold(token, ClusterRef{Datacenter: "aws-eu-1", Name: "c3"}, ipamPool)
+	assert.Nil(t, err)
+	assert.Equal(t, "192.168.1.32/28", allocation.CIDR)
+
+	// holds are confirmed for the pool they were made for, respecting its anti-affinity
+	token, err = ipam.Hold("aws-eu-1", ipamPool, nil, time.Minute)
+	assert.Nil(t, err)
+	_, err = ipam.ConfirmHold(token, ClusterRef{Datacenter: "aws-eu-1", Name: "c4"}, IPAMPool{Name: "pool2"})
+	assert.EqualError(t, err, "hold is for pool pool1, not pool2")
+	ipam.addAllocation(IPAMAllocation{IPAMPoolName: "pool2", Cluster: "c4", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "192.168.1.128/28"})
+	ipamPool.AntiAffinityPools = []string{"pool2"}
+	_, err = ipam.ConfirmHold(token, ClusterRef{Datacenter: "aws-eu-1", Name: "c4"}, ipamPool)
+	assert.EqualError(t, err, "held block of pool pool1 conflicts with the anti-affine block 192.168.1.128/28 of cluster c4")
+}
+
+func TestIPAMAntiAffinity(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{
+				Name: "c1",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pool1", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.0/26"},
+				},
+			},
+			{
+				Name: "c2",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pool1", Cluster: "c2", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.192/26"},
+				},
+			},
+			{Name: "c3", IPAMAllocations: []IPAMAllocation{}},
+		},
+	})
+	err := ipam.Apply(IPAMPool{
+		Name: "pool2",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "range", PoolCIDR: "10.0.0.0/22", AllocationRange: 4},
+		},
+		AntiAffinityPools: []string{"pool1"},
+	})
+	assert.Nil(t, err)
+
+	// c1 and c2 skip their own /24 and the address right after it, c3 has no anti-affine allocation
+	assert.Equal(t, []string{"10.0.1.1-10.0.1.4"}, ipam.datacenterAllocations["aws-eu-1"][0].IPAMAllocations[1].Addresses)
+	assert.Equal(t, []string{"10.0.1.5-10.0.1.8"}, ipam.datacenterAllocations["aws-eu-1"][1].IPAMAllocations[1].Addresses)
+	assert.Equal(t, []string{"10.0.0.0-10.0.0.3"}, ipam.datacenterAllocations["aws-eu-1"][2].IPAMAllocations[0].Addresses)
+}
+
+func TestIPAMLoadState(t *testing.T) {
+	state := `{"schemaVersion": 1, "datacenterAllocations": {"aws-eu-1": [
+		{"Name": "c1", "IPAMAllocations": [
+			{"IPAMPoolName": "pool1", "Cluster": "c1", "Datacenter": "aws-eu-1", "type": "range", "addresses": ["192.168.1.0-192.168.1.3"]},
+			{"IPAMPoolName": "pool2", "Cluster": "c1", "Datacenter": "aws-eu-1", "type": "prefix", "cidr": "10.0.0.0/24"}
+		]},
+		{"Name": "c2", "IPAMAllocations": [
+			{"IPAMPoolName": "pool1", "Cluster": "c2", "Datacenter": "aws-eu-1", "type": "range", "addresses": ["192.168.1.4-192.168.1.5"]},
+			{"IPAMPoolName": "pool2", "Cluster": "c2", "Datacenter": "aws-eu-1", "type": "prefix", "cidr": "fd00::/64"}
+		]},
+		{"Name": "c3", "Tenant": "team-a", "IPAMAllocations": [
+			{"IPAMPoolName": "pool1", "Cluster": "c3", "ClusterTenant": "team-a", "Datacenter": "aws-eu-1", "type": "range", "addresses": ["192.168.1.9-192.168.1.6"]},
+			{"IPAMPoolName": "pool2", "Cluster": "c3", "ClusterTenant": "team-a", "Datacenter": "aws-eu-1", "type": "prefix", "cidr": "10.0.1.1/24"},
+			{"IPAMPoolName": "pool3", "Cluster": "c3", "ClusterTenant": "team-a", "Datacenter": "aws-eu-1", "type": "range", "addresses": ["10.1.0.0-fd00::1"]}
+		]}
+	]}}`
+	pools := []IPAMPool{
+		{
+			Name: "pool1",
+			Datacenters: map[string]IPAMPoolDatacenterSettings{
+				"aws-eu-1": {Type: "range", PoolCIDR: "192.168.1.0/28", AllocationRange: 4},
+			},
+		},
+		{
+			Name: "pool2",
+			Datacenters: map[string]IPAMPoolDatacenterSettings{
+				"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/16", AllocationPrefix: 24},
+			},
+		},
+	}
+
+	restored, issues, err := LoadState([]byte(state), pools, false)
+	assert.Nil(t, err)
+	assert.Len(t, restored.datacenterAllocations["aws-eu-1"], 3)
+	assert.Equal(t, []StateLoadIssue{
+		{Datacenter: "aws-eu-1", Cluster: "c2", IPAMPool: "pool1", Message: "allocation has 2 addresses but the pool allocates 4"},
+		{Datacenter: "aws-eu-1", Cluster: "c2", IPAMPool: "pool2", Message: "fd00::/64 has a different IP family than the pool CIDR 10.0.0.0/16"},
+		{Datacenter: "aws-eu-1", Cluster: "team-a/c3", IPAMPool: "pool1", Message: `address range "192.168.1.9-192.168.1.6" ends before it starts`},
+		{Datacenter: "aws-eu-1", Cluster: "team-a/c3", IPAMPool: "pool2", Message: `CIDR "10.0.1.1/24" is not a network address`},
+		{Datacenter: "aws-eu-1", Cluster: "team-a/c3", IPAMPool: "pool3", Message: "address ranges mix IPv4 and IPv6 addresses"},
+	}, issues)
+}
+
+func TestIPAMFindAllocations(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{
+				Name: "c1",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pool1", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.0/28"},
+					{IPAMPoolName: "pool2", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.1.0.0/28"},
+				},
+			},
+		},
+		"azure-as-2": {
+			{
+				Name: "c2",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pool1", Cluster: "c2", Datacenter: "azure-as-2", Type: "prefix", CIDR: "10.0.0.0/28"},
+				},
+			},
+		},
+	})
+	c1 := ClusterRef{Datacenter: "aws-eu-1", Name: "c1"}
+	c2 := ClusterRef{Datacenter: "azure-as-2", Name: "c2"}
+	assert.Nil(t, ipam.LabelAllocation(c1, "", "pool1", map[string]string{"env": "staging", "tier": "web"}))
+	assert.Nil(t, ipam.LabelAllocation(c1, "", "pool2", map[string]string{"env": "production"}))
+	assert.Nil(t, ipam.LabelAllocation(c2, "", "pool1", map[string]string{"env": "staging", "deprecated": "true"}))
+	assert.Nil(t, ipam.LabelAllocation(c2, "", "pool1", map[string]string{"deprecated": ""}))
+	assert.NotNil(t, ipam.LabelAllocation(c2, "", "pool2", map[string]string{"env": "staging"}))
+	assert.NotNil(t, ipam.LabelAllocation(c2, "", "pool1", map[string]string{"bad key": "x"}))
+
+	testCases := []struct {
+		name              string
+		selector          string
+		expectedClusters  []string
+		expectedSelectErr bool
+	}{
+		{
+			name:             "equality",
+			selector:         "env=staging",
+			expectedClusters: []string{"c1", "c2"},
+		},
+		{
+			name:             "double equals and inequality",
+			selector:         "env==staging, tier!=web",
+			expectedClusters: []string{"c2"},
+		},
+		{
+			name:             "existence",
+			selector:         "tier",
+			expectedClusters: []string{"c1"},
+		},
+		{
+			name:             "non-existence",
+			selector:         "!deprecated,!tier",
+			expectedClusters: []string{"c1", "c2"},
+		},
+		{
+			name:             "empty selector",
+			selector:         "",
+			expectedClusters: []string{"c1", "c1", "c2"},
+		},
+		{
+			name:              "invalid selector",
+			selector:          "env=staging,=x",
+			expectedSelectErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			selector, err := ParseLabelSelector(tc.selector)
+			if tc.expectedSelectErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			clusters := []string{}
+			for _, allocation := range ipam.FindAllocations(selector) {
+				clusters = append(clusters, allocation.Cluster)
+			}
+			assert.Equal(t, tc.expectedClusters, clusters)
+		})
+	}
+}
+
+func TestIPAMFindInventoryOverlaps(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{
+				Name: "c1",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pods", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.0/24"},
+					{IPAMPoolName: "nodes", Cluster: "c1", Datacenter: "aws-eu-1", Type: "range", Addresses: []string{"192.168.1.0-192.168.1.3"}},
+				},
+			},
+		},
+		"aws-eu-2": {
+			{
+				Name: "c2",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pods", Cluster: "c2", Datacenter: "aws-eu-2", Type: "prefix", CIDR: "10.0.0.0/24"},
+				},
+			},
+		},
+	})
+
+	entries, err := ReadInventoryCSV(strings.NewReader(`Description, CIDR ,datacenter
+legacy DMZ,10.0.0.128/25,
+printers,192.168.1.2/32,aws-eu-1
+VPN,172.16.0.0/12,aws-eu-1
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, []InventoryEntry{
+		{CIDR: "10.0.0.128/25", Description: "legacy DMZ"},
+		{CIDR: "192.168.1.2/32", Datacenter: "aws-eu-1", Description: "printers"},
+		{CIDR: "172.16.0.0/12", Datacenter: "aws-eu-1", Description: "VPN"},
+	}, entries)
+
+	// entries without datacenter are checked against every datacenter
+	overlaps, err := ipam.FindInventoryOverlaps(entries)
+	assert.Nil(t, err)
+	assert.Equal(t, []InventoryOverlap{
+		{Entry: entries[0], Allocation: ipam.datacenterAllocations["aws-eu-1"][0].IPAMAllocations[0]},
+		{Entry: entries[0], Allocation: ipam.datacenterAllocations["aws-eu-2"][0].IPAMAllocations[0]},
+		{Entry: entries[1], Allocation: ipam.datacenterAllocations["aws-eu-1"][0].IPAMAllocations[1]},
+	}, overlaps)
+
+	entries, err = ReadInventoryJSON(strings.NewReader(`[{"cidr": "10.0.0.0/16", "datacenter": "aws-eu-2"}]`))
+	assert.Nil(t, err)
+	overlaps, err = ipam.FindInventoryOverlaps(entries)
+	assert.Nil(t, err)
+	assert.Equal(t, []InventoryOverlap{
+		{Entry: entries[0], Allocation: ipam.datacenterAllocations["aws-eu-2"][0].IPAMAllocations[0]},
+	}, overlaps)
+
+	_, err = ReadInventoryCSV(strings.NewReader("network,datacenter\n10.0.0.0/8,aws-eu-1\n"))
+	assert.EqualError(t, err, "inventory CSV has no cidr column")
+	_, err = ipam.FindInventoryOverlaps([]InventoryEntry{{CIDR: "10.0.0.0"}})
+	assert.EqualError(t, err, `wrong inventory CIDR "10.0.0.0": invalid CIDR address: 10.0.0.0`)
+}
+
+func TestFindFreeRangesOfLargePool(t *testing.T) {
+	// the free IPs are streamed, so only the searched part of a huge pool is visited
+	dcIPAMPoolUsageMap := newDatacenterIPAMPoolUsageMap()
+	dcIPAMPoolUsageMap.setUsed("aws-eu-1", "fd00::1")
+
+	addresses, err := findFirstFreeRangesOfPool("aws-eu-1", "fd00::/64", 3, dcIPAMPoolUsageMap)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"fd00::-fd00::", "fd00::2-fd00::3"}, addresses)
+
+	addresses, err = findLastFreeRangesOfPool("aws-eu-1", "fd00::/64", 2, dcIPAMPoolUsageMap)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"fd00::ffff:ffff:ffff:fffe-fd00::ffff:ffff:ffff:ffff"}, addresses)
+	assert.True(t, dcIPAMPoolUsageMap.isUsed("aws-eu-1", "fd00::ffff:ffff:ffff:fffe"))
+}
+
+func TestFreeSpaceOfLargePool(t *testing.T) {
+	// the free space is computed from the used space, so huge pools and reservations are never enumerated
+	dcIPAMPoolUsageMap := newDatacenterIPAMPoolUsageMap()
+	assert.Nil(t, markReservationsAsUsed("aws-eu-1", []string{"fd00::/64"}, dcIPAMPoolUsageMap))
+	dcIPAMPoolUsageMap.setUsed("aws-eu-1", "fd00:0:0:1::1")
+	rangePoolCfg := IPAMPoolDatacenterSettings{Type: "range", PoolCIDR: "fd00::/48", AllocationRange: 2}
+
+	free, err := freeCapacityOfPool("aws-eu-1", rangePoolCfg, dcIPAMPoolUsageMap)
+	assert.Nil(t, err)
+	expectedFree := new(big.Int).Lsh(big.NewInt(1), 80)
+	expectedFree.Sub(expectedFree, new(big.Int).Lsh(big.NewInt(1), 64))
+	assert.Equal(t, expectedFree.Sub(expectedFree, big.NewInt(1)), free)
+	remaining, err := remainingAllocationsOfPool("aws-eu-1", rangePoolCfg, dcIPAMPoolUsageMap)
+	assert.Nil(t, err)
+	assert.Equal(t, int(^uint(0)>>1), remaining)
+
+	blocks, err := freeBlocksOfPool("aws-eu-1", rangePoolCfg, dcIPAMPoolUsageMap, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"fd00:0:0:1::-fd00:0:0:1::", "fd00:0:0:1::2-fd00::ffff:ffff:ffff:ffff:ffff"}, blocks)
+	addresses, err := findFirstFreeRangesOfPool("aws-eu-1", "fd00::/48", 2, dcIPAMPoolUsageMap)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"fd00:0:0:1::-fd00:0:0:1::", "fd00:0:0:1::2-fd00:0:0:1::2"}, addresses)
+
+	prefixPoolCfg := IPAMPoolDatacenterSettings{Type: "prefix", PoolCIDR: "10.0.0.0/8", AllocationPrefix: 24}
+	assert.Nil(t, markReservationsAsUsed("aws-eu-1", []string{"10.0.0.0/9", "10.128.0.128/25"}, dcIPAMPoolUsageMap))
+	free, err = freeCapacityOfPool("aws-eu-1", prefixPoolCfg, dcIPAMPoolUsageMap)
+	assert.Nil(t, err)
+	assert.Equal(t, big.NewInt(1<<15-1), free)
+	subnet, err := findFirstFreeSubnetOfPool("aws-eu-1", "10.0.0.0/8", 24, dcIPAMPoolUsageMap)
+	assert.Nil(t, err)
+	assert.Equal(t, "10.128.1.0/24", subnet)
+	assert.True(t, dcIPAMPoolUsageMap.isUsed("aws-eu-1", "10.128.1.0/24"))
+	assert.True(t, dcIPAMPoolUsageMap.isUsed("aws-eu-1", "10.127.255.0/24"))
+	assert.False(t, dcIPAMPoolUsageMap.isUsed("aws-eu-1", "10.128.2.0/24"))
+}
+
+func TestIPAMPlanCompaction(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{{IPAMPoolName: "pool1", Cluster: "c1", Datacenter: "aws-eu-1", Type: "range", Addresses: []string{"192.168.1.0-192.168.1.1"}}}},
+			{Name: "c2", IPAMAllocations: []IPAMAllocation{{IPAMPoolName: "pool1", Cluster: "c2", Datacenter: "aws-eu-1", Type: "range", Addresses: []string{"192.168.1.4-192.168.1.5"}}}},
+			{Name: "c3", IPAMAllocations: []IPAMAllocation{{IPAMPoolName: "pool1", Cluster: "c3", Datacenter: "aws-eu-1", Type: "range", Addresses: []string{"192.168.1.8-192.168.1.9"}}}},
+			{Name: "c4", IPAMAllocations: []IPAMAllocation{{IPAMPoolName: "pool1", Cluster: "c4", Datacenter: "aws-eu-1", Type: "range", Addresses: []string{"192.168.1.12-192.168.1.13"}}}},
+		},
+		"azure-as-2": {
+			{Name: "c5", IPAMAllocations: []IPAMAllocation{{IPAMPoolName: "pool1", Cluster: "c5", Datacenter: "azure-as-2", Type: "range", Addresses: []string{"192.168.1.0-192.168.1.1"}}}},
+		},
+	})
+	ipamPool := IPAMPool{
+		Name: "pool1",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1":   {Type: "range", PoolCIDR: "192.168.1.0/28", AllocationRange: 2},
+			"azure-as-2": {Type: "range", PoolCIDR: "192.168.1.0/28", AllocationRange: 2},
+		},
+	}
+
+	plans, err := ipam.PlanCompaction(ipamPool, CompactionThresholds{MaxFragmentation: 0.5})
+	assert.Nil(t, err)
+	assert.Equal(t, []CompactionPlan{
+		{
+			Datacenter:          "aws-eu-1",
+			IPAMPool:            "pool1",
+			FragmentationBefore: 0.75,
+			FragmentationAfter:  0.25,
+			Renumberings: []Renumbering{
+				{
+					OldAllocation: IPAMAllocation{IPAMPoolName: "pool1", Cluster: "c4", Datacenter: "aws-eu-1", Type: "range", Addresses: []string{"192.168.1.12-192.168.1.13"}},
+					NewAllocation: &IPAMAllocation{IPAMPoolName: "pool1", Cluster: "c4", Datacenter: "aws-eu-1", Type: "range", Addresses: []string{"192.168.1.2-192.168.1.3"}},
+				},
+			},
+		},
+	}, plans)
+
+	// the plan is never applied
+	assert.Equal(t, []string{"192.168.1.12-192.168.1.13"}, ipam.datacenterAllocations["aws-eu-1"][3].IPAMAllocations[0].Addresses)
+
+	plans, err = ipam.PlanCompaction(ipamPool, CompactionThresholds{MaxFragmentation: 0})
+	assert.Nil(t, err)
+	assert.Len(t, plans, 1)
+	assert.Len(t, plans[0].Renumberings, 2)
+	assert.Equal(t, []string{"192.168.1.6-192.168.1.7"}, plans[0].Renumberings[1].NewAllocation.Addresses)
+	assert.Equal(t, 0.0, plans[0].FragmentationAfter)
+}
+
+func TestIPAMFreeBlocks(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{
+				Name: "c1",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pool1", Cluster: "c1", Datacenter: "aws-eu-1", Type: "range", Addresses: []string{"192.168.1.2-192.168.1.3", "192.168.1.8-192.168.1.9"}},
+					{IPAMPoolName: "pool2", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.16/28"},
+				},
+			},
+		},
+	})
+	pool1 := IPAMPool{
+		Name: "pool1",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "range", PoolCIDR: "192.168.1.0/28", AllocationRange: 4},
+		},
+	}
+	pool2 := IPAMPool{
+		Name: "pool2",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/26", AllocationPrefix: 28},
+		},
+	}
+
+	blocks, err := ipam.FreeBlocks("aws-eu-1", pool1)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"192.168.1.0-192.168.1.1", "192.168.1.4-192.168.1.7", "192.168.1.10-192.168.1.15"}, blocks)
+
+	blocks, err = ipam.FreeBlocks("aws-eu-1", pool2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.0.0.0/28", "10.0.0.32/28", "10.0.0.48/28"}, blocks)
+
+	_, err = ipam.FreeBlocks("azure-as-2", pool1)
+	assert.EqualError(t, err, "pool pool1 is not configured for datacenter azure-as-2")
+}
+
+func TestIPAMPeekNext(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{
+				Name: "c1",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pool1", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.0/28"},
+				},
+			},
+		},
+	})
+	ipamPool := IPAMPool{
+		Name: "pool1",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/27", AllocationPrefix: 28},
+		},
+	}
+
+	next, err := ipam.PeekNext("aws-eu-1", ipamPool)
+	assert.Nil(t, err)
+	assert.Equal(t, IPAMAllocation{IPAMPoolName: "pool1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.16/28"}, next)
+
+	// peeking doesn't reserve the block
+	next, err = ipam.PeekNext("aws-eu-1", ipamPool)
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.16/28", next.CIDR)
+
+	_, err = ipam.PeekNext("azure-as-2", ipamPool)
+	assert.EqualError(t, err, "pool pool1 is not configured for datacenter azure-as-2")
+}
+
+type fakeLoadBalancerIPLister map[ClusterRef][]string
+
+func (l fakeLoadBalancerIPLister) ListLoadBalancerIPs(cluster ClusterRef) ([]string, error) {
+	return l[cluster], nil
+}
+
+func TestIPAMReconcileLoadBalancerIPs(t *testing.T) {
+	initialDatacenterAllocations := map[string][]Cluster{
+		"aws-eu-1": {
+			{
+				Name: "c1",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "lb", Cluster: "c1", Datacenter: "aws-eu-1", Type: "range", Addresses: []string{"192.168.1.0-192.168.1.3"}},
+				},
+			},
+			{
+				Name: "c2",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "lb", Cluster: "c2", Datacenter: "aws-eu-1", Type: "range", Addresses: []string{"192.168.1.4-192.168.1.7"}},
+				},
+			},
+		},
+	}
+	lister := fakeLoadBalancerIPLister{
+		{Datacenter: "aws-eu-1", Name: "c1"}: {"192.168.1.1", "192.168.1.5", "192.168.1.20"},
+	}
+
+	ipam := New(initialDatacenterAllocations)
+	conflicts, err := ReconcileLoadBalancerIPs(ipam, lister)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"192.168.1.5/32", "192.168.1.20/32"}, ipam.reservations("aws-eu-1"))
+	assert.Equal(t, []ReservationConflict{
+		{
+			Datacenter:  "aws-eu-1",
+			Reservation: "192.168.1.5/32",
+			Allocation:  initialDatacenterAllocations["aws-eu-1"][1].IPAMAllocations[0],
+		},
+	}, conflicts)
+
+	// the IPs of deleted Services are no longer reserved on the next sync
+	lister[ClusterRef{Datacenter: "aws-eu-1", Name: "c1"}] = []string{"192.168.1.21"}
+	conflicts, err = ReconcileLoadBalancerIPs(ipam, lister)
+	assert.Nil(t, err)
+	assert.Empty(t, conflicts)
+	assert.Equal(t, []string{"192.168.1.21/32"}, ipam.reservations("aws-eu-1"))
+	_, err = ReconcileLoadBalancerIPs(ipam, fakeLoadBalancerIPLister{})
+	assert.Nil(t, err)
+	assert.Empty(t, ipam.datacenterReservations)
+
+	_, err = ReconcileLoadBalancerIPs(ipam, fakeLoadBalancerIPLister{{Datacenter: "aws-eu-1", Name: "c2"}: {"not-an-ip"}})
+	assert.EqualError(t, err, "wrong ip format")
+}
+
+func TestIPAMNetworkSettings(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+		},
+	})
+	dcIPAMPoolCfg := IPAMPoolDatacenterSettings{
+		Type:             "prefix",
+		PoolCIDR:         "10.0.0.0/24",
+		AllocationPrefix: 26,
+		Gateway:          "10.0.0.1",
+		DNSServers:       []string{"10.1.0.53"},
+		MTU:              1450,
+	}
+	err := ipam.Apply(IPAMPool{
+		Name:        "pool1",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{"aws-eu-1": dcIPAMPoolCfg},
+	})
+	assert.Nil(t, err)
+	allocation := ipam.datacenterAllocations["aws-eu-1"][0].IPAMAllocations[0]
+	assert.Equal(t, "10.0.0.1", allocation.Gateway)
+	assert.Equal(t, []string{"10.1.0.53"}, allocation.DNSServers)
+	assert.Equal(t, uint32(1450), allocation.MTU)
+
+	locals, err := RenderTerraformLocals(ipam, "ipam")
+	assert.Nil(t, err)
+	assert.Contains(t, string(locals), `"gateway": "10.0.0.1"`)
+	assert.Contains(t, string(locals), `"mtu": 1450`)
+
+	assert.Nil(t, validateIPAMPoolDatacenterSettings(dcIPAMPoolCfg))
+	dcIPAMPoolCfg.MTU = 20
+	assert.EqualError(t, validateIPAMPoolDatacenterSettings(dcIPAMPoolCfg), "mtu: MTU 20 must be between 68 and 65535")
+	dcIPAMPoolCfg.MTU = 0
+	dcIPAMPoolCfg.DNSServers = []string{"dns.example.com"}
+	assert.EqualError(t, validateIPAMPoolDatacenterSettings(dcIPAMPoolCfg), `dnsServers[0]: invalid DNS server "dns.example.com"`)
+}
+
+func TestAllocationRenderer(t *testing.T) {
+	renderer, err := NewAllocationRenderer(map[string]string{
+		"ansible": `{{ .Cluster }}_{{ .Datacenter }}:
+  pool: {{ .Pool }}
+  blocks: [{{ join .Blocks ", " }}]
+{{- with .Gateway }}
+  gateway: {{ . }}
+{{- end }}
+`,
+		"labels": `{{ .Labels.env | upper }}`,
+	})
+	assert.Nil(t, err)
+
+	allocation := IPAMAllocation{
+		IPAMPoolName:   "pool1",
+		IPAMPoolTenant: "team-a",
+		Cluster:        "c1",
+		Datacenter:     "aws-eu-1",
+		Type:           "range",
+		Addresses:      []string{"192.168.1.0-192.168.1.3", "192.168.1.8-192.168.1.9"},
+		Gateway:        "192.168.1.254",
+		Labels:         map[string]string{"env": "staging"},
+	}
+	out, err := renderer.Render(allocation, "ansible")
+	assert.Nil(t, err)
+	assert.Equal(t, `c1_aws-eu-1:
+  pool: team-a/pool1
+  blocks: [192.168.1.0-192.168.1.3, 192.168.1.8-192.168.1.9]
+  gateway: 192.168.1.254
+`, string(out))
+
+	out, err = renderer.Render(allocation, "labels")
+	assert.Nil(t, err)
+	assert.Equal(t, "STAGING", string(out))
+
+	_, err = renderer.Render(allocation, "helm")
+	assert.EqualError(t, err, `template "helm" not found`)
+
+	_, err = NewAllocationRenderer(map[string]string{"broken": "{{ .Cluster "})
+	assert.NotNil(t, err)
+}
+
+func TestRenderClusterHelmValues(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{
+				Name: "c1",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pods", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.0/20"},
+					{IPAMPoolName: "services", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.1.0.0/24"},
+					{IPAMPoolName: "load-balancers", Cluster: "c1", Datacenter: "aws-eu-1", Type: "range", Addresses: []string{"192.168.1.0-192.168.1.15"}},
+					{IPAMPoolName: "nodes", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "172.16.0.0/24"},
+				},
+			},
+		},
+	})
+	c1 := ClusterRef{Datacenter: "aws-eu-1", Name: "c1"}
+
+	values, err := RenderClusterHelmValues(ipam, c1, defaultHelmValuesKeys)
+	assert.Nil(t, err)
+	assert.Equal(t, `loadBalancerRange:
+  - 192.168.1.0-192.168.1.15
+podCIDR: 10.0.0.0/20
+servicesCIDR: 10.1.0.0/24
+`, string(values))
+
+	values, err = RenderClusterHelmValues(ipam, c1, map[string]string{"pods": "networking.pods.cidr", "services": "networking.services.cidr"})
+	assert.Nil(t, err)
+	assert.Equal(t, `networking:
+  pods:
+    cidr: 10.0.0.0/20
+  services:
+    cidr: 10.1.0.0/24
+`, string(values))
+
+	_, err = RenderClusterHelmValues(ipam, c1, map[string]string{"pods": "networking", "services": "networking.services"})
+	assert.NotNil(t, err)
+
+	_, err = RenderClusterHelmValues(ipam, ClusterRef{Datacenter: "aws-eu-1", Name: "c2"}, defaultHelmValuesKeys)
+	assert.EqualError(t, err, "cluster c2 not found in datacenter aws-eu-1")
+}
+
+func TestIPAMPoolPurposes(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{
+				Name: "c1",
+				IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "cluster-network", Purpose: "pods", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.0/20"},
+				},
+			},
+			{Name: "c2", IPAMAllocations: []IPAMAllocation{}},
+		},
+	})
+	ipamPool := IPAMPool{
+		Name: "cluster-network",
+		Purposes: map[string]map[string]IPAMPoolDatacenterSettings{
+			"pods": {
+				"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/16", AllocationPrefix: 20},
+			},
+			"services": {
+				"aws-eu-1": {Type: "prefix", PoolCIDR: "10.1.0.0/16", AllocationPrefix: 24},
+			},
+			"nodes": {
+				"aws-eu-1": {Type: "range", PoolCIDR: "192.168.1.0/24", AllocationRange: 16},
+			},
+		},
+	}
+
+	plannedAllocations, err := ipam.plan(ipamPool)
+	assert.Nil(t, err)
+	assert.Len(t, plannedAllocations, 5)
+
+	err = ipam.Apply(ipamPool)
+	assert.Nil(t, err)
+	assert.Equal(t, []IPAMAllocation{
+		{IPAMPoolName: "cluster-network", Purpose: "pods", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.0/20"},
+		{IPAMPoolName: "cluster-network", Purpose: "nodes", Cluster: "c1", Datacenter: "aws-eu-1", Type: "range", Addresses: []string{"192.168.1.0-192.168.1.15"}},
+		{IPAMPoolName: "cluster-network", Purpose: "services", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.1.0.0/24"},
+	}, ipam.datacenterAllocations["aws-eu-1"][0].IPAMAllocations)
+	assert.Equal(t, []IPAMAllocation{
+		{IPAMPoolName: "cluster-network", Purpose: "nodes", Cluster: "c2", Datacenter: "aws-eu-1", Type: "range", Addresses: []string{"192.168.1.16-192.168.1.31"}},
+		{IPAMPoolName: "cluster-network", Purpose: "pods", Cluster: "c2", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.16.0/20"},
+		{IPAMPoolName: "cluster-network", Purpose: "services", Cluster: "c2", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.1.1.0/24"},
+	}, ipam.datacenterAllocations["aws-eu-1"][1].IPAMAllocations)
+	assert.True(t, ipam.hasAllocation(ClusterRef{Datacenter: "aws-eu-1", Name: "c2"}, "cluster-network:services"))
+
+	values, err := RenderClusterHelmValues(ipam, ClusterRef{Datacenter: "aws-eu-1", Name: "c2"}, map[string]string{
+		"cluster-network:pods":     "podCIDR",
+		"cluster-network:services": "servicesCIDR",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "podCIDR: 10.0.16.0/20\nservicesCIDR: 10.1.1.0/24\n", string(values))
+
+	ipamPool.Purposes["services"]["aws-eu-1"] = IPAMPoolDatacenterSettings{Type: "prefix", PoolCIDR: "10.0.128.0/17", AllocationPrefix: 24}
+	err = ipam.Apply(ipamPool)
+	assert.EqualError(t, err, "pool cluster-network:services overlaps another purpose of the pool in datacenter aws-eu-1")
+}
+
+func newPurposesTestPool() IPAMPool {
+	return IPAMPool{
+		Name: "net",
+		Purposes: map[string]map[string]IPAMPoolDatacenterSettings{
+			"pods":  {"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/24", AllocationPrefix: 26}},
+			"nodes": {"aws-eu-1": {Type: "range", PoolCIDR: "192.168.1.0/28", AllocationRange: 4}},
+		},
+	}
+}
+
+func TestIPAMPoolForPurpose(t *testing.T) {
+	ipamPool := newPurposesTestPool()
+	podsPool, err := ipamPool.ForPurpose("pods")
+	assert.Nil(t, err)
+	assert.Equal(t, "net:pods", podsPool.qualifiedName())
+	assert.Empty(t, podsPool.Purposes)
+	_, err = ipamPool.ForPurpose("services")
+	assert.EqualError(t, err, `pool net has no purpose "services"`)
+	_, err = ipamPool.ForPurpose("")
+	assert.EqualError(t, err, `pool net has no purpose ""`)
+}
+
+func TestIPAMListAllocations(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c2", Tenant: "team-a", IPAMAllocations: []IPAMAllocation{}},
+		},
+		"aws-eu-2": {
+			{Name: "c3", IPAMAllocations: []IPAMAllocation{}},
+		},
+	})
+	assert.Nil(t, ipam.Apply(newPurposesTestPool()))
+	assert.Nil(t, ipam.Apply(IPAMPool{
+		Name:   "net",
+		Tenant: "team-a",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "prefix", PoolCIDR: "10.1.0.0/24", AllocationPrefix: 26},
+			"aws-eu-2": {Type: "prefix", PoolCIDR: "10.2.0.0/24", AllocationPrefix: 26},
+		},
+	}))
+	listed := func(filter AllocationFilter) []string {
+		page, err := ipam.ListAllocations(filter, 10, "")
+		assert.Nil(t, err)
+		allocations := []string{}
+		for _, allocation := range page.Allocations {
+			allocations = append(allocations, fmt.Sprintf("%s/%s %s", allocation.Datacenter, allocation.clusterRef().qualifiedName(), allocation.qualifiedIPAMPoolName()))
+		}
+		return allocations
+	}
+
+	// a pool matches the allocations of all its purposes, a purpose only its own
+	assert.Equal(t, []string{
+		"aws-eu-1/c1 net:nodes",
+		"aws-eu-1/c1 net:pods",
+		"aws-eu-1/c1 team-a/net",
+		"aws-eu-1/team-a/c2 net:nodes",
+		"aws-eu-1/team-a/c2 net:pods",
+		"aws-eu-1/team-a/c2 team-a/net",
+		"aws-eu-2/c3 team-a/net",
+	}, listed(AllocationFilter{Pool: "net"}))
+	assert.Equal(t, []string{"aws-eu-1/c1 net:pods", "aws-eu-1/team-a/c2 net:pods"}, listed(AllocationFilter{Pool: "net:pods"}))
+	assert.Empty(t, listed(AllocationFilter{Pool: "net:pods", Tenant: "team-a"}))
+	assert.Equal(t, []string{"aws-eu-2/c3 team-a/net"}, listed(AllocationFilter{Datacenter: "aws-eu-2", Tenant: "team-a", Pool: "net"}))
+	assert.Equal(t, []string{"aws-eu-1/team-a/c2 net:nodes", "aws-eu-1/team-a/c2 net:pods", "aws-eu-1/team-a/c2 team-a/net"}, listed(AllocationFilter{Datacenter: "aws-eu-1", Cluster: "team-a/c2"}))
+	assert.Equal(t, []string{"aws-eu-1/c1 net:nodes", "aws-eu-1/team-a/c2 net:nodes"}, listed(AllocationFilter{WithinCIDR: "192.168.1.0/24"}))
+
+	// pages follow each other until the last one
+	page, err := ipam.ListAllocations(AllocationFilter{Pool: "net"}, 4, "")
+	assert.Nil(t, err)
+	assert.Equal(t, 7, page.Total)
+	assert.Len(t, page.Allocations, 4)
+	assert.Equal(t, "4", page.NextPageToken)
+	page, err = ipam.ListAllocations(AllocationFilter{Pool: "net"}, 4, page.NextPageToken)
+	assert.Nil(t, err)
+	assert.Len(t, page.Allocations, 3)
+	assert.Empty(t, page.NextPageToken)
+	_, err = ipam.ListAllocations(AllocationFilter{}, 4, "x")
+	assert.EqualError(t, err, "invalid page token")
+	_, err = ipam.ListAllocations(AllocationFilter{}, 0, "")
+	assert.EqualError(t, err, "page size must be positive")
+}
+
+func TestIPAMDetectDriftWithPurposes(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+		},
+	})
+	ipamPool := newPurposesTestPool()
+	assert.Nil(t, ipam.Apply(ipamPool))
+	ipam.datacenterAllocations["aws-eu-1"] = append(ipam.datacenterAllocations["aws-eu-1"], Cluster{Name: "c2", IPAMAllocations: []IPAMAllocation{
+		{IPAMPoolName: "net", Purpose: "pods", Cluster: "c2", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.64/26"},
+	}})
+
+	drifts, err := ipam.DetectDrift([]IPAMPool{ipamPool})
+	assert.Nil(t, err)
+	assert.Equal(t, []AllocationDrift{{
+		Kind:       DriftMissingAllocation,
+		Datacenter: "aws-eu-1",
+		Cluster:    "c2",
+		IPAMPool:   "net:nodes",
+		Message:    "cluster has no allocation of pool net:nodes",
+	}}, drifts)
+}
+
+func TestIPAMPoolAllocateBatchWithPurposes(t *testing.T) {
+	ipam := New(map[string][]Cluster{})
+	newAllocations, err := ipam.AllocateBatch(newPurposesTestPool(), []ClusterRef{
+		{Datacenter: "aws-eu-1", Name: "c1"},
+		{Datacenter: "aws-eu-1", Name: "c2"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []IPAMAllocation{
+		{IPAMPoolName: "net", Purpose: "nodes", Cluster: "c1", Datacenter: "aws-eu-1", Type: "range", Addresses: []string{"192.168.1.0-192.168.1.3"}},
+		{IPAMPoolName: "net", Purpose: "nodes", Cluster: "c2", Datacenter: "aws-eu-1", Type: "range", Addresses: []string{"192.168.1.4-192.168.1.7"}},
+		{IPAMPoolName: "net", Purpose: "pods", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.0/26"},
+		{IPAMPoolName: "net", Purpose: "pods", Cluster: "c2", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.64/26"},
+	}, newAllocations)
+
+	// nothing is allocated when a purpose is exhausted
+	_, err = ipam.AllocateBatch(newPurposesTestPool(), []ClusterRef{
+		{Datacenter: "aws-eu-1", Name: "c3"},
+		{Datacenter: "aws-eu-1", Name: "c4"},
+		{Datacenter: "aws-eu-1", Name: "c5"},
+	})
+	assert.ErrorIs(t, err, errNotEnoughFreeIPs)
+	assert.Len(t, ipam.Allocations(), 4)
+}
+
+func TestIPAMCanAllocateWithPurposes(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+		},
+	})
+	canAllocate, detail, err := ipam.CanAllocate(newPurposesTestPool(), 3)
+	assert.Nil(t, err)
+	assert.True(t, canAllocate)
+	assert.Equal(t, CapacityDetail{
+		Datacenters: map[string]DatacenterCapacity{},
+		Purposes: map[string]CapacityDetail{
+			"nodes": {Datacenters: map[string]DatacenterCapacity{"aws-eu-1": {Required: 4, Available: 4}}},
+			"pods":  {Datacenters: map[string]DatacenterCapacity{"aws-eu-1": {Required: 4, Available: 4}}},
+		},
+	}, detail)
+
+	canAllocate, detail, err = ipam.CanAllocate(newPurposesTestPool(), 4)
+	assert.Nil(t, err)
+	assert.False(t, canAllocate)
+	assert.Equal(t, 1, detail.Purposes["nodes"].Datacenters["aws-eu-1"].Shortfall)
+}
+
+func TestIPAMSingleBlockOperationsWithPurposes(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+		},
+	})
+	ipamPool := newPurposesTestPool()
+
+	_, err := ipam.FreeBlocks("aws-eu-1", ipamPool)
+	assert.ErrorIs(t, err, errPoolHasPurposes)
+	assert.EqualError(t, err, "pool has purposes: select a purpose of pool net with ForPurpose")
+	_, err = ipam.PeekNext("aws-eu-1", ipamPool)
+	assert.ErrorIs(t, err, errPoolHasPurposes)
+	_, err = ipam.Explain("aws-eu-1", "c1", ipamPool)
+	assert.ErrorIs(t, err, errPoolHasPurposes)
+	_, err = ipam.Hold("aws-eu-1", ipamPool, nil, time.Hour)
+	assert.ErrorIs(t, err, errPoolHasPurposes)
+	_, err = ipam.ConfirmHold("token", ClusterRef{Datacenter: "aws-eu-1", Name: "c1"}, ipamPool)
+	assert.ErrorIs(t, err, errPoolHasPurposes)
+
+	nodesPool, err := ipamPool.ForPurpose("nodes")
+	assert.Nil(t, err)
+	freeBlocks, err := ipam.FreeBlocks("aws-eu-1", nodesPool)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"192.168.1.0-192.168.1.15"}, freeBlocks)
+	next, err := ipam.PeekNext("aws-eu-1", nodesPool)
+	assert.Nil(t, err)
+	assert.Equal(t, "nodes", next.Purpose)
+	assert.Equal(t, []string{"192.168.1.0-192.168.1.3"}, next.Addresses)
+	explanation, err := ipam.Explain("aws-eu-1", "c1", nodesPool)
+	assert.Nil(t, err)
+	assert.Equal(t, "net:nodes", explanation.IPAMPool)
+	assert.True(t, explanation.IsPlanned)
+
+	token, err := ipam.Hold("aws-eu-1", nodesPool, nil, time.Hour)
+	assert.Nil(t, err)
+	allocation, err := ipam.ConfirmHold(token, ClusterRef{Datacenter: "aws-eu-1", Name: "c1"}, nodesPool)
+	assert.Nil(t, err)
+	assert.Equal(t, "net:nodes", allocation.qualifiedIPAMPoolName())
+	assert.True(t, ipam.hasAllocation(ClusterRef{Datacenter: "aws-eu-1", Name: "c1"}, "net:nodes"))
+}
+
+func TestIPAMPoolStatus(t *testing.T) {
+	clock := newManualClock(time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC))
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c2", IPAMAllocations: []IPAMAllocation{}},
+		},
+		"aws-eu-2": {
+			{Name: "c3", IPAMAllocations: []IPAMAllocation{}},
+		},
+	}, WithClock(clock))
+	ipamPool := IPAMPool{
+		Name: "pool1",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/24", AllocationPrefix: 25},
+			"aws-eu-2": {Type: "range", PoolCIDR: "192.168.1.0/28", AllocationRange: 4},
+		},
+	}
+	assert.Nil(t, ipam.Apply(ipamPool))
+
+	clock.Advance(24 * time.Hour)
+	status, err := ipam.PoolStatus(ipamPool, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]IPAMPoolDatacenterStatus{
+		"aws-eu-1": {AllocatedClusters: 2, FreeCapacity: 0, Exhausted: true, ProjectedExhaustion: clock.Now()},
+		// 3 more clusters fit, at the rate of 1 allocation in the 30 days window
+		"aws-eu-2": {AllocatedClusters: 1, FreeCapacity: 12, ProjectedExhaustion: clock.Now().Add(90 * 24 * time.Hour)},
+	}, status.Datacenters)
+	assert.Nil(t, status.Purposes)
+	assert.Empty(t, status.LastError)
+	assert.Equal(t, []IPAMPoolCondition{
+		{Type: IPAMPoolConditionIncompatible, Status: "False"},
+		{Type: IPAMPoolConditionExhausted, Status: "True", Reason: "NoFreeSpace", Message: "no room for a new allocation in datacenters [aws-eu-1]"},
+	}, status.Conditions)
+
+	// the free space of a pool incompatible with the allocations is not reported
+	ipamPool.Datacenters["aws-eu-1"] = IPAMPoolDatacenterSettings{Type: "prefix", PoolCIDR: "10.1.0.0/24", AllocationPrefix: 25}
+	applyErr := ipam.Apply(ipamPool)
+	assert.ErrorIs(t, applyErr, errIncompatiblePool)
+	status, err = ipam.PoolStatus(ipamPool, applyErr)
+	assert.Nil(t, err)
+	assert.Empty(t, status.Datacenters)
+	assert.Equal(t, applyErr.Error(), status.LastError)
+	assert.Equal(t, []IPAMPoolCondition{
+		{Type: IPAMPoolConditionIncompatible, Status: "True", Reason: "IncompatibleAllocations", Message: errIncompatiblePool.Error()},
+		{Type: IPAMPoolConditionExhausted, Status: "False"},
+	}, status.Conditions)
+}
+
+func TestIPAMPoolStatusWithPurposes(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c2", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c3", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c4", IPAMAllocations: []IPAMAllocation{}},
+		},
+	})
+	ipamPool := newPurposesTestPool()
+	assert.Nil(t, ipam.Apply(ipamPool))
+
+	status, err := ipam.PoolStatus(ipamPool, nil)
+	assert.Nil(t, err)
+	assert.Empty(t, status.Datacenters)
+	assert.Equal(t, 4, status.Purposes["pods"]["aws-eu-1"].AllocatedClusters)
+	assert.Equal(t, 0, status.Purposes["pods"]["aws-eu-1"].FreeCapacity)
+	assert.True(t, status.Purposes["nodes"]["aws-eu-1"].Exhausted)
+	assert.Equal(t, IPAMPoolCondition{
+		Type:    IPAMPoolConditionExhausted,
+		Status:  "True",
+		Reason:  "NoFreeSpace",
+		Message: "no room for a new allocation in datacenters [aws-eu-1:nodes aws-eu-1:pods]",
+	}, status.Conditions[1])
+}
+
+func TestLoadStateWithPurposes(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{
+				{IPAMPoolName: "net", Purpose: "pods", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.0/25"},
+				{IPAMPoolName: "net", Purpose: "nodes", Cluster: "c1", Datacenter: "aws-eu-1", Type: "range", Addresses: []string{"192.168.1.0-192.168.1.3"}},
+			}},
+		},
+	})
+	data, err := ipam.MarshalState()
+	assert.Nil(t, err)
+
+	_, issues, err := LoadState(data, []IPAMPool{newPurposesTestPool()}, true)
+	assert.Nil(t, err)
+	assert.Equal(t, []StateLoadIssue{{
+		Datacenter: "aws-eu-1",
+		Cluster:    "c1",
+		IPAMPool:   "net:pods",
+		Message:    "allocation prefix is /25 but the pool allocates /26",
+	}}, issues)
+}
+
+func TestIPAMApplyLimits(t *testing.T) {
+	newDatacenterAllocations := func() map[string][]Cluster {
+		dcAllocations := map[string][]Cluster{}
+		for _, dc := range []string{"aws-eu-1", "aws-eu-2", "aws-eu-3", "aws-eu-4", "aws-eu-5"} {
+			dcAllocations[dc] = []Cluster{
+				{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+				{Name: "c2", IPAMAllocations: []IPAMAllocation{}},
+			}
+		}
+		return dcAllocations
+	}
+	ipamPool := IPAMPool{Name: "pool1", Datacenters: map[string]IPAMPoolDatacenterSettings{}}
+	for i, dc := range []string{"aws-eu-1", "aws-eu-2", "aws-eu-3", "aws-eu-4", "aws-eu-5"} {
+		ipamPool.Datacenters[dc] = IPAMPoolDatacenterSettings{Type: "range", PoolCIDR: fmt.Sprintf("10.%d.0.0/24", i), AllocationRange: 16}
+	}
+
+	// the datacenters allocated concurrently get the same allocations
+	sequential := New(newDatacenterAllocations())
+	assert.Nil(t, sequential.Apply(ipamPool))
+	concurrent := New(newDatacenterAllocations(), WithApplyLimits(ApplyLimits{DatacenterWorkers: 3}))
+	assert.Nil(t, concurrent.Apply(ipamPool))
+	assert.Equal(t, sequential.datacenterAllocations, concurrent.datacenterAllocations)
+	assert.Equal(t, []string{"10.4.0.16-10.4.0.31"}, concurrent.datacenterAllocations["aws-eu-5"][1].IPAMAllocations[0].Addresses)
+
+	// a pool tracking more used entries than allowed is refused
+	limited := New(newDatacenterAllocations(), WithApplyLimits(ApplyLimits{MaxUsageEntries: 40}))
+	assert.Nil(t, limited.Apply(ipamPool))
+	limited.datacenterAllocations["aws-eu-1"] = append(limited.datacenterAllocations["aws-eu-1"], Cluster{Name: "c3", IPAMAllocations: []IPAMAllocation{}})
+	err := limited.Apply(ipamPool)
+	assert.ErrorIs(t, err, errUsageLimitExceeded)
+	assert.EqualError(t, err, "usage limit exceeded: pool pool1 tracks 48 used entries in datacenter aws-eu-1, the limit is 40")
+	assert.Empty(t, limited.datacenterAllocations["aws-eu-1"][2].IPAMAllocations)
+}
+
+func TestIPAMMaxNewAllocationsPerApply(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c2", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c3", IPAMAllocations: []IPAMAllocation{}},
+		},
+	}, WithMaxNewAllocations(2))
+	ipamPool := IPAMPool{
+		Name: "pool1",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/24", AllocationPrefix: 26},
+		},
+	}
+
+	err := ipam.Apply(ipamPool)
+	assert.ErrorIs(t, err, errTooManyNewAllocations)
+	assert.EqualError(t, err, "too many new allocations: pool pool1 would make 3 new allocations, the limit is 2")
+	for _, dcCluster := range ipam.datacenterAllocations["aws-eu-1"] {
+		assert.Empty(t, dcCluster.IPAMAllocations)
+	}
+
+	err = ipam.ForceApply(ipamPool)
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.128/26", ipam.datacenterAllocations["aws-eu-1"][2].IPAMAllocations[0].CIDR)
+
+	// only the new allocations count, so re-applying the pool is fine
+	ipam.datacenterAllocations["aws-eu-1"] = append(ipam.datacenterAllocations["aws-eu-1"], Cluster{Name: "c4", IPAMAllocations: []IPAMAllocation{}})
+	err = ipam.Apply(ipamPool)
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.192/26", ipam.datacenterAllocations["aws-eu-1"][3].IPAMAllocations[0].CIDR)
+
+	// batches are limited too
+	batchPool := IPAMPool{
+		Name: "pool2",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "prefix", PoolCIDR: "10.1.0.0/24", AllocationPrefix: 26},
+		},
+	}
+	batch := []ClusterRef{{Datacenter: "aws-eu-1", Name: "c1"}, {Datacenter: "aws-eu-1", Name: "c2"}, {Datacenter: "aws-eu-1", Name: "c5"}}
+	_, err = ipam.AllocateBatch(batchPool, batch)
+	assert.EqualError(t, err, "too many new allocations: pool pool2 would make 3 new allocations, the limit is 2")
+	assert.Len(t, ipam.datacenterAllocations["aws-eu-1"], 4)
+	newAllocations, err := ipam.ForceAllocateBatch(batchPool, batch)
+	assert.Nil(t, err)
+	assert.Len(t, newAllocations, 3)
+}
+
+func TestIPAMProjectExhaustion(t *testing.T) {
+	start := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	clock := newManualClock(start)
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c2", IPAMAllocations: []IPAMAllocation{}},
+		},
+	}, WithClock(clock))
+	ipamPool := IPAMPool{
+		Name: "pool1",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/24", AllocationPrefix: 28},
+			"aws-us-1": {Type: "range", PoolCIDR: "10.1.0.0/24", AllocationRange: 8},
+		},
+	}
+	assert.Nil(t, ipam.Apply(ipamPool))
+
+	clock.Advance(24 * time.Hour)
+	ipam.datacenterAllocations["aws-eu-1"] = append(ipam.datacenterAllocations["aws-eu-1"],
+		Cluster{Name: "c3", IPAMAllocations: []IPAMAllocation{}},
+		Cluster{Name: "c4", IPAMAllocations: []IPAMAllocation{}},
+	)
+	assert.Nil(t, ipam.Apply(ipamPool))
+
+	projections, err := ipam.ProjectExhaustion(ipamPool, 10*24*time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, []ExhaustionProjection{
+		{
+			Datacenter:           "aws-eu-1",
+			IPAMPool:             "pool1",
+			RemainingAllocations: 12,
+			AllocationsPerDay:    0.4,
+			ExhaustedAt:          start.Add(31 * 24 * time.Hour),
+		},
+		{
+			Datacenter:           "aws-us-1",
+			IPAMPool:             "pool1",
+			RemainingAllocations: 32,
+		},
+	}, projections)
+
+	// allocations made before the window don't count
+	clock.Advance(20 * 24 * time.Hour)
+	projections, err = ipam.ProjectExhaustion(ipamPool, 10*24*time.Hour)
+	assert.Nil(t, err)
+	assert.True(t, projections[0].ExhaustedAt.IsZero())
+
+	// the status measures the rate over 30 days: 4 allocations in 30 days leave the 12 remaining ones for 90 days
+	status, err := ipam.PoolStatus(ipamPool, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, start.Add(111*24*time.Hour), status.Datacenters["aws-eu-1"].ProjectedExhaustion)
+}
+
+func TestIPAMAllocationIDPolicy(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "C_2", Tenant: "team-a", IPAMAllocations: []IPAMAllocation{}},
+		},
+	}, WithAllocationIDPolicy(DefaultAllocationID))
+	err := ipam.Apply(IPAMPool{
+		Name: "pool1",
+		Purposes: map[string]map[string]IPAMPoolDatacenterSettings{
+			"pods": {"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/24", AllocationPrefix: 26}},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "pool1-pods-aws-eu-1-c1-3b01875fab", ipam.datacenterAllocations["aws-eu-1"][0].IPAMAllocations[0].ID)
+	assert.Equal(t, "pool1-pods-aws-eu-1-team-a-c-2-e387230b9b", ipam.datacenterAllocations["aws-eu-1"][1].IPAMAllocations[0].ID)
+
+	// the IDs of allocations which read the same differ, and fit a Kubernetes name
+	id, err := DefaultAllocationID(IPAMAllocation{IPAMPoolName: "p-d", Datacenter: "x", Cluster: "c1"})
+	assert.Nil(t, err)
+	otherID, err := DefaultAllocationID(IPAMAllocation{IPAMPoolName: "p", Datacenter: "d-x", Cluster: "c1"})
+	assert.Nil(t, err)
+	assert.NotEqual(t, id, otherID)
+	id, err = DefaultAllocationID(IPAMAllocation{IPAMPoolName: "pool1", Datacenter: "aws-eu-1", Cluster: strings.Repeat("c", 100)})
+	assert.Nil(t, err)
+	assert.Len(t, id, 63)
+	assert.Regexp(t, "^pool1-aws-eu-1-c+-[0-9a-f]{10}$", id)
+
+	// IDs must be unique, none of the new allocations is made otherwise
+	WithAllocationIDPolicy(func(allocation IPAMAllocation) (string, error) {
+		return allocation.IPAMPoolName, nil
+	})(&ipam)
+	err = ipam.Apply(IPAMPool{
+		Name: "pool2",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "prefix", PoolCIDR: "10.1.0.0/24", AllocationPrefix: 26},
+		},
+	})
+	assert.ErrorIs(t, err, errDuplicateAllocationID)
+	assert.Len(t, ipam.datacenterAllocations["aws-eu-1"][0].IPAMAllocations, 1)
+	assert.Len(t, ipam.datacenterAllocations["aws-eu-1"][1].IPAMAllocations, 1)
+}
+
+func TestPlanIPAMPoolFromAggregate(t *testing.T) {
+	ipamPool, err := PlanIPAMPoolFromAggregate("pool1", "10.0.0.0/16", []DatacenterDemand{
+		{Datacenter: "aws-eu-1", Clusters: 3, AllocationPrefix: 24},
+		{Datacenter: "aws-us-1", Clusters: 16, AllocationPrefix: 24},
+		{Datacenter: "gcp-eu-1", Clusters: 1, AllocationPrefix: 26},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, IPAMPool{
+		Name: "pool1",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-us-1": {Type: "prefix", PoolCIDR: "10.0.0.0/20", AllocationPrefix: 24},
+			"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.16.0/22", AllocationPrefix: 24},
+			"gcp-eu-1": {Type: "prefix", PoolCIDR: "10.0.20.0/26", AllocationPrefix: 26},
+		},
+	}, ipamPool)
+
+	ipamPool, err = PlanIPAMPoolFromAggregate("pool1", "fd00::/48", []DatacenterDemand{
+		{Datacenter: "aws-eu-1", Clusters: 2, AllocationPrefix: 64},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "fd00::/63", ipamPool.Datacenters["aws-eu-1"].PoolCIDR)
+
+	_, err = PlanIPAMPoolFromAggregate("pool1", "10.0.0.0/24", []DatacenterDemand{
+		{Datacenter: "aws-eu-1", Clusters: 2, AllocationPrefix: 25},
+		{Datacenter: "aws-us-1", Clusters: 1, AllocationPrefix: 26},
+	})
+	assert.EqualError(t, err, "aggregate 10.0.0.0/24 is too small for the expected clusters of every datacenter")
+}
+
+func TestIPAMPoolUniqueAcrossDatacenters(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {{Name: "c1", IPAMAllocations: []IPAMAllocation{}}},
+		"aws-us-1": {{Name: "c2", IPAMAllocations: []IPAMAllocation{}}},
+	})
+	err := ipam.Apply(IPAMPool{
+		Name:                    "pool1",
+		UniqueAcrossDatacenters: true,
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/24", AllocationPrefix: 26},
+			"aws-us-1": {Type: "prefix", PoolCIDR: "10.0.0.0/24", AllocationPrefix: 26},
+		},
+	})
+	assert.Nil(t, err)
+	// the datacenters are allocated in name order
+	assert.Equal(t, "10.0.0.0/26", ipam.datacenterAllocations["aws-eu-1"][0].IPAMAllocations[0].CIDR)
+	assert.Equal(t, "10.0.0.64/26", ipam.datacenterAllocations["aws-us-1"][0].IPAMAllocations[0].CIDR)
+
+	// the existing allocations of the other datacenters are skipped too, also by range pools
+	ipamPool := IPAMPool{
+		Name:                    "pool2",
+		UniqueAcrossDatacenters: true,
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "range", PoolCIDR: "192.168.0.0/28", AllocationRange: 4},
+			"aws-us-1": {Type: "range", PoolCIDR: "192.168.0.0/24", AllocationRange: 4},
+		},
+	}
+	err = ipam.Apply(IPAMPool{Name: "pool2", Datacenters: map[string]IPAMPoolDatacenterSettings{"aws-eu-1": ipamPool.Datacenters["aws-eu-1"]}})
+	assert.Nil(t, err)
+	err = ipam.Apply(ipamPool)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"192.168.0.0-192.168.0.3"}, ipam.datacenterAllocations["aws-eu-1"][0].IPAMAllocations[1].Addresses)
+	assert.Equal(t, []string{"192.168.0.4-192.168.0.7"}, ipam.datacenterAllocations["aws-us-1"][0].IPAMAllocations[1].Addresses)
+
+	// pools reuse the space of every datacenter by default
+	ipam.datacenterAllocations["aws-eu-1"] = append(ipam.datacenterAllocations["aws-eu-1"], Cluster{Name: "c3", IPAMAllocations: []IPAMAllocation{}})
+	ipam.datacenterAllocations["aws-us-1"] = append(ipam.datacenterAllocations["aws-us-1"], Cluster{Name: "c4", IPAMAllocations: []IPAMAllocation{}})
+	err = ipam.Apply(IPAMPool{
+		Name: "pool3",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "prefix", PoolCIDR: "10.1.0.0/24", AllocationPrefix: 26},
+			"aws-us-1": {Type: "prefix", PoolCIDR: "10.1.0.0/24", AllocationPrefix: 26},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "10.1.0.0/26", ipam.datacenterAllocations["aws-eu-1"][0].IPAMAllocations[2].CIDR)
+	assert.Equal(t, "10.1.0.0/26", ipam.datacenterAllocations["aws-us-1"][0].IPAMAllocations[2].CIDR)
+}
+
+func TestRenderWireGuardPeers(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{
+				{IPAMPoolName: "pool1", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.0/26"},
+			}},
+			{Name: "c2", IPAMAllocations: []IPAMAllocation{
+				{IPAMPoolName: "pool1", Cluster: "c2", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.64/26"},
+				{IPAMPoolName: "pool2", Cluster: "c2", Datacenter: "aws-eu-1", Type: "range", Addresses: []string{"192.168.0.3-192.168.0.9"}},
+			}},
+		},
+		"aws-us-1": {
+			{Name: "c3", Tenant: "team-a", IPAMAllocations: []IPAMAllocation{
+				{IPAMPoolName: "pool1", Cluster: "c3", ClusterTenant: "team-a", Datacenter: "aws-us-1", Type: "prefix", CIDR: "fd00::/64"},
+			}},
+			{Name: "c4", IPAMAllocations: []IPAMAllocation{}},
+		},
+	})
+	peers := map[ClusterRef]WireGuardPeer{
+		{Datacenter: "aws-eu-1", Name: "c1"}:                   {PublicKey: "key1"},
+		{Datacenter: "aws-eu-1", Name: "c2"}:                   {PublicKey: "key2", Endpoint: "c2.example.com:51820"},
+		{Datacenter: "aws-us-1", Tenant: "team-a", Name: "c3"}: {PublicKey: "key3", PersistentKeepalive: 25},
+		{Datacenter: "aws-us-1", Name: "c4"}:                   {PublicKey: "key4"},
+	}
+
+	config, err := RenderWireGuardPeers(ipam, ClusterRef{Datacenter: "aws-eu-1", Name: "c1"}, peers)
+	assert.Nil(t, err)
+	assert.Equal(t, `# cluster c2 (datacenter aws-eu-1)
+[Peer]
+PublicKey = key2
+Endpoint = c2.example.com:51820
+AllowedIPs = 10.0.0.64/26, 192.168.0.3/32, 192.168.0.4/30, 192.168.0.8/31
+
+# cluster team-a/c3 (datacenter aws-us-1)
+[Peer]
+PublicKey = key3
+AllowedIPs = fd00::/64
+PersistentKeepalive = 25
+`, config)
+
+	peers[ClusterRef{Datacenter: "aws-eu-1", Name: "c2"}] = WireGuardPeer{}
+	_, err = RenderWireGuardPeers(ipam, ClusterRef{Datacenter: "aws-eu-1", Name: "c1"}, peers)
+	assert.EqualError(t, err, "WireGuard peer of cluster c2 in datacenter aws-eu-1 has no public key")
+}
+
+func TestRenderAddressPlan(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c2", Tenant: "team-a", IPAMAllocations: []IPAMAllocation{}},
+		},
+	})
+	ipamPools := []IPAMPool{
+		{
+			Name: "pool1",
+			Datacenters: map[string]IPAMPoolDatacenterSettings{
+				"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/24", AllocationPrefix: 26},
+			},
+		},
+		{
+			Name: "pool2",
+			Datacenters: map[string]IPAMPoolDatacenterSettings{
+				"aws-eu-1": {Type: "range", PoolCIDR: "192.168.0.0/28", AllocationRange: 4},
+			},
+		},
+	}
+	for _, ipamPool := range ipamPools {
+		assert.Nil(t, ipam.Apply(ipamPool))
+	}
+	ipam.datacenterAllocations["aws-eu-1"][0].IPAMAllocations[0].Description = "pods | nodes"
+
+	markdown, err := RenderAddressPlan(ipam, ipamPools, "markdown")
+	assert.Nil(t, err)
+	assert.Equal(t, `# Address plan
+
+## aws-eu-1
+
+### pool1
+
+prefix pool 10.0.0.0/24 with allocations of /26: 2 allocations, 128 free addresses
+
+| Block | Cluster | Description |
+| --- | --- | --- |
+| 10.0.0.0/26 | c1 | pods \| nodes |
+| 10.0.0.64/26 | team-a/c2 |  |
+| 10.0.0.128/26 | *free* |  |
+| 10.0.0.192/26 | *free* |  |
+
+### pool2
+
+range pool 192.168.0.0/28 with allocations of 4 addresses: 2 allocations, 8 free addresses
+
+| Block | Cluster | Description |
+| --- | --- | --- |
+| 192.168.0.0-192.168.0.3 | c1 |  |
+| 192.168.0.4-192.168.0.7 | team-a/c2 |  |
+| 192.168.0.8-192.168.0.15 | *free* |  |
+`, markdown)
+
+	html, err := RenderAddressPlan(ipam, ipamPools, "html")
+	assert.Nil(t, err)
+	assert.Contains(t, html, "<tr><td>10.0.0.0/26</td><td>c1</td><td>pods | nodes</td></tr>\n")
+	assert.Contains(t, html, `<tr class="free"><td>10.0.0.128/26</td><td>free</td><td></td></tr>`)
+
+	_, err = RenderAddressPlan(ipam, ipamPools, "pdf")
+	assert.NotNil(t, err)
+}
+
+func TestIPAMImportAllocationsConflictPolicies(t *testing.T) {
+	newTestIPAM := func() IPAM {
+		return New(map[string][]Cluster{
+			"aws-eu-1": {
+				{Name: "c1", IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pool1", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.0/26"},
+				}},
+				{Name: "c2", IPAMAllocations: []IPAMAllocation{
+					{IPAMPoolName: "pool1", Cluster: "c2", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.64/26"},
+				}},
+			},
+		})
+	}
+	imported := []IPAMAllocation{
+		// same pool as the existing allocation of c1
+		{IPAMPoolName: "pool1", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.128/26"},
+		// overlaps the allocation of c2
+		{IPAMPoolName: "pool2", Cluster: "c3", Datacenter: "aws-eu-1", Type: "range", Addresses: []string{"10.0.0.70-10.0.0.71"}},
+		// no conflict
+		{IPAMPoolName: "pool1", Cluster: "c4", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.192/26"},
+	}
+	expectedConflicts := []ImportConflict{
+		{Imported: imported[0], Existing: []IPAMAllocation{{IPAMPoolName: "pool1", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.0/26"}}},
+		{Imported: imported[1], Existing: []IPAMAllocation{{IPAMPoolName: "pool1", Cluster: "c2", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.64/26"}}},
+	}
+	clusterBlocks := func(ipam IPAM) map[string][]string {
+		blocks := map[string][]string{}
+		for _, dcCluster := range ipam.datacenterAllocations["aws-eu-1"] {
+			blocks[dcCluster.Name] = []string{}
+			for _, ipamAllocation := range dcCluster.IPAMAllocations {
+				blocks[dcCluster.Name] = append(blocks[dcCluster.Name], allocationBlocks(ipamAllocation)...)
+			}
+		}
+		return blocks
+	}
+
+	for _, policy := range []ImportConflictPolicy{ImportConflictFail, ImportConflictList} {
+		ipam := newTestIPAM()
+		conflicts, err := ipam.ImportAllocations(imported, policy)
+		if policy == ImportConflictFail {
+			assert.ErrorIs(t, err, errImportConflict)
+		} else {
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, expectedConflicts, conflicts)
+		assert.Equal(t, map[string][]string{"c1": {"10.0.0.0/26"}, "c2": {"10.0.0.64/26"}}, clusterBlocks(ipam))
+	}
+
+	ipam := newTestIPAM()
+	conflicts, err := ipam.ImportAllocations(imported, ImportConflictPreferExisting)
+	assert.Nil(t, err)
+	assert.Equal(t, expectedConflicts, conflicts)
+	assert.Equal(t, map[string][]string{"c1": {"10.0.0.0/26"}, "c2": {"10.0.0.64/26"}, "c4": {"10.0.0.192/26"}}, clusterBlocks(ipam))
+
+	ipam = newTestIPAM()
+	conflicts, err = ipam.ImportAllocations(imported, ImportConflictPreferImported)
+	assert.Nil(t, err)
+	assert.Equal(t, expectedConflicts, conflicts)
+	assert.Equal(t, map[string][]string{"c1": {"10.0.0.128/26"}, "c2": {}, "c3": {"10.0.0.70-10.0.0.71"}, "c4": {"10.0.0.192/26"}}, clusterBlocks(ipam))
+
+	_, err = ipam.ImportAllocations(imported, "merge")
+	assert.NotNil(t, err)
+}
+
+type fakeEventSink []string
+
+func (s *fakeEventSink) Send(event AllocationEvent) error {
+	*s = append(*s, fmt.Sprintf("%s %s/%s %s %s", event.Type, event.Allocation.Datacenter, event.Allocation.Cluster, event.Allocation.qualifiedIPAMPoolName(), strings.Join(allocationBlocks(event.Allocation), ",")))
+	return nil
+}
+
+func TestIPAMEventSink(t *testing.T) {
+	sink := &fakeEventSink{}
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c2", IPAMAllocations: []IPAMAllocation{}},
+		},
+	}, WithEventSink(sink))
+	ipamPool := IPAMPool{
+		Name: "pool1",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/24", AllocationPrefix: 26},
+			"aws-eu-2": {Type: "prefix", PoolCIDR: "10.1.0.0/24", AllocationPrefix: 26},
+		},
+	}
+	assert.Nil(t, ipam.Apply(ipamPool))
+	assert.Equal(t, fakeEventSink{
+		"allocated aws-eu-1/c1 pool1 10.0.0.0/26",
+		"allocated aws-eu-1/c2 pool1 10.0.0.64/26",
+	}, *sink)
+
+	*sink = fakeEventSink{}
+	_, err := ipam.ReleaseAllocations([]AllocationRef{{Datacenter: "aws-eu-1", Cluster: "c1", IPAMPool: "pool1"}}, "decommission")
+	assert.Nil(t, err)
+	tombstone := ipam.Tombstones()[0]
+	_, err = ipam.RestoreAllocation(tombstone.ID)
+	assert.Nil(t, err)
+	assert.Nil(t, ipam.LabelAllocation(ClusterRef{Datacenter: "aws-eu-1", Name: "c1"}, "", "pool1", map[string]string{"wave": "1"}))
+	selector, err := ParseLabelSelector("wave=1")
+	assert.Nil(t, err)
+	_, err = ipam.ReleaseSelected(selector, "wave 1")
+	assert.Nil(t, err)
+	assert.Equal(t, fakeEventSink{
+		"released aws-eu-1/c1 pool1 10.0.0.0/26",
+		"allocated aws-eu-1/c1 pool1 10.0.0.0/26",
+		"labeled aws-eu-1/c1 pool1 10.0.0.0/26",
+		"released aws-eu-1/c1 pool1 10.0.0.0/26",
+	}, *sink)
+
+	*sink = fakeEventSink{}
+	_, err = ipam.MoveCluster("c2", "aws-eu-1", "aws-eu-2", ipamPool)
+	assert.Nil(t, err)
+	assert.Equal(t, fakeEventSink{
+		"allocated aws-eu-2/c2 pool1 10.1.0.0/26",
+		"released aws-eu-1/c2 pool1 10.0.0.64/26",
+	}, *sink)
+
+	*sink = fakeEventSink{}
+	_, err = ipam.ImportAllocations([]IPAMAllocation{
+		{IPAMPoolName: "pool1", Cluster: "c3", Datacenter: "aws-eu-2", Type: "prefix", CIDR: "10.1.0.0/26"},
+	}, ImportConflictPreferImported)
+	assert.Nil(t, err)
+	_, err = ipam.Release("pool1")
+	assert.Nil(t, err)
+	assert.Equal(t, fakeEventSink{
+		"released aws-eu-2/c2 pool1 10.1.0.0/26",
+		"allocated aws-eu-2/c3 pool1 10.1.0.0/26",
+		"released aws-eu-2/c3 pool1 10.1.0.0/26",
+	}, *sink)
+}
+
+type fakeDNSProvider []string
+
+func (p *fakeDNSProvider) UpsertRecord(record DNSRecord) error {
+	*p = append(*p, fmt.Sprintf("upsert %s %s %s %d", record.Name, record.Type, record.Value, record.TTL))
+	return nil
+}
+
+func (p *fakeDNSProvider) DeleteRecord(record DNSRecord) error {
+	*p = append(*p, fmt.Sprintf("delete %s %s %s %d", record.Name, record.Type, record.Value, record.TTL))
+	return nil
+}
+
+func TestDNSSink(t *testing.T) {
+	provider := &fakeDNSProvider{}
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c2", IPAMAllocations: []IPAMAllocation{}},
+		},
+	}, WithEventSink(NewDNSSink(provider, "dns-name", 300)))
+	assert.Nil(t, ipam.Apply(IPAMPool{
+		Name: "vip",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "range", PoolCIDR: "10.0.0.0/24", AllocationRange: 1},
+		},
+	}))
+	assert.Nil(t, ipam.Apply(IPAMPool{
+		Name: "nodes",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "range", PoolCIDR: "10.1.0.0/24", AllocationRange: 4},
+		},
+	}))
+	c1 := ClusterRef{Datacenter: "aws-eu-1", Name: "c1"}
+	c2 := ClusterRef{Datacenter: "aws-eu-1", Name: "c2"}
+	assert.Nil(t, ipam.LabelAllocation(c1, "", "vip", map[string]string{"dns-name": "api.c1.example.com"}))
+	assert.Nil(t, ipam.LabelAllocation(c1, "", "vip", map[string]string{"team": "platform"}))
+	assert.Nil(t, ipam.LabelAllocation(c2, "", "vip", map[string]string{"dns-name": "api.c2.example.com"}))
+	assert.Nil(t, ipam.LabelAllocation(c2, "", "vip", map[string]string{"dns-name": "ingress.c2.example.com."}))
+	assert.Nil(t, ipam.LabelAllocation(c2, "", "nodes", map[string]string{"dns-name": "nodes.c2.example.com"}))
+	assert.Equal(t, fakeDNSProvider{
+		"upsert api.c1.example.com. A 10.0.0.0 300",
+		"upsert api.c2.example.com. A 10.0.0.1 300",
+		"delete api.c2.example.com. A 10.0.0.1 300",
+		"upsert ingress.c2.example.com. A 10.0.0.1 300",
+	}, *provider)
+
+	*provider = fakeDNSProvider{}
+	_, err := ipam.ReleaseAllocations([]AllocationRef{{Datacenter: "aws-eu-1", Cluster: "c2", IPAMPool: "vip"}}, "decommission")
+	assert.Nil(t, err)
+	assert.Nil(t, ipam.LabelAllocation(c1, "", "vip", map[string]string{"dns-name": ""}))
+	assert.Equal(t, fakeDNSProvider{
+		"delete ingress.c2.example.com. A 10.0.0.1 300",
+		"delete api.c1.example.com. A 10.0.0.0 300",
+	}, *provider)
+
+	*provider = fakeDNSProvider{}
+	_, err = ipam.RestoreAllocation(ipam.Tombstones()[0].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, fakeDNSProvider{"upsert ingress.c2.example.com. A 10.0.0.1 300"}, *provider)
+}
+
+type fakeEventRecorder []string
+
+func (r *fakeEventRecorder) Event(object EventObject, eventType, reason, message string) {
+	*r = append(*r, fmt.Sprintf("%s %s %s %s: %s", object.Kind, object.Name, eventType, reason, message))
+}
+
+func TestIPAMEventRecorder(t *testing.T) {
+	recorder := &fakeEventRecorder{}
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c2", Tenant: "team-a", IPAMAllocations: []IPAMAllocation{}},
+		},
+	}, WithEventRecorder(recorder))
+	ipamPool := IPAMPool{
+		Name: "pool1",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/26", AllocationPrefix: 26},
+		},
+	}
+
+	// nothing is allocated when a cluster cannot be served
+	err := ipam.Apply(ipamPool)
+	assert.NotNil(t, err)
+	assert.Equal(t, fakeEventRecorder{
+		"Cluster team-a/c2 Warning Exhausted: " + err.Error(),
+		"IPAMPool pool1 Warning Exhausted: " + err.Error(),
+	}, *recorder)
+
+	*recorder = fakeEventRecorder{}
+	WithPendingAllocations()(&ipam)
+	assert.Nil(t, ipam.Apply(ipamPool))
+	assert.Equal(t, fakeEventRecorder{
+		"Cluster c1 Normal Allocated: allocated 10.0.0.0/26 of pool pool1 to cluster c1",
+		"IPAMPool pool1 Normal Allocated: allocated 10.0.0.0/26 of pool pool1 to cluster c1",
+		"Cluster team-a/c2 Warning Exhausted: pool pool1 is exhausted in datacenter aws-eu-1, cluster team-a/c2 waits for an allocation",
+		"IPAMPool pool1 Warning Exhausted: pool pool1 is exhausted in datacenter aws-eu-1, cluster team-a/c2 waits for an allocation",
+	}, *recorder)
+
+	*recorder = fakeEventRecorder{}
+	ipamPool.Datacenters["aws-eu-1"] = IPAMPoolDatacenterSettings{Type: "prefix", PoolCIDR: "10.0.0.0/26", AllocationPrefix: 27}
+	err = ipam.Apply(ipamPool)
+	assert.ErrorIs(t, err, errIncompatiblePool)
+	assert.Equal(t, fakeEventRecorder{"IPAMPool pool1 Warning Incompatible: " + err.Error()}, *recorder)
+}
+
+func TestIPAMApprovalHooks(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {{Name: "c1", IPAMAllocations: []IPAMAllocation{}}},
+		"aws-eu-2": {},
+	})
+	ipamPool := IPAMPool{
+		Name:  "pool1",
+		Owner: "team-network",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/24", AllocationPrefix: 26},
+			"aws-eu-2": {Type: "prefix", PoolCIDR: "10.1.0.0/24", AllocationPrefix: 26},
+		},
+	}
+	assert.Nil(t, ipam.Apply(ipamPool))
+
+	approvedTickets := map[string]bool{}
+	operations := []DestructiveOperation{}
+	WithApprovalHook(func(operation DestructiveOperation) error {
+		operations = append(operations, operation)
+		if operation.IPAMPool != nil && !approvedTickets[operation.IPAMPool.Owner] {
+			return fmt.Errorf("no approved ticket for %s", operation.IPAMPool.Owner)
+		}
+		return nil
+	})(&ipam)
+
+	_, err := ipam.MoveCluster("c1", "aws-eu-1", "aws-eu-2", ipamPool)
+	assert.ErrorIs(t, err, errNotApproved)
+	assert.EqualError(t, err, "operation not approved: no approved ticket for team-network")
+	assert.Len(t, ipam.datacenterAllocations["aws-eu-1"], 1)
+	assert.Equal(t, DestructiveReallocation, operations[0].Kind)
+	assert.Equal(t, []string{"10.0.0.0/26"}, allocationBlocks(operations[0].Allocations[0]))
+
+	approvedTickets["team-network"] = true
+	_, err = ipam.MoveCluster("c1", "aws-eu-1", "aws-eu-2", ipamPool)
+	assert.Nil(t, err)
+	assert.Equal(t, "10.1.0.0/26", ipam.datacenterAllocations["aws-eu-2"][0].IPAMAllocations[0].CIDR)
+
+	// imports releasing allocations are destructive too
+	WithApprovalHook(func(operation DestructiveOperation) error {
+		return fmt.Errorf("imports are frozen")
+	})(&ipam)
+	_, err = ipam.ImportAllocations([]IPAMAllocation{
+		{IPAMPoolName: "pool1", Cluster: "c1", Datacenter: "aws-eu-2", Type: "prefix", CIDR: "10.1.0.64/26"},
+	}, ImportConflictPreferImported)
+	assert.EqualError(t, err, "operation not approved: imports are frozen")
+	assert.Equal(t, DestructiveRelease, operations[len(operations)-1].Kind)
+	assert.Equal(t, "10.1.0.0/26", ipam.datacenterAllocations["aws-eu-2"][0].IPAMAllocations[0].CIDR)
+}
+
+func TestIPAMAllocationAccessors(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {{Name: "c2", IPAMAllocations: []IPAMAllocation{}}, {Name: "c1", IPAMAllocations: []IPAMAllocation{}}},
+	})
+	assert.Nil(t, ipam.Apply(IPAMPool{
+		Name:        "pool2",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{"aws-eu-1": {Type: "prefix", PoolCIDR: "10.1.0.0/24", AllocationPrefix: 26}},
+	}))
+	assert.Nil(t, ipam.Apply(IPAMPool{
+		Name:        "pool1",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/24", AllocationPrefix: 26}},
+	}))
+
+	allocations := ipam.Allocations()
+	assert.Len(t, allocations, 4)
+	assert.Equal(t, []string{"c1/pool1", "c1/pool2", "c2/pool1", "c2/pool2"}, []string{
+		allocations[0].Cluster + "/" + allocations[0].IPAMPoolName,
+		allocations[1].Cluster + "/" + allocations[1].IPAMPoolName,
+		allocations[2].Cluster + "/" + allocations[2].IPAMPoolName,
+		allocations[3].Cluster + "/" + allocations[3].IPAMPoolName,
+	})
+
+	clusterAllocations, err := ipam.ClusterAllocations(ClusterRef{Datacenter: "aws-eu-1", Name: "c2"})
+	assert.Nil(t, err)
+	assert.Len(t, clusterAllocations, 2)
+	assert.Equal(t, "10.0.0.0/26", clusterAllocations[0].CIDR)
+	assert.Equal(t, "10.1.0.0/26", clusterAllocations[1].CIDR)
+
+	_, err = ipam.ClusterAllocations(ClusterRef{Datacenter: "aws-eu-1", Name: "c3"})
+	assert.EqualError(t, err, "cluster c3 not found in datacenter aws-eu-1")
+}
+
+func TestPlacementConstraints(t *testing.T) {
+	env := constraintEnv{
+		ipamPool:      IPAMPool{Name: "pool1"},
+		cluster:       Cluster{Name: "c1", Priority: 2, Labels: map[string]string{"tier": "edge"}},
+		dc:            "aws-eu-1",
+		dcIPAMPoolCfg: IPAMPoolDatacenterSettings{Type: "range", PoolCIDR: "10.0.0.0/24", AllocationRange: 32},
+	}
+	testCases := []struct {
+		constraint  string
+		isSatisfied bool
+		err         string
+	}{
+		{constraint: "cluster.labels['tier'] == 'edge' implies allocationRange <= 16", isSatisfied: false},
+		{constraint: "cluster.labels[\"tier\"] == \"core\" implies allocationRange <= 16", isSatisfied: true},
+		{constraint: "cluster.labels['zone'] == ''", isSatisfied: true},
+		{constraint: "!(type == 'prefix') && (cluster.priority > 1 || datacenter != 'aws-eu-1')", isSatisfied: true},
+		{constraint: "pool == 'pool2' || cluster.name >= 'c2'", isSatisfied: false},
+		{constraint: "false implies false implies false", isSatisfied: true},
+		{constraint: "allocationRange == 'big'", err: "cannot compare 32 with \"big\""},
+		{constraint: "allocationRange", err: "constraint is not a boolean expression"},
+		{constraint: "allocationRnage <= 16", err: "unknown variable \"allocationRnage\", did you mean \"allocationRange\"?"},
+		{constraint: "cluster.lables['tier'] == 'edge'", err: "unknown variable \"cluster.lables\", did you mean \"cluster.labels\"?"},
+		{constraint: "cluster.labels['tier'] == 'edge", err: "unterminated string in constraint \"cluster.labels['tier'] == 'edge\""},
+		{constraint: "(mtu > 1500", err: "expected \")\", found \"\""},
+		{constraint: "mtu > 1500 1", err: "unexpected \"1\" in constraint \"mtu > 1500 1\""},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.constraint, func(t *testing.T) {
+			constraint, err := parsePlacementConstraint(testCase.constraint)
+			if err == nil {
+				var isSatisfied bool
+				isSatisfied, err = constraint.isSatisfied(env)
+				assert.Equal(t, testCase.isSatisfied, isSatisfied)
+			}
+			if testCase.err != "" {
+				assert.EqualError(t, err, testCase.err)
+				return
+			}
+			assert.Nil(t, err)
+		})
+	}
+}
+
+func TestIPAMPoolPlacementConstraints(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c2", Labels: map[string]string{"tier": "edge"}, IPAMAllocations: []IPAMAllocation{}},
+		},
+	})
+	ipamPool := IPAMPool{
+		Name:        "pool1",
+		Constraints: []string{"cluster.labels['tier'] == 'edge' implies allocationRange <= 16"},
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "range", PoolCIDR: "10.0.0.0/24", AllocationRange: 32},
+		},
+	}
+
+	err := ipam.Apply(ipamPool)
+	assert.ErrorIs(t, err, errPlacementConstraintViolated)
+	assert.EqualError(t, err, "placement constraint violated: cluster c2 in datacenter aws-eu-1 breaks constraint \"cluster.labels['tier'] == 'edge' implies allocationRange <= 16\" of pool pool1")
+	assert.Empty(t, ipam.Allocations())
+
+	ipamPool.Datacenters["aws-eu-1"] = IPAMPoolDatacenterSettings{Type: "range", PoolCIDR: "10.0.0.0/24", AllocationRange: 16}
+	assert.Nil(t, ipam.Apply(ipamPool))
+	assert.Len(t, ipam.Allocations(), 2)
+
+	// clusters created by a batch or by the confirmation of a hold are checked too
+	forbiddenPool := IPAMPool{
+		Name:        "pool2",
+		Constraints: []string{"cluster.name != 'forbidden'"},
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "prefix", PoolCIDR: "10.1.0.0/24", AllocationPrefix: 26},
+		},
+	}
+	_, err = ipam.AllocateBatch(forbiddenPool, []ClusterRef{{Datacenter: "aws-eu-1", Name: "forbidden"}})
+	assert.ErrorIs(t, err, errPlacementConstraintViolated)
+	token, err := ipam.Hold("aws-eu-1", forbiddenPool, nil, time.Minute)
+	assert.Nil(t, err)
+	_, err = ipam.ConfirmHold(token, ClusterRef{Datacenter: "aws-eu-1", Name: "forbidden"}, forbiddenPool)
+	assert.ErrorIs(t, err, errPlacementConstraintViolated)
+	assert.Len(t, ipam.datacenterAllocations["aws-eu-1"], 2)
+	// the hold survives the failed confirmation
+	_, err = ipam.ConfirmHold(token, ClusterRef{Datacenter: "aws-eu-1", Name: "allowed"}, forbiddenPool)
+	assert.Nil(t, err)
+	assert.Len(t, ipam.datacenterAllocations["aws-eu-1"], 3)
+
+	ipamPool.Constraints = []string{"allocationRange < "}
+	issues := lintIPAMPool(ipamPool)
+	assert.Len(t, issues, 1)
+	assert.Equal(t, "constraints[0]", issues[0].Field)
+	assert.Equal(t, "unexpected end of constraint", issues[0].Message)
+}
+
+func TestIPAMRelease(t *testing.T) {
+	now := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {{Name: "c1", IPAMAllocations: []IPAMAllocation{}}},
+		"aws-eu-2": {{Name: "c2", IPAMAllocations: []IPAMAllocation{}}},
+	}, WithClock(newManualClock(now)))
+	ipamPool := IPAMPool{
+		Name:   "pool1",
+		Tenant: "team-a",
+		Purposes: map[string]map[string]IPAMPoolDatacenterSettings{
+			"pods": {
+				"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/24", AllocationPrefix: 26},
+				"aws-eu-2": {Type: "prefix", PoolCIDR: "10.1.0.0/24", AllocationPrefix: 26},
+			},
+		},
+	}
+	assert.Nil(t, ipam.Apply(ipamPool))
+	assert.Nil(t, ipam.Apply(IPAMPool{
+		Name:        "pool2",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{"aws-eu-1": {Type: "range", PoolCIDR: "10.2.0.0/24", AllocationRange: 4}},
+	}))
+
+	WithApprovalHook(func(operation DestructiveOperation) error {
+		return fmt.Errorf("releases are frozen")
+	})(&ipam)
+	_, err := ipam.Release("team-a/pool1")
+	assert.EqualError(t, err, "operation not approved: releases are frozen")
+	assert.Len(t, ipam.Allocations(), 3)
+
+	ipam.approvalHooks = nil
+	released, err := ipam.Release("team-a/pool1")
+	assert.Nil(t, err)
+	assert.Len(t, released, 2)
+	assert.Equal(t, "10.0.0.0/26", released[0].CIDR)
+	assert.Equal(t, "10.1.0.0/26", released[1].CIDR)
+	allocations := ipam.Allocations()
+	assert.Len(t, allocations, 1)
+	assert.Equal(t, "pool2", allocations[0].IPAMPoolName)
+
+	records, err := ipam.History("10.0.0.1")
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+	assert.Equal(t, now, records[0].ReleasedAt)
+
+	// releasing a pool without allocations is a no-op
+	released, err = ipam.Release("team-a/pool1")
+	assert.Nil(t, err)
+	assert.Empty(t, released)
+
+	// the released blocks can be allocated again
+	assert.Nil(t, ipam.Apply(ipamPool))
+	assert.Len(t, ipam.Allocations(), 3)
+}
+
+func TestIPAMReleaseAllocations(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c2", Tenant: "team-a", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c3", IPAMAllocations: []IPAMAllocation{}},
+		},
+	})
+	ipamPool := IPAMPool{
+		Name: "pool1",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/24", AllocationPrefix: 26},
+		},
+	}
+	assert.Nil(t, ipam.Apply(ipamPool))
+
+	// nothing is released if any of the allocations doesn't exist
+	_, err := ipam.ReleaseAllocations([]AllocationRef{
+		{Datacenter: "aws-eu-1", Cluster: "c1", IPAMPool: "pool1"},
+		{Datacenter: "aws-eu-1", Cluster: "c2", IPAMPool: "pool1"},
+	}, "decommission")
+	assert.EqualError(t, err, "cluster c2 not found in datacenter aws-eu-1")
+	_, err = ipam.ReleaseAllocations([]AllocationRef{{Datacenter: "aws-eu-1", Cluster: "c1", IPAMPool: "pool2"}}, "decommission")
+	assert.EqualError(t, err, "cluster c1 has no allocation of pool pool2")
+	assert.Len(t, ipam.Allocations(), 3)
+
+	released, err := ipam.ReleaseAllocations([]AllocationRef{
+		{Datacenter: "aws-eu-1", Cluster: "team-a/c2", IPAMPool: "pool1"},
+		{Datacenter: "aws-eu-1", Cluster: "c1", IPAMPool: "pool1"},
+		{Datacenter: "aws-eu-1", Cluster: "c1", IPAMPool: "pool1"},
+	}, "decommission")
+	assert.Nil(t, err)
+	assert.Len(t, released, 2)
+	assert.Equal(t, "c1", released[0].Cluster)
+	assert.Equal(t, "c2", released[1].Cluster)
+	allocations := ipam.Allocations()
+	assert.Len(t, allocations, 1)
+	assert.Equal(t, "c3", allocations[0].Cluster)
+
+	// allocations are also released by label
+	assert.Nil(t, ipam.LabelAllocation(ClusterRef{Datacenter: "aws-eu-1", Name: "c3"}, "", "pool1", map[string]string{"wave": "1"}))
+	_, err = ipam.ReleaseSelected(LabelSelector{}, "wave 1")
+	assert.EqualError(t, err, "label selector cannot be empty")
+	selector, err := ParseLabelSelector("wave=1")
+	assert.Nil(t, err)
+	released, err = ipam.ReleaseSelected(selector, "wave 1")
+	assert.Nil(t, err)
+	assert.Len(t, released, 1)
+	assert.Empty(t, ipam.Allocations())
+}
+
+func TestIPAMRestoreAllocation(t *testing.T) {
+	clock := &manualClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c2", IPAMAllocations: []IPAMAllocation{}},
+		},
+	}, WithClock(clock), WithTombstoneRetention(24*time.Hour))
+	ipamPool := IPAMPool{
+		Name: "pool1",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/24", AllocationPrefix: 26},
+		},
+	}
+	assert.Nil(t, ipam.Apply(ipamPool))
+	allocations := ipam.Allocations()
+
+	released, err := ipam.ReleaseAllocations([]AllocationRef{{Datacenter: "aws-eu-1", Cluster: "c1", IPAMPool: "pool1"}}, "decommission")
+	assert.Nil(t, err)
+	tombstones := ipam.Tombstones()
+	assert.Len(t, tombstones, 1)
+	assert.Equal(t, released[0], tombstones[0].Allocation)
+	assert.Equal(t, clock.now, tombstones[0].ReleasedAt)
+	assert.Equal(t, "decommission", tombstones[0].Reason)
+
+	// tombstones are persisted
+	data, err := ipam.MarshalState()
+	assert.Nil(t, err)
+	loaded, err := unmarshalState(data, true)
+	assert.Nil(t, err)
+	loaded.clock = clock
+	assert.Len(t, loaded.Tombstones(), 1)
+	assert.Equal(t, tombstones[0].Allocation, loaded.Tombstones()[0].Allocation)
+
+	// the exact allocation is restored
+	_, err = ipam.RestoreAllocation("unknown")
+	assert.EqualError(t, err, "tombstone not found or expired")
+	restored, err := ipam.RestoreAllocation(tombstones[0].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, released[0], restored)
+	assert.Equal(t, allocations, ipam.Allocations())
+	assert.Empty(t, ipam.Tombstones())
+
+	// a release can't be restored once its blocks are allocated again
+	_, err = ipam.Release("pool1")
+	assert.Nil(t, err)
+	tombstones = ipam.Tombstones()
+	assert.Len(t, tombstones, 2)
+	assert.Equal(t, "release of pool pool1", tombstones[0].Reason)
+	assert.Nil(t, ipam.Apply(IPAMPool{
+		Name: "pool2",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/24", AllocationPrefix: 26},
+		},
+	}))
+	_, err = ipam.RestoreAllocation(tombstones[0].ID)
+	assert.EqualError(t, err, "released allocation of pool pool1 conflicts with the allocation of pool pool2 of cluster c1")
+	assert.Len(t, ipam.Tombstones(), 2)
+
+	// nor after the retention
+	clock.now = clock.now.Add(24 * time.Hour)
+	assert.Empty(t, ipam.Tombstones())
+	_, err = ipam.RestoreAllocation(tombstones[1].ID)
+	assert.EqualError(t, err, "tombstone not found or expired")
+}
+
+func TestIPAMRestoreAllocationUniqueAcrossDatacenters(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"dc1": {{Name: "c1", IPAMAllocations: []IPAMAllocation{}}},
+		"dc2": {{Name: "c2", IPAMAllocations: []IPAMAllocation{}}},
+	})
+	ipamPool := IPAMPool{
+		Name:                    "pool1",
+		UniqueAcrossDatacenters: true,
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"dc1": {Type: "prefix", PoolCIDR: "10.0.0.0/16", AllocationPrefix: 24},
+			"dc2": {Type: "prefix", PoolCIDR: "10.0.0.0/16", AllocationPrefix: 24},
+		},
+	}
+	assert.Nil(t, ipam.Apply(ipamPool))
+	_, err := ipam.ReleaseAllocations([]AllocationRef{{Datacenter: "dc1", Cluster: "c1", IPAMPool: "pool1"}}, "decommission")
+	assert.Nil(t, err)
+
+	// the freed block of the removed cluster goes to a new cluster of dc2
+	ipam.datacenterAllocations["dc1"] = []Cluster{}
+	ipam.datacenterAllocations["dc2"] = append(ipam.datacenterAllocations["dc2"], Cluster{Name: "c3", IPAMAllocations: []IPAMAllocation{}})
+	assert.Nil(t, ipam.Apply(ipamPool))
+	assert.True(t, ipam.hasAllocation(ClusterRef{Datacenter: "dc2", Name: "c3"}, "pool1"))
+
+	// the uniqueness survives a state roundtrip
+	data, err := ipam.MarshalState()
+	assert.Nil(t, err)
+	loaded, err := unmarshalState(data, true)
+	assert.Nil(t, err)
+	loaded.clock = ipam.clock
+
+	_, err = loaded.RestoreAllocation(loaded.Tombstones()[0].ID)
+	assert.EqualError(t, err, "released allocation of pool pool1 overlaps the allocation of cluster c3 in datacenter dc2, and the pool is unique across datacenters")
+	assert.Len(t, loaded.Tombstones(), 1)
+}
+
+func TestIPAMApplyExhaustionError(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c2", IPAMAllocations: []IPAMAllocation{}},
+		},
+	})
+	err := ipam.Apply(IPAMPool{
+		Name: "pool1",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "range", PoolCIDR: "192.168.1.0/29", AllocationRange: 5},
+		},
+	})
+
+	var exhaustionErr *ExhaustionError
+	assert.True(t, errors.As(err, &exhaustionErr))
+	assert.Equal(t, "aws-eu-1", exhaustionErr.Datacenter)
+	assert.Equal(t, "pool1", exhaustionErr.IPAMPool)
+	assert.Equal(t, big.NewInt(5), exhaustionErr.RequiredSize)
+	assert.Equal(t, big.NewInt(3), exhaustionErr.FreeCount)
+	assert.Equal(t, big.NewInt(3), exhaustionErr.LargestFreeBlock)
+	assert.ErrorIs(t, exhaustionErr.Err, errNotEnoughFreeIPs)
+}
+
+func TestIPAMApplyWithDiagnostics(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{
+				{IPAMPoolName: "pool1", Cluster: "c1", Datacenter: "aws-eu-1", Type: "range", Addresses: []string{"10.0.0.2-10.0.0.3", "10.0.0.0-10.0.0.1"}},
+			}},
+			{Name: "c2", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c3", IPAMAllocations: []IPAMAllocation{}},
+		},
+		"aws-eu-2": {{Name: "c4", IPAMAllocations: []IPAMAllocation{}}},
+	})
+	ipamPool := IPAMPool{
+		Name: "pool1",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "range", PoolCIDR: "10.0.0.0/28", AllocationRange: 4},
+			"aws-eu-2": {Type: "prefix", PoolCIDR: "10.1.0.0/24", AllocationPrefix: 26},
+		},
+	}
+
+	diagnostics, err := ipam.ApplyWithDiagnostics(ipamPool)
+	assert.Nil(t, err)
+	assert.Equal(t, []Diagnostic{
+		{IPAMPool: "pool1", Datacenter: "aws-eu-1", Cluster: "c1", Message: "allocation uses the legacy range format [10.0.0.2-10.0.0.3 10.0.0.0-10.0.0.1] instead of [10.0.0.0-10.0.0.3]"},
+	}, diagnostics)
+	assert.Len(t, ipam.Allocations(), 4)
+
+	// the diagnostics are returned with the apply error
+	ipam.datacenterAllocations["aws-eu-1"] = append(ipam.datacenterAllocations["aws-eu-1"], Cluster{Name: "c5", IPAMAllocations: []IPAMAllocation{}}, Cluster{Name: "c6", IPAMAllocations: []IPAMAllocation{}})
+	ipam.utilizationWarningPercent = 20
+	diagnostics, err = ipam.ApplyWithDiagnostics(ipamPool)
+	assert.ErrorIs(t, err, errNotEnoughFreeIPs)
+	assert.Len(t, diagnostics, 3)
+	assert.Equal(t, "pool pool1 datacenter aws-eu-1: datacenter pool at 75% utilization", diagnostics[0].String())
+	assert.Equal(t, "pool pool1 datacenter aws-eu-2: datacenter pool at 25% utilization", diagnostics[2].String())
+
+	// the utilization of pools too big to enumerate is computed from their used addresses
+	dcIPAMPoolUsageMap := newDatacenterIPAMPoolUsageMap()
+	dcIPAMPoolUsageMap.setUsed("aws-eu-1", "fd00::1")
+	dcIPAMPoolUsageMap.setUsed("aws-eu-1", "fd01::1")
+	utilization, err := utilizationOfPool("aws-eu-1", IPAMPoolDatacenterSettings{Type: "range", PoolCIDR: "fd00::/63"}, dcIPAMPoolUsageMap)
+	assert.Nil(t, err)
+	assert.Equal(t, 100/math.Pow(2, 65), utilization)
 }
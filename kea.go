@@ -0,0 +1,220 @@
+package ipam
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strings"
+)
+
+type keaConfig struct {
+	Dhcp4 *keaDhcpConfig `json:"Dhcp4,omitempty"`
+	Dhcp6 *keaDhcpConfig `json:"Dhcp6,omitempty"`
+}
+
+type keaDhcpConfig struct {
+	Subnet4 []keaSubnet `json:"subnet4,omitempty"`
+	Subnet6 []keaSubnet `json:"subnet6,omitempty"`
+}
+
+type keaSubnet struct {
+	ID          uint32            `json:"id"`
+	Subnet      string            `json:"subnet"`
+	Pools       []keaPool         `json:"pools"`
+	PDPools     []keaPDPool       `json:"pd-pools,omitempty"`
+	OptionData  []keaOptionData   `json:"option-data,omitempty"`
+	UserContext map[string]string `json:"user-context,omitempty"`
+}
+
+type keaOptionData struct {
+	Name string `json:"name"`
+	Data string `json:"data"`
+}
+
+type keaPool struct {
+	Pool        string            `json:"pool"`
+	UserContext map[string]string `json:"user-context,omitempty"`
+}
+
+// keaPDPool is a DHCPv6 prefix delegation pool. When PrefixLen equals DelegatedLen the pool delegates exactly one
+// prefix.
+type keaPDPool struct {
+	Prefix       string            `json:"prefix"`
+	PrefixLen    int               `json:"prefix-len"`
+	DelegatedLen int               `json:"delegated-len"`
+	UserContext  map[string]string `json:"user-context,omitempty"`
+}
+
+// RenderKeaConfig generates the ISC Kea subnet configuration serving the range allocations of a datacenter: one
+// Kea subnet per range pool (its PoolCIDR) with one Kea pool per allocated address range. The result is meant to
+// be merged into the Dhcp4/Dhcp6 sections of the Kea configuration of the datacenter DHCP servers.
+func RenderKeaConfig(p IPAM, dc string, ipamPools []IPAMPool) ([]byte, error) {
+	config := keaConfig{}
+	subnetIDs := keaSubnetIDs{}
+	for _, ipamPool := range sortedIPAMPools(ipamPools) {
+		dcIPAMPoolCfg, isDCConfigured := ipamPool.Datacenters[dc]
+		if !isDCConfigured || dcIPAMPoolCfg.Type != "range" {
+			continue
+		}
+		_, poolSubnet, err := net.ParseCIDR(dcIPAMPoolCfg.PoolCIDR)
+		if err != nil {
+			return nil, err
+		}
+
+		subnetID, err := subnetIDs.id(ipamPool, dc, poolSubnet)
+		if err != nil {
+			return nil, err
+		}
+		subnet := keaSubnet{
+			ID:          subnetID,
+			Subnet:      poolSubnet.String(),
+			Pools:       []keaPool{},
+			UserContext: map[string]string{"ipam-pool": ipamPool.qualifiedName()},
+		}
+		for _, dcCluster := range p.datacenterAllocations[dc] {
+			for _, ipamAllocation := range dcCluster.IPAMAllocations {
+				if !ipamAllocation.isFromPool(ipamPool) || ipamAllocation.Type != "range" {
+					continue
+				}
+				userContext := map[string]string{"cluster": ipamAllocation.clusterRef().qualifiedName()}
+				if ipamAllocation.Description != "" {
+					userContext["description"] = ipamAllocation.Description
+				}
+				for _, addressRange := range ipamAllocation.Addresses {
+					subnet.Pools = append(subnet.Pools, keaPool{
+						Pool:        strings.Replace(addressRange, "-", " - ", 1),
+						UserContext: userContext,
+					})
+				}
+			}
+		}
+
+		subnet.OptionData = keaNetworkOptionData(dcIPAMPoolCfg, poolSubnet.IP.To4() != nil)
+
+		if poolSubnet.IP.To4() != nil {
+			if config.Dhcp4 == nil {
+				config.Dhcp4 = &keaDhcpConfig{}
+			}
+			config.Dhcp4.Subnet4 = append(config.Dhcp4.Subnet4, subnet)
+		} else {
+			if config.Dhcp6 == nil {
+				config.Dhcp6 = &keaDhcpConfig{}
+			}
+			config.Dhcp6.Subnet6 = append(config.Dhcp6.Subnet6, subnet)
+		}
+	}
+
+	if config.Dhcp4 == nil && config.Dhcp6 == nil {
+		return nil, fmt.Errorf("no range pool configured for datacenter %s", dc)
+	}
+
+	return json.MarshalIndent(config, "", "  ")
+}
+
+// keaSubnetIDs assigns the Kea subnet IDs of a configuration.
+type keaSubnetIDs map[uint32]string
+
+// id returns the Kea subnet ID of a datacenter pool, a hash of the pool, the datacenter and the pool CIDR, so the ID
+// of a subnet doesn't change when other pools are added and the IDs of the subnets rendered by RenderKeaConfig and
+// RenderKeaPrefixDelegationConfig don't collide when both are merged. Kea uses the ID to keep the leases of the
+// subnet, so renumbering it would lose them.
+func (ids keaSubnetIDs) id(ipamPool IPAMPool, dc string, poolSubnet *net.IPNet) (uint32, error) {
+	hash := fnv.New32a()
+	hash.Write([]byte(ipamPool.qualifiedName() + "\x00" + dc + "\x00" + poolSubnet.String()))
+	// Kea subnet IDs go from 1 to 4294967294
+	id := hash.Sum32()%(1<<32-2) + 1
+	if collidingPool, isTaken := ids[id]; isTaken {
+		return 0, fmt.Errorf("kea subnet ID %d of pool %s collides with pool %s", id, ipamPool.qualifiedName(), collidingPool)
+	}
+	ids[id] = ipamPool.qualifiedName()
+	return id, nil
+}
+
+// keaNetworkOptionData returns the DHCP options announcing the gateway, DNS servers and MTU of a datacenter pool.
+// DHCPv6 has no options for the gateway and the MTU, which are learned from router advertisements.
+func keaNetworkOptionData(dcIPAMPoolCfg IPAMPoolDatacenterSettings, isIPv4 bool) []keaOptionData {
+	optionData := []keaOptionData{}
+	if isIPv4 && dcIPAMPoolCfg.Gateway != "" {
+		optionData = append(optionData, keaOptionData{Name: "routers", Data: dcIPAMPoolCfg.Gateway})
+	}
+	if len(dcIPAMPoolCfg.DNSServers) > 0 {
+		name := "dns-servers"
+		if isIPv4 {
+			name = "domain-name-servers"
+		}
+		optionData = append(optionData, keaOptionData{Name: name, Data: strings.Join(dcIPAMPoolCfg.DNSServers, ", ")})
+	}
+	if isIPv4 && dcIPAMPoolCfg.MTU != 0 {
+		optionData = append(optionData, keaOptionData{Name: "interface-mtu", Data: fmt.Sprint(dcIPAMPoolCfg.MTU)})
+	}
+	return optionData
+}
+
+// RenderKeaPrefixDelegationConfig generates the ISC Kea DHCPv6 prefix delegation (DHCPv6-PD) configuration of the
+// IPv6 prefix allocations of a datacenter, so the routers of the clusters can request their prefix and delegate it
+// onward: one Kea subnet per IPv6 prefix pool (its PoolCIDR) with one pd-pool per allocated prefix, delegating the
+// whole prefix. The result is meant to be merged into the Dhcp6 section of the Kea configuration.
+func RenderKeaPrefixDelegationConfig(p IPAM, dc string, ipamPools []IPAMPool) ([]byte, error) {
+	config := keaConfig{}
+	subnetIDs := keaSubnetIDs{}
+	for _, ipamPool := range sortedIPAMPools(ipamPools) {
+		dcIPAMPoolCfg, isDCConfigured := ipamPool.Datacenters[dc]
+		if !isDCConfigured || dcIPAMPoolCfg.Type != "prefix" {
+			continue
+		}
+		_, poolSubnet, err := net.ParseCIDR(dcIPAMPoolCfg.PoolCIDR)
+		if err != nil {
+			return nil, err
+		}
+		if poolSubnet.IP.To4() != nil {
+			continue
+		}
+
+		subnetID, err := subnetIDs.id(ipamPool, dc, poolSubnet)
+		if err != nil {
+			return nil, err
+		}
+		subnet := keaSubnet{
+			ID:          subnetID,
+			Subnet:      poolSubnet.String(),
+			Pools:       []keaPool{},
+			PDPools:     []keaPDPool{},
+			OptionData:  keaNetworkOptionData(dcIPAMPoolCfg, false),
+			UserContext: map[string]string{"ipam-pool": ipamPool.qualifiedName()},
+		}
+		for _, dcCluster := range p.datacenterAllocations[dc] {
+			for _, ipamAllocation := range dcCluster.IPAMAllocations {
+				if !ipamAllocation.isFromPool(ipamPool) || ipamAllocation.Type != "prefix" {
+					continue
+				}
+				_, allocationSubnet, err := net.ParseCIDR(ipamAllocation.CIDR)
+				if err != nil {
+					return nil, err
+				}
+				prefixLen, _ := allocationSubnet.Mask.Size()
+				userContext := map[string]string{"cluster": ipamAllocation.clusterRef().qualifiedName()}
+				if ipamAllocation.Description != "" {
+					userContext["description"] = ipamAllocation.Description
+				}
+				subnet.PDPools = append(subnet.PDPools, keaPDPool{
+					Prefix:       allocationSubnet.IP.String(),
+					PrefixLen:    prefixLen,
+					DelegatedLen: prefixLen,
+					UserContext:  userContext,
+				})
+			}
+		}
+
+		if config.Dhcp6 == nil {
+			config.Dhcp6 = &keaDhcpConfig{}
+		}
+		config.Dhcp6.Subnet6 = append(config.Dhcp6.Subnet6, subnet)
+	}
+
+	if config.Dhcp6 == nil {
+		return nil, fmt.Errorf("no IPv6 prefix pool configured for datacenter %s", dc)
+	}
+
+	return json.MarshalIndent(config, "", "  ")
+}
@@ -0,0 +1,193 @@
+package ipam
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderKeaConfig(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{
+				Name: "c1",
+				IPAMAllocations: []IPAMAllocation{
+					{
+						IPAMPoolName: "pool1",
+						Cluster:      "c1",
+						Datacenter:   "aws-eu-1",
+						Type:         "range",
+						Addresses:    []string{"192.168.1.0-192.168.1.7", "192.168.1.10-192.168.1.11"},
+					},
+					{
+						IPAMPoolName: "pool2",
+						Cluster:      "c1",
+						Datacenter:   "aws-eu-1",
+						Type:         "prefix",
+						CIDR:         "10.0.0.0/28",
+					},
+				},
+			},
+		},
+	})
+
+	c1 := ClusterRef{Datacenter: "aws-eu-1", Name: "c1"}
+	assert.Nil(t, ipam.DescribeAllocation(c1, "", "pool1", "nodes"))
+	assert.EqualError(t, ipam.DescribeAllocation(c1, "", "pool3", "nodes"), "cluster c1 has no allocation of pool pool3")
+
+	config, err := RenderKeaConfig(ipam, "aws-eu-1", []IPAMPool{
+		{
+			Name: "pool2",
+			Datacenters: map[string]IPAMPoolDatacenterSettings{
+				"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/24", AllocationPrefix: 28},
+			},
+		},
+		{
+			Name: "pool1",
+			Datacenters: map[string]IPAMPoolDatacenterSettings{
+				"aws-eu-1": {Type: "range", PoolCIDR: "192.168.1.0/24", AllocationRange: 10, Gateway: "192.168.1.254", DNSServers: []string{"10.1.0.53", "10.2.0.53"}, MTU: 9000},
+			},
+		},
+	})
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{
+		"Dhcp4": {
+			"subnet4": [
+				{
+					"id": 1798662194,
+					"subnet": "192.168.1.0/24",
+					"pools": [
+						{"pool": "192.168.1.0 - 192.168.1.7", "user-context": {"cluster": "c1", "description": "nodes"}},
+						{"pool": "192.168.1.10 - 192.168.1.11", "user-context": {"cluster": "c1", "description": "nodes"}}
+					],
+					"option-data": [
+						{"name": "routers", "data": "192.168.1.254"},
+						{"name": "domain-name-servers", "data": "10.1.0.53, 10.2.0.53"},
+						{"name": "interface-mtu", "data": "9000"}
+					],
+					"user-context": {"ipam-pool": "pool1"}
+				}
+			]
+		}
+	}`, string(config))
+
+	_, err = RenderKeaConfig(ipam, "azure-as-2", nil)
+	assert.EqualError(t, err, "no range pool configured for datacenter azure-as-2")
+}
+
+func TestRenderKeaPrefixDelegationConfig(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c2", IPAMAllocations: []IPAMAllocation{}},
+		},
+	})
+	ipamPools := []IPAMPool{
+		{
+			Name: "pool2",
+			Datacenters: map[string]IPAMPoolDatacenterSettings{
+				"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/24", AllocationPrefix: 28},
+			},
+		},
+		{
+			Name: "pool1",
+			Datacenters: map[string]IPAMPoolDatacenterSettings{
+				"aws-eu-1": {Type: "prefix", PoolCIDR: "2001:db8:1::/48", AllocationPrefix: 56, DNSServers: []string{"2001:db8::53"}},
+			},
+		},
+	}
+	for _, ipamPool := range ipamPools {
+		assert.Nil(t, ipam.Apply(ipamPool))
+	}
+	assert.Nil(t, ipam.DescribeAllocation(ClusterRef{Datacenter: "aws-eu-1", Name: "c2"}, "", "pool1", "edge routers"))
+
+	config, err := RenderKeaPrefixDelegationConfig(ipam, "aws-eu-1", ipamPools)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{
+		"Dhcp6": {
+			"subnet6": [
+				{
+					"id": 2458477724,
+					"subnet": "2001:db8:1::/48",
+					"pools": [],
+					"pd-pools": [
+						{"prefix": "2001:db8:1::", "prefix-len": 56, "delegated-len": 56, "user-context": {"cluster": "c1"}},
+						{"prefix": "2001:db8:1:100::", "prefix-len": 56, "delegated-len": 56, "user-context": {"cluster": "c2", "description": "edge routers"}}
+					],
+					"option-data": [
+						{"name": "dns-servers", "data": "2001:db8::53"}
+					],
+					"user-context": {"ipam-pool": "pool1"}
+				}
+			]
+		}
+	}`, string(config))
+
+	_, err = RenderKeaPrefixDelegationConfig(ipam, "aws-eu-1", ipamPools[:1])
+	assert.EqualError(t, err, "no IPv6 prefix pool configured for datacenter aws-eu-1")
+}
+
+func TestRenderKeaConfigsMerged(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+		},
+	})
+	ipamPools := []IPAMPool{
+		{
+			Name: "pool1",
+			Datacenters: map[string]IPAMPoolDatacenterSettings{
+				"aws-eu-1": {Type: "range", PoolCIDR: "2001:db8:2::/64", AllocationRange: 4},
+			},
+		},
+		{
+			Name: "pool2",
+			Datacenters: map[string]IPAMPoolDatacenterSettings{
+				"aws-eu-1": {Type: "prefix", PoolCIDR: "2001:db8:1::/48", AllocationPrefix: 56},
+			},
+		},
+	}
+	for _, ipamPool := range ipamPools {
+		assert.Nil(t, ipam.Apply(ipamPool))
+	}
+
+	subnetIDs := func(ipamPools []IPAMPool) map[string]uint32 {
+		ids := map[string]uint32{}
+		for _, render := range []func(IPAM, string, []IPAMPool) ([]byte, error){RenderKeaConfig, RenderKeaPrefixDelegationConfig} {
+			rendered, err := render(ipam, "aws-eu-1", ipamPools)
+			assert.Nil(t, err)
+			config := keaConfig{}
+			assert.Nil(t, json.Unmarshal(rendered, &config))
+			for _, subnet := range config.Dhcp6.Subnet6 {
+				ids[subnet.Subnet] = subnet.ID
+			}
+		}
+		return ids
+	}
+
+	// the subnets of both configurations have distinct IDs once merged into the Dhcp6 section
+	ids := subnetIDs(ipamPools)
+	assert.Len(t, ids, 2)
+	assert.NotEqual(t, ids["2001:db8:1::/48"], ids["2001:db8:2::/64"])
+
+	// adding pools doesn't renumber the existing subnets
+	ipamPools = append(ipamPools,
+		IPAMPool{
+			Name: "pool0",
+			Datacenters: map[string]IPAMPoolDatacenterSettings{
+				"aws-eu-1": {Type: "range", PoolCIDR: "2001:db8:3::/64", AllocationRange: 4},
+			},
+		},
+		IPAMPool{
+			Name: "pool00",
+			Datacenters: map[string]IPAMPoolDatacenterSettings{
+				"aws-eu-1": {Type: "prefix", PoolCIDR: "2001:db8:4::/48", AllocationPrefix: 56},
+			},
+		},
+	)
+	newIDs := subnetIDs(ipamPools)
+	assert.Len(t, newIDs, 4)
+	assert.Equal(t, ids["2001:db8:1::/48"], newIDs["2001:db8:1::/48"])
+	assert.Equal(t, ids["2001:db8:2::/64"], newIDs["2001:db8:2::/64"])
+}
@@ -0,0 +1,138 @@
+package ipam
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// LabelSelector selects allocations by their labels; an empty selector matches everything. It supports the
+// equality-based requirements of the Kubernetes label selectors, so the string form of such a selector parses with
+// ParseLabelSelector.
+type LabelSelector []LabelRequirement
+
+// LabelRequirement is a requirement on one label.
+type LabelRequirement struct {
+	Key string
+	// Operator is one of "=", "!=", "exists" and "!exists"
+	Operator string
+	Value    string
+}
+
+var labelKeyRegexp = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._/-]*[A-Za-z0-9])?$`)
+
+// ParseLabelSelector parses a comma separated list of requirements in the Kubernetes equality-based syntax:
+// "key=value" (or "key==value"), "key!=value", "key" (the label is set) and "!key" (the label isn't set), e.g.
+// "env=staging,!deprecated".
+func ParseLabelSelector(selector string) (LabelSelector, error) {
+	requirements := LabelSelector{}
+	if strings.TrimSpace(selector) == "" {
+		return requirements, nil
+	}
+	for _, term := range strings.Split(selector, ",") {
+		term = strings.TrimSpace(term)
+		requirement := LabelRequirement{}
+		switch {
+		case strings.Contains(term, "!="):
+			parts := strings.SplitN(term, "!=", 2)
+			requirement = LabelRequirement{Key: parts[0], Operator: "!=", Value: parts[1]}
+		case strings.Contains(term, "=="):
+			parts := strings.SplitN(term, "==", 2)
+			requirement = LabelRequirement{Key: parts[0], Operator: "=", Value: parts[1]}
+		case strings.Contains(term, "="):
+			parts := strings.SplitN(term, "=", 2)
+			requirement = LabelRequirement{Key: parts[0], Operator: "=", Value: parts[1]}
+		case strings.HasPrefix(term, "!"):
+			requirement = LabelRequirement{Key: strings.TrimPrefix(term, "!"), Operator: "!exists"}
+		default:
+			requirement = LabelRequirement{Key: term, Operator: "exists"}
+		}
+		requirement.Key = strings.TrimSpace(requirement.Key)
+		requirement.Value = strings.TrimSpace(requirement.Value)
+		if !labelKeyRegexp.MatchString(requirement.Key) {
+			return nil, fmt.Errorf("invalid label selector term %q", term)
+		}
+		requirements = append(requirements, requirement)
+	}
+	return requirements, nil
+}
+
+// Matches tells whether the labels satisfy every requirement of the selector.
+func (s LabelSelector) Matches(labels map[string]string) bool {
+	for _, requirement := range s {
+		value, isSet := labels[requirement.Key]
+		switch requirement.Operator {
+		case "=":
+			if !isSet || value != requirement.Value {
+				return false
+			}
+		case "!=":
+			if isSet && value == requirement.Value {
+				return false
+			}
+		case "exists":
+			if !isSet {
+				return false
+			}
+		case "!exists":
+			if isSet {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// LabelAllocation sets labels on the allocation of a pool for a cluster; an empty value removes the label. The
+// allocations of a pool purpose are designated by "<pool>:<purpose>". The labels are set even if an event sink fails.
+func (p IPAM) LabelAllocation(cluster ClusterRef, ipamPoolTenant, ipamPoolName string, labels map[string]string) error {
+	clusterIndex := p.clusterIndex(cluster)
+	if clusterIndex < 0 {
+		return fmt.Errorf("cluster %s not found in datacenter %s", cluster.qualifiedName(), cluster.Datacenter)
+	}
+	for key := range labels {
+		if !labelKeyRegexp.MatchString(key) {
+			return fmt.Errorf("invalid label key %q", key)
+		}
+	}
+	dcCluster := p.datacenterAllocations[cluster.Datacenter][clusterIndex]
+	for i, clusterAllocation := range dcCluster.IPAMAllocations {
+		if clusterAllocation.qualifiedIPAMPoolName() != qualifiedIPAMPoolName(ipamPoolTenant, ipamPoolName) {
+			continue
+		}
+		allocationLabels := map[string]string{}
+		for key, value := range clusterAllocation.Labels {
+			allocationLabels[key] = value
+		}
+		for key, value := range labels {
+			if value == "" {
+				delete(allocationLabels, key)
+				continue
+			}
+			allocationLabels[key] = value
+		}
+		if len(allocationLabels) == 0 {
+			allocationLabels = nil
+		}
+		dcCluster.IPAMAllocations[i].Labels = allocationLabels
+		return p.sendEvent(AllocationEvent{
+			Type:           AllocationEventLabeled,
+			Time:           p.clock.Now(),
+			Allocation:     dcCluster.IPAMAllocations[i],
+			PreviousLabels: clusterAllocation.Labels,
+		})
+	}
+	return fmt.Errorf("cluster %s has no allocation of pool %s", cluster.qualifiedName(), qualifiedIPAMPoolName(ipamPoolTenant, ipamPoolName))
+}
+
+// FindAllocations returns the allocations of every pool and datacenter whose labels match the selector, sorted by
+// datacenter, cluster and pool.
+func (p IPAM) FindAllocations(selector LabelSelector) []IPAMAllocation {
+	allocations := []IPAMAllocation{}
+	for _, ipamAllocation := range p.Allocations() {
+		if selector.Matches(ipamAllocation.Labels) {
+			allocations = append(allocations, ipamAllocation)
+		}
+	}
+	return allocations
+}
@@ -0,0 +1,81 @@
+package ipam
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ApplyLimits bounds the resources used to allocate a pool, keeping the peak memory of controllers running on
+// memory-constrained pods predictable.
+type ApplyLimits struct {
+	// DatacenterWorkers is how many datacenters of a pool are allocated concurrently, one when zero. The datacenters
+	// of a pool unique across datacenters are always allocated one at a time.
+	DatacenterWorkers int
+	// MaxUsageEntries caps the used addresses (or subnets) and ranges tracked for a pool in a datacenter while it's
+	// allocated, e.g. to refuse expanding a huge range allocation address by address. Zero means no limit.
+	MaxUsageEntries int
+}
+
+// WithApplyLimits makes the IPAM bound the resources used to allocate pools.
+func WithApplyLimits(limits ApplyLimits) Option {
+	return func(p *IPAM) {
+		p.applyLimits = limits
+	}
+}
+
+// checkUsageLimit returns errUsageLimitExceeded when the usage of the pool in the datacenter has more entries than
+// allowed by the apply limits.
+func (p IPAM) checkUsageLimit(ipamPool IPAMPool, dc string, dcIPAMPoolUsageMap datacenterIPAMPoolUsageMap) error {
+	usage, hasUsage := dcIPAMPoolUsageMap[dc]
+	if p.applyLimits.MaxUsageEntries <= 0 || !hasUsage {
+		return nil
+	}
+	if entries := len(usage.values) + len(usage.ranges); entries > p.applyLimits.MaxUsageEntries {
+		return fmt.Errorf("%w: pool %s tracks %d used entries in datacenter %s, the limit is %d", errUsageLimitExceeded, ipamPool.qualifiedName(), entries, dc, p.applyLimits.MaxUsageEntries)
+	}
+	return nil
+}
+
+// datacenterAllocationsResult holds the new allocations of a pool in a datacenter.
+type datacenterAllocationsResult struct {
+	newClustersAllocations []IPAMAllocation
+	exhaustedClusters      []ClusterRef
+	err                    error
+}
+
+// generateNewAllocationsConcurrently generates the new allocations of the pool with a worker per datacenter, up to
+// DatacenterWorkers at once. Every datacenter has its own usage, so the workers share nothing they write. The
+// results are merged in datacenter order, so they don't depend on the scheduling.
+func (p IPAM) generateNewAllocationsConcurrently(ipamPool IPAMPool, dcs []string, dcIPAMPoolUsageMap datacenterIPAMPoolUsageMap) ([]IPAMAllocation, []ClusterRef, error) {
+	for _, dc := range dcs {
+		// create the usage of every datacenter upfront, so the workers only read the map
+		dcIPAMPoolUsageMap.datacenter(dc)
+	}
+
+	results := make([]datacenterAllocationsResult, len(dcs))
+	workers := make(chan struct{}, p.applyLimits.DatacenterWorkers)
+	wg := sync.WaitGroup{}
+	for i, dc := range dcs {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(i int, dc string) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			results[i].newClustersAllocations, results[i].exhaustedClusters, results[i].err = p.generateNewAllocationsForDatacenter(ipamPool, dc, dcIPAMPoolUsageMap)
+		}(i, dc)
+	}
+	wg.Wait()
+
+	newClustersAllocations := []IPAMAllocation{}
+	exhaustedClusters := []ClusterRef{}
+	for _, result := range results {
+		if result.err != nil {
+			return nil, nil, result.err
+		}
+		newClustersAllocations = append(newClustersAllocations, result.newClustersAllocations...)
+		exhaustedClusters = append(exhaustedClusters, result.exhaustedClusters...)
+	}
+	return newClustersAllocations, exhaustedClusters, nil
+}
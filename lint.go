@@ -0,0 +1,251 @@
+package ipam
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// LintIssue is a problem found in an IPAM pool definition.
+type LintIssue struct {
+	File       string
+	Pool       string
+	Datacenter string
+	// Field is the full path of the wrong field in the pool document, e.g. datacenters.aws-eu-1.allocationPrefix
+	Field   string
+	Message string
+}
+
+func (i LintIssue) String() string {
+	location := i.File
+	if i.Pool != "" {
+		location += ": pool " + i.Pool
+	}
+	if i.Datacenter != "" {
+		location += " datacenter " + i.Datacenter
+	}
+	if i.Field != "" {
+		location += ": " + i.Field
+	}
+	return location + ": " + i.Message
+}
+
+// LintIPAMPoolFiles validates the IPAM pools of YAML files, or of the *.yaml and *.yml files of directories, both
+// each pool on its own and the pools against each other. Unknown fields are reported, since they are usually typos.
+func LintIPAMPoolFiles(paths []string) ([]LintIssue, error) {
+	files, err := ipamPoolFiles(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	issues := []LintIssue{}
+	ipamPoolFiles := map[string]string{}
+	ipamPools := []IPAMPool{}
+	for _, file := range files {
+		filePools, err := loadIPAMPoolsFile(file, true)
+		if fieldErr, isFieldErr := err.(*fieldError); isFieldErr {
+			issues = append(issues, LintIssue{File: file, Field: fieldErr.Field, Message: fieldErr.Message})
+			continue
+		}
+		if err != nil {
+			issues = append(issues, LintIssue{File: file, Message: err.Error()})
+			continue
+		}
+		for _, ipamPool := range filePools {
+			if previousFile, isDuplicated := ipamPoolFiles[ipamPool.qualifiedName()]; isDuplicated {
+				issues = append(issues, LintIssue{File: file, Pool: ipamPool.qualifiedName(), Message: fmt.Sprintf("pool is already defined in %s", previousFile)})
+				continue
+			}
+			ipamPoolFiles[ipamPool.qualifiedName()] = file
+			ipamPools = append(ipamPools, ipamPool)
+			for _, issue := range lintIPAMPool(ipamPool) {
+				issue.File = file
+				issues = append(issues, issue)
+			}
+		}
+	}
+
+	for _, issue := range lintIPAMPoolOverlaps(ipamPools) {
+		issue.File = ipamPoolFiles[issue.Pool]
+		issues = append(issues, issue)
+	}
+
+	return issues, nil
+}
+
+func ipamPoolFiles(paths []string) ([]string, error) {
+	files := []string{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			extension := strings.ToLower(filepath.Ext(entry.Name()))
+			if !entry.IsDir() && (extension == ".yaml" || extension == ".yml") {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+	return files, nil
+}
+
+// lintIPAMPool validates the settings of each datacenter of a pool and of its purposes.
+func lintIPAMPool(ipamPool IPAMPool) []LintIssue {
+	issues := []LintIssue{}
+	if ipamPool.Name == "" {
+		issues = append(issues, LintIssue{Field: "name", Message: "pool name cannot be empty"})
+	}
+	if strings.Contains(ipamPool.Name, "/") || strings.Contains(ipamPool.Tenant, "/") {
+		issues = append(issues, LintIssue{Pool: ipamPool.qualifiedName(), Message: "pool name and tenant cannot contain \"/\""})
+	}
+	if len(ipamPool.Datacenters) == 0 && len(ipamPool.Purposes) == 0 && ipamPool.DatacenterTemplate == nil {
+		issues = append(issues, LintIssue{Pool: ipamPool.qualifiedName(), Message: "pool has no datacenters"})
+	}
+	for _, dc := range sortedKeys(ipamPool.Datacenters) {
+		if err := validateIPAMPoolDatacenterSettings(ipamPool.Datacenters[dc]); err != nil {
+			fieldErr := asFieldError(err, "").withParent("datacenters." + dc)
+			issues = append(issues, LintIssue{Pool: ipamPool.qualifiedName(), Datacenter: dc, Field: fieldErr.Field, Message: fieldErr.Message})
+		}
+	}
+	for _, purpose := range sortedKeys(ipamPool.Purposes) {
+		purposePool := IPAMPool{Name: ipamPool.Name, Tenant: ipamPool.Tenant, purpose: purpose}
+		for _, dc := range sortedKeys(ipamPool.Purposes[purpose]) {
+			if err := validateIPAMPoolDatacenterSettings(ipamPool.Purposes[purpose][dc]); err != nil {
+				fieldErr := asFieldError(err, "").withParent("purposes." + purpose + "." + dc)
+				issues = append(issues, LintIssue{Pool: purposePool.qualifiedName(), Datacenter: dc, Field: fieldErr.Field, Message: fieldErr.Message})
+			}
+		}
+	}
+	for i, constraint := range ipamPool.Constraints {
+		if _, err := parsePlacementConstraint(constraint); err != nil {
+			issues = append(issues, LintIssue{Pool: ipamPool.qualifiedName(), Field: fmt.Sprintf("constraints[%d]", i), Message: err.Error()})
+		}
+	}
+	if _, err := ipamPool.purposePools(); err != nil {
+		issues = append(issues, LintIssue{Pool: ipamPool.qualifiedName(), Message: err.Error()})
+	}
+	return issues
+}
+
+// minMTU is the smallest MTU every IPv4 host must accept, and maxMTU the largest IP packet size.
+const (
+	minMTU = 68
+	maxMTU = 65535
+)
+
+// validateIPAMPoolDatacenterSettings checks the settings of a pool in a datacenter can be applied. The returned
+// error is a *fieldError naming the wrong setting.
+func validateIPAMPoolDatacenterSettings(dcIPAMPoolCfg IPAMPoolDatacenterSettings) error {
+	_, poolSubnet, err := net.ParseCIDR(dcIPAMPoolCfg.PoolCIDR)
+	if err != nil {
+		return &fieldError{Field: "poolCidr", Message: fmt.Sprintf("invalid pool CIDR %q", dcIPAMPoolCfg.PoolCIDR)}
+	}
+	poolPrefix, bits := poolSubnet.Mask.Size()
+	poolSize := new(big.Int).Lsh(big.NewInt(1), uint(bits-poolPrefix))
+
+	if dcIPAMPoolCfg.AllocationPercent != 0 {
+		dcIPAMPoolCfg, err = resolveAllocationPercent(dcIPAMPoolCfg)
+		if err != nil {
+			return asFieldError(err, "allocationPercent")
+		}
+	}
+
+	switch dcIPAMPoolCfg.Type {
+	case "range":
+		if dcIPAMPoolCfg.AllocationRange == 0 {
+			return &fieldError{Field: "allocationRange", Message: "allocation range must be set for range pools"}
+		}
+		if big.NewInt(int64(dcIPAMPoolCfg.AllocationRange)).Cmp(poolSize) > 0 {
+			return &fieldError{Field: "allocationRange", Message: fmt.Sprintf("allocation range %d exceeds the %s addresses of the pool", dcIPAMPoolCfg.AllocationRange, poolSize)}
+		}
+		if dcIPAMPoolCfg.AllocationPrefix != 0 {
+			return &fieldError{Field: "allocationPrefix", Message: "allocation prefix cannot be set for range pools"}
+		}
+		if dcIPAMPoolCfg.AllocateFrom != "" && dcIPAMPoolCfg.AllocateFrom != allocateFromLow && dcIPAMPoolCfg.AllocateFrom != allocateFromHigh {
+			return &fieldError{Field: "allocateFrom", Message: fmt.Sprintf("unsupported allocateFrom %q", dcIPAMPoolCfg.AllocateFrom) + suggestion(dcIPAMPoolCfg.AllocateFrom, []string{allocateFromLow, allocateFromHigh})}
+		}
+	case "prefix":
+		if int(dcIPAMPoolCfg.AllocationPrefix) < poolPrefix || int(dcIPAMPoolCfg.AllocationPrefix) > bits {
+			return &fieldError{Field: "allocationPrefix", Message: fmt.Sprintf("allocation prefix %d must be between the pool prefix %d and %d", dcIPAMPoolCfg.AllocationPrefix, poolPrefix, bits)}
+		}
+		if dcIPAMPoolCfg.AllocationRange != 0 {
+			return &fieldError{Field: "allocationRange", Message: "allocation range cannot be set for prefix pools"}
+		}
+		if dcIPAMPoolCfg.AllocateFrom != "" {
+			return &fieldError{Field: "allocateFrom", Message: "allocateFrom is only supported by range pools"}
+		}
+	default:
+		return &fieldError{Field: "type", Message: fmt.Sprintf("unsupported pool type %q", dcIPAMPoolCfg.Type) + suggestion(dcIPAMPoolCfg.Type, []string{"range", "prefix"})}
+	}
+
+	if big.NewInt(int64(dcIPAMPoolCfg.FirstAddressOffset)).Cmp(poolSize) >= 0 {
+		return &fieldError{Field: "firstAddressOffset", Message: fmt.Sprintf("first address offset %d leaves no address in the pool", dcIPAMPoolCfg.FirstAddressOffset)}
+	}
+
+	if dcIPAMPoolCfg.Gateway != "" && net.ParseIP(dcIPAMPoolCfg.Gateway) == nil {
+		return &fieldError{Field: "gateway", Message: fmt.Sprintf("invalid gateway %q", dcIPAMPoolCfg.Gateway)}
+	}
+	for i, dnsServer := range dcIPAMPoolCfg.DNSServers {
+		if net.ParseIP(dnsServer) == nil {
+			return &fieldError{Field: fmt.Sprintf("dnsServers[%d]", i), Message: fmt.Sprintf("invalid DNS server %q", dnsServer)}
+		}
+	}
+	if dcIPAMPoolCfg.MTU != 0 && (dcIPAMPoolCfg.MTU < minMTU || dcIPAMPoolCfg.MTU > maxMTU) {
+		return &fieldError{Field: "mtu", Message: fmt.Sprintf("MTU %d must be between %d and %d", dcIPAMPoolCfg.MTU, minMTU, maxMTU)}
+	}
+
+	return nil
+}
+
+// lintIPAMPoolOverlaps reports the pools whose CIDR overlaps the CIDR of another pool in the same datacenter, since
+// their allocations would collide.
+func lintIPAMPoolOverlaps(ipamPools []IPAMPool) []LintIssue {
+	type datacenterPool struct {
+		pool string
+		cidr *net.IPNet
+	}
+
+	dcPools := map[string][]datacenterPool{}
+	for _, ipamPool := range sortedIPAMPools(ipamPools) {
+		for dc, dcIPAMPoolCfg := range ipamPool.Datacenters {
+			_, poolSubnet, err := net.ParseCIDR(dcIPAMPoolCfg.PoolCIDR)
+			if err != nil {
+				// already reported by lintIPAMPool
+				continue
+			}
+			dcPools[dc] = append(dcPools[dc], datacenterPool{pool: ipamPool.qualifiedName(), cidr: poolSubnet})
+		}
+	}
+
+	issues := []LintIssue{}
+	for _, dc := range sortedKeys(dcPools) {
+		for i, pool := range dcPools[dc] {
+			for _, otherPool := range dcPools[dc][i+1:] {
+				if networksOverlap(pool.cidr, otherPool.cidr) {
+					issues = append(issues, LintIssue{
+						Pool:       otherPool.pool,
+						Datacenter: dc,
+						Message:    fmt.Sprintf("pool CIDR %s overlaps CIDR %s of pool %s", otherPool.cidr, pool.cidr, pool.pool),
+					})
+				}
+			}
+		}
+	}
+	sort.SliceStable(issues, func(i, j int) bool {
+		return issues[i].Pool < issues[j].Pool
+	})
+	return issues
+}
@@ -0,0 +1,158 @@
+package ipam
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+)
+
+// AllocationFilter selects allocations; empty fields match everything.
+type AllocationFilter struct {
+	Datacenter string
+	// Tenant is the tenant of the pool
+	Tenant string
+	// Pool is the name of the pool, matching the allocations of all its purposes, or "<pool>:<purpose>" to match the
+	// allocations of a single purpose
+	Pool string
+	// Cluster is the qualified name of the cluster, e.g. "team-a/c1" for clusters of a tenant
+	Cluster string
+	// WithinCIDR keeps only the allocations whose addresses are all inside the CIDR
+	WithinCIDR string
+}
+
+// AllocationPage is a page of the allocations listed by ListAllocations.
+type AllocationPage struct {
+	Allocations []IPAMAllocation
+	// NextPageToken is empty on the last page
+	NextPageToken string
+	Total         int
+}
+
+// ListAllocations returns the allocations matching the filter, sorted by datacenter, cluster and pool, one page at
+// a time. The page token is the NextPageToken of the previous page, or empty for the first one.
+func (p IPAM) ListAllocations(filter AllocationFilter, pageSize int, pageToken string) (AllocationPage, error) {
+	if pageSize <= 0 {
+		return AllocationPage{}, fmt.Errorf("page size must be positive")
+	}
+	offset := 0
+	if pageToken != "" {
+		var err error
+		offset, err = strconv.Atoi(pageToken)
+		if err != nil || offset < 0 {
+			return AllocationPage{}, fmt.Errorf("invalid page token")
+		}
+	}
+	var withinNet *net.IPNet
+	if filter.WithinCIDR != "" {
+		var err error
+		_, withinNet, err = net.ParseCIDR(filter.WithinCIDR)
+		if err != nil {
+			return AllocationPage{}, err
+		}
+	}
+
+	allocations := []IPAMAllocation{}
+	for dc, dcClusters := range p.datacenterAllocations {
+		if filter.Datacenter != "" && filter.Datacenter != dc {
+			continue
+		}
+		for _, dcCluster := range dcClusters {
+			if filter.Cluster != "" && filter.Cluster != dcCluster.ref(dc).qualifiedName() {
+				continue
+			}
+			for _, ipamAllocation := range dcCluster.IPAMAllocations {
+				if filter.Tenant != "" && filter.Tenant != ipamAllocation.IPAMPoolTenant {
+					continue
+				}
+				if filter.Pool != "" && filter.Pool != ipamAllocation.IPAMPoolName && filter.Pool != withPurpose(ipamAllocation.IPAMPoolName, ipamAllocation.Purpose) {
+					continue
+				}
+				if withinNet != nil {
+					isWithin, err := allocationWithin(ipamAllocation, withinNet)
+					if err != nil {
+						return AllocationPage{}, err
+					}
+					if !isWithin {
+						continue
+					}
+				}
+				allocations = append(allocations, ipamAllocation)
+			}
+		}
+	}
+	sortAllocations(allocations)
+
+	page := AllocationPage{Allocations: []IPAMAllocation{}, Total: len(allocations)}
+	if offset < len(allocations) {
+		end := offset + pageSize
+		if end < len(allocations) {
+			page.NextPageToken = strconv.Itoa(end)
+		} else {
+			end = len(allocations)
+		}
+		page.Allocations = allocations[offset:end]
+	}
+	return page, nil
+}
+
+func allocationWithin(ipamAllocation IPAMAllocation, network *net.IPNet) (bool, error) {
+	switch ipamAllocation.Type {
+	case "range":
+		ips, err := getUsedIPsFromAddressRanges(ipamAllocation.Addresses)
+		if err != nil {
+			return false, err
+		}
+		for _, ip := range ips {
+			if !network.Contains(net.ParseIP(ip)) {
+				return false, nil
+			}
+		}
+		return true, nil
+	case "prefix":
+		_, subnet, err := net.ParseCIDR(ipamAllocation.CIDR)
+		if err != nil {
+			return false, err
+		}
+		subnetPrefix, _ := subnet.Mask.Size()
+		networkPrefix, _ := network.Mask.Size()
+		return network.Contains(subnet.IP) && subnetPrefix >= networkPrefix, nil
+	}
+	return false, nil
+}
+
+// Allocations returns all the allocations, sorted by datacenter, cluster and pool.
+func (p IPAM) Allocations() []IPAMAllocation {
+	allocations := []IPAMAllocation{}
+	for _, dcClusters := range p.datacenterAllocations {
+		for _, dcCluster := range dcClusters {
+			allocations = append(allocations, dcCluster.IPAMAllocations...)
+		}
+	}
+	sortAllocations(allocations)
+	return allocations
+}
+
+// ClusterAllocations returns the allocations of a cluster, sorted by pool.
+func (p IPAM) ClusterAllocations(cluster ClusterRef) ([]IPAMAllocation, error) {
+	i := p.clusterIndex(cluster)
+	if i < 0 {
+		return nil, fmt.Errorf("cluster %s not found in datacenter %s", cluster.qualifiedName(), cluster.Datacenter)
+	}
+	allocations := append([]IPAMAllocation{}, p.datacenterAllocations[cluster.Datacenter][i].IPAMAllocations...)
+	sortAllocations(allocations)
+	return allocations, nil
+}
+
+// sortAllocations sorts allocations by datacenter, cluster and qualified pool name.
+func sortAllocations(allocations []IPAMAllocation) {
+	sort.SliceStable(allocations, func(i, j int) bool {
+		if allocations[i].Datacenter != allocations[j].Datacenter {
+			return allocations[i].Datacenter < allocations[j].Datacenter
+		}
+		if allocations[i].Cluster != allocations[j].Cluster {
+			return allocations[i].Cluster < allocations[j].Cluster
+		}
+		return allocations[i].qualifiedIPAMPoolName() < allocations[j].qualifiedIPAMPoolName()
+	})
+}
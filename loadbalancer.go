@@ -0,0 +1,64 @@
+package ipam
+
+import (
+	"fmt"
+	"net"
+)
+
+// LoadBalancerIPLister lists the external IPs of the Services of type LoadBalancer of a managed cluster.
+// It's usually backed by a Service informer watching the cluster.
+type LoadBalancerIPLister interface {
+	ListLoadBalancerIPs(cluster ClusterRef) ([]string, error)
+}
+
+// ReconcileLoadBalancerIPs replaces the load balancer reservations of every datacenter by the external IPs of the
+// LoadBalancer Services of its clusters, so they are never allocated to other clusters while in use, and returns the
+// current allocations that already collide with them. IPs inside an allocation of the cluster itself (e.g. its load
+// balancer range) are the ones handed out from that allocation, so they are not reserved.
+func ReconcileLoadBalancerIPs(p IPAM, lister LoadBalancerIPLister) ([]ReservationConflict, error) {
+	dcReservations := map[string][]string{}
+	for _, dc := range sortedKeys(p.datacenterAllocations) {
+		for _, dcCluster := range p.datacenterAllocations[dc] {
+			ips, err := lister.ListLoadBalancerIPs(dcCluster.ref(dc))
+			if err != nil {
+				return nil, err
+			}
+			for _, ip := range ips {
+				parsedIP := net.ParseIP(ip)
+				if parsedIP == nil {
+					return nil, fmt.Errorf("wrong ip format")
+				}
+				ipNet := &net.IPNet{IP: parsedIP, Mask: net.CIDRMask(8*net.IPv6len, 8*net.IPv6len)}
+				if v4 := parsedIP.To4(); v4 != nil {
+					ipNet = &net.IPNet{IP: v4, Mask: net.CIDRMask(8*net.IPv4len, 8*net.IPv4len)}
+				}
+				isClusterIP, err := clusterAllocationsOverlap(dcCluster, ipNet)
+				if err != nil {
+					return nil, err
+				}
+				if isClusterIP || containsString(dcReservations[dc], ipNet.String()) {
+					continue
+				}
+				dcReservations[dc] = append(dcReservations[dc], ipNet.String())
+			}
+		}
+	}
+	for dc := range p.datacenterReservations {
+		p.setReservations(dc, reservationSourceLoadBalancer, nil)
+	}
+	for dc, reservations := range dcReservations {
+		p.setReservations(dc, reservationSourceLoadBalancer, reservations)
+	}
+
+	return p.findReservationConflicts()
+}
+
+func clusterAllocationsOverlap(cluster Cluster, network *net.IPNet) (bool, error) {
+	for _, ipamAllocation := range cluster.IPAMAllocations {
+		overlaps, err := allocationOverlaps(ipamAllocation, network)
+		if err != nil || overlaps {
+			return overlaps, err
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,202 @@
+package ipam
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	metricLabelPool       = "pool"
+	metricLabelDatacenter = "datacenter"
+	metricLabelCluster    = "cluster"
+)
+
+// MetricsOptions configures RenderPrometheusMetrics.
+type MetricsOptions struct {
+	// Labels are the labels of the allocation metrics, among "pool", "datacenter" and "cluster". The series are
+	// aggregated over the labels left out. Defaults to pool and datacenter.
+	Labels []string
+	// MaxClusters is the cardinality guard of the cluster label: when more clusters have allocations, the cluster
+	// label is dropped and the series aggregated by the other labels. Zero means no limit.
+	MaxClusters int
+	// ExhaustionWindow enables the projected exhaustion metric, with the allocation rate measured over this window.
+	// The metric is always labeled by pool and datacenter, since projections of different pools cannot be added up.
+	ExhaustionWindow time.Duration
+}
+
+// metricSeries accumulates the values of a metric per label set.
+type metricSeries map[string]*big.Int
+
+func (s metricSeries) add(labels string, value *big.Int) {
+	if _, exists := s[labels]; !exists {
+		s[labels] = big.NewInt(0)
+	}
+	s[labels].Add(s[labels], value)
+}
+
+// RenderPrometheusMetrics generates the allocation metrics of the IPAM pools in the Prometheus text exposition
+// format: the number of allocations and allocated addresses, the free addresses of each datacenter pool and an info
+// metric with the datacenter metadata.
+func RenderPrometheusMetrics(p IPAM, ipamPools []IPAMPool, options MetricsOptions) (string, error) {
+	labels := options.Labels
+	if len(labels) == 0 {
+		labels = []string{metricLabelPool, metricLabelDatacenter}
+	}
+	for _, label := range labels {
+		if label != metricLabelPool && label != metricLabelDatacenter && label != metricLabelCluster {
+			return "", fmt.Errorf("unsupported metric label %q", label)
+		}
+	}
+	if options.MaxClusters > 0 && countAllocatedClusters(p) > options.MaxClusters {
+		labels = withoutLabel(labels, metricLabelCluster)
+	}
+	// free addresses belong to the datacenter pool, not to a cluster
+	poolLabels := withoutLabel(labels, metricLabelCluster)
+
+	allocations := metricSeries{}
+	allocatedAddresses := metricSeries{}
+	freeAddresses := metricSeries{}
+	projectedExhaustion := metricSeries{}
+
+	purposePools := []IPAMPool{}
+	for _, ipamPool := range sortedIPAMPools(ipamPools) {
+		poolPurposePools, err := ipamPool.purposePools()
+		if err != nil {
+			return "", err
+		}
+		purposePools = append(purposePools, poolPurposePools...)
+	}
+
+	for _, ipamPool := range purposePools {
+		ipamPool, err := ipamPool.withResolvedAllocationSizes()
+		if err != nil {
+			return "", err
+		}
+		dcIPAMPoolUsageMap, err := p.compileCurrentAllocationsForPool(ipamPool)
+		if err != nil {
+			return "", err
+		}
+
+		for dc, dcIPAMPoolCfg := range ipamPool.Datacenters {
+			labelValues := map[string]string{
+				metricLabelPool:       ipamPool.qualifiedName(),
+				metricLabelDatacenter: dc,
+			}
+
+			for _, dcCluster := range p.datacenterAllocations[dc] {
+				for _, ipamAllocation := range dcCluster.IPAMAllocations {
+					if !ipamAllocation.isFromPool(ipamPool) {
+						continue
+					}
+					size, err := allocationSize(ipamAllocation)
+					if err != nil {
+						return "", err
+					}
+					labelValues[metricLabelCluster] = dcCluster.ref(dc).qualifiedName()
+					allocations.add(formatMetricLabels(labels, labelValues), big.NewInt(1))
+					allocatedAddresses.add(formatMetricLabels(labels, labelValues), size)
+				}
+			}
+
+			freeCapacity, err := freeCapacityOfPool(dc, dcIPAMPoolCfg, dcIPAMPoolUsageMap)
+			if err != nil {
+				return "", err
+			}
+			free := new(big.Int).Set(freeCapacity)
+			if dcIPAMPoolCfg.Type == "prefix" {
+				_, poolSubnet, err := net.ParseCIDR(dcIPAMPoolCfg.PoolCIDR)
+				if err != nil {
+					return "", err
+				}
+				_, bits := poolSubnet.Mask.Size()
+				free.Lsh(free, uint(bits-int(dcIPAMPoolCfg.AllocationPrefix)))
+			}
+			freeAddresses.add(formatMetricLabels(poolLabels, labelValues), free)
+
+			if options.ExhaustionWindow > 0 {
+				remainingAllocations, err := remainingAllocationsOfPool(dc, dcIPAMPoolCfg, dcIPAMPoolUsageMap)
+				if err != nil {
+					return "", err
+				}
+				projection := p.projectDatacenterExhaustion(ipamPool, dc, remainingAllocations, options.ExhaustionWindow)
+				if !projection.ExhaustedAt.IsZero() {
+					projectedExhaustion.add(formatMetricLabels([]string{metricLabelPool, metricLabelDatacenter}, labelValues), big.NewInt(projection.ExhaustedAt.Unix()))
+				}
+			}
+		}
+	}
+
+	metrics := strings.Builder{}
+	writeMetric(&metrics, "ipam_pool_allocations", "Number of allocations of the IPAM pool.", allocations)
+	writeMetric(&metrics, "ipam_pool_allocated_addresses", "Number of addresses allocated from the IPAM pool.", allocatedAddresses)
+	writeMetric(&metrics, "ipam_pool_free_addresses", "Number of free addresses of the IPAM pool.", freeAddresses)
+	if options.ExhaustionWindow > 0 {
+		writeMetric(&metrics, "ipam_pool_projected_exhaustion_timestamp_seconds", "Time the IPAM pool is projected to be exhausted at, at the current allocation rate.", projectedExhaustion)
+	}
+	if len(p.datacenters) > 0 {
+		datacenterInfo := metricSeries{}
+		for _, dc := range p.datacenters {
+			datacenterInfo.add(formatMetricLabels([]string{"datacenter", "location", "provider"}, map[string]string{
+				"datacenter": dc.Name,
+				"location":   dc.Location,
+				"provider":   dc.Provider,
+			}), big.NewInt(1))
+		}
+		writeMetric(&metrics, "ipam_datacenter_info", "Metadata of the datacenter.", datacenterInfo)
+	}
+	return metrics.String(), nil
+}
+
+func writeMetric(metrics *strings.Builder, name, help string, series metricSeries) {
+	fmt.Fprintf(metrics, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(metrics, "# TYPE %s gauge\n", name)
+	labelSets := make([]string, 0, len(series))
+	for labels := range series {
+		labelSets = append(labelSets, labels)
+	}
+	sort.Strings(labelSets)
+	for _, labels := range labelSets {
+		fmt.Fprintf(metrics, "%s%s %s\n", name, labels, series[labels])
+	}
+}
+
+func formatMetricLabels(labels []string, labelValues map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels))
+	for _, label := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", label, escapeMetricLabelValue(labelValues[label])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeMetricLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func withoutLabel(labels []string, label string) []string {
+	filtered := []string{}
+	for _, l := range labels {
+		if l != label {
+			filtered = append(filtered, l)
+		}
+	}
+	return filtered
+}
+
+func countAllocatedClusters(p IPAM) int {
+	clusters := 0
+	for _, dcClusters := range p.datacenterAllocations {
+		for _, dcCluster := range dcClusters {
+			if len(dcCluster.IPAMAllocations) > 0 {
+				clusters++
+			}
+		}
+	}
+	return clusters
+}
@@ -0,0 +1,80 @@
+package ipam
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderPrometheusMetrics(t *testing.T) {
+	now := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c2", IPAMAllocations: []IPAMAllocation{}},
+		},
+	}, WithClock(newManualClock(now)))
+	ipamPools := []IPAMPool{
+		{
+			Name: "pool1",
+			Datacenters: map[string]IPAMPoolDatacenterSettings{
+				"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/24", AllocationPrefix: 26},
+			},
+		},
+	}
+	assert.Nil(t, ipam.Apply(ipamPools[0]))
+
+	metrics, err := RenderPrometheusMetrics(ipam, ipamPools, MetricsOptions{Labels: []string{"pool", "cluster"}})
+	assert.Nil(t, err)
+	assert.Equal(t, `# HELP ipam_pool_allocations Number of allocations of the IPAM pool.
+# TYPE ipam_pool_allocations gauge
+ipam_pool_allocations{pool="pool1",cluster="c1"} 1
+ipam_pool_allocations{pool="pool1",cluster="c2"} 1
+# HELP ipam_pool_allocated_addresses Number of addresses allocated from the IPAM pool.
+# TYPE ipam_pool_allocated_addresses gauge
+ipam_pool_allocated_addresses{pool="pool1",cluster="c1"} 64
+ipam_pool_allocated_addresses{pool="pool1",cluster="c2"} 64
+# HELP ipam_pool_free_addresses Number of free addresses of the IPAM pool.
+# TYPE ipam_pool_free_addresses gauge
+ipam_pool_free_addresses{pool="pool1"} 128
+`, metrics)
+
+	// the cluster label is dropped when there are too many clusters
+	metrics, err = RenderPrometheusMetrics(ipam, ipamPools, MetricsOptions{Labels: []string{"pool", "cluster"}, MaxClusters: 1})
+	assert.Nil(t, err)
+	assert.Contains(t, metrics, "ipam_pool_allocated_addresses{pool=\"pool1\"} 128\n")
+
+	// the clusters were allocated just now, so the remaining 2 allocations last 2 days at 1 allocation per day
+	metrics, err = RenderPrometheusMetrics(ipam, ipamPools, MetricsOptions{ExhaustionWindow: 48 * time.Hour})
+	assert.Nil(t, err)
+	assert.Contains(t, metrics, "# TYPE ipam_pool_projected_exhaustion_timestamp_seconds gauge\n")
+	assert.Contains(t, metrics, fmt.Sprintf("ipam_pool_projected_exhaustion_timestamp_seconds{pool=\"pool1\",datacenter=\"aws-eu-1\"} %d\n", now.Add(48*time.Hour).Unix()))
+
+	_, err = RenderPrometheusMetrics(ipam, ipamPools, MetricsOptions{Labels: []string{"tenant"}})
+	assert.NotNil(t, err)
+}
+
+func TestRenderPrometheusMetricsWithPurposes(t *testing.T) {
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+		},
+	})
+	ipamPool := IPAMPool{
+		Name: "net",
+		Purposes: map[string]map[string]IPAMPoolDatacenterSettings{
+			"pods":  {"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/24", AllocationPrefix: 26}},
+			"nodes": {"aws-eu-1": {Type: "range", PoolCIDR: "192.168.1.0/28", AllocationRange: 4}},
+		},
+	}
+	assert.Nil(t, ipam.Apply(ipamPool))
+
+	metrics, err := RenderPrometheusMetrics(ipam, []IPAMPool{ipamPool}, MetricsOptions{Labels: []string{"pool"}})
+	assert.Nil(t, err)
+	assert.Contains(t, metrics, "ipam_pool_allocated_addresses{pool=\"net:nodes\"} 4\n")
+	assert.Contains(t, metrics, "ipam_pool_allocated_addresses{pool=\"net:pods\"} 64\n")
+	assert.Contains(t, metrics, "ipam_pool_free_addresses{pool=\"net:nodes\"} 12\n")
+	assert.Contains(t, metrics, "ipam_pool_free_addresses{pool=\"net:pods\"} 192\n")
+}
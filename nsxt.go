@@ -0,0 +1,51 @@
+package ipam
+
+// NSXTClient reads and manages the subnets carved out of a VMware NSX-T IP block.
+// It's usually backed by the NSX-T policy API (/policy/api/v1/infra/ip-blocks).
+type NSXTClient interface {
+	ListIPBlockSubnets(ipBlockID string) ([]NSXTIPSubnet, error)
+	CreateIPBlockSubnet(ipBlockID string, subnet NSXTIPSubnet) error
+}
+
+// NSXTIPSubnet is a subnet carved out of an NSX-T IP block.
+type NSXTIPSubnet struct {
+	DisplayName string
+	CIDR        string
+}
+
+// SyncNSXTIPBlocks registers the subnets already carved out of the NSX-T IP block of each datacenter as external
+// reservations and returns the current allocations that collide with them. Subnets matching exactly a prefix
+// allocation of the datacenter are the ones pushed for that allocation, so they are not reserved.
+func SyncNSXTIPBlocks(p IPAM, client NSXTClient, dcIPBlocks map[string]string) ([]ReservationConflict, error) {
+	for dc, ipBlockID := range dcIPBlocks {
+		subnets, err := client.ListIPBlockSubnets(ipBlockID)
+		if err != nil {
+			return nil, err
+		}
+		cidrs := []string{}
+		for _, subnet := range subnets {
+			cidrs = append(cidrs, subnet.CIDR)
+		}
+		err = p.reserveExternalCIDRs(dc, reservationSourceNSXT, cidrs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return p.findReservationConflicts()
+}
+
+// NSXTSubnetPushHook returns an allocation hook pushing every new prefix allocation as a subnet of the NSX-T IP
+// block of its datacenter.
+func NSXTSubnetPushHook(client NSXTClient, dcIPBlocks map[string]string) AllocationHook {
+	return func(allocation IPAMAllocation) error {
+		ipBlockID, hasIPBlock := dcIPBlocks[allocation.Datacenter]
+		if !hasIPBlock || allocation.Type != "prefix" {
+			return nil
+		}
+		return client.CreateIPBlockSubnet(ipBlockID, NSXTIPSubnet{
+			DisplayName: externalName(allocation),
+			CIDR:        allocation.CIDR,
+		})
+	}
+}
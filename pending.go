@@ -0,0 +1,144 @@
+package ipam
+
+import (
+	"sort"
+	"time"
+)
+
+// WithPendingAllocations makes Apply queue the clusters it cannot serve because the pool is exhausted, instead of
+// failing. The queued clusters are served first, oldest first, as soon as space is freed in the pool.
+func WithPendingAllocations() Option {
+	return func(p *IPAM) {
+		p.queuePendingAllocations = true
+	}
+}
+
+// pendingAllocation is a cluster waiting for an allocation of an exhausted pool.
+type pendingAllocation struct {
+	Cluster        ClusterRef
+	IPAMPoolName   string
+	IPAMPoolTenant string
+	Purpose        string
+	Since          time.Time
+}
+
+func (pending pendingAllocation) key() pendingAllocationKey {
+	return pendingAllocationKey{
+		cluster: pending.Cluster,
+		pool:    qualifiedIPAMPoolName(pending.IPAMPoolTenant, withPurpose(pending.IPAMPoolName, pending.Purpose)),
+	}
+}
+
+type pendingAllocationKey struct {
+	cluster ClusterRef
+	pool    string
+}
+
+func pendingAllocationKeyOf(allocation IPAMAllocation) pendingAllocationKey {
+	return pendingAllocationKey{
+		cluster: allocation.clusterRef(),
+		pool:    allocation.qualifiedIPAMPoolName(),
+	}
+}
+
+// queuePending records the clusters as pending allocations of the pool, keeping the original time of the ones
+// already pending.
+func (p IPAM) queuePending(ipamPool IPAMPool, clusters []ClusterRef) {
+	now := p.clock.Now()
+	for _, cluster := range clusters {
+		key := pendingAllocationKey{cluster: cluster, pool: ipamPool.qualifiedName()}
+		if _, isPending := p.pendingAllocations[key]; isPending {
+			continue
+		}
+		p.pendingAllocations[key] = pendingAllocation{
+			Cluster:        cluster,
+			IPAMPoolName:   ipamPool.Name,
+			IPAMPoolTenant: ipamPool.Tenant,
+			Purpose:        ipamPool.purpose,
+			Since:          now,
+		}
+	}
+}
+
+// pending returns the pending allocations, oldest first.
+func (p IPAM) pending() []pendingAllocation {
+	pendingAllocations := make([]pendingAllocation, 0, len(p.pendingAllocations))
+	for _, pending := range p.pendingAllocations {
+		pendingAllocations = append(pendingAllocations, pending)
+	}
+	sort.Slice(pendingAllocations, func(i, j int) bool {
+		if !pendingAllocations[i].Since.Equal(pendingAllocations[j].Since) {
+			return pendingAllocations[i].Since.Before(pendingAllocations[j].Since)
+		}
+		if pendingAllocations[i].Cluster.Datacenter != pendingAllocations[j].Cluster.Datacenter {
+			return pendingAllocations[i].Cluster.Datacenter < pendingAllocations[j].Cluster.Datacenter
+		}
+		return pendingAllocations[i].Cluster.qualifiedName() < pendingAllocations[j].Cluster.qualifiedName()
+	})
+	return pendingAllocations
+}
+
+// trackPendingIPAMPool keeps the latest applied settings of the pool while it has pending allocations, so they can
+// be fulfilled when space is freed.
+func (p IPAM) trackPendingIPAMPool(ipamPool IPAMPool) {
+	for _, pending := range p.pendingAllocations {
+		if pending.IPAMPoolName == ipamPool.Name && pending.IPAMPoolTenant == ipamPool.Tenant {
+			p.pendingIPAMPools[ipamPool.qualifiedName()] = ipamPool
+			return
+		}
+	}
+	delete(p.pendingIPAMPools, ipamPool.qualifiedName())
+}
+
+// fulfillPendingAllocations re-applies the pools having pending allocations with their latest applied settings, so
+// the pending clusters are served (oldest first). It's called whenever space is freed, e.g. by Release; pools that
+// grow are applied again anyway, which serves their pending clusters first.
+func (p IPAM) fulfillPendingAllocations() error {
+	for _, poolName := range sortedKeys(p.pendingIPAMPools) {
+		if err := p.Apply(p.pendingIPAMPools[poolName]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clustersInAllocationOrder returns the clusters of a datacenter in the order they are served by the pool: higher
+// priority first, then the ones with a pending allocation of the pool (oldest first), then the others in their
+// current order.
+func (p IPAM) clustersInAllocationOrder(ipamPool IPAMPool, dc string) []Cluster {
+	dcClusters := p.datacenterAllocations[dc]
+	if len(p.pendingAllocations) == 0 && !hasPrioritizedClusters(dcClusters) {
+		return dcClusters
+	}
+
+	orderedClusters := make([]Cluster, len(dcClusters))
+	copy(orderedClusters, dcClusters)
+	pendingSince := func(cluster Cluster) (time.Time, bool) {
+		pending, isPending := p.pendingAllocations[pendingAllocationKey{
+			cluster: cluster.ref(dc),
+			pool:    ipamPool.qualifiedName(),
+		}]
+		return pending.Since, isPending
+	}
+	sort.SliceStable(orderedClusters, func(i, j int) bool {
+		if orderedClusters[i].Priority != orderedClusters[j].Priority {
+			return orderedClusters[i].Priority > orderedClusters[j].Priority
+		}
+		iSince, iIsPending := pendingSince(orderedClusters[i])
+		jSince, jIsPending := pendingSince(orderedClusters[j])
+		if iIsPending != jIsPending {
+			return iIsPending
+		}
+		return iIsPending && iSince.Before(jSince)
+	})
+	return orderedClusters
+}
+
+func hasPrioritizedClusters(clusters []Cluster) bool {
+	for _, cluster := range clusters {
+		if cluster.Priority != 0 {
+			return true
+		}
+	}
+	return false
+}
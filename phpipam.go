@@ -0,0 +1,382 @@
+package ipam
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// phpIPAMTagPrefix marks phpIPAM subnets and addresses that were exported from (or are meant to be imported into) this IPAM.
+// The full tag has the form "ipam:<pool>/<datacenter>/<cluster>" ("ipam:<tenant>/<pool>/<datacenter>/<cluster>" for
+// pools of a tenant) and is stored in the phpIPAM description field. The allocations of clusters of a tenant always
+// carry both tenants, "ipam:<pool tenant>/<pool>/<datacenter>/<cluster tenant>/<cluster>", where the pool tenant is
+// empty for pools without one.
+const phpIPAMTagPrefix = "ipam:"
+
+// PHPIPAMClient is a client of the phpIPAM REST API, authenticated with a static app token.
+type PHPIPAMClient struct {
+	// baseURL is the phpIPAM API URL including the app id, e.g. https://phpipam.example.com/api/myapp
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// NewPHPIPAMClient returns a client of the phpIPAM API at baseURL, which includes the app id.
+func NewPHPIPAMClient(baseURL, token string) *PHPIPAMClient {
+	return &PHPIPAMClient{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		token:      token,
+		httpClient: http.DefaultClient,
+	}
+}
+
+// phpIPAMString accepts both JSON strings and numbers, since phpIPAM returns numeric fields as strings
+// in most versions but as numbers in some others.
+type phpIPAMString string
+
+func (s *phpIPAMString) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*s = ""
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		*s = phpIPAMString(str)
+		return nil
+	}
+	var num json.Number
+	if err := json.Unmarshal(data, &num); err != nil {
+		return err
+	}
+	*s = phpIPAMString(num.String())
+	return nil
+}
+
+type phpIPAMResponse struct {
+	Code    int             `json:"code"`
+	Success bool            `json:"success"`
+	Message string          `json:"message,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+type phpIPAMSubnet struct {
+	ID          phpIPAMString `json:"id,omitempty"`
+	Subnet      string        `json:"subnet"`
+	Mask        phpIPAMString `json:"mask"`
+	SectionID   phpIPAMString `json:"sectionId"`
+	Description string        `json:"description,omitempty"`
+}
+
+type phpIPAMAddress struct {
+	ID          phpIPAMString `json:"id,omitempty"`
+	SubnetID    phpIPAMString `json:"subnetId"`
+	IP          string        `json:"ip"`
+	Hostname    string        `json:"hostname,omitempty"`
+	Description string        `json:"description,omitempty"`
+}
+
+func (s phpIPAMSubnet) cidr() string {
+	return fmt.Sprintf("%s/%s", s.Subnet, s.Mask)
+}
+
+func (c *PHPIPAMClient) do(method, path string, body interface{}, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("token", c.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	phpIPAMResp := phpIPAMResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&phpIPAMResp); err != nil {
+		return fmt.Errorf("cannot decode phpIPAM response for %s %s: %v", method, path, err)
+	}
+	if !phpIPAMResp.Success {
+		return &phpIPAMError{Code: phpIPAMResp.Code, Message: phpIPAMResp.Message}
+	}
+
+	if out != nil && len(phpIPAMResp.Data) > 0 {
+		return json.Unmarshal(phpIPAMResp.Data, out)
+	}
+	return nil
+}
+
+type phpIPAMError struct {
+	Code    int
+	Message string
+}
+
+func (e *phpIPAMError) Error() string {
+	return fmt.Sprintf("phpIPAM request failed with code %d: %s", e.Code, e.Message)
+}
+
+func isPHPIPAMNotFound(err error) bool {
+	phpIPAMErr, ok := err.(*phpIPAMError)
+	return ok && phpIPAMErr.Code == http.StatusNotFound
+}
+
+func (c *PHPIPAMClient) sectionSubnets(sectionID string) ([]phpIPAMSubnet, error) {
+	subnets := []phpIPAMSubnet{}
+	err := c.do(http.MethodGet, fmt.Sprintf("/sections/%s/subnets/", sectionID), nil, &subnets)
+	if isPHPIPAMNotFound(err) {
+		return []phpIPAMSubnet{}, nil
+	}
+	return subnets, err
+}
+
+func (c *PHPIPAMClient) subnetAddresses(subnetID string) ([]phpIPAMAddress, error) {
+	addresses := []phpIPAMAddress{}
+	err := c.do(http.MethodGet, fmt.Sprintf("/subnets/%s/addresses/", subnetID), nil, &addresses)
+	if isPHPIPAMNotFound(err) {
+		// phpIPAM answers with 404 when the subnet has no addresses
+		return []phpIPAMAddress{}, nil
+	}
+	return addresses, err
+}
+
+func (c *PHPIPAMClient) createSubnet(subnet phpIPAMSubnet) error {
+	return c.do(http.MethodPost, "/subnets/", subnet, nil)
+}
+
+func (c *PHPIPAMClient) createAddress(address phpIPAMAddress) error {
+	return c.do(http.MethodPost, "/addresses/", address, nil)
+}
+
+func phpIPAMTag(allocation IPAMAllocation) string {
+	if allocation.ClusterTenant != "" {
+		return fmt.Sprintf("%s%s/%s/%s/%s/%s", phpIPAMTagPrefix, allocation.IPAMPoolTenant, withPurpose(allocation.IPAMPoolName, allocation.Purpose),
+			allocation.Datacenter, allocation.ClusterTenant, allocation.Cluster)
+	}
+	return fmt.Sprintf("%s%s/%s/%s", phpIPAMTagPrefix, allocation.qualifiedIPAMPoolName(), allocation.Datacenter, allocation.Cluster)
+}
+
+// parsePHPIPAMTag returns the allocation (pool, tenants, purpose, datacenter and cluster) encoded in a phpIPAM
+// description, if it is tagged.
+func parsePHPIPAMTag(description string) (IPAMAllocation, bool) {
+	if !strings.HasPrefix(description, phpIPAMTagPrefix) {
+		return IPAMAllocation{}, false
+	}
+	parts := strings.Split(strings.TrimPrefix(description, phpIPAMTagPrefix), "/")
+	for i, part := range parts {
+		// only the pool tenant of the tags of clusters of a tenant can be empty
+		if part == "" && (i != 0 || len(parts) != 5) {
+			return IPAMAllocation{}, false
+		}
+	}
+	allocation := IPAMAllocation{}
+	switch len(parts) {
+	case 3:
+		allocation = IPAMAllocation{IPAMPoolName: parts[0], Datacenter: parts[1], Cluster: parts[2]}
+	case 4:
+		allocation = IPAMAllocation{IPAMPoolTenant: parts[0], IPAMPoolName: parts[1], Datacenter: parts[2], Cluster: parts[3]}
+	case 5:
+		allocation = IPAMAllocation{IPAMPoolTenant: parts[0], IPAMPoolName: parts[1], Datacenter: parts[2], ClusterTenant: parts[3], Cluster: parts[4]}
+	default:
+		return IPAMAllocation{}, false
+	}
+	// the pool name of the allocations of a pool purpose is "<pool>:<purpose>"
+	if poolPurpose := strings.SplitN(allocation.IPAMPoolName, purposeSeparator, 2); len(poolPurpose) == 2 {
+		allocation.IPAMPoolName, allocation.Purpose = poolPurpose[0], poolPurpose[1]
+	}
+	return allocation, true
+}
+
+// ImportPHPIPAMAllocations reads the subnets and addresses of a phpIPAM section and converts the tagged ones into
+// IPAM allocations: tagged subnets become prefix allocations and tagged addresses become range allocations
+// (contiguous addresses are merged into a single address range).
+func ImportPHPIPAMAllocations(c *PHPIPAMClient, sectionID string) ([]IPAMAllocation, error) {
+	allocations := []IPAMAllocation{}
+
+	subnets, err := c.sectionSubnets(sectionID)
+	if err != nil {
+		return nil, err
+	}
+
+	rangeAllocationIPs := map[string][]string{}
+	rangeAllocations := map[string]IPAMAllocation{}
+	for _, subnet := range subnets {
+		if allocation, isTagged := parsePHPIPAMTag(subnet.Description); isTagged {
+			allocation.Type = "prefix"
+			allocation.CIDR = subnet.cidr()
+			allocations = append(allocations, allocation)
+		}
+
+		addresses, err := c.subnetAddresses(string(subnet.ID))
+		if err != nil {
+			return nil, err
+		}
+		for _, address := range addresses {
+			allocation, isTagged := parsePHPIPAMTag(address.Description)
+			if !isTagged {
+				continue
+			}
+			if net.ParseIP(address.IP) == nil {
+				return nil, fmt.Errorf("wrong ip format")
+			}
+			tag := address.Description
+			rangeAllocationIPs[tag] = append(rangeAllocationIPs[tag], address.IP)
+			allocation.Type = "range"
+			rangeAllocations[tag] = allocation
+		}
+	}
+
+	tags := make([]string, 0, len(rangeAllocations))
+	for tag := range rangeAllocations {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		allocation := rangeAllocations[tag]
+		allocation.Addresses = addressRangesFromIPs(rangeAllocationIPs[tag])
+		allocations = append(allocations, allocation)
+	}
+
+	return allocations, nil
+}
+
+// ExportPHPIPAMAllocations creates the given allocations in a phpIPAM section: prefix allocations become subnets
+// and range allocations become addresses inside the most specific existing subnet of the section containing them.
+// Subnets and addresses that already exist in phpIPAM for the same allocation are left untouched, while the ones
+// that exist for anything else are conflicts, reported before anything is created.
+func ExportPHPIPAMAllocations(c *PHPIPAMClient, sectionID string, allocations []IPAMAllocation) error {
+	subnets, err := c.sectionSubnets(sectionID)
+	if err != nil {
+		return err
+	}
+
+	// existing subnets and addresses are mapped to their descriptions
+	existingSubnets := map[string]string{}
+	for _, subnet := range subnets {
+		existingSubnets[subnet.cidr()] = subnet.Description
+	}
+
+	existingSubnetAddresses := map[string]map[string]string{}
+	subnetAddresses := func(subnetID string) (map[string]string, error) {
+		if addresses, isLoaded := existingSubnetAddresses[subnetID]; isLoaded {
+			return addresses, nil
+		}
+		addresses, err := c.subnetAddresses(subnetID)
+		if err != nil {
+			return nil, err
+		}
+		existingSubnetAddresses[subnetID] = map[string]string{}
+		for _, address := range addresses {
+			existingSubnetAddresses[subnetID][address.IP] = address.Description
+		}
+		return existingSubnetAddresses[subnetID], nil
+	}
+
+	newSubnets := []phpIPAMSubnet{}
+	newAddresses := []phpIPAMAddress{}
+	for _, allocation := range allocations {
+		tag := phpIPAMTag(allocation)
+		switch allocation.Type {
+		case "range":
+			ips, err := getUsedIPsFromAddressRanges(allocation.Addresses)
+			if err != nil {
+				return err
+			}
+			for _, ip := range ips {
+				subnet, found := mostSpecificPHPIPAMSubnet(subnets, net.ParseIP(ip))
+				if !found {
+					return fmt.Errorf("cannot find phpIPAM subnet for address %s", ip)
+				}
+				existingAddresses, err := subnetAddresses(string(subnet.ID))
+				if err != nil {
+					return err
+				}
+				if description, exists := existingAddresses[ip]; exists {
+					if err := checkPHPIPAMDescription("address "+ip, description, allocation); err != nil {
+						return err
+					}
+					continue
+				}
+				newAddresses = append(newAddresses, phpIPAMAddress{
+					SubnetID:    subnet.ID,
+					IP:          ip,
+					Hostname:    strings.ReplaceAll(allocation.clusterRef().qualifiedName(), "/", "-"),
+					Description: tag,
+				})
+				existingAddresses[ip] = tag
+			}
+		case "prefix":
+			_, subnetNet, err := net.ParseCIDR(allocation.CIDR)
+			if err != nil {
+				return err
+			}
+			if description, exists := existingSubnets[subnetNet.String()]; exists {
+				if err := checkPHPIPAMDescription("subnet "+subnetNet.String(), description, allocation); err != nil {
+					return err
+				}
+				continue
+			}
+			prefixLen, _ := subnetNet.Mask.Size()
+			newSubnets = append(newSubnets, phpIPAMSubnet{
+				Subnet:      subnetNet.IP.String(),
+				Mask:        phpIPAMString(fmt.Sprint(prefixLen)),
+				SectionID:   phpIPAMString(sectionID),
+				Description: tag,
+			})
+			existingSubnets[subnetNet.String()] = tag
+		}
+	}
+
+	for _, subnet := range newSubnets {
+		if err := c.createSubnet(subnet); err != nil {
+			return err
+		}
+	}
+	for _, address := range newAddresses {
+		if err := c.createAddress(address); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkPHPIPAMDescription returns a conflict error unless the description of an existing phpIPAM subnet or address
+// is the tag of the allocation.
+func checkPHPIPAMDescription(entry, description string, allocation IPAMAllocation) error {
+	if owner, isTagged := parsePHPIPAMTag(description); isTagged && phpIPAMTag(owner) == phpIPAMTag(allocation) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s already exists as %q, not for cluster %s of pool %s", errPHPIPAMConflict, entry, description,
+		allocation.clusterRef().qualifiedName(), allocation.qualifiedIPAMPoolName())
+}
+
+func mostSpecificPHPIPAMSubnet(subnets []phpIPAMSubnet, ip net.IP) (phpIPAMSubnet, bool) {
+	var found phpIPAMSubnet
+	foundPrefix := -1
+	for _, subnet := range subnets {
+		_, subnetNet, err := net.ParseCIDR(subnet.cidr())
+		if err != nil || !subnetNet.Contains(ip) {
+			continue
+		}
+		prefix, _ := subnetNet.Mask.Size()
+		if prefix > foundPrefix {
+			found = subnet
+			foundPrefix = prefix
+		}
+	}
+	return found, foundPrefix >= 0
+}
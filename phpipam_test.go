@@ -0,0 +1,141 @@
+package ipam
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPHPIPAMImportExport(t *testing.T) {
+	subnets := []phpIPAMSubnet{
+		{ID: "1", Subnet: "192.168.1.0", Mask: "24", SectionID: "1"},
+		{ID: "2", Subnet: "10.0.0.0", Mask: "28", SectionID: "1", Description: "ipam:pool2/aws-eu-1/c1"},
+	}
+	addresses := map[string][]phpIPAMAddress{
+		"1": {
+			{ID: "10", SubnetID: "1", IP: "192.168.1.3", Description: "ipam:pool1/aws-eu-1/c1"},
+			{ID: "11", SubnetID: "1", IP: "192.168.1.4", Description: "ipam:pool1/aws-eu-1/c1"},
+			{ID: "12", SubnetID: "1", IP: "192.168.1.9", Description: "ipam:pool1/aws-eu-1/c1"},
+			{ID: "13", SubnetID: "1", IP: "192.168.1.20", Description: "manually managed"},
+		},
+	}
+	createdSubnets := []phpIPAMSubnet{}
+	createdAddresses := []phpIPAMAddress{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secret", r.Header.Get("token"))
+		var resp phpIPAMResponse
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/app/sections/1/subnets/":
+			data, _ := json.Marshal(subnets)
+			resp = phpIPAMResponse{Code: 200, Success: true, Data: data}
+		case r.Method == http.MethodGet && r.URL.Path == "/api/app/subnets/1/addresses/":
+			data, _ := json.Marshal(addresses["1"])
+			resp = phpIPAMResponse{Code: 200, Success: true, Data: data}
+		case r.Method == http.MethodGet && r.URL.Path == "/api/app/subnets/2/addresses/":
+			resp = phpIPAMResponse{Code: 404, Success: false, Message: "No addresses found"}
+		case r.Method == http.MethodPost && r.URL.Path == "/api/app/subnets/":
+			subnet := phpIPAMSubnet{}
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&subnet))
+			createdSubnets = append(createdSubnets, subnet)
+			resp = phpIPAMResponse{Code: 201, Success: true}
+		case r.Method == http.MethodPost && r.URL.Path == "/api/app/addresses/":
+			address := phpIPAMAddress{}
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&address))
+			createdAddresses = append(createdAddresses, address)
+			resp = phpIPAMResponse{Code: 201, Success: true}
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	client := NewPHPIPAMClient(server.URL+"/api/app/", "secret")
+
+	allocations, err := ImportPHPIPAMAllocations(client, "1")
+	assert.Nil(t, err)
+	assert.Equal(t, []IPAMAllocation{
+		{
+			IPAMPoolName: "pool2",
+			Cluster:      "c1",
+			Datacenter:   "aws-eu-1",
+			Type:         "prefix",
+			CIDR:         "10.0.0.0/28",
+		},
+		{
+			IPAMPoolName: "pool1",
+			Cluster:      "c1",
+			Datacenter:   "aws-eu-1",
+			Type:         "range",
+			Addresses:    []string{"192.168.1.3-192.168.1.4", "192.168.1.9-192.168.1.9"},
+		},
+	}, allocations)
+
+	// 192.168.1.4 is tagged for c1, so exporting it for c2 is a conflict and nothing is created
+	err = ExportPHPIPAMAllocations(client, "1", []IPAMAllocation{
+		{
+			IPAMPoolName: "pool1",
+			Cluster:      "c2",
+			Datacenter:   "aws-eu-1",
+			Type:         "range",
+			Addresses:    []string{"192.168.1.4-192.168.1.5"},
+		},
+	})
+	assert.ErrorIs(t, err, errPHPIPAMConflict)
+	assert.EqualError(t, err, "phpIPAM entry conflicts with the exported allocation: address 192.168.1.4 already exists as \"ipam:pool1/aws-eu-1/c1\", not for cluster c2 of pool pool1")
+	err = ExportPHPIPAMAllocations(client, "1", []IPAMAllocation{
+		{
+			IPAMPoolName: "pool2",
+			Cluster:      "c2",
+			Datacenter:   "aws-eu-1",
+			Type:         "prefix",
+			CIDR:         "10.0.0.0/28",
+		},
+	})
+	assert.ErrorIs(t, err, errPHPIPAMConflict)
+	assert.Empty(t, createdAddresses)
+	assert.Empty(t, createdSubnets)
+
+	err = ExportPHPIPAMAllocations(client, "1", []IPAMAllocation{
+		{
+			IPAMPoolName: "pool1",
+			Cluster:      "c1",
+			Datacenter:   "aws-eu-1",
+			Type:         "range",
+			Addresses:    []string{"192.168.1.3-192.168.1.4"},
+		},
+		{
+			IPAMPoolName: "pool1",
+			Cluster:      "c2",
+			Datacenter:   "aws-eu-1",
+			Type:         "range",
+			Addresses:    []string{"192.168.1.5-192.168.1.6"},
+		},
+		{
+			IPAMPoolName: "pool2",
+			Cluster:      "c1",
+			Datacenter:   "aws-eu-1",
+			Type:         "prefix",
+			CIDR:         "10.0.0.0/28",
+		},
+		{
+			IPAMPoolName: "pool2",
+			Cluster:      "c2",
+			Datacenter:   "aws-eu-1",
+			Type:         "prefix",
+			CIDR:         "10.0.0.16/28",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []phpIPAMAddress{
+		{SubnetID: "1", IP: "192.168.1.5", Hostname: "c2", Description: "ipam:pool1/aws-eu-1/c2"},
+		{SubnetID: "1", IP: "192.168.1.6", Hostname: "c2", Description: "ipam:pool1/aws-eu-1/c2"},
+	}, createdAddresses)
+	assert.Equal(t, []phpIPAMSubnet{
+		{Subnet: "10.0.0.16", Mask: "28", SectionID: "1", Description: "ipam:pool2/aws-eu-1/c2"},
+	}, createdSubnets)
+}
@@ -0,0 +1,130 @@
+package ipam
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// decodeIPAMPoolsYAML decodes a YAML list of IPAM pools. The YAML is converted to JSON first, so the pools are
+// decoded with the same field names as in their JSON form (e.g. poolCidr). In strict mode unknown fields (e.g. a
+// typo like allocationPrefx) are rejected instead of being ignored, with a *fieldError locating the first of them and
+// suggesting the closest known field.
+func decodeIPAMPoolsYAML(data []byte, strict bool) ([]IPAMPool, error) {
+	var document interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+
+	jsonData, err := json.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+
+	if strict {
+		if fieldErrs := unknownIPAMPoolFields(document); len(fieldErrs) > 0 {
+			return nil, fieldErrs[0]
+		}
+	}
+
+	ipamPools := []IPAMPool{}
+	if bytes.Equal(jsonData, []byte("null")) {
+		return ipamPools, nil
+	}
+	if err := decodeJSON(jsonData, &ipamPools, strict); err != nil {
+		return nil, err
+	}
+	return ipamPools, nil
+}
+
+func loadIPAMPoolsFile(path string, strict bool) ([]IPAMPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeIPAMPoolsYAML(data, strict)
+}
+
+// PoolConfigWatcher re-applies the IPAM pools of a YAML file every time its content changes. It must be the only
+// writer of the IPAM while running.
+type PoolConfigWatcher struct {
+	path     string
+	interval time.Duration
+	ipam     IPAM
+	// Confirm is optional and called with the plan of every pool before applying it; the pool is not applied
+	// when it returns false
+	Confirm func(ipamPool IPAMPool, plan []IPAMAllocation) bool
+	// OnError is optional and called with the errors of reloads, which don't stop the watcher
+	OnError func(error)
+	// Strict rejects files with unknown fields
+	Strict bool
+
+	lastDigest [sha256.Size]byte
+}
+
+// NewPoolConfigWatcher returns a watcher polling the file at path every interval. It is started with Run.
+func NewPoolConfigWatcher(path string, interval time.Duration, p IPAM) *PoolConfigWatcher {
+	return &PoolConfigWatcher{
+		path:     path,
+		interval: interval,
+		ipam:     p,
+	}
+}
+
+// Run reloads the file right away and then polls it for changes until the context is done.
+func (w *PoolConfigWatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := w.reload(); err != nil && w.OnError != nil {
+			w.OnError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reload applies the pools of the file if its content changed since the last successful reload, and returns
+// whether it was applied.
+func (w *PoolConfigWatcher) reload() (bool, error) {
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		return false, err
+	}
+	digest := sha256.Sum256(data)
+	if digest == w.lastDigest {
+		return false, nil
+	}
+
+	ipamPools, err := decodeIPAMPoolsYAML(data, w.Strict)
+	if err != nil {
+		return false, err
+	}
+
+	for _, ipamPool := range ipamPools {
+		if w.Confirm != nil {
+			plan, err := w.ipam.plan(ipamPool)
+			if err != nil {
+				return false, err
+			}
+			if !w.Confirm(ipamPool, plan) {
+				continue
+			}
+		}
+		if err := w.ipam.Apply(ipamPool); err != nil {
+			return false, err
+		}
+	}
+
+	w.lastDigest = digest
+	return true, nil
+}
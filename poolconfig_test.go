@@ -0,0 +1,218 @@
+package ipam
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPoolConfigWatcherReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pools.yaml")
+	writePools := func(poolCIDR string) {
+		err := os.WriteFile(path, []byte(`
+- name: pool1
+  datacenters:
+    aws-eu-1:
+      type: prefix
+      poolCidr: `+poolCIDR+`
+      allocationPrefix: 26
+`), 0600)
+		assert.Nil(t, err)
+	}
+
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+		},
+	})
+	watcher := NewPoolConfigWatcher(path, 0, ipam)
+	plans := [][]IPAMAllocation{}
+	watcher.Confirm = func(ipamPool IPAMPool, plan []IPAMAllocation) bool {
+		plans = append(plans, plan)
+		return len(plans) > 1
+	}
+
+	writePools("10.0.0.0/24")
+	reloaded, err := watcher.reload()
+	assert.Nil(t, err)
+	assert.True(t, reloaded)
+	assert.Equal(t, [][]IPAMAllocation{
+		{{IPAMPoolName: "pool1", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.0.0/26"}},
+	}, plans)
+	assert.Empty(t, ipam.datacenterAllocations["aws-eu-1"][0].IPAMAllocations)
+
+	reloaded, err = watcher.reload()
+	assert.Nil(t, err)
+	assert.False(t, reloaded)
+
+	writePools("10.0.1.0/24")
+	reloaded, err = watcher.reload()
+	assert.Nil(t, err)
+	assert.True(t, reloaded)
+	assert.Equal(t, []IPAMAllocation{
+		{IPAMPoolName: "pool1", Cluster: "c1", Datacenter: "aws-eu-1", Type: "prefix", CIDR: "10.0.1.0/26"},
+	}, ipam.datacenterAllocations["aws-eu-1"][0].IPAMAllocations)
+}
+
+func TestDecodeIPAMPoolsYAMLStrict(t *testing.T) {
+	data := []byte(`
+- name: pool1
+  datacenters:
+    aws-eu-1:
+      type: prefix
+      poolCidr: 10.0.0.0/24
+      allocationPrefx: 26
+`)
+
+	ipamPools, err := decodeIPAMPoolsYAML(data, false)
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(0), ipamPools[0].Datacenters["aws-eu-1"].AllocationPrefix)
+
+	_, err = decodeIPAMPoolsYAML(data, true)
+	assert.EqualError(t, err, `[0].datacenters.aws-eu-1.allocationPrefx: unknown field, did you mean "allocationPrefix"?`)
+}
+
+func TestLintIPAMPoolFieldPaths(t *testing.T) {
+	issues := lintIPAMPool(IPAMPool{
+		Name: "pool1",
+		Purposes: map[string]map[string]IPAMPoolDatacenterSettings{
+			"pods": {"aws-eu-1": {Type: "prefx", PoolCIDR: "10.0.0.0/16", AllocationPrefix: 24}},
+		},
+	})
+	assert.Equal(t, []LintIssue{
+		{Pool: "pool1:pods", Datacenter: "aws-eu-1", Field: "purposes.pods.aws-eu-1.type", Message: `unsupported pool type "prefx", did you mean "prefix"?`},
+	}, issues)
+	assert.Equal(t, `pools.yaml: pool pool1:pods datacenter aws-eu-1: purposes.pods.aws-eu-1.type: unsupported pool type "prefx", did you mean "prefix"?`, LintIssue{
+		File: "pools.yaml", Pool: issues[0].Pool, Datacenter: issues[0].Datacenter, Field: issues[0].Field, Message: issues[0].Message,
+	}.String())
+
+	_, err := decodeIPAMPoolsYAML([]byte(`[{name: pool1, tenantt: team-a}]`), true)
+	assert.EqualError(t, err, `[0].tenantt: unknown field, did you mean "tenant"?`)
+}
+
+func TestLintIPAMPoolFiles(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "pools.yaml"), []byte(`
+- name: pool1
+  datacenters:
+    aws-eu-1:
+      type: prefix
+      poolCidr: 192.168.0.0/24
+      allocationPrefix: 16
+- name: pool2
+  datacenters:
+    aws-eu-1:
+      type: range
+      poolCidr: 192.168.0.128/25
+      allocationRange: 8
+`), 0o644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "more-pools.yml"), []byte(`
+- name: pool2
+  datacenters:
+    aws-eu-1:
+      type: range
+      poolCidr: 10.0.0.0/24
+      allocationRange: 8
+`), 0o644))
+
+	issues, err := LintIPAMPoolFiles([]string{dir})
+	assert.Nil(t, err)
+	assert.Equal(t, []LintIssue{
+		{File: filepath.Join(dir, "pools.yaml"), Pool: "pool1", Datacenter: "aws-eu-1", Field: "datacenters.aws-eu-1.allocationPrefix", Message: "allocation prefix 16 must be between the pool prefix 24 and 32"},
+		{File: filepath.Join(dir, "pools.yaml"), Pool: "pool2", Message: "pool is already defined in " + filepath.Join(dir, "more-pools.yml")},
+	}, issues)
+}
+
+func TestDiffStateFiles(t *testing.T) {
+	before := New(map[string][]Cluster{
+		"aws-eu-1": {
+			{Name: "c1", IPAMAllocations: []IPAMAllocation{}},
+			{Name: "c2", IPAMAllocations: []IPAMAllocation{}},
+		},
+	})
+	ipamPool := IPAMPool{
+		Name: "pool1",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/24", AllocationPrefix: 26},
+		},
+	}
+	assert.Nil(t, before.Apply(ipamPool))
+	beforeData, err := before.MarshalState()
+	assert.Nil(t, err)
+
+	after, err := unmarshalState(beforeData, true)
+	assert.Nil(t, err)
+	after.datacenterAllocations["aws-eu-1"][0].IPAMAllocations[0].CIDR = "10.0.0.128/26"
+	after.datacenterAllocations["aws-eu-1"][1].IPAMAllocations[0].Labels = map[string]string{"env": "staging"}
+	after.datacenterAllocations["aws-eu-1"] = append(after.datacenterAllocations["aws-eu-1"], Cluster{Name: "c3", IPAMAllocations: []IPAMAllocation{}})
+	assert.Nil(t, after.Apply(ipamPool))
+	after.datacenterAllocations["aws-eu-1"][0].IPAMAllocations = []IPAMAllocation{}
+	afterData, err := after.MarshalState()
+	assert.Nil(t, err)
+
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "state-a.json"), beforeData, 0o644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "state-b.json"), afterData, 0o644))
+
+	diffs, err := DiffStateFiles(filepath.Join(dir, "state-a.json"), filepath.Join(dir, "state-b.json"))
+	assert.Nil(t, err)
+	lines := []string{}
+	for _, diff := range diffs {
+		lines = append(lines, diff.String())
+	}
+	assert.Equal(t, []string{
+		"removed aws-eu-1 cluster c1 pool pool1: 10.0.0.0/26",
+		"changed aws-eu-1 cluster c2 pool pool1: 10.0.0.64/26 (blocks unchanged)",
+		"added aws-eu-1 cluster c3 pool pool1: 10.0.0.0/26",
+	}, lines)
+	assert.Nil(t, diffs[0].After)
+	assert.Equal(t, map[string]string{"env": "staging"}, diffs[1].After.Labels)
+
+	diffs, err = DiffStateFiles(filepath.Join(dir, "state-a.json"), filepath.Join(dir, "state-a.json"))
+	assert.Nil(t, err)
+	assert.Empty(t, diffs)
+}
+
+func TestLoadTemplatedIPAMPoolsFile(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "pools.yaml"), []byte(`
+- name: pool1
+  datacenterTemplate:
+    type: prefix
+    poolCidr: "10.{{ .dcIndex }}.0.0/16"
+    allocationPrefix: 24
+    dnsServers: ["10.{{ .dcIndex }}.0.53", "{{ .resolver }}"]
+  datacenters:
+    aws-eu-1:
+      type: prefix
+      poolCidr: 192.168.0.0/16
+      allocationPrefix: 24
+`), 0o644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "inventory.yaml"), []byte(`
+- name: aws-eu-1
+  index: 1
+  variables: {resolver: 1.1.1.1}
+- name: aws-us-1
+  index: 2
+  variables: {resolver: 8.8.8.8}
+`), 0o644))
+
+	ipamPools, err := LoadTemplatedIPAMPoolsFile(filepath.Join(dir, "pools.yaml"), filepath.Join(dir, "inventory.yaml"), true)
+	assert.Nil(t, err)
+	assert.Equal(t, []IPAMPool{
+		{
+			Name: "pool1",
+			Datacenters: map[string]IPAMPoolDatacenterSettings{
+				"aws-eu-1": {Type: "prefix", PoolCIDR: "192.168.0.0/16", AllocationPrefix: 24},
+				"aws-us-1": {Type: "prefix", PoolCIDR: "10.2.0.0/16", AllocationPrefix: 24, DNSServers: []string{"10.2.0.53", "8.8.8.8"}},
+			},
+		},
+	}, ipamPools)
+
+	// variables missing from the inventory are errors
+	_, err = expandIPAMPoolTemplates([]IPAMPool{{Name: "pool1", DatacenterTemplate: &IPAMPoolDatacenterSettings{Type: "prefix", PoolCIDR: "10.{{ .region }}.0.0/16"}}},
+		[]datacenterInventoryEntry{{Name: "aws-eu-1", Index: 1}})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,133 @@
+package ipam
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// datacenterInventoryEntry is a datacenter pool templates are expanded for. Index is a stable number of the
+// datacenter, e.g. to derive its pool CIDRs, and Variables are extra values available to the templates.
+type datacenterInventoryEntry struct {
+	Name      string            `json:"name"`
+	Index     int               `json:"index"`
+	Variables map[string]string `json:"variables,omitempty"`
+}
+
+// decodeDatacenterInventoryYAML decodes a YAML list of datacenter inventory entries.
+func decodeDatacenterInventoryYAML(data []byte) ([]datacenterInventoryEntry, error) {
+	var document interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	jsonData, err := json.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	inventory := []datacenterInventoryEntry{}
+	if err := decodeJSON(jsonData, &inventory, true); err != nil {
+		return nil, err
+	}
+	for _, entry := range inventory {
+		if entry.Name == "" {
+			return nil, fmt.Errorf("datacenter name cannot be empty")
+		}
+	}
+	return inventory, nil
+}
+
+// LoadTemplatedIPAMPoolsFile loads the IPAM pools of a YAML file and expands their datacenter templates for the
+// datacenters of a YAML inventory file.
+func LoadTemplatedIPAMPoolsFile(path, inventoryPath string, strict bool) ([]IPAMPool, error) {
+	ipamPools, err := loadIPAMPoolsFile(path, strict)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(inventoryPath)
+	if err != nil {
+		return nil, err
+	}
+	inventory, err := decodeDatacenterInventoryYAML(data)
+	if err != nil {
+		return nil, err
+	}
+	return expandIPAMPoolTemplates(ipamPools, inventory)
+}
+
+// expandIPAMPoolTemplates adds the settings of every inventory datacenter to the pools with a datacenter template,
+// executing the templates of its string settings (type, poolCidr, allocateFrom, gateway and dnsServers) with the
+// variables of the datacenter plus "dc" (its name) and "dcIndex" (its index), e.g. "10.{{ .dcIndex }}.0.0/16".
+// Datacenters explicitly configured in the pool keep their settings.
+func expandIPAMPoolTemplates(ipamPools []IPAMPool, inventory []datacenterInventoryEntry) ([]IPAMPool, error) {
+	expandedPools := make([]IPAMPool, 0, len(ipamPools))
+	for _, ipamPool := range ipamPools {
+		if ipamPool.DatacenterTemplate == nil {
+			expandedPools = append(expandedPools, ipamPool)
+			continue
+		}
+
+		datacenters := make(map[string]IPAMPoolDatacenterSettings, len(ipamPool.Datacenters)+len(inventory))
+		for dc, dcIPAMPoolCfg := range ipamPool.Datacenters {
+			datacenters[dc] = dcIPAMPoolCfg
+		}
+		for _, entry := range inventory {
+			if _, isConfigured := datacenters[entry.Name]; isConfigured {
+				continue
+			}
+			dcIPAMPoolCfg, err := expandIPAMPoolDatacenterTemplate(*ipamPool.DatacenterTemplate, entry)
+			if err != nil {
+				return nil, fmt.Errorf("cannot expand the datacenter template of pool %s for datacenter %s: %v", ipamPool.qualifiedName(), entry.Name, err)
+			}
+			datacenters[entry.Name] = dcIPAMPoolCfg
+		}
+		ipamPool.Datacenters = datacenters
+		ipamPool.DatacenterTemplate = nil
+		expandedPools = append(expandedPools, ipamPool)
+	}
+	return expandedPools, nil
+}
+
+func expandIPAMPoolDatacenterTemplate(dcTemplate IPAMPoolDatacenterSettings, entry datacenterInventoryEntry) (IPAMPoolDatacenterSettings, error) {
+	variables := map[string]string{}
+	for name, value := range entry.Variables {
+		variables[name] = value
+	}
+	variables["dc"] = entry.Name
+	variables["dcIndex"] = strconv.Itoa(entry.Index)
+
+	expand := func(text string) (string, error) {
+		tmpl, err := template.New("").Funcs(allocationTemplateFuncs).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return "", err
+		}
+		expanded := bytes.Buffer{}
+		if err := tmpl.Execute(&expanded, variables); err != nil {
+			return "", err
+		}
+		return expanded.String(), nil
+	}
+
+	dcIPAMPoolCfg := dcTemplate
+	var err error
+	for _, field := range []*string{&dcIPAMPoolCfg.Type, &dcIPAMPoolCfg.PoolCIDR, &dcIPAMPoolCfg.AllocateFrom, &dcIPAMPoolCfg.Gateway} {
+		*field, err = expand(*field)
+		if err != nil {
+			return IPAMPoolDatacenterSettings{}, err
+		}
+	}
+	if dcTemplate.DNSServers != nil {
+		dcIPAMPoolCfg.DNSServers = make([]string, len(dcTemplate.DNSServers))
+		for i, dnsServer := range dcTemplate.DNSServers {
+			dcIPAMPoolCfg.DNSServers[i], err = expand(dnsServer)
+			if err != nil {
+				return IPAMPoolDatacenterSettings{}, err
+			}
+		}
+	}
+	return dcIPAMPoolCfg, nil
+}
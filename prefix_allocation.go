@@ -1,7 +1,7 @@
 package ipam
 
 import (
-	"fmt"
+	"math/big"
 	"net"
 )
 
@@ -37,29 +37,19 @@ func checkPrefixAllocation(subnetCIDR, poolCIDR string, allocationPrefix int) er
 }
 
 func findFirstFreeSubnetOfPool(dc, poolCIDR string, subnetPrefix int, dcIPAMPoolUsageMap datacenterIPAMPoolUsageMap) (string, error) {
-	poolIP, poolSubnet, err := net.ParseCIDR(poolCIDR)
+	units, err := newPoolUnits(poolCIDR, subnetPrefix)
 	if err != nil {
 		return "", err
 	}
-
-	poolPrefix, bits := poolSubnet.Mask.Size()
-	if subnetPrefix < poolPrefix {
-		return "", fmt.Errorf("invalid prefix for subnet")
-	}
-	if subnetPrefix > bits {
-		return "", fmt.Errorf("invalid prefix for subnet")
-	}
-
-	_, possibleSubnet, err := net.ParseCIDR(fmt.Sprintf("%s/%d", poolIP.Mask(poolSubnet.Mask), subnetPrefix))
-	if err != nil {
-		return "", err
-	}
-	for ; poolSubnet.Contains(possibleSubnet.IP); possibleSubnet, _ = nextSubnet(possibleSubnet, subnetPrefix) {
-		if !dcIPAMPoolUsageMap.isUsed(dc, possibleSubnet.String()) {
-			dcIPAMPoolUsageMap.setUsed(dc, possibleSubnet.String())
-			return possibleSubnet.String(), nil
-		}
+	freeSubnet := ""
+	units.forEachFreeRun(dc, dcIPAMPoolUsageMap, false, func(first, _ *big.Int) bool {
+		freeSubnet = units.subnet(first).String()
+		return false
+	})
+	if freeSubnet == "" {
+		return "", errNoFreeSubnet
 	}
 
-	return "", fmt.Errorf("cannot find free subnet")
+	dcIPAMPoolUsageMap.setUsed(dc, freeSubnet)
+	return freeSubnet, nil
 }
@@ -0,0 +1,105 @@
+package ipam
+
+import (
+	"math"
+	"time"
+)
+
+// defaultExhaustionProjectionWindow is how far back the allocation rate of a pool is measured for the projection
+// of the pool status.
+const defaultExhaustionProjectionWindow = 30 * 24 * time.Hour
+
+// ExhaustionProjection estimates when a datacenter pool runs out of room for new allocations, assuming allocations
+// keep being made (and released) at the rate they were during the projection window.
+type ExhaustionProjection struct {
+	Datacenter string
+	// IPAMPool is the qualified name of the pool
+	IPAMPool string
+	// RemainingAllocations is the number of allocations that still fit in the datacenter pool
+	RemainingAllocations int
+	// AllocationsPerDay is the net rate of the window: allocations minus releases per day
+	AllocationsPerDay float64
+	// ExhaustedAt is zero when the pool isn't shrinking
+	ExhaustedAt time.Time
+}
+
+// ProjectExhaustion projects the exhaustion of each datacenter of the pool (and of its purposes) from the allocations
+// and releases recorded in the address history during the window before now.
+func (p IPAM) ProjectExhaustion(ipamPool IPAMPool, window time.Duration) ([]ExhaustionProjection, error) {
+	purposePools, err := ipamPool.purposePools()
+	if err != nil {
+		return nil, err
+	}
+
+	projections := []ExhaustionProjection{}
+	for _, purposePool := range purposePools {
+		purposePool, err := purposePool.withResolvedAllocationSizes()
+		if err != nil {
+			return nil, err
+		}
+		dcIPAMPoolUsageMap, err := p.compileCurrentAllocationsForPool(purposePool)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, dc := range sortedKeys(purposePool.Datacenters) {
+			dcIPAMPoolCfg := purposePool.Datacenters[dc]
+			remaining, err := remainingAllocationsOfPool(dc, dcIPAMPoolCfg, dcIPAMPoolUsageMap)
+			if err != nil {
+				return nil, err
+			}
+			projections = append(projections, p.projectDatacenterExhaustion(purposePool, dc, remaining, window))
+		}
+	}
+	return projections, nil
+}
+
+func (p IPAM) projectDatacenterExhaustion(ipamPool IPAMPool, dc string, remaining int, window time.Duration) ExhaustionProjection {
+	projection := ExhaustionProjection{
+		Datacenter:           dc,
+		IPAMPool:             ipamPool.qualifiedName(),
+		RemainingAllocations: remaining,
+	}
+
+	now := p.clock.Now()
+	windowStart := now.Add(-window)
+	isInWindow := func(at time.Time) bool {
+		return !at.IsZero() && at.After(windowStart) && !at.After(now)
+	}
+
+	// range allocations have a record per address range, so the allocations are counted once per cluster and time
+	type allocationEvent struct {
+		cluster ClusterRef
+		at      time.Time
+	}
+	allocated := map[allocationEvent]struct{}{}
+	released := map[allocationEvent]struct{}{}
+	for _, record := range p.addressHistory.records {
+		if record.Datacenter != dc || record.IPAMPoolName != ipamPool.Name || record.IPAMPoolTenant != ipamPool.Tenant ||
+			record.Purpose != ipamPool.purpose {
+			continue
+		}
+		if isInWindow(record.AllocatedAt) {
+			allocated[allocationEvent{cluster: record.clusterRef(), at: record.AllocatedAt}] = struct{}{}
+		}
+		if isInWindow(record.ReleasedAt) {
+			released[allocationEvent{cluster: record.clusterRef(), at: record.ReleasedAt}] = struct{}{}
+		}
+	}
+
+	days := window.Hours() / 24
+	if days <= 0 {
+		return projection
+	}
+	projection.AllocationsPerDay = float64(len(allocated)-len(released)) / days
+	if projection.AllocationsPerDay <= 0 {
+		return projection
+	}
+	timeLeft := float64(remaining) / projection.AllocationsPerDay * 24 * float64(time.Hour)
+	if timeLeft >= math.MaxInt64 {
+		// too far away to be represented, which is as good as never
+		return projection
+	}
+	projection.ExhaustedAt = now.Add(time.Duration(timeLeft))
+	return projection
+}
@@ -0,0 +1,121 @@
+package ipam
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"text/template"
+)
+
+// maxPTRRecordsPerAllocation bounds the records generated for a single allocation, since big prefixes (specially
+// IPv6 ones) cannot be enumerated address by address.
+const maxPTRRecordsPerAllocation = 65536
+
+// ptrRecordData is the data available to the PTR record name templates.
+type ptrRecordData struct {
+	Cluster string
+	// ClusterTenant is the tenant of the cluster, if any, while Tenant is the tenant of the pool
+	ClusterTenant string
+	// QualifiedCluster is "<cluster tenant>-<cluster>" for clusters of a tenant, or the cluster name
+	QualifiedCluster string
+	Datacenter       string
+	Tenant           string
+	Pool             string
+	IP               string
+	// DashedIP is the IP with dots and colons replaced by dashes, e.g. 192-168-1-4
+	DashedIP string
+}
+
+// RenderPTRRecords generates the reverse DNS (in-addr.arpa / ip6.arpa) PTR records of every address allocated in
+// a datacenter. The record names are produced by nameTemplate (a text/template executed with ptrRecordData),
+// e.g. "{{ .QualifiedCluster }}-{{ .DashedIP }}.example.com".
+func RenderPTRRecords(p IPAM, dc, nameTemplate string) (string, error) {
+	tmpl, err := template.New("ptr").Parse(nameTemplate)
+	if err != nil {
+		return "", err
+	}
+
+	records := strings.Builder{}
+	for _, dcCluster := range p.datacenterAllocations[dc] {
+		for _, ipamAllocation := range dcCluster.IPAMAllocations {
+			ips, err := allocationIPs(ipamAllocation, maxPTRRecordsPerAllocation)
+			if err != nil {
+				return "", err
+			}
+			for _, ip := range ips {
+				name := strings.Builder{}
+				err := tmpl.Execute(&name, newPTRRecordData(ipamAllocation, ip))
+				if err != nil {
+					return "", err
+				}
+				fmt.Fprintf(&records, "%s IN PTR %s\n", reverseDNSName(ip), fqdn(name.String()))
+			}
+		}
+	}
+
+	return records.String(), nil
+}
+
+func newPTRRecordData(allocation IPAMAllocation, ip net.IP) ptrRecordData {
+	return ptrRecordData{
+		Cluster:          allocation.Cluster,
+		ClusterTenant:    allocation.ClusterTenant,
+		QualifiedCluster: strings.ReplaceAll(allocation.clusterRef().qualifiedName(), "/", "-"),
+		Datacenter:       allocation.Datacenter,
+		Tenant:           allocation.IPAMPoolTenant,
+		Pool:             allocation.IPAMPoolName,
+		IP:               ip.String(),
+		DashedIP:         strings.NewReplacer(".", "-", ":", "-").Replace(ip.String()),
+	}
+}
+
+// allocationIPs returns every address of an allocation, failing if there are more than maxIPs.
+func allocationIPs(ipamAllocation IPAMAllocation, maxIPs int) ([]net.IP, error) {
+	ips := []net.IP{}
+
+	switch ipamAllocation.Type {
+	case "range":
+		usedIPs, err := getUsedIPsFromAddressRanges(ipamAllocation.Addresses)
+		if err != nil {
+			return nil, err
+		}
+		if len(usedIPs) > maxIPs {
+			return nil, fmt.Errorf("allocation has more than %d addresses", maxIPs)
+		}
+		for _, ip := range usedIPs {
+			ips = append(ips, checkIPv4(net.ParseIP(ip)))
+		}
+	case "prefix":
+		ip, subnet, err := net.ParseCIDR(ipamAllocation.CIDR)
+		if err != nil {
+			return nil, err
+		}
+		prefixLen, bits := subnet.Mask.Size()
+		if hostBits := bits - prefixLen; hostBits > 30 || 1<<hostBits > maxIPs {
+			return nil, fmt.Errorf("allocation has more than %d addresses", maxIPs)
+		}
+		for ip := ip.Mask(subnet.Mask); subnet.Contains(ip); ip = incIP(ip) {
+			ips = append(ips, ip)
+		}
+	}
+
+	return ips, nil
+}
+
+func reverseDNSName(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", v4[3], v4[2], v4[1], v4[0])
+	}
+	nibbles := make([]string, 0, 2*net.IPv6len)
+	for i := net.IPv6len - 1; i >= 0; i-- {
+		nibbles = append(nibbles, fmt.Sprintf("%x", ip[i]&0x0f), fmt.Sprintf("%x", ip[i]>>4))
+	}
+	return strings.Join(nibbles, ".") + ".ip6.arpa."
+}
+
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
@@ -0,0 +1,57 @@
+package ipam
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// MessagePublisher publishes a message to a topic of a message broker, e.g. backed by a Kafka producer (the key
+// selects the partition) or a NATS connection (the key is ignored).
+type MessagePublisher interface {
+	Publish(topic string, key, payload []byte) error
+}
+
+// PublisherSink is an event sink publishing allocation events as JSON messages to a topic. The messages are keyed by
+// datacenter, cluster and pool, so the events of an allocation keep their order on partitioned topics.
+type PublisherSink struct {
+	publisher MessagePublisher
+	topic     string
+}
+
+// NewPublisherSink returns a sink publishing to the topic.
+func NewPublisherSink(publisher MessagePublisher, topic string) *PublisherSink {
+	return &PublisherSink{publisher: publisher, topic: topic}
+}
+
+type allocationEventMessage struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	Pool       string    `json:"pool"`
+	Tenant     string    `json:"tenant,omitempty"`
+	Datacenter string    `json:"datacenter"`
+	Cluster    string    `json:"cluster"`
+	// ClusterTenant is the tenant of the cluster, if any, while Tenant is the tenant of the pool
+	ClusterTenant string `json:"clusterTenant,omitempty"`
+	// Blocks are the allocated CIDRs or address ranges
+	Blocks []string `json:"blocks"`
+}
+
+func (s *PublisherSink) Send(event AllocationEvent) error {
+	allocation := event.Allocation
+	payload, err := json.Marshal(allocationEventMessage{
+		Type:          event.Type,
+		Time:          event.Time.UTC(),
+		Pool:          allocation.IPAMPoolName,
+		Tenant:        allocation.IPAMPoolTenant,
+		Datacenter:    allocation.Datacenter,
+		Cluster:       allocation.Cluster,
+		ClusterTenant: allocation.ClusterTenant,
+		Blocks:        allocationBlocks(allocation),
+	})
+	if err != nil {
+		return err
+	}
+
+	key := allocation.Datacenter + "/" + allocation.clusterRef().qualifiedName() + "/" + allocation.qualifiedIPAMPoolName()
+	return s.publisher.Publish(s.topic, []byte(key), payload)
+}
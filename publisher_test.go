@@ -0,0 +1,51 @@
+package ipam
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeMessagePublisher struct {
+	messages []string
+	err      error
+}
+
+func (p *fakeMessagePublisher) Publish(topic string, key, payload []byte) error {
+	p.messages = append(p.messages, fmt.Sprintf("%s %s %s", topic, key, payload))
+	return p.err
+}
+
+func TestPublisherSink(t *testing.T) {
+	publisher := &fakeMessagePublisher{}
+	ipam := New(map[string][]Cluster{
+		"aws-eu-1": {{Name: "c1", Tenant: "team-b", IPAMAllocations: []IPAMAllocation{}}},
+	}, WithClock(newManualClock(time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC))), WithEventSink(NewPublisherSink(publisher, "ipam-events")))
+	err := ipam.Apply(IPAMPool{
+		Name:   "pool1",
+		Tenant: "team-a",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "range", PoolCIDR: "192.168.1.0/24", AllocationRange: 2},
+		},
+	})
+	assert.Nil(t, err)
+	_, err = ipam.Release("team-a/pool1")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		`ipam-events aws-eu-1/team-b/c1/team-a/pool1 {"type":"allocated","time":"2021-06-01T00:00:00Z","pool":"pool1","tenant":"team-a","datacenter":"aws-eu-1","cluster":"c1","clusterTenant":"team-b","blocks":["192.168.1.0-192.168.1.1"]}`,
+		`ipam-events aws-eu-1/team-b/c1/team-a/pool1 {"type":"released","time":"2021-06-01T00:00:00Z","pool":"pool1","tenant":"team-a","datacenter":"aws-eu-1","cluster":"c1","clusterTenant":"team-b","blocks":["192.168.1.0-192.168.1.1"]}`,
+	}, publisher.messages)
+
+	// a failing publisher fails the apply, but the allocation is kept
+	publisher.err = fmt.Errorf("broker unavailable")
+	err = ipam.Apply(IPAMPool{
+		Name: "pool2",
+		Datacenters: map[string]IPAMPoolDatacenterSettings{
+			"aws-eu-1": {Type: "prefix", PoolCIDR: "10.0.0.0/24", AllocationPrefix: 28},
+		},
+	})
+	assert.EqualError(t, err, "broker unavailable")
+	assert.Len(t, ipam.Allocations(), 1)
+}
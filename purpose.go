@@ -0,0 +1,87 @@
+package ipam
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// purposeSeparator separates the pool name from the purpose in the qualified names of pool purposes, e.g.
+// "team-a/pool1:pods".
+const purposeSeparator = ":"
+
+func withPurpose(name, purpose string) string {
+	if purpose == "" {
+		return name
+	}
+	return name + purposeSeparator + purpose
+}
+
+// purposePools splits a pool with purposes into one pool per purpose, plus the pool itself when it also has
+// datacenters of its own, which are applied independently. The CIDRs of the purposes must not overlap in a
+// datacenter, since their allocations would collide.
+func (ipamPool IPAMPool) purposePools() ([]IPAMPool, error) {
+	if len(ipamPool.Purposes) == 0 {
+		return []IPAMPool{ipamPool}, nil
+	}
+
+	purposePools := []IPAMPool{}
+	if len(ipamPool.Datacenters) > 0 {
+		purposePool := ipamPool
+		purposePool.Purposes = nil
+		purposePools = append(purposePools, purposePool)
+	}
+	for _, purpose := range sortedKeys(ipamPool.Purposes) {
+		if purpose == "" || strings.ContainsAny(purpose, "/"+purposeSeparator) {
+			return nil, fmt.Errorf("invalid purpose %q of pool %s", purpose, ipamPool.qualifiedName())
+		}
+		purposePool := ipamPool
+		purposePool.Datacenters = ipamPool.Purposes[purpose]
+		purposePool.Purposes = nil
+		purposePool.purpose = purpose
+		purposePools = append(purposePools, purposePool)
+	}
+
+	dcPurposeNets := map[string][]*net.IPNet{}
+	for _, purposePool := range purposePools {
+		for _, dc := range sortedKeys(purposePool.Datacenters) {
+			_, poolNet, err := net.ParseCIDR(purposePool.Datacenters[dc].PoolCIDR)
+			if err != nil {
+				return nil, err
+			}
+			for _, purposeNet := range dcPurposeNets[dc] {
+				if networksOverlap(poolNet, purposeNet) {
+					return nil, fmt.Errorf("pool %s overlaps another purpose of the pool in datacenter %s", purposePool.qualifiedName(), dc)
+				}
+			}
+			dcPurposeNets[dc] = append(dcPurposeNets[dc], poolNet)
+		}
+	}
+
+	return purposePools, nil
+}
+
+// ForPurpose returns the pool of one of the purposes of the pool, or the pool restricted to its own datacenters for
+// the empty purpose. The operations about a single block of a pool (e.g. FreeBlocks, PeekNext, Hold) take it instead
+// of a pool with purposes.
+func (ipamPool IPAMPool) ForPurpose(purpose string) (IPAMPool, error) {
+	purposePools, err := ipamPool.purposePools()
+	if err != nil {
+		return IPAMPool{}, err
+	}
+	for _, purposePool := range purposePools {
+		if purposePool.purpose == purpose {
+			return purposePool, nil
+		}
+	}
+	return IPAMPool{}, fmt.Errorf("pool %s has no purpose %q", ipamPool.qualifiedName(), purpose)
+}
+
+// checkSinglePurpose fails for pools with purposes, which the operations about a single block of a pool cannot pick
+// the block of.
+func (ipamPool IPAMPool) checkSinglePurpose() error {
+	if len(ipamPool.Purposes) > 0 {
+		return fmt.Errorf("%w: select a purpose of pool %s with ForPurpose", errPoolHasPurposes, ipamPool.qualifiedName())
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package ipam
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+)
+
+// WithTenantQuota caps the number of addresses a tenant may have allocated, or held, across all its pools.
+func WithTenantQuota(tenant string, addresses *big.Int) Option {
+	return func(p *IPAM) {
+		p.setTenantQuota(tenant, addresses)
+	}
+}
+
+// setTenantQuota caps the number of addresses a tenant may have allocated, or held, across all its pools. A nil
+// quota removes the cap.
+func (p IPAM) setTenantQuota(tenant string, addresses *big.Int) {
+	if addresses == nil {
+		delete(p.tenantQuotas, tenant)
+		return
+	}
+	p.tenantQuotas[tenant] = new(big.Int).Set(addresses)
+}
+
+// tenantUsage returns the number of addresses allocated to the pools of a tenant, or held by their unexpired holds.
+func (p IPAM) tenantUsage(tenant string) (*big.Int, error) {
+	usage := big.NewInt(0)
+	addUsage := func(ipamAllocation IPAMAllocation) error {
+		if ipamAllocation.IPAMPoolTenant != tenant {
+			return nil
+		}
+		size, err := allocationSize(ipamAllocation)
+		if err != nil {
+			return err
+		}
+		usage.Add(usage, size)
+		return nil
+	}
+
+	for _, dcClusters := range p.datacenterAllocations {
+		for _, dcCluster := range dcClusters {
+			for _, ipamAllocation := range dcCluster.IPAMAllocations {
+				if err := addUsage(ipamAllocation); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	now := p.clock.Now()
+	for _, hold := range p.holds {
+		if !now.Before(hold.ExpiresAt) {
+			continue
+		}
+		if err := addUsage(hold.Allocation); err != nil {
+			return nil, err
+		}
+	}
+	return usage, nil
+}
+
+// checkTenantQuota fails if adding the new allocations would take the tenant over its quota.
+func (p IPAM) checkTenantQuota(tenant string, newAllocations []IPAMAllocation) error {
+	return p.checkTenantQuotaAfterRelease(tenant, nil, newAllocations)
+}
+
+// checkTenantQuotaAfterRelease fails if releasing the released allocations and adding the new ones would take the
+// tenant over its quota.
+func (p IPAM) checkTenantQuotaAfterRelease(tenant string, releasedAllocations, newAllocations []IPAMAllocation) error {
+	quota, hasQuota := p.tenantQuotas[tenant]
+	if !hasQuota || len(newAllocations) == 0 {
+		return nil
+	}
+
+	usage, err := p.tenantUsage(tenant)
+	if err != nil {
+		return err
+	}
+	for _, releasedAllocation := range releasedAllocations {
+		if releasedAllocation.IPAMPoolTenant != tenant {
+			continue
+		}
+		size, err := allocationSize(releasedAllocation)
+		if err != nil {
+			return err
+		}
+		usage.Sub(usage, size)
+	}
+	for _, newAllocation := range newAllocations {
+		size, err := allocationSize(newAllocation)
+		if err != nil {
+			return err
+		}
+		usage.Add(usage, size)
+	}
+
+	if usage.Cmp(quota) > 0 {
+		return errTenantQuotaExceeded
+	}
+	return nil
+}
+
+// allocationSize returns the number of addresses of an allocation.
+func allocationSize(ipamAllocation IPAMAllocation) (*big.Int, error) {
+	size := big.NewInt(0)
+
+	switch ipamAllocation.Type {
+	case "range":
+		for _, addressRange := range ipamAllocation.Addresses {
+			ipRange := strings.SplitN(addressRange, "-", 2)
+			if len(ipRange) != 2 {
+				return nil, fmt.Errorf("wrong ip range format")
+			}
+			firstIP, lastIP := net.ParseIP(ipRange[0]), net.ParseIP(ipRange[1])
+			if firstIP == nil || lastIP == nil {
+				return nil, fmt.Errorf("wrong ip format")
+			}
+			firstIPInt, _ := ipToInt(checkIPv4(firstIP))
+			lastIPInt, _ := ipToInt(checkIPv4(lastIP))
+			rangeSize := new(big.Int).Sub(lastIPInt, firstIPInt)
+			size.Add(size, rangeSize.Add(rangeSize, big.NewInt(1)))
+		}
+	case "prefix":
+		_, subnet, err := net.ParseCIDR(ipamAllocation.CIDR)
+		if err != nil {
+			return nil, err
+		}
+		prefixLen, bits := subnet.Mask.Size()
+		size.Lsh(big.NewInt(1), uint(bits-prefixLen))
+	}
+
+	return size, nil
+}
@@ -1,8 +1,11 @@
 package ipam
 
 import (
+	"bytes"
 	"fmt"
+	"math/big"
 	"net"
+	"sort"
 	"strings"
 )
 
@@ -50,50 +53,92 @@ func checkRangeAllocation(ips []string, poolCIDR string, allocationRange int) er
 	return nil
 }
 
-func calculateRangeFreeIPsFromDatacenterPool(dc, poolCIDR string, dcIPAMPoolUsageMap datacenterIPAMPoolUsageMap) ([]string, error) {
-	rangeFreeIPs := []string{}
-
-	ip, ipNet, err := net.ParseCIDR(poolCIDR)
+// forEachFreeIPOfPool calls fn with every free IP of the datacenter pool, in ascending order (descending when
+// reverse is set), until fn returns false. The free IPs are streamed from the runs of free IPs between the used
+// ones, so searching a large pool neither holds all its free IPs in memory nor visits its used IPs one by one.
+func forEachFreeIPOfPool(dc, poolCIDR string, reverse bool, dcIPAMPoolUsageMap datacenterIPAMPoolUsageMap, fn func(net.IP) bool) error {
+	_, ipNet, err := net.ParseCIDR(poolCIDR)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	for ip := ip.Mask(ipNet.Mask); ipNet.Contains(ip); ip = incIP(ip) {
-		if dcIPAMPoolUsageMap.isUsed(dc, ip.String()) {
-			continue
-		}
-		rangeFreeIPs = append(rangeFreeIPs, ip.String())
+	_, bits := ipNet.Mask.Size()
+	units, err := newPoolUnits(poolCIDR, bits)
+	if err != nil {
+		return err
 	}
 
-	return rangeFreeIPs, nil
+	units.forEachFreeRun(dc, dcIPAMPoolUsageMap, reverse, func(first, last *big.Int) bool {
+		ip, end, nextIP := units.ip(first), units.ip(last), incIP
+		if reverse {
+			ip, end, nextIP = end, ip, decIP
+		}
+		for {
+			if !fn(ip) {
+				return false
+			}
+			if ip.Equal(end) {
+				return true
+			}
+			ip = nextIP(ip)
+		}
+	})
+	return nil
 }
 
 func findFirstFreeRangesOfPool(dc, poolCIDR string, allocationRange int, dcIPAMPoolUsageMap datacenterIPAMPoolUsageMap) ([]string, error) {
-	addressRanges := []string{}
+	return findFreeRangesOfPool(dc, poolCIDR, allocationRange, false, dcIPAMPoolUsageMap)
+}
 
-	rangeFreeIPs, err := calculateRangeFreeIPsFromDatacenterPool(dc, poolCIDR, dcIPAMPoolUsageMap)
+// findLastFreeRangesOfPool allocates the highest free IPs of the pool.
+func findLastFreeRangesOfPool(dc, poolCIDR string, allocationRange int, dcIPAMPoolUsageMap datacenterIPAMPoolUsageMap) ([]string, error) {
+	return findFreeRangesOfPool(dc, poolCIDR, allocationRange, true, dcIPAMPoolUsageMap)
+}
+
+// findFreeRangesOfPool allocates the lowest (highest when reverse is set) free IPs of the pool, stopping the search
+// as soon as enough free IPs are found.
+func findFreeRangesOfPool(dc, poolCIDR string, allocationRange int, reverse bool, dcIPAMPoolUsageMap datacenterIPAMPoolUsageMap) ([]string, error) {
+	ipsToAllocate := make([]string, 0, allocationRange)
+	err := forEachFreeIPOfPool(dc, poolCIDR, reverse, dcIPAMPoolUsageMap, func(ip net.IP) bool {
+		if len(ipsToAllocate) >= allocationRange {
+			return false
+		}
+		ipsToAllocate = append(ipsToAllocate, ip.String())
+		return len(ipsToAllocate) < allocationRange
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	if allocationRange > len(rangeFreeIPs) {
-		return nil, fmt.Errorf("there is no enough free IPs available for pool")
+	if allocationRange > len(ipsToAllocate) {
+		return nil, errNotEnoughFreeIPs
 	}
 
-	rangeFreeIPsIterator := 0
-	firstAddressRangeIP := rangeFreeIPs[rangeFreeIPsIterator]
-	for j := 0; j < allocationRange; j++ {
-		ipToAllocate := rangeFreeIPs[rangeFreeIPsIterator]
+	for _, ipToAllocate := range ipsToAllocate {
 		dcIPAMPoolUsageMap.setUsed(dc, ipToAllocate)
-		rangeFreeIPsIterator++
-		// if no next ip to allocate or next ip is not the next one, close a new address range
-		if j+1 == allocationRange || !isTheNextIP(rangeFreeIPs[rangeFreeIPsIterator], ipToAllocate) {
-			addressRange := fmt.Sprintf("%s-%s", firstAddressRangeIP, ipToAllocate)
-			addressRanges = append(addressRanges, addressRange)
-			if j+1 < allocationRange {
-				firstAddressRangeIP = rangeFreeIPs[rangeFreeIPsIterator]
-			}
+	}
+
+	return addressRangesFromIPs(ipsToAllocate), nil
+}
+
+// addressRangesFromIPs sorts the given IPs and merges the contiguous ones into "first-last" address ranges.
+func addressRangesFromIPs(ips []string) []string {
+	addressRanges := []string{}
+
+	parsedIPs := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		parsedIPs = append(parsedIPs, checkIPv4(net.ParseIP(ip)))
+	}
+	sort.Slice(parsedIPs, func(i, j int) bool {
+		return bytes.Compare(parsedIPs[i], parsedIPs[j]) < 0
+	})
+
+	for i := 0; i < len(parsedIPs); i++ {
+		firstAddressRangeIP := parsedIPs[i]
+		for i+1 < len(parsedIPs) && isTheNextIP(parsedIPs[i+1].String(), parsedIPs[i].String()) {
+			i++
 		}
+		addressRanges = append(addressRanges, fmt.Sprintf("%s-%s", firstAddressRangeIP, parsedIPs[i]))
 	}
 
-	return addressRanges, nil
+	return addressRanges
 }
@@ -0,0 +1,88 @@
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Types of the recorded events, those of the Kubernetes Events.
+const (
+	EventTypeNormal  = "Normal"
+	EventTypeWarning = "Warning"
+)
+
+// Reasons of the recorded events.
+const (
+	EventReasonAllocated    = "Allocated"
+	EventReasonExhausted    = "Exhausted"
+	EventReasonIncompatible = "Incompatible"
+)
+
+// Kinds of the objects events are recorded on.
+const (
+	EventObjectCluster  = "Cluster"
+	EventObjectIPAMPool = "IPAMPool"
+)
+
+// EventObject designates the cluster or pool an event is about.
+type EventObject struct {
+	Kind string
+	// Datacenter is the datacenter of the cluster, or of the pool the event is about, if any
+	Datacenter string
+	// Name is the qualified name of the cluster or pool
+	Name string
+}
+
+// EventRecorder records the outcomes of the allocations as events on the clusters and pools they are about, so
+// operators see them next to those objects, e.g. as Kubernetes Events recorded by a controller with its
+// record.EventRecorder, on the objects it maps the EventObject to.
+type EventRecorder interface {
+	Event(object EventObject, eventType, reason, message string)
+}
+
+// WithEventRecorder makes the IPAM record an event on the cluster and the pool of every new allocation, and on the
+// clusters and pools that cannot be served because the pool is exhausted or incompatible with the allocations.
+func WithEventRecorder(recorder EventRecorder) Option {
+	return func(p *IPAM) {
+		p.eventRecorders = append(p.eventRecorders, recorder)
+	}
+}
+
+// recordEvent records the event on the cluster, if any, and on the pool.
+func (p IPAM) recordEvent(ipamPool string, cluster ClusterRef, eventType, reason, message string) {
+	for _, recorder := range p.eventRecorders {
+		if cluster.Name != "" {
+			recorder.Event(EventObject{Kind: EventObjectCluster, Datacenter: cluster.Datacenter, Name: cluster.qualifiedName()}, eventType, reason, message)
+		}
+		recorder.Event(EventObject{Kind: EventObjectIPAMPool, Datacenter: cluster.Datacenter, Name: ipamPool}, eventType, reason, message)
+	}
+}
+
+func (p IPAM) recordAllocationEvent(allocation IPAMAllocation) {
+	message := fmt.Sprintf("allocated %s of pool %s to cluster %s", strings.Join(allocationBlocks(allocation), ", "),
+		allocation.qualifiedIPAMPoolName(), allocation.clusterRef().qualifiedName())
+	p.recordEvent(allocation.qualifiedIPAMPoolName(), allocation.clusterRef(), EventTypeNormal, EventReasonAllocated, message)
+}
+
+// recordApplyFailureEvents records the exhaustion or incompatibility failing the apply of a pool, if that's the
+// cause.
+func (p IPAM) recordApplyFailureEvents(ipamPool IPAMPool, err error) {
+	var exhaustionErr *ExhaustionError
+	switch {
+	case errors.As(err, &exhaustionErr):
+		cluster := clusterRefOf(exhaustionErr.Datacenter, exhaustionErr.Cluster)
+		p.recordEvent(exhaustionErr.IPAMPool, cluster, EventTypeWarning, EventReasonExhausted, err.Error())
+	case errors.Is(err, errIncompatiblePool):
+		p.recordEvent(ipamPool.qualifiedName(), ClusterRef{}, EventTypeWarning, EventReasonIncompatible, err.Error())
+	}
+}
+
+// recordPendingEvents records the exhaustion of the pool on the clusters left waiting for an allocation.
+func (p IPAM) recordPendingEvents(ipamPool IPAMPool, clusters []ClusterRef) {
+	for _, cluster := range clusters {
+		message := fmt.Sprintf("pool %s is exhausted in datacenter %s, cluster %s waits for an allocation", ipamPool.qualifiedName(),
+			cluster.Datacenter, cluster.qualifiedName())
+		p.recordEvent(ipamPool.qualifiedName(), cluster, EventTypeWarning, EventReasonExhausted, message)
+	}
+}
@@ -0,0 +1,147 @@
+package ipam
+
+import (
+	"fmt"
+)
+
+// AllocationRef designates the allocation of a pool for a cluster of a datacenter.
+type AllocationRef struct {
+	Datacenter string
+	// Cluster is the qualified name of the cluster, e.g. "team-a/c1" for clusters of a tenant
+	Cluster string
+	// IPAMPool is the qualified name of the pool (and purpose), e.g. "team-a/pool1:pods"
+	IPAMPool string
+}
+
+// Release removes the allocations of a pool, given by its qualified name (e.g. "team-a/pool1"), from the clusters of
+// every datacenter, including the allocations of its purposes, and returns them so the freed blocks can be cleaned
+// up downstream. The clusters waiting for an allocation of the pool stop waiting, while the ones waiting for other
+// pools are served if the freed space lets them (e.g. pools anti-affine with the released one). Releasing is
+// destructive, so the approval hooks are asked first, and the released allocations are kept as tombstones to restore
+// them.
+func (p IPAM) Release(poolName string) ([]IPAMAllocation, error) {
+	if poolName == "" {
+		return nil, fmt.Errorf("pool name cannot be empty")
+	}
+
+	released := []IPAMAllocation{}
+	for _, allocation := range p.Allocations() {
+		if qualifiedIPAMPoolName(allocation.IPAMPoolTenant, allocation.IPAMPoolName) == poolName {
+			released = append(released, allocation)
+		}
+	}
+	err := p.release(released, "release of pool "+poolName)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, pending := range p.pendingAllocations {
+		if qualifiedIPAMPoolName(pending.IPAMPoolTenant, pending.IPAMPoolName) == poolName {
+			delete(p.pendingAllocations, key)
+		}
+	}
+	delete(p.pendingIPAMPools, poolName)
+	return released, p.completeRelease(released)
+}
+
+// ReleaseAllocations releases the designated allocations at once, e.g. when decommissioning a wave of clusters, and
+// returns them. The reason is kept in their tombstones. Nothing is released if any of them doesn't exist or if the
+// approval hooks reject the release.
+func (p IPAM) ReleaseAllocations(refs []AllocationRef, reason string) ([]IPAMAllocation, error) {
+	released := []IPAMAllocation{}
+	isReleased := map[AllocationRef]struct{}{}
+	for _, ref := range refs {
+		if _, isDuplicated := isReleased[ref]; isDuplicated {
+			continue
+		}
+		isReleased[ref] = struct{}{}
+
+		allocation, err := p.allocation(ref)
+		if err != nil {
+			return nil, err
+		}
+		released = append(released, allocation)
+	}
+	sortAllocations(released)
+	err := p.release(released, reason)
+	if err != nil {
+		return nil, err
+	}
+	return released, p.completeRelease(released)
+}
+
+// ReleaseSelected releases at once the allocations whose labels match the selector, which cannot be empty, and
+// returns them. The reason is kept in their tombstones. Nothing is released if the approval hooks reject the release.
+func (p IPAM) ReleaseSelected(selector LabelSelector, reason string) ([]IPAMAllocation, error) {
+	if len(selector) == 0 {
+		return nil, fmt.Errorf("label selector cannot be empty")
+	}
+
+	released := p.FindAllocations(selector)
+	err := p.release(released, reason)
+	if err != nil {
+		return nil, err
+	}
+	return released, p.completeRelease(released)
+}
+
+// allocation returns the designated allocation.
+func (p IPAM) allocation(ref AllocationRef) (IPAMAllocation, error) {
+	cluster := clusterRefOf(ref.Datacenter, ref.Cluster)
+	clusterIndex := p.clusterIndex(cluster)
+	if clusterIndex < 0 {
+		return IPAMAllocation{}, fmt.Errorf("cluster %s not found in datacenter %s", cluster.qualifiedName(), cluster.Datacenter)
+	}
+	for _, allocation := range p.datacenterAllocations[cluster.Datacenter][clusterIndex].IPAMAllocations {
+		if allocation.qualifiedIPAMPoolName() == ref.IPAMPool {
+			return allocation, nil
+		}
+	}
+	return IPAMAllocation{}, fmt.Errorf("cluster %s has no allocation of pool %s", cluster.qualifiedName(), ref.IPAMPool)
+}
+
+// release removes the allocations from their clusters, once the approval hooks approve, records their release in
+// the address history and keeps them as tombstones, released for the given reason.
+func (p IPAM) release(allocations []IPAMAllocation, reason string) error {
+	err := p.requestApproval(DestructiveOperation{Kind: DestructiveRelease, Allocations: allocations})
+	if err != nil {
+		return err
+	}
+	return p.removeReleasedAllocations(allocations, reason)
+}
+
+// removeReleasedAllocations removes the approved release of the allocations from their clusters, records it in the
+// address history and keeps them as tombstones, released for the given reason.
+func (p IPAM) removeReleasedAllocations(allocations []IPAMAllocation, reason string) error {
+	var err error
+	tombstoneIDs := make([]string, len(allocations))
+	for i := range allocations {
+		tombstoneIDs[i], err = newRandomToken()
+		if err != nil {
+			return err
+		}
+	}
+	p.purgeExpiredTombstones()
+	now := p.clock.Now()
+	for i, allocation := range allocations {
+		p.removeAllocation(allocation)
+		p.addressHistory.recordRelease(allocation, now)
+		p.tombstones[tombstoneIDs[i]] = Tombstone{
+			ID:         tombstoneIDs[i],
+			Allocation: allocation,
+			ReleasedAt: now,
+			Reason:     reason,
+		}
+	}
+	return nil
+}
+
+// completeRelease sends the released events of the allocations and serves the pending allocations the freed space
+// lets through, even if a sink fails.
+func (p IPAM) completeRelease(released []IPAMAllocation) error {
+	sendErr := p.sendEvents(AllocationEventReleased, released)
+	if err := p.fulfillPendingAllocations(); err != nil {
+		return err
+	}
+	return sendErr
+}
@@ -0,0 +1,76 @@
+package ipam
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// AllocationRenderer renders allocations with user supplied text/template templates, so teams can generate any
+// config format (Ansible vars, Helm values...) from the allocations.
+type AllocationRenderer struct {
+	templates *template.Template
+}
+
+// AllocationTemplateData is the data templates are executed with: the allocation fields plus the qualified pool
+// name and the blocks (CIDR or address ranges) of the allocation.
+type AllocationTemplateData struct {
+	IPAMAllocation
+	Pool   string
+	Blocks []string
+}
+
+// allocationTemplateFuncs are the functions available to templates on top of the text/template builtins.
+var allocationTemplateFuncs = template.FuncMap{
+	"join":  strings.Join,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// NewAllocationRenderer parses the templates, keyed by name.
+func NewAllocationRenderer(templates map[string]string) (*AllocationRenderer, error) {
+	root := template.New("").Funcs(allocationTemplateFuncs).Option("missingkey=error")
+	for _, name := range sortedKeys(templates) {
+		if _, err := root.New(name).Parse(templates[name]); err != nil {
+			return nil, err
+		}
+	}
+	return &AllocationRenderer{templates: root}, nil
+}
+
+// NewAllocationRendererFromFiles parses the template files matching the glob pattern, named after their base
+// file name.
+func NewAllocationRendererFromFiles(pattern string) (*AllocationRenderer, error) {
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no template file matches %s", pattern)
+	}
+	templates, err := template.New("").Funcs(allocationTemplateFuncs).Option("missingkey=error").ParseFiles(paths...)
+	if err != nil {
+		return nil, err
+	}
+	return &AllocationRenderer{templates: templates}, nil
+}
+
+// Render executes the named template with the allocation.
+func (r *AllocationRenderer) Render(allocation IPAMAllocation, templateName string) ([]byte, error) {
+	tmpl := r.templates.Lookup(templateName)
+	if tmpl == nil {
+		return nil, fmt.Errorf("template %q not found", templateName)
+	}
+	out := bytes.Buffer{}
+	err := tmpl.Execute(&out, AllocationTemplateData{
+		IPAMAllocation: allocation,
+		Pool:           allocation.qualifiedIPAMPoolName(),
+		Blocks:         allocationBlocks(allocation),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
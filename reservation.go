@@ -0,0 +1,191 @@
+package ipam
+
+import (
+	"math/big"
+	"net"
+)
+
+// ReservationConflict describes a cluster allocation overlapping an external reservation.
+type ReservationConflict struct {
+	Datacenter  string
+	Reservation string
+	Allocation  IPAMAllocation
+}
+
+// Sources of the external reservations. Each sync with an external system replaces the reservations of its source.
+const (
+	reservationSourceManual       = "manual"
+	reservationSourceAWS          = "aws"
+	reservationSourceAzure        = "azure"
+	reservationSourceGCP          = "gcp"
+	reservationSourceNSXT         = "nsxt"
+	reservationSourceLoadBalancer = "loadbalancer"
+)
+
+// Reserve registers CIDRs used outside of this IPAM for a datacenter, so they are never allocated to clusters.
+func (p IPAM) Reserve(dc string, cidrs ...string) error {
+	reservations := p.datacenterReservations[dc][reservationSourceManual]
+	for _, cidr := range cidrs {
+		_, reservedNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		if containsString(reservations, reservedNet.String()) {
+			continue
+		}
+		reservations = append(reservations, reservedNet.String())
+	}
+	p.setReservations(dc, reservationSourceManual, reservations)
+	return nil
+}
+
+// reserveExternalCIDRs replaces the reservations of a datacenter read from an external system by its current CIDRs,
+// except the ones matching exactly a prefix allocation of the datacenter, which were created in the external system
+// for that allocation.
+func (p IPAM) reserveExternalCIDRs(dc, source string, cidrs []string) error {
+	reservations := []string{}
+	for _, cidr := range cidrs {
+		_, cidrNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		if p.isPrefixAllocated(dc, cidrNet.String()) || containsString(reservations, cidrNet.String()) {
+			continue
+		}
+		reservations = append(reservations, cidrNet.String())
+	}
+	p.setReservations(dc, source, reservations)
+	return nil
+}
+
+// setReservations replaces the reservations of a datacenter coming from the source.
+func (p IPAM) setReservations(dc, source string, cidrs []string) {
+	if len(cidrs) == 0 {
+		delete(p.datacenterReservations[dc], source)
+		if len(p.datacenterReservations[dc]) == 0 {
+			delete(p.datacenterReservations, dc)
+		}
+		return
+	}
+	if p.datacenterReservations[dc] == nil {
+		p.datacenterReservations[dc] = map[string][]string{}
+	}
+	p.datacenterReservations[dc][source] = cidrs
+}
+
+// reservations returns the reservations of a datacenter from every source, ordered by source.
+func (p IPAM) reservations(dc string) []string {
+	reservations := []string{}
+	for _, source := range sortedKeys(p.datacenterReservations[dc]) {
+		for _, cidr := range p.datacenterReservations[dc][source] {
+			if !containsString(reservations, cidr) {
+				reservations = append(reservations, cidr)
+			}
+		}
+	}
+	return reservations
+}
+
+// findReservationConflicts returns the current cluster allocations overlapping any external reservation of
+// their datacenter.
+func (p IPAM) findReservationConflicts() ([]ReservationConflict, error) {
+	conflicts := []ReservationConflict{}
+
+	for dc, dcClusters := range p.datacenterAllocations {
+		reservations := p.reservations(dc)
+		if len(reservations) == 0 {
+			continue
+		}
+		reservedNets, err := parseCIDRs(reservations)
+		if err != nil {
+			return nil, err
+		}
+		for _, dcCluster := range dcClusters {
+			for _, ipamAllocation := range dcCluster.IPAMAllocations {
+				for i, reservedNet := range reservedNets {
+					overlaps, err := allocationOverlaps(ipamAllocation, reservedNet)
+					if err != nil {
+						return nil, err
+					}
+					if overlaps {
+						conflicts = append(conflicts, ReservationConflict{
+							Datacenter:  dc,
+							Reservation: reservations[i],
+							Allocation:  ipamAllocation,
+						})
+					}
+				}
+			}
+		}
+	}
+
+	return conflicts, nil
+}
+
+func allocationOverlaps(ipamAllocation IPAMAllocation, network *net.IPNet) (bool, error) {
+	switch ipamAllocation.Type {
+	case "range":
+		ips, err := getUsedIPsFromAddressRanges(ipamAllocation.Addresses)
+		if err != nil {
+			return false, err
+		}
+		for _, ip := range ips {
+			if network.Contains(net.ParseIP(ip)) {
+				return true, nil
+			}
+		}
+	case "prefix":
+		_, subnet, err := net.ParseCIDR(ipamAllocation.CIDR)
+		if err != nil {
+			return false, err
+		}
+		return networksOverlap(subnet, network), nil
+	}
+	return false, nil
+}
+
+// markReservationsAsUsed marks the IPs (for range allocation type), or the subnets (for prefix allocation type),
+// overlapping any of the reservations as used. The reservations are marked as address ranges, so their size
+// doesn't matter.
+func markReservationsAsUsed(dc string, reservations []string, dcIPAMPoolUsageMap datacenterIPAMPoolUsageMap) error {
+	reservedNets, err := parseCIDRs(reservations)
+	if err != nil {
+		return err
+	}
+	for _, reservedNet := range reservedNets {
+		dcIPAMPoolUsageMap.setUsedRange(dc, reservedNet)
+	}
+	return nil
+}
+
+// markOffsetAsUsed marks the first FirstAddressOffset addresses of the datacenter pool (or the subnets containing
+// them) as used.
+func markOffsetAsUsed(dc string, dcIPAMPoolCfg IPAMPoolDatacenterSettings, dcIPAMPoolUsageMap datacenterIPAMPoolUsageMap) error {
+	if dcIPAMPoolCfg.FirstAddressOffset == 0 {
+		return nil
+	}
+	poolIP, poolSubnet, err := net.ParseCIDR(dcIPAMPoolCfg.PoolCIDR)
+	if err != nil {
+		return err
+	}
+	poolStartInt, _ := ipToInt(poolIP.Mask(poolSubnet.Mask).To16())
+	lastSkippedInt := new(big.Int).Add(poolStartInt, big.NewInt(int64(dcIPAMPoolCfg.FirstAddressOffset)-1))
+	dcIPAMPoolUsageMap.setUsedBounds(dc, poolStartInt, lastSkippedInt)
+	return nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func networksOverlap(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
@@ -0,0 +1,183 @@
+package ipam
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// RouteExportOptions configures the generated routing configuration.
+type RouteExportOptions struct {
+	// Format is either "bird" (BIRD 2 static protocols) or "frr" (FRRouting bgpd configuration)
+	Format string
+	// ASN is the local autonomous system number, required by the "frr" format
+	ASN uint32
+	// Communities are the BGP communities (e.g. "65000:100") attached to the prefixes of each pool, keyed by the
+	// qualified pool name ("<tenant>/<pool>" for pools of a tenant)
+	Communities map[string][]string
+}
+
+type exportedRoute struct {
+	Prefix  *net.IPNet
+	Pool    string
+	Cluster string
+}
+
+// RenderRouteExport generates the router configuration announcing the prefix allocations of a datacenter, tagged
+// with the BGP communities configured for their pool. Range allocations are not announced.
+func RenderRouteExport(p IPAM, dc string, options RouteExportOptions) (string, error) {
+	routes := []exportedRoute{}
+	for _, dcCluster := range p.datacenterAllocations[dc] {
+		for _, ipamAllocation := range dcCluster.IPAMAllocations {
+			if ipamAllocation.Type != "prefix" {
+				continue
+			}
+			_, prefix, err := net.ParseCIDR(ipamAllocation.CIDR)
+			if err != nil {
+				return "", err
+			}
+			routes = append(routes, exportedRoute{Prefix: prefix, Pool: ipamAllocation.qualifiedIPAMPoolName(), Cluster: dcCluster.ref(dc).qualifiedName()})
+		}
+	}
+
+	for _, communities := range options.Communities {
+		for _, community := range communities {
+			if _, _, err := parseBGPCommunity(community); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	switch options.Format {
+	case "bird":
+		return renderBIRDRoutes(dc, routes, options.Communities), nil
+	case "frr":
+		if options.ASN == 0 {
+			return "", fmt.Errorf("ASN is required for frr format")
+		}
+		return renderFRRRoutes(routes, options.ASN, options.Communities), nil
+	default:
+		return "", fmt.Errorf("unsupported route export format %q", options.Format)
+	}
+}
+
+func renderBIRDRoutes(dc string, routes []exportedRoute, communities map[string][]string) string {
+	config := strings.Builder{}
+
+	for _, family := range []string{"ipv4", "ipv6"} {
+		familyRoutes := filterRoutesByFamily(routes, family)
+		if len(familyRoutes) == 0 {
+			continue
+		}
+		fmt.Fprintf(&config, "protocol static ipam_%s_%s {\n", birdIdentifier(dc), family)
+		fmt.Fprintf(&config, "\t%s;\n", family)
+		for _, route := range familyRoutes {
+			fmt.Fprintf(&config, "\t# cluster %s (pool %s)\n", route.Cluster, route.Pool)
+			poolCommunities := communities[route.Pool]
+			if len(poolCommunities) == 0 {
+				fmt.Fprintf(&config, "\troute %s blackhole;\n", route.Prefix)
+				continue
+			}
+			fmt.Fprintf(&config, "\troute %s blackhole {\n", route.Prefix)
+			for _, community := range poolCommunities {
+				asn, value, _ := parseBGPCommunity(community)
+				fmt.Fprintf(&config, "\t\tbgp_community.add((%d,%d));\n", asn, value)
+			}
+			fmt.Fprintf(&config, "\t};\n")
+		}
+		fmt.Fprintf(&config, "}\n")
+	}
+
+	return config.String()
+}
+
+func renderFRRRoutes(routes []exportedRoute, asn uint32, communities map[string][]string) string {
+	config := strings.Builder{}
+
+	pools := []string{}
+	for pool := range communities {
+		pools = append(pools, pool)
+	}
+	sort.Strings(pools)
+
+	for _, family := range []string{"ipv4", "ipv6"} {
+		familyRoutes := filterRoutesByFamily(routes, family)
+		if len(familyRoutes) == 0 {
+			continue
+		}
+		ipKeyword := "ip"
+		if family == "ipv6" {
+			ipKeyword = "ipv6"
+		}
+
+		// one prefix list per pool, used to set the pool communities in the export route map
+		for i, route := range familyRoutes {
+			fmt.Fprintf(&config, "%s prefix-list IPAM-%s seq %d permit %s\n", ipKeyword, frrIdentifier(route.Pool), 5*(i+1), route.Prefix)
+		}
+		sequence := 0
+		for _, pool := range pools {
+			if !hasRouteForPool(familyRoutes, pool) {
+				continue
+			}
+			sequence += 10
+			fmt.Fprintf(&config, "route-map IPAM-EXPORT-%s permit %d\n", family, sequence)
+			fmt.Fprintf(&config, " match %s address prefix-list IPAM-%s\n", ipKeyword, frrIdentifier(pool))
+			fmt.Fprintf(&config, " set community %s additive\n", strings.Join(communities[pool], " "))
+		}
+		fmt.Fprintf(&config, "route-map IPAM-EXPORT-%s permit %d\n", family, sequence+10)
+
+		fmt.Fprintf(&config, "router bgp %d\n", asn)
+		fmt.Fprintf(&config, " address-family %s unicast\n", family)
+		for _, route := range familyRoutes {
+			fmt.Fprintf(&config, "  network %s route-map IPAM-EXPORT-%s\n", route.Prefix, family)
+		}
+		fmt.Fprintf(&config, " exit-address-family\n")
+	}
+
+	return config.String()
+}
+
+func filterRoutesByFamily(routes []exportedRoute, family string) []exportedRoute {
+	familyRoutes := []exportedRoute{}
+	for _, route := range routes {
+		isIPv4 := route.Prefix.IP.To4() != nil
+		if isIPv4 == (family == "ipv4") {
+			familyRoutes = append(familyRoutes, route)
+		}
+	}
+	return familyRoutes
+}
+
+func hasRouteForPool(routes []exportedRoute, pool string) bool {
+	for _, route := range routes {
+		if route.Pool == pool {
+			return true
+		}
+	}
+	return false
+}
+
+func parseBGPCommunity(community string) (uint16, uint16, error) {
+	var asn, value uint16
+	_, err := fmt.Sscanf(community, "%d:%d", &asn, &value)
+	if err != nil || fmt.Sprintf("%d:%d", asn, value) != community {
+		return 0, 0, fmt.Errorf("wrong BGP community format %q", community)
+	}
+	return asn, value, nil
+}
+
+// frrIdentifier converts a qualified pool name into a valid FRR list name.
+func frrIdentifier(name string) string {
+	return strings.ReplaceAll(name, "/", "-")
+}
+
+// birdIdentifier converts a name into a valid BIRD symbol.
+func birdIdentifier(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
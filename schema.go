@@ -0,0 +1,166 @@
+package ipam
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// fieldError is a problem of a field of a pool document, located by the full path of the field, e.g.
+// "datacenters.aws-eu-1.allocationPrefix", so it can be fixed without guessing which entry is wrong.
+type fieldError struct {
+	Field   string
+	Message string
+}
+
+func (e *fieldError) Error() string {
+	if e.Field == "" {
+		return e.Message
+	}
+	return e.Field + ": " + e.Message
+}
+
+// withParent returns the error with its field path nested under the given parent path.
+func (e *fieldError) withParent(parent string) *fieldError {
+	field := parent
+	if e.Field != "" {
+		field += "." + e.Field
+	}
+	return &fieldError{Field: field, Message: e.Message}
+}
+
+// asFieldError returns the error as a field error of the given field, unless it's already located.
+func asFieldError(err error, field string) *fieldError {
+	if fieldErr, isFieldErr := err.(*fieldError); isFieldErr {
+		return fieldErr
+	}
+	return &fieldError{Field: field, Message: err.Error()}
+}
+
+// unknownIPAMPoolFields returns the fields of a decoded YAML (or JSON) list of pools which don't exist in IPAMPool
+// or IPAMPoolDatacenterSettings, with the closest known field as suggestion. Values of an unexpected shape are
+// skipped, the decoder reports them.
+func unknownIPAMPoolFields(document interface{}) []*fieldError {
+	fieldErrs := []*fieldError{}
+	ipamPools, _ := document.([]interface{})
+	for i, ipamPool := range ipamPools {
+		poolFields, _ := ipamPool.(map[string]interface{})
+		poolPath := fmt.Sprintf("[%d]", i)
+		fieldErrs = append(fieldErrs, unknownFields(poolPath, poolFields, reflect.TypeOf(IPAMPool{}))...)
+
+		for _, key := range sortedKeys(poolFields) {
+			value := poolFields[key]
+			switch {
+			case strings.EqualFold(key, "datacenters"):
+				datacenters, _ := value.(map[string]interface{})
+				for _, dc := range sortedKeys(datacenters) {
+					settings, _ := datacenters[dc].(map[string]interface{})
+					dcPath := poolPath + "." + key + "." + dc
+					fieldErrs = append(fieldErrs, unknownFields(dcPath, settings, reflect.TypeOf(IPAMPoolDatacenterSettings{}))...)
+				}
+			case strings.EqualFold(key, "datacenterTemplate"):
+				settings, _ := value.(map[string]interface{})
+				fieldErrs = append(fieldErrs, unknownFields(poolPath+"."+key, settings, reflect.TypeOf(IPAMPoolDatacenterSettings{}))...)
+			case strings.EqualFold(key, "purposes"):
+				purposes, _ := value.(map[string]interface{})
+				for _, purpose := range sortedKeys(purposes) {
+					datacenters, _ := purposes[purpose].(map[string]interface{})
+					for _, dc := range sortedKeys(datacenters) {
+						settings, _ := datacenters[dc].(map[string]interface{})
+						dcPath := poolPath + "." + key + "." + purpose + "." + dc
+						fieldErrs = append(fieldErrs, unknownFields(dcPath, settings, reflect.TypeOf(IPAMPoolDatacenterSettings{}))...)
+					}
+				}
+			}
+		}
+	}
+	return fieldErrs
+}
+
+// unknownFields returns the keys of an object without a matching field in the struct type. Like encoding/json,
+// keys match the field names case-insensitively.
+func unknownFields(path string, object map[string]interface{}, structType reflect.Type) []*fieldError {
+	knownFields := jsonFieldNames(structType)
+	fieldErrs := []*fieldError{}
+	for _, key := range sortedKeys(object) {
+		isKnown := false
+		for _, knownField := range knownFields {
+			if strings.EqualFold(key, knownField) {
+				isKnown = true
+				break
+			}
+		}
+		if !isKnown {
+			fieldErrs = append(fieldErrs, &fieldError{Field: path + "." + key, Message: "unknown field" + suggestion(key, knownFields)})
+		}
+	}
+	return fieldErrs
+}
+
+// jsonFieldNames returns the names the exported fields of a struct type have in JSON.
+func jsonFieldNames(structType reflect.Type) []string {
+	names := []string{}
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// maxSuggestionDistance is the largest edit distance between a wrong value and a known one for the known one to be
+// suggested, enough for the usual typos (a missing, extra or swapped letter).
+const maxSuggestionDistance = 2
+
+// suggestion returns a hint with the candidate closest to the value, e.g. `, did you mean "prefix"?`, or nothing if
+// no candidate is close enough.
+func suggestion(value string, candidates []string) string {
+	closest := ""
+	closestDistance := maxSuggestionDistance + 1
+	for _, candidate := range candidates {
+		distance := editDistance(strings.ToLower(value), strings.ToLower(candidate))
+		if distance < closestDistance {
+			closest, closestDistance = candidate, distance
+		}
+	}
+	if closest == "" {
+		return ""
+	}
+	return fmt.Sprintf(", did you mean %q?", closest)
+}
+
+// editDistance returns the Levenshtein distance between two strings.
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			substitution := previous[j-1]
+			if a[i-1] != b[j-1] {
+				substitution++
+			}
+			current[j] = substitution
+			if previous[j]+1 < current[j] {
+				current[j] = previous[j] + 1
+			}
+			if current[j-1]+1 < current[j] {
+				current[j] = current[j-1] + 1
+			}
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
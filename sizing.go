@@ -0,0 +1,64 @@
+package ipam
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+)
+
+// withResolvedAllocationSizes returns a copy of the pool where the allocation sizes expressed as a percentage of the
+// pool are converted into a concrete allocation range (range pools) or allocation prefix (prefix pools).
+func (ipamPool IPAMPool) withResolvedAllocationSizes() (IPAMPool, error) {
+	resolvedPool := ipamPool
+	resolvedPool.Datacenters = make(map[string]IPAMPoolDatacenterSettings, len(ipamPool.Datacenters))
+	for dc, dcIPAMPoolCfg := range ipamPool.Datacenters {
+		if dcIPAMPoolCfg.AllocationPercent != 0 {
+			var err error
+			dcIPAMPoolCfg, err = resolveAllocationPercent(dcIPAMPoolCfg)
+			if err != nil {
+				return IPAMPool{}, fmt.Errorf("pool %s datacenter %s: %v", ipamPool.qualifiedName(), dc, err)
+			}
+		}
+		resolvedPool.Datacenters[dc] = dcIPAMPoolCfg
+	}
+	return resolvedPool, nil
+}
+
+// resolveAllocationPercent converts the allocation percent into the largest allocation range, or the largest
+// subnet, not exceeding that fraction of the pool.
+func resolveAllocationPercent(dcIPAMPoolCfg IPAMPoolDatacenterSettings) (IPAMPoolDatacenterSettings, error) {
+	if dcIPAMPoolCfg.AllocationPercent < 0 || dcIPAMPoolCfg.AllocationPercent > 100 {
+		return IPAMPoolDatacenterSettings{}, fmt.Errorf("allocation percent must be between 0 and 100")
+	}
+	if dcIPAMPoolCfg.AllocationRange != 0 || dcIPAMPoolCfg.AllocationPrefix != 0 {
+		return IPAMPoolDatacenterSettings{}, fmt.Errorf("allocation percent cannot be combined with an allocation range or prefix")
+	}
+
+	_, poolSubnet, err := net.ParseCIDR(dcIPAMPoolCfg.PoolCIDR)
+	if err != nil {
+		return IPAMPoolDatacenterSettings{}, err
+	}
+	poolPrefix, bits := poolSubnet.Mask.Size()
+	poolSize := new(big.Float).SetInt(new(big.Int).Lsh(big.NewInt(1), uint(bits-poolPrefix)))
+	allocationSize := new(big.Float).Mul(poolSize, big.NewFloat(dcIPAMPoolCfg.AllocationPercent/100))
+	if allocationSize.Cmp(big.NewFloat(1)) < 0 {
+		return IPAMPoolDatacenterSettings{}, fmt.Errorf("allocation percent is smaller than a single address")
+	}
+
+	switch dcIPAMPoolCfg.Type {
+	case "range":
+		allocationRange, _ := allocationSize.Int(nil)
+		if !allocationRange.IsUint64() || allocationRange.Uint64() > math.MaxUint32 {
+			return IPAMPoolDatacenterSettings{}, fmt.Errorf("allocation percent exceeds the maximum allocation range")
+		}
+		dcIPAMPoolCfg.AllocationRange = uint32(allocationRange.Uint64())
+	case "prefix":
+		// allocationSize = mantissa * 2^exp with mantissa in [0.5, 1), so the largest power of two not exceeding
+		// it is 2^(exp-1)
+		exp := allocationSize.MantExp(nil)
+		dcIPAMPoolCfg.AllocationPrefix = uint8(bits - (exp - 1))
+	}
+
+	return dcIPAMPoolCfg, nil
+}
@@ -0,0 +1,396 @@
+package ipam
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+)
+
+// stateSchemaVersion is the version of the persisted state written by MarshalState. It must be increased, with a
+// migration added to stateMigrations, whenever the state format changes in a way older versions of the package
+// would misinterpret.
+const stateSchemaVersion = 3
+
+// stateChecksumVersion is the first schema version whose states carry a checksum.
+const stateChecksumVersion = 3
+
+// stateMigrations[v] converts a state document of schema version v into a document of version v+1.
+var stateMigrations = map[int]func(document map[string]json.RawMessage) (map[string]json.RawMessage, error){
+	1: migrateStateFromV1,
+	2: migrateStateFromV2,
+}
+
+// ipamState is the persisted form of an IPAM. Version 1 had the allocations, datacenter metadata, reservations,
+// tenant quotas and address history; version 2 added the pending allocations, holds, tombstones and unique pools,
+// and keeps the reservations by source; version 3 added the checksum, which is kept next to the other fields of the
+// document rather than in ipamState since it covers all of them.
+type ipamState struct {
+	SchemaVersion          int                            `json:"schemaVersion"`
+	DatacenterAllocations  map[string][]Cluster           `json:"datacenterAllocations"`
+	Datacenters            map[string]Datacenter          `json:"datacenters,omitempty"`
+	DatacenterReservations map[string]map[string][]string `json:"datacenterReservations,omitempty"`
+	TenantQuotas           map[string]*big.Int            `json:"tenantQuotas,omitempty"`
+	AddressHistory         []AddressHistoryRecord         `json:"addressHistory,omitempty"`
+	PendingAllocations     []pendingAllocation            `json:"pendingAllocations,omitempty"`
+	// PendingIPAMPools are the settings the pending allocations are fulfilled with, by pool qualified name
+	PendingIPAMPools map[string]IPAMPool `json:"pendingIPAMPools,omitempty"`
+	// Holds are the unexpired holds by token
+	Holds map[string]allocationHold `json:"holds,omitempty"`
+	// Tombstones are the restorable released allocations by ID
+	Tombstones map[string]Tombstone `json:"tombstones,omitempty"`
+	// UniqueIPAMPools are the qualified names of the pools unique across datacenters, which restores keep unique
+	UniqueIPAMPools []string `json:"uniqueIPAMPools,omitempty"`
+}
+
+// MarshalState encodes the allocations, datacenter metadata, reservations, tenant quotas, address history, pending
+// allocations, holds and tombstones as versioned JSON, with a checksum verified on load.
+func (p IPAM) MarshalState() ([]byte, error) {
+	p.releaseExpiredHolds()
+	p.purgeExpiredTombstones()
+	data, err := json.Marshal(ipamState{
+		SchemaVersion:          stateSchemaVersion,
+		DatacenterAllocations:  p.datacenterAllocations,
+		Datacenters:            p.datacenters,
+		DatacenterReservations: p.datacenterReservations,
+		TenantQuotas:           p.tenantQuotas,
+		AddressHistory:         p.addressHistory.records,
+		PendingAllocations:     p.pending(),
+		PendingIPAMPools:       p.pendingIPAMPools,
+		Holds:                  p.holds,
+		Tombstones:             p.tombstones,
+		UniqueIPAMPools:        sortedKeys(p.uniqueIPAMPools),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	document := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	checksum, err := stateChecksum(document)
+	if err != nil {
+		return nil, err
+	}
+	document["checksum"], err = json.Marshal(checksum)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(document)
+}
+
+// stateChecksum returns the hex encoded SHA-256 of the state document without its checksum. The document is encoded
+// with sorted keys and without insignificant whitespace, so reformatting the file doesn't change the checksum.
+func stateChecksum(document map[string]json.RawMessage) (string, error) {
+	checkedDocument := make(map[string]json.RawMessage, len(document))
+	for key, value := range document {
+		if key != "checksum" {
+			checkedDocument[key] = value
+		}
+	}
+	data, err := json.Marshal(checkedDocument)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// verifyStateChecksum checks the checksum of a state document of the given schema version, to detect corrupted or
+// hand-edited states before they are used. States older than stateChecksumVersion have none.
+func verifyStateChecksum(document map[string]json.RawMessage, version int) error {
+	if version < stateChecksumVersion {
+		return nil
+	}
+	rawChecksum, hasChecksum := document["checksum"]
+	if !hasChecksum {
+		return fmt.Errorf("%w: state has no checksum", errStateChecksumMismatch)
+	}
+	checksum := ""
+	if err := json.Unmarshal(rawChecksum, &checksum); err != nil {
+		return fmt.Errorf("%w: invalid checksum: %v", errStateChecksumMismatch, err)
+	}
+	expectedChecksum, err := stateChecksum(document)
+	if err != nil {
+		return err
+	}
+	if checksum != expectedChecksum {
+		return fmt.Errorf("%w: state was modified or corrupted", errStateChecksumMismatch)
+	}
+	return nil
+}
+
+// unmarshalState decodes a state written by MarshalState, migrating it from older schema versions. States written
+// by a newer version of the package or not matching their checksum are refused, and so are states with unknown
+// fields in strict mode. The options configure the decoded IPAM like the ones of New.
+func unmarshalState(data []byte, strict bool, options ...Option) (IPAM, error) {
+	document := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return IPAM{}, err
+	}
+
+	rawVersion, isVersioned := document["schemaVersion"]
+	if !isVersioned {
+		return IPAM{}, fmt.Errorf("state has no schema version")
+	}
+	version := 0
+	if err := json.Unmarshal(rawVersion, &version); err != nil {
+		return IPAM{}, fmt.Errorf("invalid state schema version: %v", err)
+	}
+	if version > stateSchemaVersion {
+		return IPAM{}, fmt.Errorf("state schema version %d is newer than the supported version %d", version, stateSchemaVersion)
+	}
+	if version < 1 {
+		return IPAM{}, fmt.Errorf("invalid state schema version %d", version)
+	}
+	if err := verifyStateChecksum(document, version); err != nil {
+		return IPAM{}, err
+	}
+	delete(document, "checksum")
+	for ; version < stateSchemaVersion; version++ {
+		var err error
+		document, err = stateMigrations[version](document)
+		if err != nil {
+			return IPAM{}, fmt.Errorf("cannot migrate state from schema version %d: %v", version, err)
+		}
+	}
+
+	migratedData, err := json.Marshal(document)
+	if err != nil {
+		return IPAM{}, err
+	}
+	state := ipamState{}
+	if err := decodeJSON(migratedData, &state, strict); err != nil {
+		return IPAM{}, err
+	}
+
+	if state.DatacenterAllocations == nil {
+		state.DatacenterAllocations = map[string][]Cluster{}
+	}
+	p := New(state.DatacenterAllocations, options...)
+	for dc, metadata := range state.Datacenters {
+		p.datacenters[dc] = metadata
+	}
+	for dc, reservations := range state.DatacenterReservations {
+		p.datacenterReservations[dc] = reservations
+	}
+	for tenant, quota := range state.TenantQuotas {
+		p.setTenantQuota(tenant, quota)
+	}
+	p.addressHistory.records = append(p.addressHistory.records, state.AddressHistory...)
+	for _, pending := range state.PendingAllocations {
+		p.pendingAllocations[pending.key()] = pending
+	}
+	for poolName, ipamPool := range state.PendingIPAMPools {
+		p.pendingIPAMPools[poolName] = ipamPool
+	}
+	for token, hold := range state.Holds {
+		p.holds[token] = hold
+	}
+	for id, tombstone := range state.Tombstones {
+		p.tombstones[id] = tombstone
+	}
+	for _, poolName := range state.UniqueIPAMPools {
+		p.uniqueIPAMPools[poolName] = struct{}{}
+	}
+	return p, nil
+}
+
+// StateLoadIssue describes a stored allocation which cannot be used as is.
+type StateLoadIssue struct {
+	Datacenter string
+	// Cluster is the tenant qualified name of the cluster
+	Cluster string
+	// IPAMPool is the tenant qualified name of the pool
+	IPAMPool string
+	Message  string
+}
+
+// LoadState decodes a state written by MarshalState into an IPAM configured by the options, and reports the stored
+// allocations which cannot be used: their addresses must parse, have a single IP family and fit the allocation type,
+// and the allocations of the given pools must match the family, CIDR and size of the pool (or purpose) in their
+// datacenter. Reporting them on load avoids failing later, in the middle of an apply.
+func LoadState(data []byte, pools []IPAMPool, strict bool, options ...Option) (IPAM, []StateLoadIssue, error) {
+	p, err := unmarshalState(data, strict, options...)
+	if err != nil {
+		return IPAM{}, nil, err
+	}
+
+	resolvedPools := map[string]IPAMPool{}
+	for _, ipamPool := range pools {
+		purposePools, err := ipamPool.purposePools()
+		if err != nil {
+			return IPAM{}, nil, err
+		}
+		for _, purposePool := range purposePools {
+			resolvedPool, err := purposePool.withResolvedAllocationSizes()
+			if err != nil {
+				return IPAM{}, nil, err
+			}
+			resolvedPools[resolvedPool.qualifiedName()] = resolvedPool
+		}
+	}
+
+	issues := []StateLoadIssue{}
+	for _, dc := range sortedKeys(p.datacenterAllocations) {
+		for _, dcCluster := range p.datacenterAllocations[dc] {
+			for _, ipamAllocation := range dcCluster.IPAMAllocations {
+				err := validateStoredAllocation(ipamAllocation)
+				if err == nil {
+					if dcIPAMPoolCfg, isDCConfigured := resolvedPools[ipamAllocation.qualifiedIPAMPoolName()].Datacenters[ipamAllocation.Datacenter]; isDCConfigured {
+						err = validateStoredAllocationOfPool(ipamAllocation, dcIPAMPoolCfg)
+					}
+				}
+				if err != nil {
+					issues = append(issues, StateLoadIssue{
+						Datacenter: dc,
+						Cluster:    dcCluster.ref(dc).qualifiedName(),
+						IPAMPool:   ipamAllocation.qualifiedIPAMPoolName(),
+						Message:    err.Error(),
+					})
+				}
+			}
+		}
+	}
+
+	return p, issues, nil
+}
+
+// validateStoredAllocation checks the addresses of an allocation parse, have a single IP family and fit the
+// allocation type.
+func validateStoredAllocation(ipamAllocation IPAMAllocation) error {
+	switch ipamAllocation.Type {
+	case "range":
+		if ipamAllocation.CIDR != "" {
+			return fmt.Errorf("range allocation has a CIDR")
+		}
+		if len(ipamAllocation.Addresses) == 0 {
+			return fmt.Errorf("range allocation has no addresses")
+		}
+		isIPv4 := false
+		for i, addressRange := range ipamAllocation.Addresses {
+			first, last, err := parseStoredAddressRange(addressRange)
+			if err != nil {
+				return err
+			}
+			if i == 0 {
+				isIPv4 = first.To4() != nil
+			}
+			if (first.To4() != nil) != isIPv4 || (last.To4() != nil) != isIPv4 {
+				return fmt.Errorf("address ranges mix IPv4 and IPv6 addresses")
+			}
+			if bytes.Compare(first.To16(), last.To16()) > 0 {
+				return fmt.Errorf("address range %q ends before it starts", addressRange)
+			}
+		}
+	case "prefix":
+		if len(ipamAllocation.Addresses) > 0 {
+			return fmt.Errorf("prefix allocation has addresses")
+		}
+		ip, subnet, err := net.ParseCIDR(ipamAllocation.CIDR)
+		if err != nil {
+			return fmt.Errorf("invalid CIDR %q", ipamAllocation.CIDR)
+		}
+		if !ip.Equal(subnet.IP) {
+			return fmt.Errorf("CIDR %q is not a network address", ipamAllocation.CIDR)
+		}
+	default:
+		return fmt.Errorf("unsupported allocation type %q", ipamAllocation.Type)
+	}
+	return nil
+}
+
+// validateStoredAllocationOfPool checks a valid stored allocation matches the family, CIDR and size of its pool in
+// its datacenter.
+func validateStoredAllocationOfPool(ipamAllocation IPAMAllocation, dcIPAMPoolCfg IPAMPoolDatacenterSettings) error {
+	if ipamAllocation.Type != dcIPAMPoolCfg.Type {
+		return fmt.Errorf("%s allocation of a %s pool", ipamAllocation.Type, dcIPAMPoolCfg.Type)
+	}
+	_, poolSubnet, err := net.ParseCIDR(dcIPAMPoolCfg.PoolCIDR)
+	if err != nil {
+		return fmt.Errorf("invalid pool CIDR %q", dcIPAMPoolCfg.PoolCIDR)
+	}
+
+	blocks := ipamAllocation.Addresses
+	if ipamAllocation.Type == "prefix" {
+		blocks = []string{ipamAllocation.CIDR}
+	}
+	size := new(big.Int)
+	for _, block := range blocks {
+		first, last, err := blockBounds(block)
+		if err != nil {
+			return err
+		}
+		if (first.To4() != nil) != (poolSubnet.IP.To4() != nil) {
+			return fmt.Errorf("%s has a different IP family than the pool CIDR %s", block, poolSubnet)
+		}
+		if !poolSubnet.Contains(first) || !poolSubnet.Contains(last) {
+			return fmt.Errorf("%s is outside the pool CIDR %s", block, poolSubnet)
+		}
+		firstInt, _ := ipToInt(first)
+		lastInt, _ := ipToInt(last)
+		size.Add(size, new(big.Int).Sub(lastInt, firstInt))
+		size.Add(size, big.NewInt(1))
+	}
+
+	switch ipamAllocation.Type {
+	case "range":
+		if size.Cmp(big.NewInt(int64(dcIPAMPoolCfg.AllocationRange))) != 0 {
+			return fmt.Errorf("allocation has %s addresses but the pool allocates %d", size, dcIPAMPoolCfg.AllocationRange)
+		}
+	case "prefix":
+		_, subnet, _ := net.ParseCIDR(ipamAllocation.CIDR)
+		if subnetPrefix, _ := subnet.Mask.Size(); subnetPrefix != int(dcIPAMPoolCfg.AllocationPrefix) {
+			return fmt.Errorf("allocation prefix is /%d but the pool allocates /%d", subnetPrefix, dcIPAMPoolCfg.AllocationPrefix)
+		}
+	}
+	return nil
+}
+
+func parseStoredAddressRange(addressRange string) (net.IP, net.IP, error) {
+	ipRange := strings.SplitN(addressRange, "-", 2)
+	if len(ipRange) != 2 {
+		return nil, nil, fmt.Errorf("invalid address range %q", addressRange)
+	}
+	first, last := net.ParseIP(ipRange[0]), net.ParseIP(ipRange[1])
+	if first == nil || last == nil {
+		return nil, nil, fmt.Errorf("invalid address range %q", addressRange)
+	}
+	return first, last, nil
+}
+
+// migrateStateFromV1 converts a version 1 state into a version 2 state. The reservations of version 1 have no
+// source, so they are kept as manual reservations; the fields added by version 2 are empty.
+func migrateStateFromV1(document map[string]json.RawMessage) (map[string]json.RawMessage, error) {
+	document["schemaVersion"] = json.RawMessage("2")
+	rawReservations, hasReservations := document["datacenterReservations"]
+	if !hasReservations {
+		return document, nil
+	}
+	dcReservations := map[string][]string{}
+	if err := json.Unmarshal(rawReservations, &dcReservations); err != nil {
+		return nil, err
+	}
+	dcSourceReservations := map[string]map[string][]string{}
+	for dc, reservations := range dcReservations {
+		dcSourceReservations[dc] = map[string][]string{reservationSourceManual: reservations}
+	}
+	migratedReservations, err := json.Marshal(dcSourceReservations)
+	if err != nil {
+		return nil, err
+	}
+	document["datacenterReservations"] = migratedReservations
+	return document, nil
+}
+
+// migrateStateFromV2 only bumps the version: version 3 has the same fields plus the checksum, which is verified
+// before migrating.
+func migrateStateFromV2(document map[string]json.RawMessage) (map[string]json.RawMessage, error) {
+	document["schemaVersion"] = json.RawMessage("3")
+	return document, nil
+}
@@ -0,0 +1,207 @@
+package ipam
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// IPAMPoolStatus is the observed state of an IPAM pool, e.g. to be written in the status of an IPAMPool resource.
+type IPAMPoolStatus struct {
+	Datacenters map[string]IPAMPoolDatacenterStatus
+	// Purposes are the statuses of the datacenters of the purposes of the pool, by purpose
+	Purposes   map[string]map[string]IPAMPoolDatacenterStatus
+	LastError  string
+	Conditions []IPAMPoolCondition
+}
+
+// IPAMPoolDatacenterStatus is the observed state of a datacenter of an IPAM pool.
+type IPAMPoolDatacenterStatus struct {
+	AllocatedClusters int
+	// FreeCapacity is the number of free addresses (range pools) or free subnets of the allocation prefix
+	// (prefix pools), capped at the largest int
+	FreeCapacity int
+	Exhausted    bool
+	// ProjectedExhaustion is when the datacenter pool is expected to be exhausted at the allocation rate of the
+	// last defaultExhaustionProjectionWindow, zero if it isn't shrinking
+	ProjectedExhaustion time.Time
+}
+
+// IPAMPoolCondition follows the conventions of the conditions of Kubernetes resources: Status is "True" or "False",
+// and Reason and Message explain true conditions.
+type IPAMPoolCondition struct {
+	Type    string
+	Status  string
+	Reason  string
+	Message string
+}
+
+// Types of IPAMPoolCondition.
+const (
+	IPAMPoolConditionExhausted    = "Exhausted"
+	IPAMPoolConditionIncompatible = "Incompatible"
+)
+
+// PoolStatus computes the status of an IPAM pool from the current allocations. lastApplyErr is the error of the
+// last apply of the pool, if any.
+func (p IPAM) PoolStatus(ipamPool IPAMPool, lastApplyErr error) (IPAMPoolStatus, error) {
+	status := IPAMPoolStatus{
+		Datacenters: map[string]IPAMPoolDatacenterStatus{},
+	}
+	if lastApplyErr != nil {
+		status.LastError = lastApplyErr.Error()
+	}
+
+	purposePools, err := ipamPool.purposePools()
+	if err != nil {
+		return IPAMPoolStatus{}, err
+	}
+	isIncompatible := lastApplyErr == errIncompatiblePool
+	exhaustedDCs := []string{}
+	for _, purposePool := range purposePools {
+		dcStatuses, isPurposeIncompatible, err := p.purposePoolStatus(purposePool)
+		if err != nil {
+			return IPAMPoolStatus{}, err
+		}
+		isIncompatible = isIncompatible || isPurposeIncompatible
+		for dc, dcStatus := range dcStatuses {
+			if dcStatus.Exhausted {
+				exhaustedDCs = append(exhaustedDCs, withPurpose(dc, purposePool.purpose))
+			}
+		}
+		if purposePool.purpose == "" {
+			status.Datacenters = dcStatuses
+			continue
+		}
+		if status.Purposes == nil {
+			status.Purposes = map[string]map[string]IPAMPoolDatacenterStatus{}
+		}
+		status.Purposes[purposePool.purpose] = dcStatuses
+	}
+	if isIncompatible {
+		// the free space of incompatible pools is meaningless
+		status.Datacenters = map[string]IPAMPoolDatacenterStatus{}
+		status.Purposes = nil
+		exhaustedDCs = nil
+	}
+	status.Conditions = append(status.Conditions, newIPAMPoolCondition(IPAMPoolConditionIncompatible, isIncompatible, "IncompatibleAllocations", errIncompatiblePool.Error()))
+	sort.Strings(exhaustedDCs)
+	status.Conditions = append(status.Conditions, newIPAMPoolCondition(IPAMPoolConditionExhausted, len(exhaustedDCs) > 0, "NoFreeSpace", fmt.Sprintf("no room for a new allocation in datacenters %v", exhaustedDCs)))
+
+	return status, nil
+}
+
+// purposePoolStatus computes the status of the datacenters of a pool without purposes, or of one of the purposes of
+// a pool, and tells whether the pool is incompatible with the current allocations.
+func (p IPAM) purposePoolStatus(ipamPool IPAMPool) (map[string]IPAMPoolDatacenterStatus, bool, error) {
+	ipamPool, err := ipamPool.withResolvedAllocationSizes()
+	if err != nil {
+		return nil, false, err
+	}
+	dcIPAMPoolUsageMap, err := p.compileCurrentAllocationsForPool(ipamPool)
+	if err == errIncompatiblePool {
+		return map[string]IPAMPoolDatacenterStatus{}, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	dcStatuses := map[string]IPAMPoolDatacenterStatus{}
+	for dc, dcIPAMPoolCfg := range ipamPool.Datacenters {
+		dcStatus := IPAMPoolDatacenterStatus{}
+		for _, dcCluster := range p.datacenterAllocations[dc] {
+			for _, ipamAllocation := range dcCluster.IPAMAllocations {
+				if ipamAllocation.isFromPool(ipamPool) {
+					dcStatus.AllocatedClusters++
+					break
+				}
+			}
+		}
+
+		freeCapacity, err := freeCapacityOfPool(dc, dcIPAMPoolCfg, dcIPAMPoolUsageMap)
+		if err != nil {
+			return nil, false, err
+		}
+		dcStatus.FreeCapacity = bigIntToInt(freeCapacity)
+		remainingAllocations, err := remainingAllocationsOfPool(dc, dcIPAMPoolCfg, dcIPAMPoolUsageMap)
+		if err != nil {
+			return nil, false, err
+		}
+		switch dcIPAMPoolCfg.Type {
+		case "range":
+			dcStatus.Exhausted = freeCapacity.Cmp(big.NewInt(int64(dcIPAMPoolCfg.AllocationRange))) < 0
+		case "prefix":
+			dcStatus.Exhausted = freeCapacity.Sign() == 0
+		}
+		projection := p.projectDatacenterExhaustion(ipamPool, dc, remainingAllocations, defaultExhaustionProjectionWindow)
+		dcStatus.ProjectedExhaustion = projection.ExhaustedAt
+		dcStatuses[dc] = dcStatus
+	}
+	return dcStatuses, false, nil
+}
+
+func newIPAMPoolCondition(conditionType string, isTrue bool, reason, message string) IPAMPoolCondition {
+	if !isTrue {
+		return IPAMPoolCondition{Type: conditionType, Status: "False"}
+	}
+	return IPAMPoolCondition{Type: conditionType, Status: "True", Reason: reason, Message: message}
+}
+
+// totalCapacityOfPool returns the number of addresses (range pools) or subnets of the allocation prefix (prefix
+// pools) of a datacenter pool, zero for unknown pool types.
+func totalCapacityOfPool(dcIPAMPoolCfg IPAMPoolDatacenterSettings) (*big.Int, error) {
+	if dcIPAMPoolCfg.Type != "range" && dcIPAMPoolCfg.Type != "prefix" {
+		return new(big.Int), nil
+	}
+	units, err := datacenterPoolUnits(dcIPAMPoolCfg)
+	if err != nil {
+		return nil, err
+	}
+	return units.count, nil
+}
+
+// usedCapacityOfPool returns the number of addresses (range pools) or subnets of the allocation prefix (prefix
+// pools) of a datacenter pool marked as used, zero for unknown pool types. Only the used space is walked, never the
+// whole pool.
+func usedCapacityOfPool(dc string, dcIPAMPoolCfg IPAMPoolDatacenterSettings, dcIPAMPoolUsageMap datacenterIPAMPoolUsageMap) (*big.Int, error) {
+	used := new(big.Int)
+	if dcIPAMPoolCfg.Type != "range" && dcIPAMPoolCfg.Type != "prefix" {
+		return used, nil
+	}
+	units, err := datacenterPoolUnits(dcIPAMPoolCfg)
+	if err != nil {
+		return nil, err
+	}
+	for _, usedRun := range units.usedRuns(dc, dcIPAMPoolUsageMap) {
+		used.Add(used, runLength(usedRun[0], usedRun[1]))
+	}
+	return used, nil
+}
+
+// freeCapacityOfPool returns the number of free addresses (range pools) or free subnets of the allocation prefix
+// (prefix pools) of a datacenter pool, computed from the used ones.
+func freeCapacityOfPool(dc string, dcIPAMPoolCfg IPAMPoolDatacenterSettings, dcIPAMPoolUsageMap datacenterIPAMPoolUsageMap) (*big.Int, error) {
+	total, err := totalCapacityOfPool(dcIPAMPoolCfg)
+	if err != nil {
+		return nil, err
+	}
+	used, err := usedCapacityOfPool(dc, dcIPAMPoolCfg, dcIPAMPoolUsageMap)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).Sub(total, used), nil
+}
+
+// remainingAllocationsOfPool returns the number of allocations that still fit in a datacenter pool, capped at the
+// largest int for the pools too big to count them in one.
+func remainingAllocationsOfPool(dc string, dcIPAMPoolCfg IPAMPoolDatacenterSettings, dcIPAMPoolUsageMap datacenterIPAMPoolUsageMap) (int, error) {
+	remaining, err := freeCapacityOfPool(dc, dcIPAMPoolCfg, dcIPAMPoolUsageMap)
+	if err != nil {
+		return 0, err
+	}
+	if dcIPAMPoolCfg.Type == "range" && dcIPAMPoolCfg.AllocationRange > 0 {
+		remaining.Quo(remaining, big.NewInt(int64(dcIPAMPoolCfg.AllocationRange)))
+	}
+	return bigIntToInt(remaining), nil
+}
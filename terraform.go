@@ -0,0 +1,60 @@
+package ipam
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type terraformAllocation struct {
+	Type        string   `json:"type"`
+	CIDR        string   `json:"cidr,omitempty"`
+	Addresses   []string `json:"addresses,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Gateway     string   `json:"gateway,omitempty"`
+	DNSServers  []string `json:"dnsServers,omitempty"`
+	MTU         uint32   `json:"mtu,omitempty"`
+}
+
+// RenderTerraformLocals renders all the allocations as a Terraform JSON configuration file (.tf.json) declaring a
+// local value named localName, which is a map of datacenter => cluster => pool => allocation (clusters and pools of
+// tenants are keyed by "<tenant>/<cluster>" and "<tenant>/<pool>"), e.g.
+// local.ipam_allocations["aws-eu-1"]["c1"]["pool1"].cidr
+// The datacenter metadata is declared in a second local value named "<localName>_datacenters", a map of datacenter
+// => metadata.
+func RenderTerraformLocals(p IPAM, localName string) ([]byte, error) {
+	if localName == "" {
+		return nil, fmt.Errorf("local name cannot be empty")
+	}
+
+	allocations := map[string]map[string]map[string]terraformAllocation{}
+	for dc, dcClusters := range p.datacenterAllocations {
+		allocations[dc] = map[string]map[string]terraformAllocation{}
+		for _, dcCluster := range dcClusters {
+			clusterName := dcCluster.ref(dc).qualifiedName()
+			allocations[dc][clusterName] = map[string]terraformAllocation{}
+			for _, ipamAllocation := range dcCluster.IPAMAllocations {
+				allocations[dc][clusterName][ipamAllocation.qualifiedIPAMPoolName()] = terraformAllocation{
+					Type:        ipamAllocation.Type,
+					CIDR:        ipamAllocation.CIDR,
+					Addresses:   ipamAllocation.Addresses,
+					Description: ipamAllocation.Description,
+					Gateway:     ipamAllocation.Gateway,
+					DNSServers:  ipamAllocation.DNSServers,
+					MTU:         ipamAllocation.MTU,
+				}
+			}
+		}
+	}
+
+	datacenters := map[string]Datacenter{}
+	for dc := range allocations {
+		datacenters[dc] = p.datacenter(dc)
+	}
+
+	return json.MarshalIndent(map[string]interface{}{
+		"locals": map[string]interface{}{
+			localName:                  allocations,
+			localName + "_datacenters": datacenters,
+		},
+	}, "", "  ")
+}
@@ -0,0 +1,128 @@
+package ipam
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// defaultTombstoneRetention is how long released allocations can be restored, unless set by WithTombstoneRetention.
+const defaultTombstoneRetention = 30 * 24 * time.Hour
+
+// Tombstone keeps a released allocation, so an accidental release can be restored exactly.
+type Tombstone struct {
+	ID string `json:"id"`
+	// Allocation is the released allocation, with its cluster, blocks, ID and labels
+	Allocation IPAMAllocation `json:"allocation"`
+	ReleasedAt time.Time      `json:"releasedAt"`
+	Reason     string         `json:"reason,omitempty"`
+}
+
+// WithTombstoneRetention sets how long released allocations can be restored, defaultTombstoneRetention when not
+// positive.
+func WithTombstoneRetention(retention time.Duration) Option {
+	return func(p *IPAM) {
+		p.tombstoneRetention = retention
+	}
+}
+
+// Tombstones returns the released allocations which can still be restored, oldest release first, then sorted like
+// Allocations.
+func (p IPAM) Tombstones() []Tombstone {
+	p.purgeExpiredTombstones()
+	tombstones := []Tombstone{}
+	for _, tombstone := range p.tombstones {
+		tombstones = append(tombstones, tombstone)
+	}
+	sort.Slice(tombstones, func(i, j int) bool {
+		a, b := tombstones[i], tombstones[j]
+		switch {
+		case !a.ReleasedAt.Equal(b.ReleasedAt):
+			return a.ReleasedAt.Before(b.ReleasedAt)
+		case a.Allocation.Datacenter != b.Allocation.Datacenter:
+			return a.Allocation.Datacenter < b.Allocation.Datacenter
+		case a.Allocation.Cluster != b.Allocation.Cluster:
+			return a.Allocation.Cluster < b.Allocation.Cluster
+		case a.Allocation.qualifiedIPAMPoolName() != b.Allocation.qualifiedIPAMPoolName():
+			return a.Allocation.qualifiedIPAMPoolName() < b.Allocation.qualifiedIPAMPoolName()
+		}
+		return a.ID < b.ID
+	})
+	return tombstones
+}
+
+// RestoreAllocation gives a released allocation back to its cluster, with the same blocks, ID and labels, recreating
+// the cluster if it was removed meanwhile. It fails, keeping the tombstone, if the cluster got another allocation of
+// the pool, if the blocks were allocated, held or reserved again (in any datacenter for the pools unique across
+// datacenters), or if the tenant of the pool would exceed its quota.
+func (p IPAM) RestoreAllocation(tombstoneID string) (IPAMAllocation, error) {
+	p.purgeExpiredTombstones()
+	p.releaseExpiredHolds()
+
+	tombstone, exists := p.tombstones[tombstoneID]
+	if !exists {
+		return IPAMAllocation{}, fmt.Errorf("tombstone not found or expired")
+	}
+	allocation := tombstone.Allocation
+	conflicts, err := p.conflictingAllocations(allocation)
+	if err != nil {
+		return IPAMAllocation{}, err
+	}
+	if len(conflicts) > 0 {
+		return IPAMAllocation{}, fmt.Errorf("released allocation of pool %s conflicts with the allocation of pool %s of cluster %s", allocation.qualifiedIPAMPoolName(),
+			conflicts[0].qualifiedIPAMPoolName(), conflicts[0].clusterRef().qualifiedName())
+	}
+	for _, hold := range p.holds {
+		if hold.Allocation.Datacenter != allocation.Datacenter {
+			continue
+		}
+		overlaps, err := allocationsOverlap(allocation, hold.Allocation)
+		if err != nil {
+			return IPAMAllocation{}, err
+		}
+		if overlaps {
+			return IPAMAllocation{}, fmt.Errorf("released allocation of pool %s overlaps a hold of pool %s", allocation.qualifiedIPAMPoolName(), hold.Allocation.qualifiedIPAMPoolName())
+		}
+	}
+	conflict, err := p.uniquenessConflict(allocation)
+	if err != nil {
+		return IPAMAllocation{}, err
+	}
+	if conflict != nil {
+		return IPAMAllocation{}, fmt.Errorf("released allocation of pool %s overlaps the allocation of cluster %s in datacenter %s, and the pool is unique across datacenters", allocation.qualifiedIPAMPoolName(),
+			conflict.clusterRef().qualifiedName(), conflict.Datacenter)
+	}
+	for _, reservation := range p.reservations(allocation.Datacenter) {
+		for _, block := range allocationBlocks(allocation) {
+			overlaps, err := blocksOverlap(block, reservation)
+			if err != nil {
+				return IPAMAllocation{}, err
+			}
+			if overlaps {
+				return IPAMAllocation{}, fmt.Errorf("released allocation of pool %s overlaps the reservation %s", allocation.qualifiedIPAMPoolName(), reservation)
+			}
+		}
+	}
+	err = p.checkTenantQuota(allocation.IPAMPoolTenant, []IPAMAllocation{allocation})
+	if err != nil {
+		return IPAMAllocation{}, err
+	}
+
+	delete(p.tombstones, tombstoneID)
+	// the allocation is restored even if a hook fails, so it's returned with the error
+	err = p.addNewAllocations([]IPAMAllocation{allocation})
+	return allocation, err
+}
+
+func (p IPAM) purgeExpiredTombstones() {
+	retention := p.tombstoneRetention
+	if retention <= 0 {
+		retention = defaultTombstoneRetention
+	}
+	now := p.clock.Now()
+	for id, tombstone := range p.tombstones {
+		if !now.Before(tombstone.ReleasedAt.Add(retention)) {
+			delete(p.tombstones, id)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package ipam
+
+import (
+	"net"
+)
+
+// markAllocationsInOtherDatacentersAsUsed marks as used, in the usage of each datacenter of the pool, the space of
+// the given allocations made in the other datacenters. It makes pools unique across datacenters never hand out the
+// same block twice, e.g. when the clusters of different datacenters are connected over a routed backbone.
+func markAllocationsInOtherDatacentersAsUsed(ipamPool IPAMPool, allocations []IPAMAllocation, dcIPAMPoolUsageMap datacenterIPAMPoolUsageMap) error {
+	for dc := range ipamPool.Datacenters {
+		cidrs := []string{}
+		for _, allocation := range allocations {
+			if allocation.Datacenter == dc {
+				continue
+			}
+			allocationCIDRs, err := allocationCIDRs(allocation)
+			if err != nil {
+				return err
+			}
+			cidrs = append(cidrs, allocationCIDRs...)
+		}
+		if len(cidrs) == 0 {
+			continue
+		}
+		err := markReservationsAsUsed(dc, cidrs, dcIPAMPoolUsageMap)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trackUniqueIPAMPool records whether the pool (or purpose), given with its latest applied settings, is unique across
+// datacenters, so the operations without the pool settings (e.g. RestoreAllocation) keep its blocks unique.
+func (p IPAM) trackUniqueIPAMPool(ipamPool IPAMPool) {
+	if ipamPool.UniqueAcrossDatacenters {
+		p.uniqueIPAMPools[ipamPool.qualifiedName()] = struct{}{}
+		return
+	}
+	delete(p.uniqueIPAMPools, ipamPool.qualifiedName())
+}
+
+// uniquenessConflict returns the allocation or hold of another datacenter overlapping the allocation, when its pool
+// is unique across datacenters, nil otherwise. Holds are returned as allocations without cluster.
+func (p IPAM) uniquenessConflict(allocation IPAMAllocation) (*IPAMAllocation, error) {
+	if _, isUnique := p.uniqueIPAMPools[allocation.qualifiedIPAMPoolName()]; !isUnique {
+		return nil, nil
+	}
+	candidates := []IPAMAllocation{}
+	for dc, dcClusters := range p.datacenterAllocations {
+		if dc == allocation.Datacenter {
+			continue
+		}
+		for _, dcCluster := range dcClusters {
+			candidates = append(candidates, dcCluster.IPAMAllocations...)
+		}
+	}
+	for _, hold := range p.holds {
+		if hold.Allocation.Datacenter != allocation.Datacenter {
+			candidates = append(candidates, hold.Allocation)
+		}
+	}
+	sortAllocations(candidates)
+	for i, candidate := range candidates {
+		if candidate.qualifiedIPAMPoolName() != allocation.qualifiedIPAMPoolName() {
+			continue
+		}
+		overlaps, err := allocationsOverlap(allocation, candidate)
+		if err != nil {
+			return nil, err
+		}
+		if overlaps {
+			return &candidates[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// allocationCIDRs returns the CIDR of a prefix allocation, or a single address CIDR per IP of a range allocation.
+func allocationCIDRs(allocation IPAMAllocation) ([]string, error) {
+	if allocation.Type == "prefix" {
+		return []string{allocation.CIDR}, nil
+	}
+	ips, err := getUsedIPsFromAddressRanges(allocation.Addresses)
+	if err != nil {
+		return nil, err
+	}
+	cidrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		parsedIP := checkIPv4(net.ParseIP(ip))
+		cidrs = append(cidrs, (&net.IPNet{IP: parsedIP, Mask: net.CIDRMask(8*len(parsedIP), 8*len(parsedIP))}).String())
+	}
+	return cidrs, nil
+}
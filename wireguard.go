@@ -0,0 +1,125 @@
+package ipam
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+)
+
+// WireGuardPeer is the WireGuard identity of the gateway of a cluster.
+type WireGuardPeer struct {
+	PublicKey string
+	// Endpoint is the "host:port" the gateway is reachable at, left out for gateways behind NAT
+	Endpoint string
+	// PersistentKeepalive is the keepalive interval in seconds, zero to disable it
+	PersistentKeepalive uint16
+}
+
+// clusterRoutes returns the routes to each cluster with allocations: the CIDRs of its prefix allocations and the
+// smallest CIDRs covering the address ranges of its range allocations, in allocation order.
+func clusterRoutes(p IPAM) (map[ClusterRef][]string, error) {
+	routes := map[ClusterRef][]string{}
+	for dc, dcClusters := range p.datacenterAllocations {
+		for _, dcCluster := range dcClusters {
+			clusterCIDRs := []string{}
+			for _, ipamAllocation := range dcCluster.IPAMAllocations {
+				if ipamAllocation.Type == "prefix" {
+					clusterCIDRs = append(clusterCIDRs, ipamAllocation.CIDR)
+					continue
+				}
+				for _, addressRange := range ipamAllocation.Addresses {
+					rangeCIDRs, err := addressRangeCIDRs(addressRange)
+					if err != nil {
+						return nil, err
+					}
+					clusterCIDRs = append(clusterCIDRs, rangeCIDRs...)
+				}
+			}
+			if len(clusterCIDRs) > 0 {
+				routes[dcCluster.ref(dc)] = clusterCIDRs
+			}
+		}
+	}
+	return routes, nil
+}
+
+// RenderWireGuardPeers generates the [Peer] sections of the WireGuard configuration of the gateway of the local
+// cluster: one per other cluster with a known peer and allocations, with the routes to the cluster as AllowedIPs.
+// The peers are sorted by datacenter and cluster.
+func RenderWireGuardPeers(p IPAM, local ClusterRef, peers map[ClusterRef]WireGuardPeer) (string, error) {
+	routes, err := clusterRoutes(p)
+	if err != nil {
+		return "", err
+	}
+
+	clusters := []ClusterRef{}
+	for cluster := range peers {
+		if _, hasRoutes := routes[cluster]; hasRoutes && cluster != local {
+			clusters = append(clusters, cluster)
+		}
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		if clusters[i].Datacenter != clusters[j].Datacenter {
+			return clusters[i].Datacenter < clusters[j].Datacenter
+		}
+		return clusters[i].qualifiedName() < clusters[j].qualifiedName()
+	})
+
+	config := strings.Builder{}
+	for i, cluster := range clusters {
+		peer := peers[cluster]
+		if peer.PublicKey == "" {
+			return "", fmt.Errorf("WireGuard peer of cluster %s in datacenter %s has no public key", cluster.qualifiedName(), cluster.Datacenter)
+		}
+		if i > 0 {
+			config.WriteString("\n")
+		}
+		fmt.Fprintf(&config, "# cluster %s (datacenter %s)\n", cluster.qualifiedName(), cluster.Datacenter)
+		fmt.Fprintf(&config, "[Peer]\n")
+		fmt.Fprintf(&config, "PublicKey = %s\n", peer.PublicKey)
+		if peer.Endpoint != "" {
+			fmt.Fprintf(&config, "Endpoint = %s\n", peer.Endpoint)
+		}
+		fmt.Fprintf(&config, "AllowedIPs = %s\n", strings.Join(routes[cluster], ", "))
+		if peer.PersistentKeepalive > 0 {
+			fmt.Fprintf(&config, "PersistentKeepalive = %d\n", peer.PersistentKeepalive)
+		}
+	}
+	return config.String(), nil
+}
+
+// addressRangeCIDRs splits a "first-last" address range into the smallest list of CIDRs covering it exactly.
+func addressRangeCIDRs(addressRange string) ([]string, error) {
+	addresses := strings.SplitN(addressRange, "-", 2)
+	firstIP := net.ParseIP(addresses[0])
+	lastIP := firstIP
+	if len(addresses) == 2 {
+		lastIP = net.ParseIP(addresses[1])
+	}
+	if firstIP == nil || lastIP == nil {
+		return nil, fmt.Errorf("wrong ip format")
+	}
+	first, bits := ipToInt(checkIPv4(firstIP))
+	last, lastBits := ipToInt(checkIPv4(lastIP))
+	if bits != lastBits || first.Cmp(last) > 0 {
+		return nil, fmt.Errorf("invalid address range %s", addressRange)
+	}
+
+	cidrs := []string{}
+	for first.Cmp(last) <= 0 {
+		// the largest block aligned on first that doesn't go past last
+		hostBits := 0
+		for hostBits < bits && first.Bit(hostBits) == 0 {
+			blockLast := new(big.Int).Add(first, new(big.Int).Lsh(big.NewInt(1), uint(hostBits+1)))
+			if blockLast.Sub(blockLast, big.NewInt(1)).Cmp(last) > 0 {
+				break
+			}
+			hostBits++
+		}
+		cidrs = append(cidrs, (&net.IPNet{IP: intToIP(first, bits), Mask: net.CIDRMask(bits-hostBits, bits)}).String())
+		first = new(big.Int).Add(first, new(big.Int).Lsh(big.NewInt(1), uint(hostBits)))
+	}
+	return cidrs, nil
+}